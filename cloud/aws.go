@@ -1,11 +1,13 @@
 package cloud
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
@@ -13,6 +15,28 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
+const (
+	// RollingUpdateAbortedTagKey is the tag used to abort the rolling update of an ASG and roll back its nodes
+	RollingUpdateAbortedTagKey = "aws-eks-asg-rolling-update-handler/aborted"
+
+	// RollingUpdatePausedTagKey is the tag used to pause the rolling update of an ASG
+	RollingUpdatePausedTagKey = "aws-eks-asg-rolling-update-handler/paused"
+
+	// MaxUnavailableTagKey is the tag used to override the maximum number of unavailable nodes of an ASG
+	MaxUnavailableTagKey = "aws-eks-asg-rolling-update-handler/max-unavailable"
+
+	// OrphanReplacementsTagKey is the tag used to keep track of the number of updated instances of an ASG that have
+	// been replaced because they never registered as a node
+	OrphanReplacementsTagKey = "aws-eks-asg-rolling-update-handler/orphan-replacements"
+
+	// FailingTagKey is the tag used to flag an ASG whose updated instances keep failing to register as nodes
+	FailingTagKey = "aws-eks-asg-rolling-update-handler/failing"
+
+	// OriginalDesiredCapacityTagKey is the tag used to keep track of the desired capacity of an ASG before it was first
+	// increased during its rolling update, so that the surge capacity can be removed if the rolling update is aborted
+	OriginalDesiredCapacityTagKey = "aws-eks-asg-rolling-update-handler/original-desired-capacity"
+)
+
 var (
 	ErrCannotIncreaseDesiredCountAboveMax = errors.New("cannot increase ASG desired size above max ASG size")
 )
@@ -25,12 +49,12 @@ func GetServices(awsRegion string) (ec2iface.EC2API, autoscalingiface.AutoScalin
 	return ec2.New(awsSession), autoscaling.New(awsSession), nil
 }
 
-func DescribeAutoScalingGroupsByNames(svc autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
+func DescribeAutoScalingGroupsByNames(ctx context.Context, svc autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice(names),
 		MaxRecords:            aws.Int64(100),
 	}
-	result, err := svc.DescribeAutoScalingGroups(input)
+	result, err := svc.DescribeAutoScalingGroupsWithContext(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -48,10 +72,10 @@ func filterAutoScalingGroupsByTag(autoScalingGroups []*autoscaling.Group, filter
 
 // DescribeEnabledAutoScalingGroupsByClusterName Gets cluster AutoScalingGroups that are enabled
 // See: https://docs.aws.amazon.com/eks/latest/userguide/cluster-autoscaler.html
-func DescribeEnabledAutoScalingGroupsByClusterName(svc autoscalingiface.AutoScalingAPI, clusterName string) ([]*autoscaling.Group, error) {
+func DescribeEnabledAutoScalingGroupsByClusterName(ctx context.Context, svc autoscalingiface.AutoScalingAPI, clusterName string) ([]*autoscaling.Group, error) {
 	input := &autoscaling.DescribeAutoScalingGroupsInput{}
 	var result []*autoscaling.Group
-	err := svc.DescribeAutoScalingGroupsPages(input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+	err := svc.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
 		tagFilter := func(tagDescriptions []*autoscaling.TagDescription) bool {
 			clusterNameTag := false
 			enabledTag := false
@@ -71,26 +95,26 @@ func DescribeEnabledAutoScalingGroupsByClusterName(svc autoscalingiface.AutoScal
 	return result, nil
 }
 
-func DescribeLaunchTemplateByID(svc ec2iface.EC2API, id string) (*ec2.LaunchTemplate, error) {
+func DescribeLaunchTemplateByID(ctx context.Context, svc ec2iface.EC2API, id string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateIds: []*string{
 			aws.String(id),
 		},
 	}
-	return DescribeLaunchTemplate(svc, input)
+	return DescribeLaunchTemplate(ctx, svc, input)
 }
 
-func DescribeLaunchTemplateByName(svc ec2iface.EC2API, name string) (*ec2.LaunchTemplate, error) {
+func DescribeLaunchTemplateByName(ctx context.Context, svc ec2iface.EC2API, name string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateNames: []*string{
 			aws.String(name),
 		},
 	}
-	return DescribeLaunchTemplate(svc, input)
+	return DescribeLaunchTemplate(ctx, svc, input)
 }
 
-func DescribeLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
-	templatesOutput, err := svc.DescribeLaunchTemplates(input)
+func DescribeLaunchTemplate(ctx context.Context, svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
+	templatesOutput, err := svc.DescribeLaunchTemplatesWithContext(ctx, input)
 	descriptiveMsg := fmt.Sprintf("%v / %v", aws.StringValueSlice(input.LaunchTemplateIds), aws.StringValueSlice(input.LaunchTemplateNames))
 	if err != nil {
 		return nil, fmt.Errorf("unable to get description for Launch Templates %s: %v", descriptiveMsg, err)
@@ -101,7 +125,7 @@ func DescribeLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTempla
 	return templatesOutput.LaunchTemplates[0], nil
 }
 
-func SetAutoScalingGroupDesiredCount(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64) error {
+func SetAutoScalingGroupDesiredCount(ctx context.Context, svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64) error {
 	if count > aws.Int64Value(asg.MaxSize) {
 		return ErrCannotIncreaseDesiredCountAboveMax
 	}
@@ -110,17 +134,153 @@ func SetAutoScalingGroupDesiredCount(svc autoscalingiface.AutoScalingAPI, asg *a
 		DesiredCapacity:      aws.Int64(count),
 		HonorCooldown:        aws.Bool(true),
 	}
-	_, err := svc.SetDesiredCapacity(desiredInput)
+	_, err := svc.SetDesiredCapacityWithContext(ctx, desiredInput)
 	if err != nil {
 		return fmt.Errorf("unable to increase ASG %s desired count to %d: %v", aws.StringValue(asg.AutoScalingGroupName), count, err)
 	}
 	return nil
 }
 
-func TerminateEc2Instance(svc autoscalingiface.AutoScalingAPI, instance *autoscaling.Instance, shouldDecrementDesiredCapacity bool) error {
-	_, err := svc.TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+func TerminateEc2Instance(ctx context.Context, svc autoscalingiface.AutoScalingAPI, instance *autoscaling.Instance, shouldDecrementDesiredCapacity bool) error {
+	_, err := svc.TerminateInstanceInAutoScalingGroupWithContext(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
 		InstanceId:                     instance.InstanceId,
 		ShouldDecrementDesiredCapacity: aws.Bool(shouldDecrementDesiredCapacity),
 	})
 	return err
 }
+
+// CompleteLifecycleAction completes the lifecycle action of an instance waiting on a lifecycle hook, letting the
+// ASG proceed with the next step of the instance's lifecycle
+func CompleteLifecycleAction(ctx context.Context, svc autoscalingiface.AutoScalingAPI, autoScalingGroupName, lifecycleHookName, instanceId, result string) error {
+	_, err := svc.CompleteLifecycleActionWithContext(ctx, &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(autoScalingGroupName),
+		LifecycleHookName:     aws.String(lifecycleHookName),
+		InstanceId:            aws.String(instanceId),
+		LifecycleActionResult: aws.String(result),
+	})
+	return err
+}
+
+// RecordLifecycleActionHeartbeat extends the timeout of the lifecycle action of an instance waiting on a lifecycle hook
+func RecordLifecycleActionHeartbeat(ctx context.Context, svc autoscalingiface.AutoScalingAPI, autoScalingGroupName, lifecycleHookName, instanceId string) error {
+	_, err := svc.RecordLifecycleActionHeartbeatWithContext(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(autoScalingGroupName),
+		LifecycleHookName:    aws.String(lifecycleHookName),
+		InstanceId:           aws.String(instanceId),
+	})
+	return err
+}
+
+// DescribeEc2Instance retrieves the EC2 instance with the given id, or nil if the instance doesn't exist
+func DescribeEc2Instance(ctx context.Context, svc ec2iface.EC2API, instanceId string) (*ec2.Instance, error) {
+	output, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceId)},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidInstanceID.NotFound" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to describe instance %s: %v", instanceId, err)
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceId {
+				return instance, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// IsEc2InstanceTerminated checks whether an EC2 instance no longer exists or has been terminated
+func IsEc2InstanceTerminated(instance *ec2.Instance) bool {
+	return instance == nil || instance.State == nil || aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated
+}
+
+// DescribeAutoScalingInstance retrieves the details of an instance from the ASG it is part of, or nil if the instance
+// is not part of any ASG
+func DescribeAutoScalingInstance(ctx context.Context, svc autoscalingiface.AutoScalingAPI, instanceId string) (*autoscaling.InstanceDetails, error) {
+	output, err := svc.DescribeAutoScalingInstancesWithContext(ctx, &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []*string{aws.String(instanceId)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe AutoScaling instance %s: %v", instanceId, err)
+	}
+	for _, instanceDetails := range output.AutoScalingInstances {
+		if aws.StringValue(instanceDetails.InstanceId) == instanceId {
+			return instanceDetails, nil
+		}
+	}
+	return nil, nil
+}
+
+// DetachInstanceFromAutoScalingGroup removes an instance from its ASG without terminating it
+func DetachInstanceFromAutoScalingGroup(ctx context.Context, svc autoscalingiface.AutoScalingAPI, autoScalingGroupName, instanceId string, shouldDecrementDesiredCapacity bool) error {
+	_, err := svc.DetachInstancesWithContext(ctx, &autoscaling.DetachInstancesInput{
+		AutoScalingGroupName:           aws.String(autoScalingGroupName),
+		InstanceIds:                    []*string{aws.String(instanceId)},
+		ShouldDecrementDesiredCapacity: aws.Bool(shouldDecrementDesiredCapacity),
+	})
+	return err
+}
+
+// TerminateEc2InstanceById terminates an EC2 instance directly, bypassing its ASG
+func TerminateEc2InstanceById(ctx context.Context, svc ec2iface.EC2API, instanceId string) error {
+	_, err := svc.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(instanceId)},
+	})
+	return err
+}
+
+// GetTagValue returns the value of the tag with the given key, or an empty string if the ASG has no such tag
+func GetTagValue(asg *autoscaling.Group, key string) string {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// HasTag checks whether an ASG has a tag with the given key and value, ignoring the case of the value
+func HasTag(asg *autoscaling.Group, key, value string) bool {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) == key && strings.EqualFold(aws.StringValue(tag.Value), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAutoScalingGroupTag creates or updates a tag of an ASG
+func SetAutoScalingGroupTag(ctx context.Context, svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, key, value string) error {
+	_, err := svc.CreateOrUpdateTagsWithContext(ctx, &autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{{
+			Key:               aws.String(key),
+			Value:             aws.String(value),
+			ResourceId:        asg.AutoScalingGroupName,
+			ResourceType:      aws.String("auto-scaling-group"),
+			PropagateAtLaunch: aws.Bool(false),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set tag %s of ASG %s: %v", key, aws.StringValue(asg.AutoScalingGroupName), err)
+	}
+	return nil
+}
+
+// DeleteAutoScalingGroupTags deletes tags of an ASG
+func DeleteAutoScalingGroupTags(ctx context.Context, svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, keys ...string) error {
+	var tags []*autoscaling.Tag
+	for _, key := range keys {
+		tags = append(tags, &autoscaling.Tag{
+			Key:          aws.String(key),
+			ResourceId:   asg.AutoScalingGroupName,
+			ResourceType: aws.String("auto-scaling-group"),
+		})
+	}
+	if _, err := svc.DeleteTagsWithContext(ctx, &autoscaling.DeleteTagsInput{Tags: tags}); err != nil {
+		return fmt.Errorf("unable to delete tags %v of ASG %s: %v", keys, aws.StringValue(asg.AutoScalingGroupName), err)
+	}
+	return nil
+}
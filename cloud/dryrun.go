@@ -0,0 +1,124 @@
+package cloud
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+// dryRunAutoScalingService logs the requests that would mutate ASGs or their instances instead of sending them
+type dryRunAutoScalingService struct {
+	autoscalingiface.AutoScalingAPI
+}
+
+// NewDryRunAutoScalingService wraps an AutoScaling service so that the requests used by this application to mutate
+// ASGs and their instances are logged instead of being sent
+func NewDryRunAutoScalingService(svc autoscalingiface.AutoScalingAPI) autoscalingiface.AutoScalingAPI {
+	return &dryRunAutoScalingService{AutoScalingAPI: svc}
+}
+
+func (s *dryRunAutoScalingService) SetDesiredCapacityWithContext(_ aws.Context, input *autoscaling.SetDesiredCapacityInput, _ ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error) {
+	logDryRunRequest("SetDesiredCapacity", input)
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) TerminateInstanceInAutoScalingGroupWithContext(_ aws.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	logDryRunRequest("TerminateInstanceInAutoScalingGroup", input)
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) CompleteLifecycleActionWithContext(_ aws.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	logDryRunRequest("CompleteLifecycleAction", input)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) RecordLifecycleActionHeartbeatWithContext(_ aws.Context, input *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...request.Option) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	logDryRunRequest("RecordLifecycleActionHeartbeat", input)
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) DetachInstancesWithContext(_ aws.Context, input *autoscaling.DetachInstancesInput, _ ...request.Option) (*autoscaling.DetachInstancesOutput, error) {
+	logDryRunRequest("DetachInstances", input)
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) CreateOrUpdateTagsWithContext(_ aws.Context, input *autoscaling.CreateOrUpdateTagsInput, _ ...request.Option) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	logDryRunRequest("CreateOrUpdateTags", input)
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (s *dryRunAutoScalingService) DeleteTagsWithContext(_ aws.Context, input *autoscaling.DeleteTagsInput, _ ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	logDryRunRequest("DeleteTags", input)
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+// dryRunEC2Service logs the requests that would terminate EC2 instances instead of sending them
+type dryRunEC2Service struct {
+	ec2iface.EC2API
+}
+
+// NewDryRunEC2Service wraps an EC2 service so that the requests used by this application to terminate instances are
+// logged instead of being sent
+func NewDryRunEC2Service(svc ec2iface.EC2API) ec2iface.EC2API {
+	return &dryRunEC2Service{EC2API: svc}
+}
+
+func (s *dryRunEC2Service) TerminateInstancesWithContext(_ aws.Context, input *ec2.TerminateInstancesInput, _ ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	logDryRunRequest("TerminateInstances", input)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+// dryRunELBV2Service logs the requests that would deregister targets instead of sending them
+type dryRunELBV2Service struct {
+	elbv2iface.ELBV2API
+}
+
+// NewDryRunELBV2Service wraps an ELBV2 service so that the requests used by this application to deregister instances
+// from target groups are logged instead of being sent
+func NewDryRunELBV2Service(svc elbv2iface.ELBV2API) elbv2iface.ELBV2API {
+	return &dryRunELBV2Service{ELBV2API: svc}
+}
+
+func (s *dryRunELBV2Service) DeregisterTargetsWithContext(_ aws.Context, input *elbv2.DeregisterTargetsInput, _ ...request.Option) (*elbv2.DeregisterTargetsOutput, error) {
+	logDryRunRequest("DeregisterTargets", input)
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+// dryRunELBService logs the requests that would deregister instances from classic load balancers instead of sending them
+type dryRunELBService struct {
+	elbiface.ELBAPI
+}
+
+// NewDryRunELBService wraps an ELB service so that the requests used by this application to deregister instances
+// from classic load balancers are logged instead of being sent
+func NewDryRunELBService(svc elbiface.ELBAPI) elbiface.ELBAPI {
+	return &dryRunELBService{ELBAPI: svc}
+}
+
+func (s *dryRunELBService) DeregisterInstancesFromLoadBalancerWithContext(_ aws.Context, input *elb.DeregisterInstancesFromLoadBalancerInput, _ ...request.Option) (*elb.DeregisterInstancesFromLoadBalancerOutput, error) {
+	logDryRunRequest("DeregisterInstancesFromLoadBalancer", input)
+	return &elb.DeregisterInstancesFromLoadBalancerOutput{}, nil
+}
+
+// logDryRunRequest logs a request that would have been sent to AWS as a JSON record
+func logDryRunRequest(operation string, input interface{}) {
+	record, err := json.Marshal(struct {
+		WouldDo string      `json:"wouldDo"`
+		Input   interface{} `json:"input"`
+	}{operation, input})
+	if err != nil {
+		log.Printf("[DRY-RUN] Unable to log request %s: %v", operation, err)
+		return
+	}
+	log.Printf("[DRY-RUN] %s", record)
+}
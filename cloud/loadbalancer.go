@@ -0,0 +1,144 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+const (
+	// DefaultDeregistrationDelay is the deregistration delay used when it cannot be retrieved from the target group
+	// or the classic load balancer, and is the default deregistration delay of target groups
+	DefaultDeregistrationDelay = 300 * time.Second
+
+	targetGroupDeregistrationDelayAttributeKey = "deregistration_delay.timeout_seconds"
+)
+
+// GetLoadBalancingServices creates the services used to deregister instances from target groups and classic load
+// balancers
+func GetLoadBalancingServices(awsRegion string) (elbv2iface.ELBV2API, elbiface.ELBAPI, error) {
+	awsSession, err := session.NewSession(&aws.Config{Region: aws.String(awsRegion)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return elbv2.New(awsSession), elb.New(awsSession), nil
+}
+
+// DeregisterInstanceFromTargetGroup deregisters an instance from a target group
+func DeregisterInstanceFromTargetGroup(ctx context.Context, svc elbv2iface.ELBV2API, targetGroupArn, instanceId string) error {
+	_, err := svc.DeregisterTargetsWithContext(ctx, &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceId)}},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elbv2.ErrCodeInvalidTargetException {
+			return nil
+		}
+		return fmt.Errorf("unable to deregister instance %s from target group %s: %v", instanceId, targetGroupArn, err)
+	}
+	return nil
+}
+
+// IsInstanceRegisteredInTargetGroup checks whether an instance is still registered in a target group, including
+// while its deregistration is in progress
+func IsInstanceRegisteredInTargetGroup(ctx context.Context, svc elbv2iface.ELBV2API, targetGroupArn, instanceId string) (bool, error) {
+	output, err := svc.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceId)}},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elbv2.ErrCodeInvalidTargetException {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to describe health of instance %s in target group %s: %v", instanceId, targetGroupArn, err)
+	}
+	for _, targetHealthDescription := range output.TargetHealthDescriptions {
+		if targetHealthDescription.Target == nil || aws.StringValue(targetHealthDescription.Target.Id) != instanceId {
+			continue
+		}
+		if targetHealthDescription.TargetHealth == nil || aws.StringValue(targetHealthDescription.TargetHealth.State) != elbv2.TargetHealthStateEnumUnused {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetTargetGroupDeregistrationDelay retrieves the deregistration delay of a target group
+func GetTargetGroupDeregistrationDelay(ctx context.Context, svc elbv2iface.ELBV2API, targetGroupArn string) (time.Duration, error) {
+	output, err := svc.DescribeTargetGroupAttributesWithContext(ctx, &elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to describe attributes of target group %s: %v", targetGroupArn, err)
+	}
+	for _, attribute := range output.Attributes {
+		if aws.StringValue(attribute.Key) == targetGroupDeregistrationDelayAttributeKey {
+			seconds, err := strconv.Atoi(aws.StringValue(attribute.Value))
+			if err != nil {
+				return 0, fmt.Errorf("invalid deregistration delay '%s' for target group %s", aws.StringValue(attribute.Value), targetGroupArn)
+			}
+			return time.Duration(seconds) * time.Second, nil
+		}
+	}
+	return DefaultDeregistrationDelay, nil
+}
+
+// DeregisterInstanceFromClassicLoadBalancer deregisters an instance from a classic load balancer
+func DeregisterInstanceFromClassicLoadBalancer(ctx context.Context, svc elbiface.ELBAPI, loadBalancerName, instanceId string) error {
+	_, err := svc.DeregisterInstancesFromLoadBalancerWithContext(ctx, &elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String(loadBalancerName),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceId)}},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elb.ErrCodeInvalidEndPointException {
+			return nil
+		}
+		return fmt.Errorf("unable to deregister instance %s from classic load balancer %s: %v", instanceId, loadBalancerName, err)
+	}
+	return nil
+}
+
+// IsInstanceRegisteredInClassicLoadBalancer checks whether an instance is still registered in a classic load balancer,
+// including while its connections are being drained
+func IsInstanceRegisteredInClassicLoadBalancer(ctx context.Context, svc elbiface.ELBAPI, loadBalancerName, instanceId string) (bool, error) {
+	output, err := svc.DescribeInstanceHealthWithContext(ctx, &elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(loadBalancerName),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceId)}},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elb.ErrCodeInvalidEndPointException {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to describe health of instance %s in classic load balancer %s: %v", instanceId, loadBalancerName, err)
+	}
+	for _, instanceState := range output.InstanceStates {
+		if aws.StringValue(instanceState.InstanceId) == instanceId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetClassicLoadBalancerDeregistrationDelay retrieves the connection draining timeout of a classic load balancer,
+// or 0 if connection draining is disabled
+func GetClassicLoadBalancerDeregistrationDelay(ctx context.Context, svc elbiface.ELBAPI, loadBalancerName string) (time.Duration, error) {
+	output, err := svc.DescribeLoadBalancerAttributesWithContext(ctx, &elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(loadBalancerName),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to describe attributes of classic load balancer %s: %v", loadBalancerName, err)
+	}
+	if output.LoadBalancerAttributes == nil || output.LoadBalancerAttributes.ConnectionDraining == nil || !aws.BoolValue(output.LoadBalancerAttributes.ConnectionDraining.Enabled) {
+		return 0, nil
+	}
+	return time.Duration(aws.Int64Value(output.LoadBalancerAttributes.ConnectionDraining.Timeout)) * time.Second, nil
+}
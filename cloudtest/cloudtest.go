@@ -2,8 +2,10 @@ package cloudtest
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -13,18 +15,24 @@ import (
 type MockEC2Service struct {
 	ec2iface.EC2API
 
+	mutex sync.Mutex
+
 	Counter   map[string]int64
 	Templates []*ec2.LaunchTemplate
+	Instances map[string]*ec2.Instance
 }
 
 func NewMockEC2Service(templates []*ec2.LaunchTemplate) *MockEC2Service {
 	return &MockEC2Service{
 		Counter:   make(map[string]int64),
 		Templates: templates,
+		Instances: make(map[string]*ec2.Instance),
 	}
 }
 
-func (m *MockEC2Service) DescribeLaunchTemplates(_ *ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error) {
+func (m *MockEC2Service) DescribeLaunchTemplatesWithContext(_ aws.Context, _ *ec2.DescribeLaunchTemplatesInput, _ ...request.Option) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["DescribeLaunchTemplates"]++
 	output := &ec2.DescribeLaunchTemplatesOutput{
 		LaunchTemplates: m.Templates,
@@ -33,6 +41,8 @@ func (m *MockEC2Service) DescribeLaunchTemplates(_ *ec2.DescribeLaunchTemplatesI
 }
 
 func (m *MockEC2Service) DescribeLaunchTemplateByID(input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["DescribeLaunchTemplateByID"]++
 	for _, template := range m.Templates {
 		if template.LaunchTemplateId == input.LaunchTemplateIds[0] {
@@ -45,6 +55,31 @@ func (m *MockEC2Service) DescribeLaunchTemplateByID(input *ec2.DescribeLaunchTem
 	return nil, errors.New("not found")
 }
 
+func (m *MockEC2Service) DescribeInstancesWithContext(_ aws.Context, input *ec2.DescribeInstancesInput, _ ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeInstances"]++
+	var instances []*ec2.Instance
+	for _, instanceId := range input.InstanceIds {
+		if instance, ok := m.Instances[aws.StringValue(instanceId)]; ok {
+			instances = append(instances, instance)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: instances}}}, nil
+}
+
+func (m *MockEC2Service) TerminateInstancesWithContext(_ aws.Context, input *ec2.TerminateInstancesInput, _ ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["TerminateInstances"]++
+	for _, instanceId := range input.InstanceIds {
+		if instance, ok := m.Instances[aws.StringValue(instanceId)]; ok {
+			instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameShuttingDown)}
+		}
+	}
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
 func CreateTestEc2Instance(id string) *ec2.Instance {
 	instance := &ec2.Instance{
 		InstanceId: aws.String(id),
@@ -55,6 +90,8 @@ func CreateTestEc2Instance(id string) *ec2.Instance {
 type MockAutoScalingService struct {
 	autoscalingiface.AutoScalingAPI
 
+	mutex sync.Mutex
+
 	Counter           map[string]int64
 	AutoScalingGroups map[string]*autoscaling.Group
 }
@@ -70,12 +107,19 @@ func NewMockAutoScalingService(autoScalingGroups []*autoscaling.Group) *MockAuto
 	return service
 }
 
-func (m *MockAutoScalingService) TerminateInstanceInAutoScalingGroup(_ *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+func (m *MockAutoScalingService) TerminateInstanceInAutoScalingGroupWithContext(_ aws.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["TerminateInstanceInAutoScalingGroup"]++
+	if aws.BoolValue(input.ShouldDecrementDesiredCapacity) {
+		m.Counter["TerminateInstanceInAutoScalingGroupAndDecrementDesiredCapacity"]++
+	}
 	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
 }
 
-func (m *MockAutoScalingService) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+func (m *MockAutoScalingService) DescribeAutoScalingGroupsWithContext(_ aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, _ ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["DescribeAutoScalingGroups"]++
 	var autoScalingGroups []*autoscaling.Group
 	for _, autoScalingGroupName := range input.AutoScalingGroupNames {
@@ -90,17 +134,131 @@ func (m *MockAutoScalingService) DescribeAutoScalingGroups(input *autoscaling.De
 	}, nil
 }
 
-func (m *MockAutoScalingService) SetDesiredCapacity(input *autoscaling.SetDesiredCapacityInput) (*autoscaling.SetDesiredCapacityOutput, error) {
+func (m *MockAutoScalingService) SetDesiredCapacityWithContext(_ aws.Context, input *autoscaling.SetDesiredCapacityInput, _ ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["SetDesiredCapacity"]++
 	m.AutoScalingGroups[aws.StringValue(input.AutoScalingGroupName)].SetDesiredCapacity(aws.Int64Value(input.DesiredCapacity))
 	return &autoscaling.SetDesiredCapacityOutput{}, nil
 }
 
-func (m *MockAutoScalingService) UpdateAutoScalingGroup(_ *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+func (m *MockAutoScalingService) UpdateAutoScalingGroupWithContext(_ aws.Context, _ *autoscaling.UpdateAutoScalingGroupInput, _ ...request.Option) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Counter["UpdateAutoScalingGroup"]++
 	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
 }
 
+func (m *MockAutoScalingService) DescribeAutoScalingInstancesWithContext(_ aws.Context, input *autoscaling.DescribeAutoScalingInstancesInput, _ ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeAutoScalingInstances"]++
+	var instancesDetails []*autoscaling.InstanceDetails
+	for _, instanceId := range input.InstanceIds {
+		for _, autoScalingGroup := range m.AutoScalingGroups {
+			for _, instance := range autoScalingGroup.Instances {
+				if aws.StringValue(instance.InstanceId) == aws.StringValue(instanceId) {
+					instancesDetails = append(instancesDetails, &autoscaling.InstanceDetails{
+						AutoScalingGroupName: autoScalingGroup.AutoScalingGroupName,
+						InstanceId:           instance.InstanceId,
+						LifecycleState:       instance.LifecycleState,
+					})
+				}
+			}
+		}
+	}
+	return &autoscaling.DescribeAutoScalingInstancesOutput{AutoScalingInstances: instancesDetails}, nil
+}
+
+func (m *MockAutoScalingService) DetachInstancesWithContext(_ aws.Context, input *autoscaling.DetachInstancesInput, _ ...request.Option) (*autoscaling.DetachInstancesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DetachInstances"]++
+	autoScalingGroup, ok := m.AutoScalingGroups[aws.StringValue(input.AutoScalingGroupName)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	for _, instanceId := range input.InstanceIds {
+		for i, instance := range autoScalingGroup.Instances {
+			if aws.StringValue(instance.InstanceId) == aws.StringValue(instanceId) {
+				autoScalingGroup.Instances = append(autoScalingGroup.Instances[:i], autoScalingGroup.Instances[i+1:]...)
+				break
+			}
+		}
+	}
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+func (m *MockAutoScalingService) CompleteLifecycleActionWithContext(_ aws.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["CompleteLifecycleAction"]++
+	autoScalingGroup, ok := m.AutoScalingGroups[aws.StringValue(input.AutoScalingGroupName)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	for _, instance := range autoScalingGroup.Instances {
+		if aws.StringValue(instance.InstanceId) == aws.StringValue(input.InstanceId) {
+			if aws.StringValue(instance.LifecycleState) != autoscaling.LifecycleStateTerminatingWait {
+				return nil, errors.New("no active lifecycle action found")
+			}
+			instance.SetLifecycleState(autoscaling.LifecycleStateTerminatingProceed)
+			return &autoscaling.CompleteLifecycleActionOutput{}, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *MockAutoScalingService) RecordLifecycleActionHeartbeatWithContext(_ aws.Context, _ *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...request.Option) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["RecordLifecycleActionHeartbeat"]++
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (m *MockAutoScalingService) CreateOrUpdateTagsWithContext(_ aws.Context, input *autoscaling.CreateOrUpdateTagsInput, _ ...request.Option) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["CreateOrUpdateTags"]++
+	for _, tag := range input.Tags {
+		autoScalingGroup, ok := m.AutoScalingGroups[aws.StringValue(tag.ResourceId)]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		updated := false
+		for _, existingTag := range autoScalingGroup.Tags {
+			if aws.StringValue(existingTag.Key) == aws.StringValue(tag.Key) {
+				existingTag.Value = tag.Value
+				updated = true
+			}
+		}
+		if !updated {
+			autoScalingGroup.Tags = append(autoScalingGroup.Tags, &autoscaling.TagDescription{Key: tag.Key, Value: tag.Value, ResourceId: tag.ResourceId, ResourceType: tag.ResourceType})
+		}
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (m *MockAutoScalingService) DeleteTagsWithContext(_ aws.Context, input *autoscaling.DeleteTagsInput, _ ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DeleteTags"]++
+	for _, tag := range input.Tags {
+		autoScalingGroup, ok := m.AutoScalingGroups[aws.StringValue(tag.ResourceId)]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		var tags []*autoscaling.TagDescription
+		for _, existingTag := range autoScalingGroup.Tags {
+			if aws.StringValue(existingTag.Key) != aws.StringValue(tag.Key) {
+				tags = append(tags, existingTag)
+			}
+		}
+		autoScalingGroup.Tags = tags
+	}
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
 func CreateTestAutoScalingGroup(name, launchConfigurationName string, launchTemplateSpecification *autoscaling.LaunchTemplateSpecification, instances []*autoscaling.Instance, withMixedInstancesPolicy bool) *autoscaling.Group {
 	asg := &autoscaling.Group{
 		AutoScalingGroupName: aws.String(name),
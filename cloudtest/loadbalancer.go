@@ -0,0 +1,157 @@
+package cloudtest
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+type MockELBV2Service struct {
+	elbv2iface.ELBV2API
+
+	mutex sync.Mutex
+
+	Counter map[string]int64
+	// Targets maps the ARN of each target group to the state of each of its registered instances
+	Targets map[string]map[string]string
+	// DeregistrationDelaySeconds is the deregistration delay of every target group
+	DeregistrationDelaySeconds int
+	// KeepDraining prevents deregistered targets from ever leaving the draining state
+	KeepDraining bool
+}
+
+func NewMockELBV2Service(targets map[string][]string) *MockELBV2Service {
+	service := &MockELBV2Service{
+		Counter: make(map[string]int64),
+		Targets: make(map[string]map[string]string),
+	}
+	for targetGroupArn, instanceIds := range targets {
+		service.Targets[targetGroupArn] = make(map[string]string)
+		for _, instanceId := range instanceIds {
+			service.Targets[targetGroupArn][instanceId] = elbv2.TargetHealthStateEnumHealthy
+		}
+	}
+	return service
+}
+
+func (m *MockELBV2Service) DeregisterTargetsWithContext(_ aws.Context, input *elbv2.DeregisterTargetsInput, _ ...request.Option) (*elbv2.DeregisterTargetsOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DeregisterTargets"]++
+	targets, ok := m.Targets[aws.StringValue(input.TargetGroupArn)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	for _, target := range input.Targets {
+		if m.KeepDraining {
+			targets[aws.StringValue(target.Id)] = elbv2.TargetHealthStateEnumDraining
+		} else {
+			delete(targets, aws.StringValue(target.Id))
+		}
+	}
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (m *MockELBV2Service) DescribeTargetHealthWithContext(_ aws.Context, input *elbv2.DescribeTargetHealthInput, _ ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeTargetHealth"]++
+	targets, ok := m.Targets[aws.StringValue(input.TargetGroupArn)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	var targetHealthDescriptions []*elbv2.TargetHealthDescription
+	for _, target := range input.Targets {
+		state, ok := targets[aws.StringValue(target.Id)]
+		if !ok {
+			state = elbv2.TargetHealthStateEnumUnused
+		}
+		targetHealthDescriptions = append(targetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: target.Id},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: targetHealthDescriptions}, nil
+}
+
+func (m *MockELBV2Service) DescribeTargetGroupAttributesWithContext(_ aws.Context, _ *elbv2.DescribeTargetGroupAttributesInput, _ ...request.Option) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeTargetGroupAttributes"]++
+	return &elbv2.DescribeTargetGroupAttributesOutput{
+		Attributes: []*elbv2.TargetGroupAttribute{{
+			Key:   aws.String("deregistration_delay.timeout_seconds"),
+			Value: aws.String(strconv.Itoa(m.DeregistrationDelaySeconds)),
+		}},
+	}, nil
+}
+
+type MockELBService struct {
+	elbiface.ELBAPI
+
+	mutex sync.Mutex
+
+	Counter map[string]int64
+	// Instances maps the name of each classic load balancer to the ids of its registered instances
+	Instances map[string][]string
+}
+
+func NewMockELBService(instances map[string][]string) *MockELBService {
+	return &MockELBService{
+		Counter:   make(map[string]int64),
+		Instances: instances,
+	}
+}
+
+func (m *MockELBService) DeregisterInstancesFromLoadBalancerWithContext(_ aws.Context, input *elb.DeregisterInstancesFromLoadBalancerInput, _ ...request.Option) (*elb.DeregisterInstancesFromLoadBalancerOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DeregisterInstancesFromLoadBalancer"]++
+	instanceIds, ok := m.Instances[aws.StringValue(input.LoadBalancerName)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	for _, instance := range input.Instances {
+		for i, instanceId := range instanceIds {
+			if instanceId == aws.StringValue(instance.InstanceId) {
+				instanceIds = append(instanceIds[:i], instanceIds[i+1:]...)
+				break
+			}
+		}
+	}
+	m.Instances[aws.StringValue(input.LoadBalancerName)] = instanceIds
+	return &elb.DeregisterInstancesFromLoadBalancerOutput{}, nil
+}
+
+func (m *MockELBService) DescribeInstanceHealthWithContext(_ aws.Context, input *elb.DescribeInstanceHealthInput, _ ...request.Option) (*elb.DescribeInstanceHealthOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeInstanceHealth"]++
+	var instanceStates []*elb.InstanceState
+	for _, instance := range input.Instances {
+		for _, instanceId := range m.Instances[aws.StringValue(input.LoadBalancerName)] {
+			if instanceId == aws.StringValue(instance.InstanceId) {
+				instanceStates = append(instanceStates, &elb.InstanceState{InstanceId: aws.String(instanceId), State: aws.String("InService")})
+			}
+		}
+	}
+	return &elb.DescribeInstanceHealthOutput{InstanceStates: instanceStates}, nil
+}
+
+func (m *MockELBService) DescribeLoadBalancerAttributesWithContext(_ aws.Context, _ *elb.DescribeLoadBalancerAttributesInput, _ ...request.Option) (*elb.DescribeLoadBalancerAttributesOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Counter["DescribeLoadBalancerAttributes"]++
+	return &elb.DescribeLoadBalancerAttributesOutput{
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionDraining: &elb.ConnectionDraining{Enabled: aws.Bool(true), Timeout: aws.Int64(300)},
+		},
+	}, nil
+}
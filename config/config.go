@@ -4,19 +4,85 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var cfg *config
 
 const (
-	EnvEnvironment           = "ENVIRONMENT"
-	EnvDebug                 = "DEBUG"
-	EnvIgnoreDaemonSets      = "IGNORE_DAEMON_SETS"
-	EnvDeleteLocalData       = "DELETE_LOCAL_DATA"
-	EnvClusterName           = "CLUSTER_NAME"
-	EnvAutoScalingGroupNames = "AUTO_SCALING_GROUP_NAMES"
-	EnvAwsRegion             = "AWS_REGION"
+	EnvEnvironment                         = "ENVIRONMENT"
+	EnvDebug                               = "DEBUG"
+	EnvIgnoreDaemonSets                    = "IGNORE_DAEMON_SETS"
+	EnvDeleteLocalData                     = "DELETE_LOCAL_DATA"
+	EnvClusterName                         = "CLUSTER_NAME"
+	EnvAutoScalingGroupNames               = "AUTO_SCALING_GROUP_NAMES"
+	EnvAwsRegion                           = "AWS_REGION"
+	EnvMigrationStrategy                   = "MIGRATION_STRATEGY"
+	EnvMigrationTimeout                    = "MIGRATION_TIMEOUT"
+	EnvPriorityOrderedEviction             = "PRIORITY_ORDERED_EVICTION"
+	EnvEvictionTierTimeout                 = "EVICTION_TIER_TIMEOUT"
+	EnvEvictionTimeout                     = "EVICTION_TIMEOUT"
+	EnvEvictionFallbackToDeletion          = "EVICTION_FALLBACK_TO_DELETION"
+	EnvEvictionFallbackNamespaces          = "EVICTION_FALLBACK_NAMESPACES"
+	EnvVerifyEvictedWorkloads              = "VERIFY_EVICTED_WORKLOADS"
+	EnvEvictedWorkloadsVerificationTimeout = "EVICTED_WORKLOADS_VERIFICATION_TIMEOUT"
+	EnvStuckTerminationThreshold           = "STUCK_TERMINATION_THRESHOLD"
+	EnvStuckDrainThreshold                 = "STUCK_DRAIN_THRESHOLD"
+	EnvOutdatedNodeTaintEffect             = "OUTDATED_NODE_TAINT_EFFECT"
+	EnvMaxUnavailable                      = "MAX_UNAVAILABLE"
+	EnvAutoScalingGroupConcurrency         = "AUTO_SCALING_GROUP_CONCURRENCY"
+	EnvAutoScalingGroupTimeout             = "AUTO_SCALING_GROUP_TIMEOUT"
+	EnvMaxConcurrentDrains                 = "MAX_CONCURRENT_DRAINS"
+	EnvLifecycleHookName                   = "LIFECYCLE_HOOK_NAME"
+	EnvLifecycleHookHeartbeatInterval      = "LIFECYCLE_HOOK_HEARTBEAT_INTERVAL"
+	EnvWaitForLoadBalancerDeregistration   = "WAIT_FOR_LOAD_BALANCER_DEREGISTRATION"
+	EnvWaitForVolumeDetachment             = "WAIT_FOR_VOLUME_DETACHMENT"
+	EnvVolumeDetachmentTimeout             = "VOLUME_DETACHMENT_TIMEOUT"
+	EnvDeleteNodeAfterTermination          = "DELETE_NODE_AFTER_TERMINATION"
+	EnvOrphanInstanceGracePeriod           = "ORPHAN_INSTANCE_GRACE_PERIOD"
+	EnvOrphanInstanceRetryBudget           = "ORPHAN_INSTANCE_RETRY_BUDGET"
+	EnvStartupTaints                       = "STARTUP_TAINTS"
+	EnvRequiredDaemonSets                  = "REQUIRED_DAEMON_SETS"
+	EnvNodeReadySoakDuration               = "NODE_READY_SOAK_DURATION"
+	EnvKubernetesClientCache               = "KUBERNETES_CLIENT_CACHE"
+	EnvListenAddress                       = "LISTEN_ADDRESS"
+	EnvLeaderElection                      = "LEADER_ELECTION"
+	EnvLeaderElectionNamespace             = "LEADER_ELECTION_NAMESPACE"
+	EnvLeaderElectionLeaseName             = "LEADER_ELECTION_LEASE_NAME"
+	EnvLeaderElectionLeaseDuration         = "LEADER_ELECTION_LEASE_DURATION"
+	EnvLeaderElectionRenewDeadline         = "LEADER_ELECTION_RENEW_DEADLINE"
+	EnvLeaderElectionRetryPeriod           = "LEADER_ELECTION_RETRY_PERIOD"
+	EnvDryRun                              = "DRY_RUN"
+	EnvNodeGroupRollouts                   = "NODE_GROUP_ROLLOUTS"
+	EnvPauseConfigMap                      = "PAUSE_CONFIG_MAP"
+	EnvMaintenanceWindows                  = "MAINTENANCE_WINDOWS"
+	EnvMaintenanceWindowTimezone           = "MAINTENANCE_WINDOW_TIMEZONE"
+	EnvMaintenanceWindowClosePolicy        = "MAINTENANCE_WINDOW_CLOSE_POLICY"
+)
+
+const (
+	// MigrationStrategyEvict relies exclusively on the eviction of the pods when draining a node
+	MigrationStrategyEvict = "evict"
+
+	// MigrationStrategyScaleUp temporarily increases the replicas of the Deployments that have pods on the node
+	// being drained, and restores the original number of replicas once the node has been drained
+	MigrationStrategyScaleUp = "scale-up"
+
+	// MigrationStrategyRolloutRestart triggers a rollout restart of the Deployments that have pods on the node
+	// being drained
+	MigrationStrategyRolloutRestart = "rollout-restart"
+)
+
+const (
+	// LoadBalancerDeregistrationDelay is the default deregistration delay of target groups, which is how long the
+	// deregistration of an instance is expected to take when WaitForLoadBalancerDeregistration is enabled
+	LoadBalancerDeregistrationDelay = 300 * time.Second
+
+	// AutoScalingGroupTimeoutMargin is added to the timeouts of the steps a node goes through to get the default
+	// AutoScalingGroupTimeout, to leave room for the calls to AWS and Kubernetes
+	AutoScalingGroupTimeoutMargin = 5 * time.Minute
 )
 
 type config struct {
@@ -40,10 +106,136 @@ type config struct {
 
 	// Defaults to true
 	DeleteLocalData bool
+
+	// Defaults to evict
+	MigrationStrategy string
+
+	// Defaults to 5 minutes
+	MigrationTimeout time.Duration
+
+	// Defaults to false
+	PriorityOrderedEviction bool
+
+	// Defaults to 5 minutes
+	EvictionTierTimeout time.Duration
+
+	// Defaults to 5 minutes
+	EvictionTimeout time.Duration
+
+	// Defaults to false
+	EvictionFallbackToDeletion bool
+
+	// Defaults to every namespace
+	EvictionFallbackNamespaces []string
+
+	// Defaults to false
+	VerifyEvictedWorkloads bool
+
+	// Defaults to 10 minutes
+	EvictedWorkloadsVerificationTimeout time.Duration
+
+	// Defaults to 0, which disables the recovery of stuck terminations
+	StuckTerminationThreshold time.Duration
+
+	// Defaults to 0, which disables the recovery of stuck drains
+	StuckDrainThreshold time.Duration
+
+	// Defaults to "", meaning that outdated nodes are not tainted
+	OutdatedNodeTaintEffect string
+
+	// Defaults to 1. Can be either a number of nodes or a percentage of the ASG's desired capacity (e.g. 25%)
+	MaxUnavailable string
+
+	// Defaults to 1
+	AutoScalingGroupConcurrency int
+
+	// Defaults to the sum of the timeouts of the steps a node goes through plus AutoScalingGroupTimeoutMargin, which
+	// is 10 minutes with the default configuration. Cannot be lower than that sum, unless set to 0
+	AutoScalingGroupTimeout time.Duration
+
+	// Defaults to 0, meaning that there is no limit
+	MaxConcurrentDrains int
+
+	// Defaults to "", meaning that lifecycle hooks are not handled
+	LifecycleHookName string
+
+	// Defaults to 1 minute
+	LifecycleHookHeartbeatInterval time.Duration
+
+	// Defaults to false
+	WaitForLoadBalancerDeregistration bool
+
+	// Defaults to false
+	WaitForVolumeDetachment bool
+
+	// Defaults to 5 minutes
+	VolumeDetachmentTimeout time.Duration
+
+	// Defaults to false
+	DeleteNodeAfterTermination bool
+
+	// Defaults to 0, which disables the handling of orphan instances
+	OrphanInstanceGracePeriod time.Duration
+
+	// Defaults to 3
+	OrphanInstanceRetryBudget int
+
+	// Defaults to no taints
+	StartupTaints []string
+
+	// Defaults to no DaemonSets. Each DaemonSet must be in the format namespace/name
+	RequiredDaemonSets []string
+
+	// Defaults to 0
+	NodeReadySoakDuration time.Duration
+
+	// Defaults to false. Node and pod events are only received when enabled
+	KubernetesClientCache bool
+
+	// Defaults to blank, which means that no HTTP server is started
+	ListenAddress string
+
+	// Defaults to false
+	LeaderElection bool
+
+	// Defaults to kube-system
+	LeaderElectionNamespace string
+
+	// Defaults to aws-eks-asg-rolling-update-handler
+	LeaderElectionLeaseName string
+
+	// Defaults to 15 seconds
+	LeaderElectionLeaseDuration time.Duration
+
+	// Defaults to 10 seconds
+	LeaderElectionRenewDeadline time.Duration
+
+	// Defaults to 2 seconds
+	LeaderElectionRetryPeriod time.Duration
+
+	// Defaults to false
+	DryRun bool
+
+	// Defaults to false
+	NodeGroupRollouts bool
+
+	// Defaults to blank, which means that rolling updates cannot be paused through a ConfigMap.
+	// Must be in the format namespace/name
+	PauseConfigMap string
+
+	// Defaults to no maintenance windows, which means that nodes can be rolled out at any time
+	MaintenanceWindows []*MaintenanceWindow
+
+	// Defaults to UTC
+	MaintenanceWindowTimezone string
+
+	// Defaults to finish
+	MaintenanceWindowClosePolicy string
 }
 
 // Initialize is used to initialize the application's configuration
 func Initialize() error {
+	var err error
 	cfg = &config{
 		Environment: strings.ToLower(os.Getenv(EnvEnvironment)),
 		Debug:       strings.ToLower(os.Getenv(EnvDebug)) == "true",
@@ -67,9 +259,221 @@ func Initialize() error {
 	} else {
 		cfg.AwsRegion = awsRegion
 	}
+	switch migrationStrategy := strings.ToLower(os.Getenv(EnvMigrationStrategy)); migrationStrategy {
+	case "", MigrationStrategyEvict:
+		cfg.MigrationStrategy = MigrationStrategyEvict
+	case MigrationStrategyScaleUp, MigrationStrategyRolloutRestart:
+		cfg.MigrationStrategy = migrationStrategy
+	default:
+		return fmt.Errorf("environment variable '%s' has an invalid value '%s', must be one of %s, %s or %s", EnvMigrationStrategy, migrationStrategy, MigrationStrategyEvict, MigrationStrategyScaleUp, MigrationStrategyRolloutRestart)
+	}
+	if cfg.MigrationTimeout, err = getDurationFromEnv(EnvMigrationTimeout, 5*time.Minute); err != nil {
+		return err
+	}
+	cfg.PriorityOrderedEviction = strings.ToLower(os.Getenv(EnvPriorityOrderedEviction)) == "true"
+	if cfg.EvictionTierTimeout, err = getDurationFromEnv(EnvEvictionTierTimeout, 5*time.Minute); err != nil {
+		return err
+	}
+	if cfg.EvictionTimeout, err = getDurationFromEnv(EnvEvictionTimeout, 5*time.Minute); err != nil {
+		return err
+	}
+	cfg.EvictionFallbackToDeletion = strings.ToLower(os.Getenv(EnvEvictionFallbackToDeletion)) == "true"
+	if evictionFallbackNamespaces := strings.TrimSpace(os.Getenv(EnvEvictionFallbackNamespaces)); len(evictionFallbackNamespaces) > 0 {
+		cfg.EvictionFallbackNamespaces = strings.Split(evictionFallbackNamespaces, ",")
+	}
+	cfg.VerifyEvictedWorkloads = strings.ToLower(os.Getenv(EnvVerifyEvictedWorkloads)) == "true"
+	if cfg.EvictedWorkloadsVerificationTimeout, err = getDurationFromEnv(EnvEvictedWorkloadsVerificationTimeout, 10*time.Minute); err != nil {
+		return err
+	}
+	if cfg.StuckTerminationThreshold, err = getDurationFromEnv(EnvStuckTerminationThreshold, 0); err != nil {
+		return err
+	}
+	if cfg.StuckDrainThreshold, err = getDurationFromEnv(EnvStuckDrainThreshold, 0); err != nil {
+		return err
+	}
+	switch outdatedNodeTaintEffect := os.Getenv(EnvOutdatedNodeTaintEffect); outdatedNodeTaintEffect {
+	case "", "PreferNoSchedule", "NoSchedule":
+		cfg.OutdatedNodeTaintEffect = outdatedNodeTaintEffect
+	default:
+		return fmt.Errorf("environment variable '%s' has an invalid value '%s', must be either PreferNoSchedule or NoSchedule", EnvOutdatedNodeTaintEffect, outdatedNodeTaintEffect)
+	}
+	if maxUnavailable := strings.TrimSpace(os.Getenv(EnvMaxUnavailable)); len(maxUnavailable) > 0 {
+		if _, err = ParseMaxUnavailable(maxUnavailable, 0); err != nil {
+			return fmt.Errorf("environment variable '%s' is invalid: %v", EnvMaxUnavailable, err)
+		}
+		cfg.MaxUnavailable = maxUnavailable
+	} else {
+		cfg.MaxUnavailable = "1"
+	}
+	if cfg.AutoScalingGroupConcurrency, err = getNonNegativeIntFromEnv(EnvAutoScalingGroupConcurrency, 1); err != nil {
+		return err
+	}
+	if cfg.AutoScalingGroupConcurrency == 0 {
+		return fmt.Errorf("environment variable '%s' must be greater than 0", EnvAutoScalingGroupConcurrency)
+	}
+	if cfg.MaxConcurrentDrains, err = getNonNegativeIntFromEnv(EnvMaxConcurrentDrains, 0); err != nil {
+		return err
+	}
+	cfg.LifecycleHookName = strings.TrimSpace(os.Getenv(EnvLifecycleHookName))
+	if cfg.LifecycleHookHeartbeatInterval, err = getDurationFromEnv(EnvLifecycleHookHeartbeatInterval, time.Minute); err != nil {
+		return err
+	}
+	if cfg.LifecycleHookHeartbeatInterval <= 0 {
+		return fmt.Errorf("environment variable '%s' must be greater than 0", EnvLifecycleHookHeartbeatInterval)
+	}
+	cfg.WaitForLoadBalancerDeregistration = strings.ToLower(os.Getenv(EnvWaitForLoadBalancerDeregistration)) == "true"
+	cfg.WaitForVolumeDetachment = strings.ToLower(os.Getenv(EnvWaitForVolumeDetachment)) == "true"
+	if cfg.VolumeDetachmentTimeout, err = getDurationFromEnv(EnvVolumeDetachmentTimeout, 5*time.Minute); err != nil {
+		return err
+	}
+	minimumAutoScalingGroupTimeout := getMinimumAutoScalingGroupTimeout(cfg)
+	if cfg.AutoScalingGroupTimeout, err = getDurationFromEnv(EnvAutoScalingGroupTimeout, minimumAutoScalingGroupTimeout+AutoScalingGroupTimeoutMargin); err != nil {
+		return err
+	}
+	if cfg.AutoScalingGroupTimeout > 0 && cfg.AutoScalingGroupTimeout < minimumAutoScalingGroupTimeout {
+		return fmt.Errorf("environment variable '%s' must be 0 or at least %s, which is the sum of the timeouts of the steps a node goes through", EnvAutoScalingGroupTimeout, minimumAutoScalingGroupTimeout)
+	}
+	cfg.DeleteNodeAfterTermination = strings.ToLower(os.Getenv(EnvDeleteNodeAfterTermination)) == "true"
+	if cfg.OrphanInstanceGracePeriod, err = getDurationFromEnv(EnvOrphanInstanceGracePeriod, 0); err != nil {
+		return err
+	}
+	if cfg.OrphanInstanceRetryBudget, err = getNonNegativeIntFromEnv(EnvOrphanInstanceRetryBudget, 3); err != nil {
+		return err
+	}
+	if startupTaints := strings.TrimSpace(os.Getenv(EnvStartupTaints)); len(startupTaints) > 0 {
+		cfg.StartupTaints = strings.Split(startupTaints, ",")
+	}
+	if requiredDaemonSets := strings.TrimSpace(os.Getenv(EnvRequiredDaemonSets)); len(requiredDaemonSets) > 0 {
+		cfg.RequiredDaemonSets = strings.Split(requiredDaemonSets, ",")
+		for _, requiredDaemonSet := range cfg.RequiredDaemonSets {
+			if len(strings.Split(requiredDaemonSet, "/")) != 2 {
+				return fmt.Errorf("environment variable '%s' has an invalid DaemonSet '%s', must be in the format namespace/name", EnvRequiredDaemonSets, requiredDaemonSet)
+			}
+		}
+	}
+	if cfg.NodeReadySoakDuration, err = getDurationFromEnv(EnvNodeReadySoakDuration, 0); err != nil {
+		return err
+	}
+	cfg.KubernetesClientCache = strings.ToLower(os.Getenv(EnvKubernetesClientCache)) == "true"
+	cfg.ListenAddress = os.Getenv(EnvListenAddress)
+	cfg.LeaderElection = strings.ToLower(os.Getenv(EnvLeaderElection)) == "true"
+	cfg.DryRun = strings.ToLower(os.Getenv(EnvDryRun)) == "true"
+	cfg.NodeGroupRollouts = strings.ToLower(os.Getenv(EnvNodeGroupRollouts)) == "true"
+	if cfg.PauseConfigMap = strings.TrimSpace(os.Getenv(EnvPauseConfigMap)); len(cfg.PauseConfigMap) > 0 && len(strings.Split(cfg.PauseConfigMap, "/")) != 2 {
+		return fmt.Errorf("environment variable '%s' has an invalid ConfigMap '%s', must be in the format namespace/name", EnvPauseConfigMap, cfg.PauseConfigMap)
+	}
+	if cfg.MaintenanceWindowTimezone = strings.TrimSpace(os.Getenv(EnvMaintenanceWindowTimezone)); len(cfg.MaintenanceWindowTimezone) == 0 {
+		cfg.MaintenanceWindowTimezone = "UTC"
+	}
+	if cfg.MaintenanceWindows, err = ParseMaintenanceWindows(os.Getenv(EnvMaintenanceWindows), cfg.MaintenanceWindowTimezone); err != nil {
+		return fmt.Errorf("environment variable '%s' or '%s' is invalid: %v", EnvMaintenanceWindows, EnvMaintenanceWindowTimezone, err)
+	}
+	switch maintenanceWindowClosePolicy := strings.ToLower(os.Getenv(EnvMaintenanceWindowClosePolicy)); maintenanceWindowClosePolicy {
+	case "", MaintenanceWindowClosePolicyFinish:
+		cfg.MaintenanceWindowClosePolicy = MaintenanceWindowClosePolicyFinish
+	case MaintenanceWindowClosePolicyRevert:
+		cfg.MaintenanceWindowClosePolicy = maintenanceWindowClosePolicy
+	default:
+		return fmt.Errorf("environment variable '%s' has an invalid value '%s', must be either %s or %s", EnvMaintenanceWindowClosePolicy, maintenanceWindowClosePolicy, MaintenanceWindowClosePolicyFinish, MaintenanceWindowClosePolicyRevert)
+	}
+	if cfg.LeaderElectionNamespace = os.Getenv(EnvLeaderElectionNamespace); len(cfg.LeaderElectionNamespace) == 0 {
+		cfg.LeaderElectionNamespace = "kube-system"
+	}
+	if cfg.LeaderElectionLeaseName = os.Getenv(EnvLeaderElectionLeaseName); len(cfg.LeaderElectionLeaseName) == 0 {
+		cfg.LeaderElectionLeaseName = "aws-eks-asg-rolling-update-handler"
+	}
+	if cfg.LeaderElectionLeaseDuration, err = getDurationFromEnv(EnvLeaderElectionLeaseDuration, 15*time.Second); err != nil {
+		return err
+	}
+	if cfg.LeaderElectionRenewDeadline, err = getDurationFromEnv(EnvLeaderElectionRenewDeadline, 10*time.Second); err != nil {
+		return err
+	}
+	if cfg.LeaderElectionRetryPeriod, err = getDurationFromEnv(EnvLeaderElectionRetryPeriod, 2*time.Second); err != nil {
+		return err
+	}
+	if cfg.LeaderElectionRetryPeriod <= 0 || cfg.LeaderElectionRenewDeadline <= cfg.LeaderElectionRetryPeriod || cfg.LeaderElectionLeaseDuration <= cfg.LeaderElectionRenewDeadline {
+		return fmt.Errorf("environment variables '%s', '%s' and '%s' must be in decreasing order and greater than 0", EnvLeaderElectionLeaseDuration, EnvLeaderElectionRenewDeadline, EnvLeaderElectionRetryPeriod)
+	}
 	return nil
 }
 
+// getMinimumAutoScalingGroupTimeout returns the sum of the timeouts of the steps a node goes through when it is
+// replaced, given the configuration
+func getMinimumAutoScalingGroupTimeout(cfg *config) time.Duration {
+	timeout := cfg.EvictionTimeout
+	if cfg.MigrationStrategy != MigrationStrategyEvict {
+		timeout += cfg.MigrationTimeout
+	}
+	if cfg.PriorityOrderedEviction {
+		timeout += cfg.EvictionTierTimeout
+	}
+	if cfg.VerifyEvictedWorkloads {
+		timeout += cfg.EvictedWorkloadsVerificationTimeout
+	}
+	if cfg.WaitForLoadBalancerDeregistration {
+		timeout += LoadBalancerDeregistrationDelay
+	}
+	if cfg.WaitForVolumeDetachment {
+		timeout += cfg.VolumeDetachmentTimeout
+	}
+	return timeout
+}
+
+// ParseMaxUnavailable resolves a maximum number of unavailable nodes, which is either an absolute number of nodes
+// (e.g. 3) or a percentage of the given total (e.g. 25%).
+// Percentages are rounded down, but the result is never lower than 1 so that the rollout can always progress.
+func ParseMaxUnavailable(value string, total int) (int, error) {
+	if len(value) == 0 {
+		return 1, nil
+	}
+	var maxUnavailable int
+	if strings.HasSuffix(value, "%") {
+		percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid percentage '%s', must be between 1%% and 100%%", value)
+		}
+		maxUnavailable = total * percentage / 100
+	} else {
+		count, err := strconv.Atoi(value)
+		if err != nil || count <= 0 {
+			return 0, fmt.Errorf("invalid value '%s', must be a positive number or a percentage", value)
+		}
+		maxUnavailable = count
+	}
+	if maxUnavailable < 1 {
+		maxUnavailable = 1
+	}
+	return maxUnavailable, nil
+}
+
+// getDurationFromEnv parses the duration in a given environment variable, or returns the default value if the
+// environment variable is not set
+func getDurationFromEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("environment variable '%s' has an invalid duration '%s': %v", key, value, err)
+	}
+	return duration, nil
+}
+
+// getNonNegativeIntFromEnv parses the non-negative integer in a given environment variable, or returns the default value
+// if the environment variable is not set
+func getNonNegativeIntFromEnv(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("environment variable '%s' has an invalid value '%s', must be a non-negative number", key, value)
+	}
+	return number, nil
+}
+
 // Set sets the application's configuration and is intended to be used for testing purposes.
 // See Initialize() for production
 func Set(autoScalingGroupNames []string, ignoreDaemonSets, deleteLocalData bool) {
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestInitialize(t *testing.T) {
@@ -37,6 +38,15 @@ func TestInitialize_withDefaultNonRequiredValues(t *testing.T) {
 	if !config.DeleteLocalData {
 		t.Error("should've defaulted to deleting local data")
 	}
+	if config.MigrationStrategy != MigrationStrategyEvict {
+		t.Error("should've defaulted to the evict migration strategy")
+	}
+	if config.OrphanInstanceGracePeriod != 0 {
+		t.Error("should've defaulted to not handling orphan instances")
+	}
+	if config.StuckTerminationThreshold != 0 || config.StuckDrainThreshold != 0 {
+		t.Error("should've defaulted to not recovering stuck terminations and drains")
+	}
 }
 
 func TestInitialize_withMissingRequiredValues(t *testing.T) {
@@ -58,3 +68,185 @@ func TestSet(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestInitialize_withMigrationStrategy(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvMigrationStrategy, "scale-up")
+	_ = os.Setenv(EnvMigrationTimeout, "10m")
+	defer os.Clearenv()
+	if err := Initialize(); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	config := Get()
+	if config.MigrationStrategy != MigrationStrategyScaleUp {
+		t.Errorf("expected migration strategy to be %s, got %s", MigrationStrategyScaleUp, config.MigrationStrategy)
+	}
+	if config.MigrationTimeout != 10*time.Minute {
+		t.Errorf("expected migration timeout to be 10m, got %s", config.MigrationTimeout)
+	}
+}
+
+func TestInitialize_withInvalidMigrationStrategy(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvMigrationStrategy, "teleport")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because the migration strategy is invalid")
+	}
+}
+
+func TestInitialize_withEvictionFallbackToDeletion(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvEvictionTimeout, "15m")
+	_ = os.Setenv(EnvEvictionFallbackToDeletion, "true")
+	_ = os.Setenv(EnvEvictionFallbackNamespaces, "batch,sandbox")
+	defer os.Clearenv()
+	if err := Initialize(); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	config := Get()
+	if config.EvictionTimeout != 15*time.Minute {
+		t.Errorf("expected eviction timeout to be 15m, got %s", config.EvictionTimeout)
+	}
+	if !config.EvictionFallbackToDeletion {
+		t.Error("fallback to deletion should've been enabled")
+	}
+	if len(config.EvictionFallbackNamespaces) != 2 {
+		t.Errorf("expected 2 namespaces, got %d", len(config.EvictionFallbackNamespaces))
+	}
+}
+
+func TestInitialize_withInvalidOutdatedNodeTaintEffect(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvOutdatedNodeTaintEffect, "NoExecute")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because NoExecute would evict the pods without going through the drain")
+	}
+}
+
+func TestInitialize_withLeaderElection(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvLeaderElection, "true")
+	_ = os.Setenv(EnvLeaderElectionLeaseDuration, "30s")
+	defer os.Clearenv()
+	if err := Initialize(); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	config := Get()
+	if !config.LeaderElection {
+		t.Error("leader election should've been enabled")
+	}
+	if config.LeaderElectionNamespace != "kube-system" || config.LeaderElectionLeaseName != "aws-eks-asg-rolling-update-handler" {
+		t.Errorf("expected the default lease kube-system/aws-eks-asg-rolling-update-handler, got %s/%s", config.LeaderElectionNamespace, config.LeaderElectionLeaseName)
+	}
+	if config.LeaderElectionLeaseDuration != 30*time.Second || config.LeaderElectionRenewDeadline != 10*time.Second || config.LeaderElectionRetryPeriod != 2*time.Second {
+		t.Errorf("unexpected lease durations %s, %s and %s", config.LeaderElectionLeaseDuration, config.LeaderElectionRenewDeadline, config.LeaderElectionRetryPeriod)
+	}
+}
+
+func TestInitialize_withInvalidPauseConfigMap(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvPauseConfigMap, "aws-eks-asg-rolling-update-handler")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because the ConfigMap isn't in the format namespace/name")
+	}
+}
+
+func TestInitialize_withInvalidLeaderElectionDurations(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvLeaderElectionRenewDeadline, "20s")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because the renew deadline is longer than the lease duration")
+	}
+}
+
+func TestParseMaxUnavailable(t *testing.T) {
+	scenarios := []struct {
+		value    string
+		total    int
+		expected int
+		isValid  bool
+	}{
+		{value: "", total: 10, expected: 1, isValid: true},
+		{value: "3", total: 10, expected: 3, isValid: true},
+		{value: "25%", total: 10, expected: 2, isValid: true},
+		{value: "25%", total: 2, expected: 1, isValid: true},
+		{value: "100%", total: 4, expected: 4, isValid: true},
+		{value: "0", total: 10, isValid: false},
+		{value: "150%", total: 10, isValid: false},
+		{value: "many", total: 10, isValid: false},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.value, func(t *testing.T) {
+			maxUnavailable, err := ParseMaxUnavailable(scenario.value, scenario.total)
+			if scenario.isValid != (err == nil) {
+				t.Fatalf("expected valid=%v, got error %v", scenario.isValid, err)
+			}
+			if scenario.isValid && maxUnavailable != scenario.expected {
+				t.Errorf("expected %d, got %d", scenario.expected, maxUnavailable)
+			}
+		})
+	}
+}
+
+func TestInitialize_withMaintenanceWindows(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvMaintenanceWindows, "0 22 * * 1-5 4h;0 0 * * 0,6 24h")
+	_ = os.Setenv(EnvMaintenanceWindowTimezone, "America/Montreal")
+	defer os.Clearenv()
+	if err := Initialize(); err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	config := Get()
+	if len(config.MaintenanceWindows) != 2 || config.MaintenanceWindows[1].Location.String() != "America/Montreal" {
+		t.Errorf("unexpected maintenance windows %+v", config.MaintenanceWindows)
+	}
+	if config.MaintenanceWindowClosePolicy != MaintenanceWindowClosePolicyFinish {
+		t.Error("should've defaulted to the finish maintenance window close policy")
+	}
+}
+
+func TestInitialize_withInvalidMaintenanceWindowClosePolicy(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvMaintenanceWindowClosePolicy, "abandon")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because the maintenance window close policy is invalid")
+	}
+}
+
+func TestInitialize_withAutoScalingGroupTimeout(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	defer os.Clearenv()
+	if err := Initialize(); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if Get().AutoScalingGroupTimeout != 10*time.Minute {
+		t.Errorf("should've defaulted to 10m with the default configuration, got %s", Get().AutoScalingGroupTimeout)
+	}
+	_ = os.Setenv(EnvWaitForLoadBalancerDeregistration, "true")
+	_ = os.Setenv(EnvWaitForVolumeDetachment, "true")
+	if err := Initialize(); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if Get().AutoScalingGroupTimeout != 20*time.Minute {
+		t.Errorf("should've defaulted to the eviction, load balancer deregistration and volume detachment timeouts plus the margin, got %s", Get().AutoScalingGroupTimeout)
+	}
+	_ = os.Setenv(EnvAutoScalingGroupTimeout, "0")
+	if err := Initialize(); err != nil {
+		t.Error("shouldn't have returned an error, because 0 disables the timeout, but got", err)
+	}
+}
+
+func TestInitialize_withAutoScalingGroupTimeoutShorterThanSteps(t *testing.T) {
+	_ = os.Setenv(EnvAutoScalingGroupNames, "asg-a")
+	_ = os.Setenv(EnvWaitForVolumeDetachment, "true")
+	_ = os.Setenv(EnvAutoScalingGroupTimeout, "8m")
+	defer os.Clearenv()
+	if err := Initialize(); err == nil {
+		t.Error("expected error because the timeout is shorter than the eviction and volume detachment timeouts")
+	}
+}
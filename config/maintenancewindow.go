@@ -0,0 +1,264 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embeds the timezone database, since the image the application runs on doesn't have one
+	_ "time/tzdata"
+)
+
+const (
+	// MaintenanceWindowClosePolicyFinish lets the drain of a node that is in progress when the maintenance window
+	// closes run to completion, and terminates the nodes that have already been drained
+	MaintenanceWindowClosePolicyFinish = "finish"
+
+	// MaintenanceWindowClosePolicyRevert cancels the drain of a node that is in progress when the maintenance window
+	// closes, and rolls back the nodes whose rollout had started but that haven't been terminated yet
+	MaintenanceWindowClosePolicyRevert = "revert"
+)
+
+// maximumScheduleLookahead is the maximum duration past which Schedule.Next gives up looking for a matching time,
+// which prevents schedules that can never match (e.g. 0 0 30 2 *) from looping forever
+const maximumScheduleLookahead = 5 * 366 * 24 * time.Hour
+
+// MaintenanceWindow is a recurring period during which the rollout of new nodes may be started
+type MaintenanceWindow struct {
+	// Schedule is the schedule at which the maintenance window opens
+	Schedule *Schedule
+
+	// Duration is how long the maintenance window stays open after opening
+	Duration time.Duration
+
+	// Location is the timezone in which the schedule is evaluated
+	Location *time.Location
+}
+
+// NewMaintenanceWindow creates a MaintenanceWindow from a cron expression, a duration and the name of a timezone.
+// If the name of the timezone is blank, the schedule is evaluated in UTC
+func NewMaintenanceWindow(schedule string, duration time.Duration, timezone string) (*MaintenanceWindow, error) {
+	parsedSchedule, err := ParseSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("invalid duration '%s', must be greater than 0", duration)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone '%s': %v", timezone, err)
+	}
+	return &MaintenanceWindow{Schedule: parsedSchedule, Duration: duration, Location: location}, nil
+}
+
+// ParseMaintenanceWindows parses a semicolon-separated list of maintenance windows, each of which is a cron
+// expression followed by a duration (e.g. "0 22 * * 1-5 4h; 0 0 * * 0,6 24h"), evaluated in the given timezone
+func ParseMaintenanceWindows(value, timezone string) ([]*MaintenanceWindow, error) {
+	var maintenanceWindows []*MaintenanceWindow
+	for _, rawMaintenanceWindow := range strings.Split(value, ";") {
+		if len(strings.TrimSpace(rawMaintenanceWindow)) == 0 {
+			continue
+		}
+		fields := strings.Fields(rawMaintenanceWindow)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid maintenance window '%s', must be a cron expression with 5 fields followed by a duration", strings.TrimSpace(rawMaintenanceWindow))
+		}
+		duration, err := time.ParseDuration(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window '%s': %v", strings.TrimSpace(rawMaintenanceWindow), err)
+		}
+		maintenanceWindow, err := NewMaintenanceWindow(strings.Join(fields[:5], " "), duration, timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window '%s': %v", strings.TrimSpace(rawMaintenanceWindow), err)
+		}
+		maintenanceWindows = append(maintenanceWindows, maintenanceWindow)
+	}
+	return maintenanceWindows, nil
+}
+
+// ClosesAt returns when the maintenance window closes if it is open at the given time.
+// Returns false if the maintenance window is closed at the given time
+func (w *MaintenanceWindow) ClosesAt(now time.Time) (time.Time, bool) {
+	// The maintenance window is open if it opened less than its duration ago. If it opened several times during that
+	// period (i.e. its duration is longer than the interval of its schedule), it closes after the last one
+	var closesAt time.Time
+	for openedAt := w.Schedule.Next(now.Add(-w.Duration).In(w.Location)); !openedAt.IsZero() && !openedAt.After(now); openedAt = w.Schedule.Next(openedAt) {
+		closesAt = openedAt.Add(w.Duration)
+	}
+	return closesAt, !closesAt.IsZero()
+}
+
+// OpensAt returns when the maintenance window opens next after the given time.
+// Returns the zero time if the maintenance window never opens
+func (w *MaintenanceWindow) OpensAt(now time.Time) time.Time {
+	return w.Schedule.Next(now.In(w.Location))
+}
+
+// Schedule is a parsed cron expression with 5 fields: minute, hour, day of month, month and day of week.
+//
+// Each field is either *, a value, a range (e.g. 1-5) or a comma-separated list of these, each of which can be
+// followed by a step (e.g. */15). Months and days of week can also be given by their first three letters
+// (e.g. JAN, MON), and both 0 and 7 are Sunday.
+// Like cron, if both the day of month and the day of week are restricted, a day matches if it matches either of them
+type Schedule struct {
+	expression string
+
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+
+	// isDayOfMonthWildcard and isDayOfWeekWildcard are whether the day of month and the day of week fields start with *
+	isDayOfMonthWildcard bool
+	isDayOfWeekWildcard  bool
+}
+
+// scheduleField are the bounds and names of the values of a field of a cron expression
+type scheduleField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField     = scheduleField{name: "minute", min: 0, max: 59}
+	hourField       = scheduleField{name: "hour", min: 0, max: 23}
+	dayOfMonthField = scheduleField{name: "day of month", min: 1, max: 31}
+	monthField      = scheduleField{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}}
+	// 7 is accepted as Sunday, and is folded into 0 once parsed
+	dayOfWeekField = scheduleField{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}}
+)
+
+// ParseSchedule parses a cron expression with 5 fields
+func ParseSchedule(expression string) (*Schedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s', must have 5 fields", expression)
+	}
+	schedule := &Schedule{
+		expression:           strings.Join(fields, " "),
+		isDayOfMonthWildcard: strings.HasPrefix(fields[2], "*"),
+		isDayOfWeekWildcard:  strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if schedule.minutes, err = parseScheduleField(fields[0], minuteField); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': %v", expression, err)
+	}
+	if schedule.hours, err = parseScheduleField(fields[1], hourField); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': %v", expression, err)
+	}
+	if schedule.daysOfMonth, err = parseScheduleField(fields[2], dayOfMonthField); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': %v", expression, err)
+	}
+	if schedule.months, err = parseScheduleField(fields[3], monthField); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': %v", expression, err)
+	}
+	if schedule.daysOfWeek, err = parseScheduleField(fields[4], dayOfWeekField); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': %v", expression, err)
+	}
+	if schedule.daysOfWeek&(1<<7) != 0 {
+		schedule.daysOfWeek = schedule.daysOfWeek&^(1<<7) | 1
+	}
+	return schedule, nil
+}
+
+// parseScheduleField parses a field of a cron expression into a bitmask of the values it matches
+func parseScheduleField(value string, field scheduleField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(value, ",") {
+		rangeAndStep := strings.SplitN(item, "/", 2)
+		start, end := field.min, field.max
+		if rangeAndStep[0] != "*" {
+			bounds := strings.SplitN(rangeAndStep[0], "-", 2)
+			var err error
+			if start, err = parseScheduleValue(bounds[0], field); err != nil {
+				return 0, err
+			}
+			if len(bounds) == 2 {
+				if end, err = parseScheduleValue(bounds[1], field); err != nil {
+					return 0, err
+				}
+				if end < start {
+					return 0, fmt.Errorf("invalid %s range '%s'", field.name, rangeAndStep[0])
+				}
+			} else if len(rangeAndStep) == 1 {
+				// A single value without a step only matches itself, whereas with a step (e.g. 5/15), it is the
+				// start of a range ending at the maximum value of the field
+				end = start
+			}
+		}
+		step := 1
+		if len(rangeAndStep) == 2 {
+			var err error
+			if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid %s step '%s'", field.name, rangeAndStep[1])
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// parseScheduleValue parses a single value of a field of a cron expression, which is either a number or a name
+func parseScheduleValue(value string, field scheduleField) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(value, name) {
+			return i + field.min, nil
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, fmt.Errorf("invalid %s '%s', must be between %d and %d", field.name, value, field.min, field.max)
+	}
+	return number, nil
+}
+
+// Next returns the first time matching the schedule strictly after the given time, in the location of the given time.
+// Returns the zero time if no time matches the schedule in the next few years
+func (s *Schedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	limit := t.Add(maximumScheduleLookahead)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		// Hours and minutes are added rather than set, so that t keeps moving forward across DST transitions
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchesDay checks whether the day of the given time matches both the day of month and the day of week of the
+// schedule, or either of them if both are restricted
+func (s *Schedule) matchesDay(t time.Time) bool {
+	matchesDayOfMonth := s.daysOfMonth&(1<<uint(t.Day())) != 0
+	matchesDayOfWeek := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.isDayOfMonthWildcard || s.isDayOfWeekWildcard {
+		return matchesDayOfMonth && matchesDayOfWeek
+	}
+	return matchesDayOfMonth || matchesDayOfWeek
+}
+
+// String returns the cron expression of the schedule
+func (s *Schedule) String() string {
+	return s.expression
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	scenarios := []struct {
+		expression string
+		isValid    bool
+	}{
+		{expression: "* * * * *", isValid: true},
+		{expression: "*/15 22-23,0-4 * * MON-FRI", isValid: true},
+		{expression: "0 0 1 jan,jul 7", isValid: true},
+		{expression: "5/10 * * * *", isValid: true},
+		{expression: "* * * *", isValid: false},
+		{expression: "60 * * * *", isValid: false},
+		{expression: "* 5-2 * * *", isValid: false},
+		{expression: "* * 0 * *", isValid: false},
+		{expression: "*/0 * * * *", isValid: false},
+		{expression: "* * * FOO *", isValid: false},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.expression, func(t *testing.T) {
+			if _, err := ParseSchedule(scenario.expression); scenario.isValid != (err == nil) {
+				t.Errorf("expected valid=%v, got error %v", scenario.isValid, err)
+			}
+		})
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	// Thursday
+	now := time.Date(2021, time.January, 7, 10, 30, 15, 0, time.UTC)
+	scenarios := []struct {
+		expression string
+		expected   time.Time
+	}{
+		{expression: "* * * * *", expected: time.Date(2021, time.January, 7, 10, 31, 0, 0, time.UTC)},
+		{expression: "30 10 * * *", expected: time.Date(2021, time.January, 8, 10, 30, 0, 0, time.UTC)},
+		{expression: "*/20 * * * *", expected: time.Date(2021, time.January, 7, 10, 40, 0, 0, time.UTC)},
+		{expression: "0 22 * * 1-5", expected: time.Date(2021, time.January, 7, 22, 0, 0, 0, time.UTC)},
+		{expression: "0 2 * * SAT,SUN", expected: time.Date(2021, time.January, 9, 2, 0, 0, 0, time.UTC)},
+		{expression: "0 0 * * 7", expected: time.Date(2021, time.January, 10, 0, 0, 0, 0, time.UTC)},
+		{expression: "0 0 1 * *", expected: time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		// When both the day of month and the day of week are restricted, either of them must match
+		{expression: "0 0 15 * MON", expected: time.Date(2021, time.January, 11, 0, 0, 0, 0, time.UTC)},
+		{expression: "0 0 29 2 *", expected: time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{expression: "0 0 30 2 *", expected: time.Time{}},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.expression, func(t *testing.T) {
+			schedule, err := ParseSchedule(scenario.expression)
+			if err != nil {
+				t.Fatal("expected no error, got", err)
+			}
+			if next := schedule.Next(now); !next.Equal(scenario.expected) {
+				t.Errorf("expected %s, got %s", scenario.expected, next)
+			}
+		})
+	}
+}
+
+func TestSchedule_NextAcrossDaylightSavingTime(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	schedule, _ := ParseSchedule("30 2 * * *")
+	// 2:30 doesn't exist on 2021-03-14, as the clocks jump from 2:00 to 3:00
+	next := schedule.Next(time.Date(2021, time.March, 14, 0, 0, 0, 0, location))
+	if expected := time.Date(2021, time.March, 15, 2, 30, 0, 0, location); !next.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, next)
+	}
+	schedule, _ = ParseSchedule("*/30 1 * * *")
+	// 1:00 to 2:00 happens twice on 2021-11-07, as the clocks go back from 2:00 to 1:00
+	first := schedule.Next(time.Date(2021, time.November, 7, 1, 45, 0, 0, location))
+	second := schedule.Next(first)
+	if !second.After(first) {
+		t.Errorf("expected %s to be after %s", second, first)
+	}
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	maintenanceWindows, err := ParseMaintenanceWindows("0 22 * * 1-5 4h; 0 0 * * 0,6 24h;", "Europe/Paris")
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	if len(maintenanceWindows) != 2 {
+		t.Fatalf("expected 2 maintenance windows, got %d", len(maintenanceWindows))
+	}
+	if maintenanceWindows[0].Schedule.String() != "0 22 * * 1-5" || maintenanceWindows[0].Duration != 4*time.Hour || maintenanceWindows[0].Location.String() != "Europe/Paris" {
+		t.Errorf("unexpected maintenance window %+v", maintenanceWindows[0])
+	}
+	if maintenanceWindows, err := ParseMaintenanceWindows("", "UTC"); err != nil || len(maintenanceWindows) != 0 {
+		t.Errorf("expected no maintenance windows, got %v and error %v", maintenanceWindows, err)
+	}
+	for _, value := range []string{"0 22 * * 1-5", "0 22 * * 1-5 forever", "0 22 * * 1-5 -1h", "0 25 * * * 1h"} {
+		if _, err := ParseMaintenanceWindows(value, "UTC"); err == nil {
+			t.Errorf("expected error for maintenance window '%s'", value)
+		}
+	}
+	if _, err := ParseMaintenanceWindows("0 22 * * * 1h", "Mars/Olympus_Mons"); err == nil {
+		t.Error("expected error because the timezone doesn't exist")
+	}
+}
+
+func TestMaintenanceWindow_ClosesAt(t *testing.T) {
+	maintenanceWindow, err := NewMaintenanceWindow("0 22 * * 1-5", 4*time.Hour, "Europe/Paris")
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	// Thursday 22:30 in Paris
+	now := time.Date(2021, time.January, 7, 21, 30, 0, 0, time.UTC)
+	if closesAt, ok := maintenanceWindow.ClosesAt(now); !ok || !closesAt.Equal(time.Date(2021, time.January, 8, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the maintenance window to be open until 01:00 UTC, got %s and %v", closesAt, ok)
+	}
+	// Friday 02:00 in Paris
+	if _, ok := maintenanceWindow.ClosesAt(now.Add(3*time.Hour + 30*time.Minute)); ok {
+		t.Error("expected the maintenance window to be closed, because it closed an hour ago")
+	}
+	// Thursday 21:59 in Paris
+	if _, ok := maintenanceWindow.ClosesAt(now.Add(-31 * time.Minute)); ok {
+		t.Error("expected the maintenance window to be closed, because it hasn't opened yet")
+	}
+	if opensAt := maintenanceWindow.OpensAt(now.Add(-31 * time.Minute)); !opensAt.Equal(time.Date(2021, time.January, 7, 21, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the maintenance window to open at 21:00 UTC, got %s", opensAt)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// EventReconciliationDelay is the delay between a node or pod event and the reconciliation of its ASG, so that
+	// a burst of events results in a single reconciliation
+	EventReconciliationDelay = 5 * time.Second
+
+	// TriggerPath is the path on which external triggers can request the reconciliation of ASGs
+	TriggerPath = "/trigger"
+)
+
+// Controller reconciles ASGs from a work queue keyed by ASG name.
+//
+// ASGs are enqueued by a periodic resync of the AWS state, by node, pod and NodeGroupRollout events, and by external
+// triggers.
+// Failed reconciliations are requeued with an exponential backoff.
+type Controller struct {
+	kubernetesClient   k8s.KubernetesClientApi
+	ec2Service         ec2iface.EC2API
+	autoScalingService autoscalingiface.AutoScalingAPI
+	queue              workqueue.RateLimitingInterface
+
+	mutex sync.RWMutex
+	// autoScalingGroups and autoScalingGroupNames contain the ASGs found during the last resync
+	autoScalingGroups     []*autoscaling.Group
+	autoScalingGroupNames map[string]bool
+	// autoScalingGroupNameByInstanceId and autoScalingGroupNameByNodeName map instances and nodes to their ASG,
+	// so that node and pod events can be translated to the ASG to reconcile
+	autoScalingGroupNameByInstanceId map[string]string
+	autoScalingGroupNameByNodeName   map[string]string
+	// lockedAutoScalingGroupNames contains the ASGs being reconciled by a worker or prepared by a resync, neither of
+	// which may touch the nodes of an ASG while the other one is
+	lockedAutoScalingGroupNames map[string]bool
+	// ctx is the context passed to Run, which the event handlers use so that they stop along with the controller
+	ctx context.Context
+}
+
+// NewController creates a new Controller
+func NewController(kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI) *Controller {
+	return &Controller{
+		kubernetesClient:                 kubernetesClient,
+		ec2Service:                       ec2Service,
+		autoScalingService:               autoScalingService,
+		queue:                            workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		autoScalingGroupNames:            make(map[string]bool),
+		autoScalingGroupNameByInstanceId: make(map[string]string),
+		autoScalingGroupNameByNodeName:   make(map[string]string),
+		lockedAutoScalingGroupNames:      make(map[string]bool),
+		ctx:                              context.Background(),
+	}
+}
+
+// Run starts config.AutoScalingGroupConcurrency workers and resyncs every ResyncInterval until the context is
+// cancelled, after which it waits for the reconciliations in progress to return
+func (c *Controller) Run(ctx context.Context) {
+	c.mutex.Lock()
+	c.ctx = ctx
+	c.mutex.Unlock()
+	concurrency := config.Get().AutoScalingGroupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var waitGroup sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for c.processNextItem(ctx) {
+			}
+		}()
+	}
+	defer func() {
+		c.queue.ShutDown()
+		waitGroup.Wait()
+	}()
+	for {
+		start := time.Now()
+		if err := c.Resync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error during resync: %s", err.Error())
+			executionFailedCounter++
+			if executionFailedCounter > MaximumFailedExecutionBeforePanic {
+				panic(fmt.Errorf("resync failed %d times: %v", executionFailedCounter, err))
+			}
+		} else if executionFailedCounter > 0 {
+			log.Printf("Resync was successful after %d failed attempts, resetting counter to 0", executionFailedCounter)
+			executionFailedCounter = 0
+		}
+		if config.Get().Debug {
+			log.Printf("Resync took %dms, next resync in %s", time.Since(start).Milliseconds(), ResyncInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ResyncInterval):
+		}
+	}
+}
+
+// Resync describes the ASGs to refresh the mapping of instances and nodes to their ASG, handles the nodes that don't
+// belong to any ASG anymore, and enqueues every ASG
+func (c *Controller) Resync(ctx context.Context) error {
+	autoScalingGroups, err := describeAutoScalingGroups(ctx, c.autoScalingService)
+	if err != nil {
+		return errors.New("unable to describe AutoScalingGroups: " + err.Error())
+	}
+	nodes, err := c.kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		return errors.New("unable to get nodes: " + err.Error())
+	}
+	autoScalingGroupNames := make(map[string]bool)
+	autoScalingGroupNameByInstanceId := make(map[string]string)
+	autoScalingGroupNameByNodeName := make(map[string]string)
+	for _, autoScalingGroup := range autoScalingGroups {
+		autoScalingGroupName := aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+		autoScalingGroupNames[autoScalingGroupName] = true
+		for _, instance := range autoScalingGroup.Instances {
+			autoScalingGroupNameByInstanceId[aws.StringValue(instance.InstanceId)] = autoScalingGroupName
+		}
+	}
+	for i := range nodes {
+		if autoScalingGroupName, ok := autoScalingGroupNameByInstanceId[k8s.GetInstanceIdFromNode(&nodes[i])]; ok {
+			autoScalingGroupNameByNodeName[nodes[i].Name] = autoScalingGroupName
+		}
+	}
+	c.mutex.Lock()
+	c.autoScalingGroups = autoScalingGroups
+	c.autoScalingGroupNames = autoScalingGroupNames
+	c.autoScalingGroupNameByInstanceId = autoScalingGroupNameByInstanceId
+	c.autoScalingGroupNameByNodeName = autoScalingGroupNameByNodeName
+	c.mutex.Unlock()
+	c.prepareExecution(ctx, autoScalingGroups)
+	for autoScalingGroupName := range autoScalingGroupNames {
+		c.queue.Add(autoScalingGroupName)
+	}
+	return nil
+}
+
+// Enqueue enqueues an ASG for reconciliation.
+//
+// Returns false if the ASG isn't one of the ASGs found during the last resync
+func (c *Controller) Enqueue(autoScalingGroupName string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if !c.autoScalingGroupNames[autoScalingGroupName] {
+		return false
+	}
+	c.queue.Add(autoScalingGroupName)
+	return true
+}
+
+// EnqueueAll enqueues every ASG found during the last resync for reconciliation
+func (c *Controller) EnqueueAll() {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for autoScalingGroupName := range c.autoScalingGroupNames {
+		c.queue.Add(autoScalingGroupName)
+	}
+}
+
+// OnNodeEvent enqueues the ASG of a node that has been added or deleted, or whose changes may affect its rollout
+func (c *Controller) OnNodeEvent(node *v1.Node) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	autoScalingGroupName, ok := c.autoScalingGroupNameByInstanceId[k8s.GetInstanceIdFromNode(node)]
+	if !ok {
+		return
+	}
+	c.autoScalingGroupNameByNodeName[node.Name] = autoScalingGroupName
+	c.queue.AddAfter(autoScalingGroupName, EventReconciliationDelay)
+}
+
+// OnPodEvent enqueues the ASG of the node of a pod that has been added or deleted, or whose changes may affect the
+// rollout of its node
+func (c *Controller) OnPodEvent(pod *v1.Pod) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if autoScalingGroupName, ok := c.autoScalingGroupNameByNodeName[pod.Spec.NodeName]; ok {
+		c.queue.AddAfter(autoScalingGroupName, EventReconciliationDelay)
+	}
+}
+
+// OnNodeGroupRolloutEvent refreshes the NodeGroupRollouts when one of them has been added, deleted or its spec
+// changed, and enqueues the ASGs it selects, as well as the ASGs it selected before the change
+func (c *Controller) OnNodeGroupRolloutEvent(oldNodeGroupRollout, nodeGroupRollout *v1alpha1.NodeGroupRollout) {
+	c.mutex.RLock()
+	ctx := c.ctx
+	autoScalingGroups := c.autoScalingGroups
+	c.mutex.RUnlock()
+	// Until the first resync, there are no ASGs to map the NodeGroupRollouts to
+	if len(autoScalingGroups) == 0 || ctx.Err() != nil {
+		return
+	}
+	refreshNodeGroupRollouts(ctx, c.kubernetesClient, autoScalingGroups)
+	for _, autoScalingGroup := range autoScalingGroups {
+		if nodeGroupRolloutSelectsAutoScalingGroup(nodeGroupRollout, autoScalingGroup) || (oldNodeGroupRollout != nil && nodeGroupRolloutSelectsAutoScalingGroup(oldNodeGroupRollout, autoScalingGroup)) {
+			c.queue.Add(aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		}
+	}
+}
+
+// ServeHTTP enqueues the ASG passed as the autoScalingGroupName query parameter, or every ASG if the parameter is
+// omitted
+func (c *Controller) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if autoScalingGroupName := request.URL.Query().Get("autoScalingGroupName"); len(autoScalingGroupName) > 0 {
+		if !c.Enqueue(autoScalingGroupName) {
+			http.Error(writer, fmt.Sprintf("AutoScalingGroup '%s' not found", autoScalingGroupName), http.StatusNotFound)
+			return
+		}
+		log.Printf("[%s] Reconciliation triggered externally", autoScalingGroupName)
+	} else {
+		c.EnqueueAll()
+		log.Println("Reconciliation of every AutoScalingGroup triggered externally")
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// processNextItem reconciles the next ASG of the queue, and requeues it with a backoff if the reconciliation fails.
+//
+// Returns false once the queue has been shut down or the context has been cancelled
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	if ctx.Err() != nil {
+		return false
+	}
+	autoScalingGroupName := key.(string)
+	if err := c.reconcile(ctx, autoScalingGroupName); err != nil {
+		log.Printf("[%s] Requeuing after failed reconciliation: %v", autoScalingGroupName, err.Error())
+		c.queue.AddRateLimited(key)
+	} else {
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// reconcile describes an ASG and handles its rolling upgrade
+func (c *Controller) reconcile(ctx context.Context, autoScalingGroupName string) error {
+	c.mutex.RLock()
+	isKnown := c.autoScalingGroupNames[autoScalingGroupName]
+	c.mutex.RUnlock()
+	if !isKnown {
+		return nil
+	}
+	locked := c.tryLockAutoScalingGroups([]string{autoScalingGroupName})
+	if !locked[autoScalingGroupName] {
+		// The nodes of the ASG are being prepared by a resync, which doesn't take long
+		c.queue.AddAfter(autoScalingGroupName, EventReconciliationDelay)
+		return nil
+	}
+	defer c.unlockAutoScalingGroups(locked)
+	autoScalingGroups, err := cloud.DescribeAutoScalingGroupsByNames(ctx, c.autoScalingService, []string{autoScalingGroupName})
+	if err != nil {
+		return errors.New("unable to describe AutoScalingGroup: " + err.Error())
+	}
+	if len(autoScalingGroups) == 0 {
+		log.Printf("[%s] Skipping because the ASG no longer exists", autoScalingGroupName)
+		return nil
+	}
+	autoScalingGroup := autoScalingGroups[0]
+	c.mutex.Lock()
+	for _, instance := range autoScalingGroup.Instances {
+		c.autoScalingGroupNameByInstanceId[aws.StringValue(instance.InstanceId)] = autoScalingGroupName
+	}
+	c.mutex.Unlock()
+	return handleRollingUpgradeForAutoScalingGroupWithTimeout(ctx, c.kubernetesClient, c.ec2Service, c.autoScalingService, autoScalingGroup)
+}
+
+// prepareExecution goes through the same steps as the prepareExecution function, but leaves alone the nodes of the
+// ASGs being reconciled by a worker. These nodes are looked at during the next resync instead
+func (c *Controller) prepareExecution(ctx context.Context, autoScalingGroups []*autoscaling.Group) {
+	var autoScalingGroupNames []string
+	for _, autoScalingGroup := range autoScalingGroups {
+		autoScalingGroupNames = append(autoScalingGroupNames, aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+	}
+	locked := c.tryLockAutoScalingGroups(autoScalingGroupNames)
+	defer c.unlockAutoScalingGroups(locked)
+	skipNode := func(node *v1.Node) bool {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		autoScalingGroupName, ok := c.autoScalingGroupNameByInstanceId[k8s.GetInstanceIdFromNode(node)]
+		if !ok {
+			// The instance doesn't belong to any ASG, so no worker looks at its node
+			return false
+		}
+		return !locked[autoScalingGroupName]
+	}
+	prepareExecution(ctx, c.kubernetesClient, c.ec2Service, c.autoScalingService, autoScalingGroups, skipNode)
+}
+
+// tryLockAutoScalingGroups locks the ASGs that aren't locked yet, and returns them, so that they can be passed to
+// unlockAutoScalingGroups
+func (c *Controller) tryLockAutoScalingGroups(autoScalingGroupNames []string) map[string]bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	locked := make(map[string]bool)
+	for _, autoScalingGroupName := range autoScalingGroupNames {
+		if !c.lockedAutoScalingGroupNames[autoScalingGroupName] {
+			c.lockedAutoScalingGroupNames[autoScalingGroupName] = true
+			locked[autoScalingGroupName] = true
+		}
+	}
+	return locked
+}
+
+// unlockAutoScalingGroups unlocks the ASGs locked by tryLockAutoScalingGroups
+func (c *Controller) unlockAutoScalingGroups(locked map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for autoScalingGroupName := range locked {
+		delete(c.lockedAutoScalingGroupNames, autoScalingGroupName)
+	}
+}
+
+// describeAutoScalingGroups describes the ASGs of the cluster if config.ClusterName is set, or the ASGs listed in
+// config.AutoScalingGroupNames otherwise
+func describeAutoScalingGroups(ctx context.Context, autoScalingService autoscalingiface.AutoScalingAPI) ([]*autoscaling.Group, error) {
+	if len(config.Get().ClusterName) > 0 {
+		return cloud.DescribeEnabledAutoScalingGroupsByClusterName(ctx, autoScalingService, config.Get().ClusterName)
+	}
+	return cloud.DescribeAutoScalingGroupsByNames(ctx, autoScalingService, config.Get().AutoScalingGroupNames)
+}
@@ -0,0 +1,244 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// providerIdIndex is the name of the index of the node cache by providerID
+	providerIdIndex = "providerID"
+
+	// nodeNameIndex is the name of the index of the pod cache by node name
+	nodeNameIndex = "nodeName"
+)
+
+// CachedKubernetesClient is a KubernetesClient whose reads of nodes and pods are served from in-memory caches kept
+// up to date by informers watching the cluster, rather than by listing every node or pod on each call.
+//
+// The node cache is indexed by providerID, and the pod cache is indexed by node name. The caches are only ever written
+// to by the informers, so a node that has just been updated may be read with an outdated resource version until the
+// informer receives the update; GetNode always reads from the API server for that reason.
+type CachedKubernetesClient struct {
+	*KubernetesClient
+
+	nodeInformer cache.SharedIndexInformer
+	podInformer  cache.SharedIndexInformer
+}
+
+// NewCachedKubernetesClient creates a new CachedKubernetesClient
+//
+// Start must be called before the client is used
+func NewCachedKubernetesClient(client kubernetes.Interface) *CachedKubernetesClient {
+	nodeInformer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Nodes().List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Nodes().Watch(context.TODO(), options)
+			},
+		},
+		&v1.Node{}, 0, cache.Indexers{providerIdIndex: indexNodeByProviderId},
+	)
+	podInformer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Pods("").List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Pods("").Watch(context.TODO(), options)
+			},
+		},
+		&v1.Pod{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc, nodeNameIndex: indexPodByNodeName},
+	)
+	return &CachedKubernetesClient{
+		KubernetesClient: NewKubernetesClient(client),
+		nodeInformer:     nodeInformer,
+		podInformer:      podInformer,
+	}
+}
+
+func indexNodeByProviderId(object interface{}) ([]string, error) {
+	node, ok := object.(*v1.Node)
+	if !ok || len(node.Spec.ProviderID) == 0 {
+		return nil, nil
+	}
+	return []string{node.Spec.ProviderID}, nil
+}
+
+func indexPodByNodeName(object interface{}) ([]string, error) {
+	pod, ok := object.(*v1.Pod)
+	if !ok || len(pod.Spec.NodeName) == 0 {
+		return nil, nil
+	}
+	return []string{pod.Spec.NodeName}, nil
+}
+
+// AddNodeEventHandler registers a function to call whenever a node is added or deleted in the cluster, or whenever
+// a node is modified in a way that may affect its rollout (see isRelevantNodeUpdate).
+//
+// Handlers must be registered before calling Start
+func (k *CachedKubernetesClient) AddNodeEventHandler(handler func(node *v1.Node)) {
+	k.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(object interface{}) { handleNodeEvent(handler, object) },
+		UpdateFunc: func(oldObject, object interface{}) {
+			oldNode, oldOk := oldObject.(*v1.Node)
+			node, ok := object.(*v1.Node)
+			if oldOk && ok && isRelevantNodeUpdate(oldNode, node) {
+				handler(node)
+			}
+		},
+		DeleteFunc: func(object interface{}) { handleNodeEvent(handler, object) },
+	})
+}
+
+// isRelevantNodeUpdate checks whether a node update may affect the rollout of the node's ASG, which excludes the
+// periodic status updates of the kubelet as well as the annotations written by this application
+func isRelevantNodeUpdate(oldNode, node *v1.Node) bool {
+	if node.DeletionTimestamp != nil && oldNode.DeletionTimestamp == nil {
+		return true
+	}
+	if oldNode.Spec.Unschedulable != node.Spec.Unschedulable || !equality.Semantic.DeepEqual(oldNode.Spec.Taints, node.Spec.Taints) {
+		return true
+	}
+	// The rollout of a node can be paused and resumed by an operator through this annotation
+	if oldNode.Annotations[RollingUpdatePausedAnnotationKey] != node.Annotations[RollingUpdatePausedAnnotationKey] {
+		return true
+	}
+	oldReadyCondition, readyCondition := GetNodeReadyCondition(oldNode), GetNodeReadyCondition(node)
+	if oldReadyCondition == nil || readyCondition == nil {
+		return oldReadyCondition != readyCondition
+	}
+	return oldReadyCondition.Status != readyCondition.Status
+}
+
+func handleNodeEvent(handler func(node *v1.Node), object interface{}) {
+	if tombstone, ok := object.(cache.DeletedFinalStateUnknown); ok {
+		object = tombstone.Obj
+	}
+	if node, ok := object.(*v1.Node); ok {
+		handler(node)
+	}
+}
+
+// AddPodEventHandler registers a function to call whenever a pod is added or deleted in the cluster, or whenever
+// a pod is modified in a way that may affect the rollout of its node (see isRelevantPodUpdate).
+//
+// Handlers must be registered before calling Start
+func (k *CachedKubernetesClient) AddPodEventHandler(handler func(pod *v1.Pod)) {
+	k.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(object interface{}) { handlePodEvent(handler, object) },
+		UpdateFunc: func(oldObject, object interface{}) {
+			oldPod, oldOk := oldObject.(*v1.Pod)
+			pod, ok := object.(*v1.Pod)
+			if oldOk && ok && isRelevantPodUpdate(oldPod, pod) {
+				handler(pod)
+			}
+		},
+		DeleteFunc: func(object interface{}) { handlePodEvent(handler, object) },
+	})
+}
+
+// isRelevantPodUpdate checks whether a pod update may affect the rollout of its node, which is the case when the pod
+// is scheduled, terminated, or when its phase or readiness changes
+func isRelevantPodUpdate(oldPod, pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil && oldPod.DeletionTimestamp == nil {
+		return true
+	}
+	if oldPod.Spec.NodeName != pod.Spec.NodeName || oldPod.Status.Phase != pod.Status.Phase {
+		return true
+	}
+	return IsPodReady(oldPod) != IsPodReady(pod)
+}
+
+func handlePodEvent(handler func(pod *v1.Pod), object interface{}) {
+	if tombstone, ok := object.(cache.DeletedFinalStateUnknown); ok {
+		object = tombstone.Obj
+	}
+	if pod, ok := object.(*v1.Pod); ok {
+		handler(pod)
+	}
+}
+
+// Start starts keeping the caches up to date until the context is done
+func (k *CachedKubernetesClient) Start(ctx context.Context) {
+	go k.nodeInformer.Run(ctx.Done())
+	go k.podInformer.Run(ctx.Done())
+}
+
+// WaitForCacheSync waits until the caches have been populated for the first time
+func (k *CachedKubernetesClient) WaitForCacheSync(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for name, informer := range map[string]cache.SharedIndexInformer{"nodes": k.nodeInformer, "pods": k.podInformer} {
+		if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			return fmt.Errorf("timed out after %s waiting for the %s cache to sync", timeout, name)
+		}
+	}
+	return nil
+}
+
+// GetNodes retrieves all nodes from the cache
+func (k *CachedKubernetesClient) GetNodes(_ context.Context) ([]v1.Node, error) {
+	objects := k.nodeInformer.GetStore().List()
+	nodes := make([]v1.Node, 0, len(objects))
+	for _, object := range objects {
+		nodes = append(nodes, *object.(*v1.Node).DeepCopy())
+	}
+	return nodes, nil
+}
+
+// GetPodsInNode retrieves all pods from a given node from the cache
+func (k *CachedKubernetesClient) GetPodsInNode(_ context.Context, node string) ([]v1.Pod, error) {
+	objects, err := k.podInformer.GetIndexer().ByIndex(nodeNameIndex, node)
+	if err != nil {
+		return nil, err
+	}
+	var pods []v1.Pod
+	for _, object := range objects {
+		pods = append(pods, *object.(*v1.Pod).DeepCopy())
+	}
+	return pods, nil
+}
+
+// GetPodsByLabelSelector retrieves all pods matching a given label selector in a given namespace from the cache
+func (k *CachedKubernetesClient) GetPodsByLabelSelector(_ context.Context, namespace, labelSelector string) ([]v1.Pod, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var pods []v1.Pod
+	err = cache.ListAllByNamespace(k.podInformer.GetIndexer(), namespace, selector, func(object interface{}) {
+		pods = append(pods, *object.(*v1.Pod).DeepCopy())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// GetNodeByAwsAutoScalingInstance gets the Kubernetes node matching an AWS AutoScaling instance from the cache
+func (k *CachedKubernetesClient) GetNodeByAwsAutoScalingInstance(_ context.Context, instance *autoscaling.Instance) (*v1.Node, error) {
+	providerId := fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId))
+	objects, err := k.nodeInformer.GetIndexer().ByIndex(providerIdIndex, providerId)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("node with providerID \"%s\" not found", providerId)
+	}
+	return objects[0].(*v1.Node).DeepCopy(), nil
+}
@@ -0,0 +1,352 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestClientSet(nodes []v1.Node, pods []v1.Pod) *fake.Clientset {
+	var objects []runtime.Object
+	for i := range nodes {
+		objects = append(objects, nodes[i].DeepCopy())
+	}
+	for i := range pods {
+		objects = append(objects, pods[i].DeepCopy())
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+func startTestCachedKubernetesClient(t *testing.T, ctx context.Context, clientSet *fake.Clientset) *CachedKubernetesClient {
+	cachedKubernetesClient := NewCachedKubernetesClient(clientSet)
+	cachedKubernetesClient.Start(ctx)
+	if err := cachedKubernetesClient.WaitForCacheSync(time.Second); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	return cachedKubernetesClient
+}
+
+func getSortedNames(objects interface{}) []string {
+	var names []string
+	switch objects := objects.(type) {
+	case []v1.Node:
+		for _, node := range objects {
+			names = append(names, node.Name)
+		}
+	case []v1.Pod:
+		for _, pod := range objects {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalNames(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitUntil polls a condition until it's true, because the cache is updated asynchronously by the informers
+func waitUntil(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestCachedKubernetesClient_matchesKubernetesClient(t *testing.T) {
+	nodes := []v1.Node{
+		k8stest.CreateTestNode("node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi"),
+		k8stest.CreateTestNode("node-2", "us-west-2b", "i-07550830aef9e1481", "1000m", "1000Mi"),
+	}
+	pods := []v1.Pod{
+		k8stest.CreateTestPod("pod-1", "node-1", "100m", "100Mi", false, v1.PodRunning),
+		k8stest.CreateTestPod("pod-2", "node-1", "100m", "100Mi", true, v1.PodRunning),
+		k8stest.CreateTestPod("pod-3", "node-2", "100m", "100Mi", false, v1.PodRunning),
+	}
+	pods[0].SetLabels(map[string]string{"app": "a"})
+	pods[2].SetLabels(map[string]string{"app": "a"})
+	clientSet := newTestClientSet(nodes, pods)
+	kubernetesClient := NewKubernetesClient(clientSet)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cachedKubernetesClient := startTestCachedKubernetesClient(t, ctx, clientSet)
+
+	expectedNodes, _ := kubernetesClient.GetNodes(context.TODO())
+	actualNodes, _ := cachedKubernetesClient.GetNodes(context.TODO())
+	if expected, actual := getSortedNames(expectedNodes), getSortedNames(actualNodes); len(expected) != 2 || !equalNames(expected, actual) {
+		t.Errorf("expected nodes %v, got %v", expected, actual)
+	}
+	for _, nodeName := range []string{"node-1", "node-2", "node-3"} {
+		podsInNode, _ := kubernetesClient.GetPodsInNode(context.TODO(), nodeName)
+		// The fake clientset ignores field selectors, so the pods on other nodes have to be filtered out
+		var expectedPods []v1.Pod
+		for _, pod := range podsInNode {
+			if pod.Spec.NodeName == nodeName {
+				expectedPods = append(expectedPods, pod)
+			}
+		}
+		actualPods, _ := cachedKubernetesClient.GetPodsInNode(context.TODO(), nodeName)
+		if expected, actual := getSortedNames(expectedPods), getSortedNames(actualPods); !equalNames(expected, actual) {
+			t.Errorf("expected pods %v in node %s, got %v", expected, nodeName, actual)
+		}
+	}
+	for _, namespace := range []string{"", "default", "kube-system"} {
+		expectedPods, _ := kubernetesClient.GetPodsByLabelSelector(context.TODO(), namespace, "app=a")
+		actualPods, _ := cachedKubernetesClient.GetPodsByLabelSelector(context.TODO(), namespace, "app=a")
+		if expected, actual := getSortedNames(expectedPods), getSortedNames(actualPods); !equalNames(expected, actual) {
+			t.Errorf("expected pods %v in namespace %q, got %v", expected, namespace, actual)
+		}
+	}
+	instance := &autoscaling.Instance{AvailabilityZone: aws.String("us-west-2b"), InstanceId: aws.String("i-07550830aef9e1481")}
+	expectedNode, _ := kubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), instance)
+	actualNode, err := cachedKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), instance)
+	if err != nil || expectedNode == nil || actualNode.Name != expectedNode.Name {
+		t.Errorf("expected node %v, got %v (err=%v)", expectedNode, actualNode, err)
+	}
+	if _, err := cachedKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), &autoscaling.Instance{AvailabilityZone: aws.String("us-west-2a"), InstanceId: aws.String("i-00000000000000000")}); err == nil {
+		t.Error("should've returned an error, because no node has that providerID")
+	}
+}
+
+func TestCachedKubernetesClient_withWatchEvents(t *testing.T) {
+	node := k8stest.CreateTestNode("node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	pod := k8stest.CreateTestPod("pod-1", "node-1", "100m", "100Mi", false, v1.PodRunning)
+	clientSet := newTestClientSet([]v1.Node{node}, []v1.Pod{pod})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cachedKubernetesClient := NewCachedKubernetesClient(clientSet)
+	handledNodeEvents := make(chan string, 10)
+	cachedKubernetesClient.AddNodeEventHandler(func(node *v1.Node) { handledNodeEvents <- node.Name })
+	cachedKubernetesClient.Start(ctx)
+	if err := cachedKubernetesClient.WaitForCacheSync(time.Second); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+
+	newNode := k8stest.CreateTestNode("node-2", "us-west-2b", "i-07550830aef9e1481", "1000m", "1000Mi")
+	if _, err := clientSet.CoreV1().Nodes().Create(context.TODO(), &newNode, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	newPod := k8stest.CreateTestPod("pod-2", "node-2", "100m", "100Mi", false, v1.PodRunning)
+	if _, err := clientSet.CoreV1().Pods(newPod.Namespace).Create(context.TODO(), &newPod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The fake clientset doesn't allow changing the node of a pod through an update, so the pod is recreated instead
+	if err := clientSet.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	movedPod := pod.DeepCopy()
+	movedPod.Spec.NodeName = "node-2"
+	if _, err := clientSet.CoreV1().Pods(movedPod.Namespace).Create(context.TODO(), movedPod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSet.CoreV1().Nodes().Delete(context.TODO(), node.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitUntil(func() bool {
+		nodes, _ := cachedKubernetesClient.GetNodes(context.TODO())
+		return equalNames([]string{"node-2"}, getSortedNames(nodes))
+	}) {
+		nodes, _ := cachedKubernetesClient.GetNodes(context.TODO())
+		t.Errorf("expected only node-2, got %v", getSortedNames(nodes))
+	}
+	if _, err := cachedKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), &autoscaling.Instance{AvailabilityZone: aws.String("us-west-2a"), InstanceId: aws.String("i-034fa1dfbfd35f8bb")}); err == nil {
+		t.Error("should've returned an error, because node-1 was deleted")
+	}
+	if !waitUntil(func() bool {
+		pods, _ := cachedKubernetesClient.GetPodsInNode(context.TODO(), "node-2")
+		return len(pods) == 2
+	}) {
+		pods, _ := cachedKubernetesClient.GetPodsInNode(context.TODO(), "node-2")
+		t.Errorf("expected 2 pods in node-2, got %v", getSortedNames(pods))
+	}
+	if pods, _ := cachedKubernetesClient.GetPodsInNode(context.TODO(), "node-1"); len(pods) != 0 {
+		t.Errorf("expected no pods in node-1, got %v", getSortedNames(pods))
+	}
+	if !waitUntil(func() bool { return len(handledNodeEvents) >= 3 }) {
+		t.Errorf("expected the node event handler to be called for the initial node, the new node and the deletion, got %d calls", len(handledNodeEvents))
+	}
+}
+
+func TestCachedKubernetesClient_UpdateNode(t *testing.T) {
+	node := k8stest.CreateTestNode("node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	clientSet := newTestClientSet([]v1.Node{node}, nil)
+	// The first update conflicts, as if the node read from the cache had been updated since
+	numberOfConflicts := 1
+	clientSet.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if numberOfConflicts > 0 {
+			numberOfConflicts--
+			return true, nil, apierrors.NewConflict(v1.Resource("nodes"), node.Name, errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cachedKubernetesClient := startTestCachedKubernetesClient(t, ctx, clientSet)
+
+	instance := &autoscaling.Instance{AvailabilityZone: aws.String("us-west-2a"), InstanceId: aws.String("i-034fa1dfbfd35f8bb")}
+	if err := AnnotateNodeByAwsAutoScalingInstance(context.TODO(), cachedKubernetesClient, instance, RollingUpdateStartedTimestampAnnotationKey, "value"); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	// The annotation must be retried with the node read from the API server
+	if updatedNode, _ := clientSet.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{}); updatedNode.Annotations[RollingUpdateStartedTimestampAnnotationKey] != "value" {
+		t.Error("expected the node to have been annotated after the conflict")
+	}
+	// The cache is only ever updated by the informer
+	if !waitUntil(func() bool {
+		cachedNode, err := cachedKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), instance)
+		return err == nil && cachedNode.Annotations[RollingUpdateStartedTimestampAnnotationKey] == "value"
+	}) {
+		t.Error("expected the cache to eventually contain the updated node")
+	}
+	if err := cachedKubernetesClient.DeleteNode(context.TODO(), node.Name); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if !waitUntil(func() bool {
+		nodes, _ := cachedKubernetesClient.GetNodes(context.TODO())
+		return len(nodes) == 0
+	}) {
+		t.Error("expected the cache to eventually be empty after deleting the node")
+	}
+}
+
+func TestIsRelevantNodeUpdate(t *testing.T) {
+	scenarios := []struct {
+		name             string
+		update           func(node *v1.Node)
+		expectedRelevant bool
+	}{
+		{
+			name: "heartbeat",
+			update: func(node *v1.Node) {
+				node.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+			},
+			expectedRelevant: false,
+		},
+		{
+			name: "annotated-by-handler",
+			update: func(node *v1.Node) {
+				node.Annotations[RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+			},
+			expectedRelevant: false,
+		},
+		{
+			name: "paused",
+			update: func(node *v1.Node) {
+				node.Annotations[RollingUpdatePausedAnnotationKey] = "true"
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "no-longer-ready",
+			update: func(node *v1.Node) {
+				node.Status.Conditions[0].Status = v1.ConditionFalse
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "tainted",
+			update: func(node *v1.Node) {
+				node.Spec.Taints = []v1.Taint{{Key: "node.cilium.io/agent-not-ready", Effect: v1.TaintEffectNoSchedule}}
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "cordoned",
+			update: func(node *v1.Node) {
+				node.Spec.Unschedulable = true
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "deleted",
+			update: func(node *v1.Node) {
+				now := metav1.Now()
+				node.DeletionTimestamp = &now
+			},
+			expectedRelevant: true,
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			oldNode := k8stest.CreateTestNode("node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+			oldNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+			node := oldNode.DeepCopy()
+			scenario.update(node)
+			if relevant := isRelevantNodeUpdate(&oldNode, node); relevant != scenario.expectedRelevant {
+				t.Errorf("expected relevant to be %v, got %v", scenario.expectedRelevant, relevant)
+			}
+		})
+	}
+}
+
+func TestIsRelevantPodUpdate(t *testing.T) {
+	scenarios := []struct {
+		name             string
+		update           func(pod *v1.Pod)
+		expectedRelevant bool
+	}{
+		{
+			name: "labeled",
+			update: func(pod *v1.Pod) {
+				pod.Labels = map[string]string{"app": "test"}
+			},
+			expectedRelevant: false,
+		},
+		{
+			name: "ready",
+			update: func(pod *v1.Pod) {
+				pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "succeeded",
+			update: func(pod *v1.Pod) {
+				pod.Status.Phase = v1.PodSucceeded
+			},
+			expectedRelevant: true,
+		},
+		{
+			name: "deleted",
+			update: func(pod *v1.Pod) {
+				now := metav1.Now()
+				pod.DeletionTimestamp = &now
+			},
+			expectedRelevant: true,
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			oldPod := k8stest.CreateTestPod("pod-1", "node-1", "100m", "100Mi", false, v1.PodRunning)
+			pod := oldPod.DeepCopy()
+			scenario.update(pod)
+			if relevant := isRelevantPodUpdate(&oldPod, pod); relevant != scenario.expectedRelevant {
+				t.Errorf("expected relevant to be %v, got %v", scenario.expectedRelevant, relevant)
+			}
+		})
+	}
+}
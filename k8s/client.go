@@ -6,10 +6,14 @@ import (
 	"log"
 	"time"
 
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubectl/pkg/drain"
 )
@@ -18,31 +22,55 @@ const (
 	RollingUpdateStartedTimestampAnnotationKey    = "aws-eks-asg-rolling-update-handler/started-at"
 	RollingUpdateDrainedTimestampAnnotationKey    = "aws-eks-asg-rolling-update-handler/drained-at"
 	RollingUpdateTerminatedTimestampAnnotationKey = "aws-eks-asg-rolling-update-handler/terminated-at"
+
+	DeploymentOriginalReplicasAnnotationKey = "aws-eks-asg-rolling-update-handler/original-replicas"
+	DeploymentIncrementsAnnotationKey       = "aws-eks-asg-rolling-update-handler/increments"
+	EvictionEscalationsAnnotationKey        = "aws-eks-asg-rolling-update-handler/eviction-escalations"
+	EvictedWorkloadsAnnotationKey           = "aws-eks-asg-rolling-update-handler/evicted-workloads"
+	VerificationTimedOutAtAnnotationKey     = "aws-eks-asg-rolling-update-handler/verification-timed-out-at"
+	RollingUpdatePausedAnnotationKey        = "aws-eks-asg-rolling-update-handler/paused"
+	CordonedAnnotationKey                   = "aws-eks-asg-rolling-update-handler/cordoned"
+	TaintsAnnotationKey                     = "aws-eks-asg-rolling-update-handler/taints"
+
+	// EventSource is the component used as the source of the events created by this application
+	EventSource = "aws-eks-asg-rolling-update-handler"
 )
 
 type KubernetesClientApi interface {
-	GetNodes() ([]v1.Node, error)
-	GetPodsInNode(node string) ([]v1.Pod, error)
-	GetNodeByAwsAutoScalingInstance(instance *autoscaling.Instance) (*v1.Node, error)
+	GetNodes(ctx context.Context) ([]v1.Node, error)
+	GetPodsInNode(ctx context.Context, node string) ([]v1.Pod, error)
+	GetPodsByLabelSelector(ctx context.Context, namespace, labelSelector string) ([]v1.Pod, error)
+	GetNodeByAwsAutoScalingInstance(ctx context.Context, instance *autoscaling.Instance) (*v1.Node, error)
+	GetNode(ctx context.Context, name string) (*v1.Node, error)
 	FilterNodeByAutoScalingInstance(nodes []v1.Node, instance *autoscaling.Instance) (*v1.Node, error)
-	UpdateNode(node *v1.Node) error
-	Drain(nodeName string, ignoreDaemonSets, deleteLocalData bool) error
+	UpdateNode(ctx context.Context, node *v1.Node) error
+	DeleteNode(ctx context.Context, nodeName string) error
+	GetReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error)
+	GetStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error)
+	GetDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error)
+	UpdateDeployment(ctx context.Context, deployment *appsv1.Deployment) error
+	Drain(ctx context.Context, nodeName string, ignoreDaemonSets, deleteLocalData bool, evictionTimeout, evictionTierTimeout time.Duration, isNamespaceEligibleForDeletionFallback func(namespace string) bool) error
+	CreateNodeEvent(ctx context.Context, node *v1.Node, eventType, reason, message string) error
+	GetVolumeAttachmentsInNode(ctx context.Context, nodeName string) ([]storagev1.VolumeAttachment, error)
+	GetConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error)
+	GetNodeGroupRollouts(ctx context.Context) ([]v1alpha1.NodeGroupRollout, error)
+	UpdateNodeGroupRolloutStatus(ctx context.Context, nodeGroupRollout *v1alpha1.NodeGroupRollout) (*v1alpha1.NodeGroupRollout, error)
 }
 
 type KubernetesClient struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
 }
 
 // NewKubernetesClient creates a new KubernetesClient
-func NewKubernetesClient(client *kubernetes.Clientset) *KubernetesClient {
+func NewKubernetesClient(client kubernetes.Interface) *KubernetesClient {
 	return &KubernetesClient{
 		client: client,
 	}
 }
 
 // GetNodes retrieves all nodes from the cluster
-func (k *KubernetesClient) GetNodes() ([]v1.Node, error) {
-	nodeList, err := k.client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+func (k *KubernetesClient) GetNodes(ctx context.Context) ([]v1.Node, error) {
+	nodeList, err := k.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -50,8 +78,8 @@ func (k *KubernetesClient) GetNodes() ([]v1.Node, error) {
 }
 
 // GetPodsInNode retrieves all pods from a given node
-func (k *KubernetesClient) GetPodsInNode(node string) ([]v1.Pod, error) {
-	podList, err := k.client.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+func (k *KubernetesClient) GetPodsInNode(ctx context.Context, node string) ([]v1.Pod, error) {
+	podList, err := k.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
 		FieldSelector: fmt.Sprintf("spec.nodeName=%s", node),
 	})
 	if err != nil {
@@ -60,10 +88,22 @@ func (k *KubernetesClient) GetPodsInNode(node string) ([]v1.Pod, error) {
 	return podList.Items, nil
 }
 
+// GetPodsByLabelSelector retrieves all pods matching a given label selector in a given namespace
+func (k *KubernetesClient) GetPodsByLabelSelector(ctx context.Context, namespace, labelSelector string) ([]v1.Pod, error) {
+	podList, err := k.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
 // GetNodeByAwsAutoScalingInstance gets the Kubernetes node matching an AWS AutoScaling instance
-// Because we cannot filter by spec.providerID, the entire list of nodes is fetched every time
-// this function is called
-func (k *KubernetesClient) GetNodeByAwsAutoScalingInstance(instance *autoscaling.Instance) (*v1.Node, error) {
+// Because we cannot filter by spec.providerID, the entire list of nodes is fetched from the API server every time
+// this function is called. CachedKubernetesClient overrides it to look the node up in its node cache, which is
+// indexed by providerID
+func (k *KubernetesClient) GetNodeByAwsAutoScalingInstance(ctx context.Context, instance *autoscaling.Instance) (*v1.Node, error) {
 	////For some reason, we can't filter by spec.providerID
 	//api := k.client.CoreV1().Nodes()
 	//nodeList, err := api.List(metav1.ListOptions{
@@ -78,7 +118,7 @@ func (k *KubernetesClient) GetNodeByAwsAutoScalingInstance(instance *autoscaling
 	//	return nil, fmt.Errorf("nodes with AWS instance id \"%s\" not found", aws.StringValue(instance.InstanceId))
 	//}
 	//return &nodeList.Items[0], nil
-	nodes, err := k.GetNodes()
+	nodes, err := k.GetNodes(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -96,26 +136,67 @@ func (k *KubernetesClient) FilterNodeByAutoScalingInstance(nodes []v1.Node, inst
 	return nil, fmt.Errorf("node with providerID \"%s\" not found", providerId)
 }
 
-// UpdateNode updates a node
-func (k *KubernetesClient) UpdateNode(node *v1.Node) error {
+// GetNode retrieves a node from the API server
+func (k *KubernetesClient) GetNode(ctx context.Context, name string) (*v1.Node, error) {
+	return k.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+}
+
+// UpdateNode updates a node, and replaces it with the node returned by the API server so that the caller can keep
+// updating it without conflicting with its own update
+func (k *KubernetesClient) UpdateNode(ctx context.Context, node *v1.Node) error {
 	api := k.client.CoreV1().Nodes()
-	_, err := api.Update(context.TODO(), node, metav1.UpdateOptions{})
+	updatedNode, err := api.Update(ctx, node, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	*node = *updatedNode
+	return nil
+}
+
+// DeleteNode deletes a node
+func (k *KubernetesClient) DeleteNode(ctx context.Context, nodeName string) error {
+	return k.client.CoreV1().Nodes().Delete(ctx, nodeName, metav1.DeleteOptions{})
+}
+
+// GetReplicaSet retrieves a ReplicaSet
+func (k *KubernetesClient) GetReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	return k.client.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// GetStatefulSet retrieves a StatefulSet
+func (k *KubernetesClient) GetStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	return k.client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// GetDeployment retrieves a Deployment
+func (k *KubernetesClient) GetDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	return k.client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// UpdateDeployment updates a Deployment
+func (k *KubernetesClient) UpdateDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	_, err := k.client.AppsV1().Deployments(deployment.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
 	return err
 }
 
-// Drain gracefully deletes all pods from a given node
-func (k *KubernetesClient) Drain(nodeName string, ignoreDaemonSets, deleteLocalData bool) error {
-	node, err := k.client.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+// Drain gracefully deletes all pods from a given node.
+//
+// If evictionTierTimeout is greater than 0, the pods are evicted in tiers of increasing priority, waiting up to
+// evictionTierTimeout for the replacement pods of each tier to be ready. Pods that cannot be evicted within
+// evictionTimeout are deleted if isNamespaceEligibleForDeletionFallback is set and returns true for their namespace.
+func (k *KubernetesClient) Drain(ctx context.Context, nodeName string, ignoreDaemonSets, deleteLocalData bool, evictionTimeout, evictionTierTimeout time.Duration, isNamespaceEligibleForDeletionFallback func(namespace string) bool) error {
+	node, err := k.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 	drainer := &drain.Helper{
+		Ctx:                 ctx,
 		Client:              k.client,
 		Force:               true,
 		IgnoreAllDaemonSets: ignoreDaemonSets,
 		DeleteLocalData:     deleteLocalData,
 		GracePeriodSeconds:  -1,
-		Timeout:             5 * time.Minute,
+		Timeout:             evictionTimeout,
 		Out:                 drainLogger{NodeName: nodeName},
 		ErrOut:              drainLogger{NodeName: nodeName},
 		OnPodDeletedOrEvicted: func(pod *v1.Pod, usingEviction bool) {
@@ -126,13 +207,77 @@ func (k *KubernetesClient) Drain(nodeName string, ignoreDaemonSets, deleteLocalD
 		log.Printf("[%s][DRAINER] Failed to cordon node: %v", node.Name, err)
 		return err
 	}
-	if err := drain.RunNodeDrain(drainer, node.Name); err != nil {
+	podDeleteList, errs := drainer.GetPodsForDeletion(node.Name)
+	if errs != nil {
+		err = utilerrors.NewAggregate(errs)
+		log.Printf("[%s][DRAINER] Failed to get pods for deletion: %v", node.Name, err)
+		return err
+	}
+	if warnings := podDeleteList.Warnings(); warnings != "" {
+		log.Printf("[%s][DRAINER] WARNING: %s", node.Name, warnings)
+	}
+	evictPods := func(nodeName string, pods []v1.Pod) error {
+		return k.evictOrDeletePods(ctx, drainer, nodeName, pods, evictionTimeout, isNamespaceEligibleForDeletionFallback)
+	}
+	if evictionTierTimeout > 0 {
+		err = k.evictPodsInTiers(ctx, node.Name, podDeleteList.Pods(), evictPods, evictionTierTimeout)
+	} else {
+		err = evictPods(node.Name, podDeleteList.Pods())
+	}
+	if err != nil {
 		log.Printf("[%s][DRAINER] Failed to drain node: %v", node.Name, err)
 		return err
 	}
 	return nil
 }
 
+// CreateNodeEvent creates an event for a given node
+func (k *KubernetesClient) CreateNodeEvent(ctx context.Context, node *v1.Node, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: node.Name + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: node.Name,
+			UID:  node.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: EventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := k.client.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// GetVolumeAttachmentsInNode retrieves the VolumeAttachments referencing a given node.
+//
+// VolumeAttachments don't support field selectors on spec.nodeName, so they're filtered after being listed
+func (k *KubernetesClient) GetVolumeAttachmentsInNode(ctx context.Context, nodeName string) ([]storagev1.VolumeAttachment, error) {
+	volumeAttachmentList, err := k.client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var volumeAttachments []storagev1.VolumeAttachment
+	for _, volumeAttachment := range volumeAttachmentList.Items {
+		if volumeAttachment.Spec.NodeName == nodeName {
+			volumeAttachments = append(volumeAttachments, volumeAttachment)
+		}
+	}
+	return volumeAttachments, nil
+}
+
+// GetConfigMap retrieves a ConfigMap
+func (k *KubernetesClient) GetConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	return k.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
 type drainLogger struct {
 	NodeName string
 }
@@ -0,0 +1,207 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+)
+
+// DryRunKubernetesClient is a KubernetesClientApi that logs the calls that would mutate the cluster instead of
+// making them, and delegates every other call to the wrapped client.
+//
+// The nodes that would have been updated or deleted are kept in memory and returned in place of the nodes of the
+// wrapped client, so that the progress of the rolling update carries over from one execution to the next as if the
+// nodes had really been updated.
+type DryRunKubernetesClient struct {
+	KubernetesClientApi
+
+	mutex            sync.RWMutex
+	updatedNodes     map[string]*v1.Node
+	deletedNodeNames map[string]bool
+}
+
+// NewDryRunKubernetesClient creates a new DryRunKubernetesClient wrapping the given client
+func NewDryRunKubernetesClient(client KubernetesClientApi) *DryRunKubernetesClient {
+	return &DryRunKubernetesClient{
+		KubernetesClientApi: client,
+		updatedNodes:        make(map[string]*v1.Node),
+		deletedNodeNames:    make(map[string]bool),
+	}
+}
+
+// GetNodes retrieves all nodes from the wrapped client, replacing the nodes that would have been updated or deleted
+func (k *DryRunKubernetesClient) GetNodes(ctx context.Context) ([]v1.Node, error) {
+	nodes, err := k.KubernetesClientApi.GetNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	var result []v1.Node
+	for _, node := range nodes {
+		if k.deletedNodeNames[node.Name] {
+			continue
+		}
+		if updatedNode, ok := k.updatedNodes[node.Name]; ok {
+			node = *updatedNode
+		}
+		// The nodes are copied so that modifying them before calling UpdateNode never modifies the nodes of the
+		// wrapped client
+		result = append(result, *node.DeepCopy())
+	}
+	return result, nil
+}
+
+// GetNodeByAwsAutoScalingInstance gets the node associated with an EC2 instance from the wrapped client, replacing
+// it if it would have been updated or deleted
+func (k *DryRunKubernetesClient) GetNodeByAwsAutoScalingInstance(ctx context.Context, instance *autoscaling.Instance) (*v1.Node, error) {
+	node, err := k.KubernetesClientApi.GetNodeByAwsAutoScalingInstance(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	return k.replaceNode(node)
+}
+
+// GetNode gets a node from the wrapped client, replacing it if it would have been updated or deleted
+func (k *DryRunKubernetesClient) GetNode(ctx context.Context, name string) (*v1.Node, error) {
+	node, err := k.KubernetesClientApi.GetNode(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return k.replaceNode(node)
+}
+
+// replaceNode returns a copy of the node that would have replaced a node of the wrapped client, or an error if the
+// node would have been deleted
+func (k *DryRunKubernetesClient) replaceNode(node *v1.Node) (*v1.Node, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if k.deletedNodeNames[node.Name] {
+		return nil, fmt.Errorf("node %s would have been deleted", node.Name)
+	}
+	if updatedNode, ok := k.updatedNodes[node.Name]; ok {
+		return updatedNode.DeepCopy(), nil
+	}
+	return node.DeepCopy(), nil
+}
+
+// UpdateNode logs the update of a node, and keeps the node in memory in place of the node of the wrapped client
+func (k *DryRunKubernetesClient) UpdateNode(_ context.Context, node *v1.Node) error {
+	var taints []string
+	for _, taint := range node.Spec.Taints {
+		taints = append(taints, fmt.Sprintf("%s:%s", taint.Key, taint.Effect))
+	}
+	logDryRunAction("UpdateNode", map[string]interface{}{
+		"node":          node.Name,
+		"unschedulable": node.Spec.Unschedulable,
+		"taints":        taints,
+		"annotations":   filterHandlerAnnotations(node.Annotations),
+	})
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.updatedNodes[node.Name] = node.DeepCopy()
+	return nil
+}
+
+// DeleteNode logs the deletion of a node, and hides the node from the subsequent reads
+func (k *DryRunKubernetesClient) DeleteNode(_ context.Context, nodeName string) error {
+	logDryRunAction("DeleteNode", map[string]interface{}{"node": nodeName})
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.deletedNodeNames[nodeName] = true
+	delete(k.updatedNodes, nodeName)
+	return nil
+}
+
+// UpdateDeployment logs the update of a deployment
+func (k *DryRunKubernetesClient) UpdateDeployment(_ context.Context, deployment *appsv1.Deployment) error {
+	details := map[string]interface{}{
+		"deployment":  deployment.Namespace + "/" + deployment.Name,
+		"annotations": filterHandlerAnnotations(deployment.Annotations),
+	}
+	if deployment.Spec.Replicas != nil {
+		details["replicas"] = *deployment.Spec.Replicas
+	}
+	if restartedAt, ok := deployment.Spec.Template.Annotations[RolloutRestartedAtAnnotationKey]; ok {
+		details["restartedAt"] = restartedAt
+	}
+	logDryRunAction("UpdateDeployment", details)
+	return nil
+}
+
+// Drain logs the drain of a node, along with the pods that would have been evicted
+func (k *DryRunKubernetesClient) Drain(ctx context.Context, nodeName string, ignoreDaemonSets, deleteLocalData bool, evictionTimeout, evictionTierTimeout time.Duration, _ func(namespace string) bool) error {
+	details := map[string]interface{}{
+		"node":             nodeName,
+		"ignoreDaemonSets": ignoreDaemonSets,
+		"deleteLocalData":  deleteLocalData,
+		"evictionTimeout":  evictionTimeout.String(),
+	}
+	if evictionTierTimeout > 0 {
+		details["evictionTierTimeout"] = evictionTierTimeout.String()
+	}
+	if pods, err := k.GetPodsInNode(ctx, nodeName); err == nil {
+		var podNames []string
+		for _, pod := range pods {
+			if pod.DeletionTimestamp == nil && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+				podNames = append(podNames, pod.Namespace+"/"+pod.Name)
+			}
+		}
+		details["pods"] = podNames
+	}
+	logDryRunAction("Drain", details)
+	return nil
+}
+
+// CreateNodeEvent logs the creation of an event for a node
+func (k *DryRunKubernetesClient) CreateNodeEvent(_ context.Context, node *v1.Node, eventType, reason, message string) error {
+	logDryRunAction("CreateNodeEvent", map[string]interface{}{
+		"node":    node.Name,
+		"type":    eventType,
+		"reason":  reason,
+		"message": message,
+	})
+	return nil
+}
+
+// UpdateNodeGroupRolloutStatus logs the update of the status of a NodeGroupRollout
+func (k *DryRunKubernetesClient) UpdateNodeGroupRolloutStatus(_ context.Context, nodeGroupRollout *v1alpha1.NodeGroupRollout) (*v1alpha1.NodeGroupRollout, error) {
+	logDryRunAction("UpdateNodeGroupRolloutStatus", map[string]interface{}{
+		"nodeGroupRollout": nodeGroupRollout.Name,
+		"status":           nodeGroupRollout.Status,
+	})
+	return nodeGroupRollout.DeepCopy(), nil
+}
+
+// filterHandlerAnnotations returns the annotations managed by this application
+func filterHandlerAnnotations(annotations map[string]string) map[string]string {
+	filteredAnnotations := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, HandlerPrefix) {
+			filteredAnnotations[key] = value
+		}
+	}
+	return filteredAnnotations
+}
+
+// logDryRunAction logs an action that would have been taken on the cluster as a JSON record
+func logDryRunAction(action string, details map[string]interface{}) {
+	record, err := json.Marshal(struct {
+		WouldDo string                 `json:"wouldDo"`
+		Details map[string]interface{} `json:"details"`
+	}{action, details})
+	if err != nil {
+		log.Printf("[DRY-RUN] Unable to log action %s: %v", action, err)
+		return
+	}
+	log.Printf("[DRY-RUN] %s", record)
+}
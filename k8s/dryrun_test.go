@@ -0,0 +1,54 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/api/core/v1"
+)
+
+func TestDryRunKubernetesClient(t *testing.T) {
+	node := k8stest.CreateTestNode("node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	otherNode := k8stest.CreateTestNode("node-2", "us-west-2b", "i-07550830aef9e1481", "1000m", "1000Mi")
+	pod := k8stest.CreateTestPod("pod-1", node.Name, "100m", "100Mi", false, v1.PodRunning)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node, otherNode}, []v1.Pod{pod})
+	dryRunKubernetesClient := NewDryRunKubernetesClient(mockKubernetesClient)
+	instance := &autoscaling.Instance{AvailabilityZone: aws.String("us-west-2a"), InstanceId: aws.String("i-034fa1dfbfd35f8bb")}
+
+	if err := AnnotateNodeByAwsAutoScalingInstance(context.TODO(), dryRunKubernetesClient, instance, RollingUpdateStartedTimestampAnnotationKey, "2021-01-01T00:00:00Z"); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if err := dryRunKubernetesClient.Drain(context.TODO(), node.Name, true, true, time.Minute, 0, nil); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if mockKubernetesClient.Counter["UpdateNode"] != 0 || mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("the wrapped client shouldn't have been mutated")
+	}
+	if _, ok := mockKubernetesClient.Nodes[node.Name].Annotations[RollingUpdateStartedTimestampAnnotationKey]; ok {
+		t.Error("the node of the wrapped client shouldn't have been annotated")
+	}
+	updatedNode, err := dryRunKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), instance)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if updatedNode.Annotations[RollingUpdateStartedTimestampAnnotationKey] != "2021-01-01T00:00:00Z" {
+		t.Error("the node that would have been annotated should've been returned in place of the node of the wrapped client")
+	}
+
+	if err := dryRunKubernetesClient.DeleteNode(context.TODO(), node.Name); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if mockKubernetesClient.Counter["DeleteNode"] != 0 {
+		t.Error("the node of the wrapped client shouldn't have been deleted")
+	}
+	if _, err := dryRunKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), instance); err == nil {
+		t.Error("should've returned an error, because the node would have been deleted")
+	}
+	if nodes, _ := dryRunKubernetesClient.GetNodes(context.TODO()); len(nodes) != 1 || nodes[0].Name != otherNode.Name {
+		t.Errorf("expected only %s, got %d nodes", otherNode.Name, len(nodes))
+	}
+}
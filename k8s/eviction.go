@@ -0,0 +1,445 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/kubectl/pkg/drain"
+)
+
+var (
+	// EvictionTierPollInterval is the interval at which the replacement pods of an eviction tier are checked
+	EvictionTierPollInterval = 5 * time.Second
+
+	// EvictionInitialBackoff is the duration to wait before retrying an eviction that was rejected because of a
+	// PodDisruptionBudget. The duration is doubled after each attempt, up to EvictionMaximumBackoff.
+	EvictionInitialBackoff = 5 * time.Second
+
+	// EvictionMaximumBackoff is the maximum duration to wait between two attempts to evict a pod
+	EvictionMaximumBackoff = time.Minute
+
+	// PodDeletionPollInterval is the interval at which pods are checked while waiting for them to be deleted
+	PodDeletionPollInterval = time.Second
+
+	// PodDeletionTimeoutMargin is added to the termination grace period of a pod deleted because it could not be
+	// evicted to get the maximum duration to wait for said pod to be deleted
+	PodDeletionTimeoutMargin = 30 * time.Second
+)
+
+const (
+	// EvictionEscalatedToDeletionEventReason is the reason of the event emitted when a pod is deleted because it
+	// could not be evicted
+	EvictionEscalatedToDeletionEventReason = "EvictionEscalatedToDeletion"
+
+	// MaximumEvictionEscalations is the number of escalations kept in the EvictionEscalationsAnnotationKey annotation
+	// of a node. The oldest escalations are dropped first
+	MaximumEvictionEscalations = 20
+)
+
+// GroupPodsIntoEvictionTiers splits a list of pods into tiers that should be evicted one after the other.
+//
+// Pods that aren't owned by a StatefulSet are evicted first, grouped by priority in ascending order, meaning that
+// pods with the lowest priority are evicted first.
+// Pods owned by StatefulSets are evicted last, also grouped by priority in ascending order, and each StatefulSet's
+// pods are evicted one at a time in descending ordinal order.
+func GroupPodsIntoEvictionTiers(pods []v1.Pod) [][]v1.Pod {
+	statelessPodsByPriority := make(map[int32][]v1.Pod)
+	// Maps each priority to the pods of each StatefulSet with that priority
+	statefulSetPodsByPriority := make(map[int32]map[types.NamespacedName][]v1.Pod)
+	for _, pod := range pods {
+		priority := getPodPriority(&pod)
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owner.Kind == "StatefulSet" {
+			if statefulSetPodsByPriority[priority] == nil {
+				statefulSetPodsByPriority[priority] = make(map[types.NamespacedName][]v1.Pod)
+			}
+			statefulSetName := types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}
+			statefulSetPodsByPriority[priority][statefulSetName] = append(statefulSetPodsByPriority[priority][statefulSetName], pod)
+		} else {
+			statelessPodsByPriority[priority] = append(statelessPodsByPriority[priority], pod)
+		}
+	}
+	var tiers [][]v1.Pod
+	for _, priority := range getSortedPriorities(statelessPodsByPriority) {
+		tiers = append(tiers, statelessPodsByPriority[priority])
+	}
+	var statefulSetPriorities []int32
+	for priority := range statefulSetPodsByPriority {
+		statefulSetPriorities = append(statefulSetPriorities, priority)
+	}
+	sort.Slice(statefulSetPriorities, func(i, j int) bool { return statefulSetPriorities[i] < statefulSetPriorities[j] })
+	for _, priority := range statefulSetPriorities {
+		// Sort the names of the StatefulSets to keep the order deterministic
+		var statefulSetNames []types.NamespacedName
+		for statefulSetName, statefulSetPods := range statefulSetPodsByPriority[priority] {
+			statefulSetNames = append(statefulSetNames, statefulSetName)
+			sort.Slice(statefulSetPods, func(i, j int) bool {
+				return getStatefulSetPodOrdinal(&statefulSetPods[i]) > getStatefulSetPodOrdinal(&statefulSetPods[j])
+			})
+		}
+		sort.Slice(statefulSetNames, func(i, j int) bool { return statefulSetNames[i].String() < statefulSetNames[j].String() })
+		// The nth tier contains the pod with the nth highest ordinal of each StatefulSet
+		for n := 0; ; n++ {
+			var tier []v1.Pod
+			for _, statefulSetName := range statefulSetNames {
+				if statefulSetPods := statefulSetPodsByPriority[priority][statefulSetName]; n < len(statefulSetPods) {
+					tier = append(tier, statefulSetPods[n])
+				}
+			}
+			if len(tier) == 0 {
+				break
+			}
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// waitForReplacementPods waits until each controller of the given evicted pods has at least as many ready pods
+// outside the drained node as it had before the eviction, plus the number of pods that were evicted.
+func (k *KubernetesClient) waitForReplacementPods(ctx context.Context, nodeName string, numberOfReadyPodsBeforeEviction map[types.UID]int, evictedPods []v1.Pod, timeout time.Duration) error {
+	numberOfEvictedPodsByController := make(map[types.UID]int)
+	controllers := make(map[types.UID]podController)
+	for _, pod := range evictedPods {
+		if owner := metav1.GetControllerOf(&pod); owner != nil {
+			numberOfEvictedPodsByController[owner.UID]++
+			controllers[owner.UID] = podController{namespace: pod.Namespace, owner: *owner}
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for controllerUID, numberOfEvictedPods := range numberOfEvictedPodsByController {
+		expectedNumberOfReadyPods := numberOfReadyPodsBeforeEviction[controllerUID] + numberOfEvictedPods
+		for {
+			numberOfReadyPods, err := k.countReadyPodsOfController(ctx, controllers[controllerUID], nodeName)
+			if err != nil {
+				return err
+			}
+			if numberOfReadyPods >= expectedNumberOfReadyPods {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %s waiting for %d replacement pods of controller with uid %s to be ready", timeout, numberOfEvictedPods, controllerUID)
+			}
+			if err := Sleep(ctx, EvictionTierPollInterval); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// podController is the controller of a pod, along with the namespace of the pod
+type podController struct {
+	namespace string
+	owner     metav1.OwnerReference
+}
+
+// countReadyPodsOfControllers counts the ready pods outside a given node for each controller of the given pods
+func (k *KubernetesClient) countReadyPodsOfControllers(ctx context.Context, pods []v1.Pod, nodeName string) (map[types.UID]int, error) {
+	numberOfReadyPods := make(map[types.UID]int)
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil {
+			continue
+		}
+		if _, ok := numberOfReadyPods[owner.UID]; ok {
+			continue
+		}
+		count, err := k.countReadyPodsOfController(ctx, podController{namespace: pod.Namespace, owner: *owner}, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		numberOfReadyPods[owner.UID] = count
+	}
+	return numberOfReadyPods, nil
+}
+
+// countReadyPodsOfController counts the ready pods of a given controller outside a given node.
+//
+// Only the pods matching the selector of the controller are listed, unless the selector of the controller cannot be
+// resolved, in which case every pod in the namespace of the controller is listed.
+func (k *KubernetesClient) countReadyPodsOfController(ctx context.Context, controller podController, nodeName string) (int, error) {
+	labelSelector, err := k.getControllerLabelSelector(ctx, controller)
+	if err != nil {
+		return 0, err
+	}
+	podList, err := k.client.CoreV1().Pods(controller.namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return 0, err
+	}
+	numberOfReadyPods := 0
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName == nodeName || pod.DeletionTimestamp != nil || !IsPodReady(&pod) {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owner.UID == controller.owner.UID {
+			numberOfReadyPods++
+		}
+	}
+	return numberOfReadyPods, nil
+}
+
+// getControllerLabelSelector returns the label selector of the pods of a controller, or an empty string if the kind
+// of the controller isn't supported or if the controller no longer exists
+func (k *KubernetesClient) getControllerLabelSelector(ctx context.Context, controller podController) (string, error) {
+	var (
+		selector *metav1.LabelSelector
+		err      error
+	)
+	switch controller.owner.Kind {
+	case "ReplicaSet":
+		var replicaSet *appsv1.ReplicaSet
+		if replicaSet, err = k.client.AppsV1().ReplicaSets(controller.namespace).Get(ctx, controller.owner.Name, metav1.GetOptions{}); err == nil {
+			selector = replicaSet.Spec.Selector
+		}
+	case "StatefulSet":
+		var statefulSet *appsv1.StatefulSet
+		if statefulSet, err = k.client.AppsV1().StatefulSets(controller.namespace).Get(ctx, controller.owner.Name, metav1.GetOptions{}); err == nil {
+			selector = statefulSet.Spec.Selector
+		}
+	case "ReplicationController":
+		var replicationController *v1.ReplicationController
+		if replicationController, err = k.client.CoreV1().ReplicationControllers(controller.namespace).Get(ctx, controller.owner.Name, metav1.GetOptions{}); err == nil {
+			selector = &metav1.LabelSelector{MatchLabels: replicationController.Spec.Selector}
+		}
+	}
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if selector == nil {
+		return "", nil
+	}
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return "", err
+	}
+	return labelSelector.String(), nil
+}
+
+// evictPodsInTiers evicts the given pods tier by tier, waiting for the replacement pods of each tier to be ready
+// before moving on to the next tier
+func (k *KubernetesClient) evictPodsInTiers(ctx context.Context, nodeName string, pods []v1.Pod, evictPods func(string, []v1.Pod) error, tierTimeout time.Duration) error {
+	tiers := GroupPodsIntoEvictionTiers(pods)
+	for i, tier := range tiers {
+		numberOfReadyPodsBeforeEviction, err := k.countReadyPodsOfControllers(ctx, tier, nodeName)
+		if err != nil {
+			return err
+		}
+		log.Printf("[%s][DRAINER] Evicting tier %d/%d (%d pods)", nodeName, i+1, len(tiers), len(tier))
+		if err := evictPods(nodeName, tier); err != nil {
+			return err
+		}
+		if i == len(tiers)-1 {
+			// There's no next tier to wait for
+			break
+		}
+		if err := k.waitForReplacementPods(ctx, nodeName, numberOfReadyPodsBeforeEviction, tier, tierTimeout); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[%s][DRAINER] Moving on to the next tier despite not all replacement pods being ready: %v", nodeName, err)
+		}
+	}
+	return nil
+}
+
+// evictOrDeletePods evicts the given pods, retrying with backoff for as long as the evictions are rejected because of
+// PodDisruptionBudgets.
+// If a pod still cannot be evicted after evictionTimeout, the pod is deleted instead, provided that
+// isNamespaceEligibleForDeletionFallback allows it for the pod's namespace. Every such escalation is recorded on the node.
+func (k *KubernetesClient) evictOrDeletePods(ctx context.Context, drainer *drain.Helper, nodeName string, pods []v1.Pod, evictionTimeout time.Duration, isNamespaceEligibleForDeletionFallback func(namespace string) bool) error {
+	if len(pods) == 0 {
+		return nil
+	}
+	policyGroupVersion, err := drain.CheckEvictionSupport(k.client)
+	if err != nil {
+		return err
+	}
+	if len(policyGroupVersion) == 0 {
+		// Eviction isn't supported by the cluster, so there's nothing to escalate from
+		return drainer.DeleteOrEvictPods(pods)
+	}
+	type result struct {
+		pod       v1.Pod
+		escalated bool
+		err       error
+	}
+	results := make(chan result, len(pods))
+	for _, pod := range pods {
+		go func(pod v1.Pod) {
+			escalated, err := k.evictOrDeletePod(ctx, drainer, nodeName, pod, policyGroupVersion, evictionTimeout, isNamespaceEligibleForDeletionFallback)
+			results <- result{pod: pod, escalated: escalated, err: err}
+		}(pod)
+	}
+	var (
+		errs          []error
+		escalatedPods []v1.Pod
+	)
+	for range pods {
+		result := <-results
+		if result.escalated {
+			escalatedPods = append(escalatedPods, result.pod)
+		}
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	if len(escalatedPods) > 0 {
+		if err := k.recordEvictionEscalations(ctx, nodeName, escalatedPods, evictionTimeout); err != nil {
+			log.Printf("[%s][DRAINER] Failed to record eviction escalations: %v", nodeName, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// evictOrDeletePod evicts a pod, or deletes it if the eviction keeps getting rejected and the fallback to deletion
+// is enabled for the pod's namespace, and then waits for the pod to be deleted.
+//
+// Returns whether the eviction was escalated to a deletion
+func (k *KubernetesClient) evictOrDeletePod(ctx context.Context, drainer *drain.Helper, nodeName string, pod v1.Pod, policyGroupVersion string, evictionTimeout time.Duration, isNamespaceEligibleForDeletionFallback func(namespace string) bool) (bool, error) {
+	escalated := false
+	deadline := time.Now().Add(evictionTimeout)
+	backoff := EvictionInitialBackoff
+	for {
+		err := drainer.EvictPod(pod, policyGroupVersion)
+		if err == nil {
+			break
+		} else if apierrors.IsNotFound(err) {
+			return false, nil
+		} else if !apierrors.IsTooManyRequests(err) {
+			return false, fmt.Errorf("error when evicting pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			if isNamespaceEligibleForDeletionFallback == nil || !isNamespaceEligibleForDeletionFallback(pod.Namespace) {
+				return false, fmt.Errorf("unable to evict pod %s/%s within %s: %v", pod.Namespace, pod.Name, evictionTimeout, err)
+			}
+			log.Printf("[%s][DRAINER] Unable to evict pod %s/%s within %s, deleting it instead", nodeName, pod.Namespace, pod.Name, evictionTimeout)
+			if err := drainer.DeletePod(pod); err != nil && !apierrors.IsNotFound(err) {
+				return false, fmt.Errorf("error when deleting pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+			escalated = true
+			break
+		}
+		log.Printf("[%s][DRAINER] Eviction of pod %s/%s was rejected, retrying in %s: %v", nodeName, pod.Namespace, pod.Name, backoff, err)
+		if err := Sleep(ctx, backoff); err != nil {
+			return false, err
+		}
+		if backoff *= 2; backoff > EvictionMaximumBackoff {
+			backoff = EvictionMaximumBackoff
+		}
+	}
+	if escalated {
+		// The eviction timeout has already been spent on the evictions, so the deletion gets its own timeout
+		return true, k.waitForPodDeletion(ctx, nodeName, pod, false, getPodDeletionTimeout(drainer, pod))
+	}
+	return false, k.waitForPodDeletion(ctx, nodeName, pod, true, evictionTimeout)
+}
+
+// getPodDeletionTimeout returns the maximum duration to wait for a pod deleted by the drainer to be deleted, which is
+// the termination grace period used for the deletion plus PodDeletionTimeoutMargin
+func getPodDeletionTimeout(drainer *drain.Helper, pod v1.Pod) time.Duration {
+	gracePeriodSeconds := int64(v1.DefaultTerminationGracePeriodSeconds)
+	if drainer.GracePeriodSeconds >= 0 {
+		gracePeriodSeconds = int64(drainer.GracePeriodSeconds)
+	} else if pod.Spec.TerminationGracePeriodSeconds != nil {
+		gracePeriodSeconds = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	return time.Duration(gracePeriodSeconds)*time.Second + PodDeletionTimeoutMargin
+}
+
+// waitForPodDeletion waits until a pod no longer exists, or until it has been replaced by a pod with the same name
+func (k *KubernetesClient) waitForPodDeletion(ctx context.Context, nodeName string, pod v1.Pod, usingEviction bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		currentPod, err := k.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && currentPod.UID != pod.UID) {
+			if usingEviction {
+				log.Printf("[%s][DRAINER] evicted pod %s/%s", nodeName, pod.Namespace, pod.Name)
+			} else {
+				log.Printf("[%s][DRAINER] deleted pod %s/%s", nodeName, pod.Namespace, pod.Name)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error when waiting for pod %s/%s to be deleted: %v", pod.Namespace, pod.Name, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for pod %s/%s to be deleted", pod.Namespace, pod.Name)
+		}
+		if err := Sleep(ctx, PodDeletionPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// recordEvictionEscalations appends the pods that had to be deleted to the EvictionEscalationsAnnotationKey
+// annotation of the node, keeping only the last MaximumEvictionEscalations of them, and emits an event for each of
+// them
+func (k *KubernetesClient) recordEvictionEscalations(ctx context.Context, nodeName string, pods []v1.Pod, evictionTimeout time.Duration) error {
+	node, err := k.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	var escalations []string
+	if currentValue := node.Annotations[EvictionEscalationsAnnotationKey]; len(currentValue) > 0 {
+		escalations = strings.Split(currentValue, ",")
+	}
+	for _, pod := range pods {
+		escalations = append(escalations, fmt.Sprintf("%s/%s=%s", pod.Namespace, pod.Name, now))
+		message := fmt.Sprintf("Deleted pod %s/%s because it could not be evicted within %s", pod.Namespace, pod.Name, evictionTimeout)
+		if err := k.CreateNodeEvent(ctx, node, v1.EventTypeWarning, EvictionEscalatedToDeletionEventReason, message); err != nil {
+			log.Printf("[%s][DRAINER] Failed to create event for the deletion of pod %s/%s: %v", nodeName, pod.Namespace, pod.Name, err)
+		}
+	}
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	if len(escalations) > MaximumEvictionEscalations {
+		escalations = escalations[len(escalations)-MaximumEvictionEscalations:]
+	}
+	node.Annotations[EvictionEscalationsAnnotationKey] = strings.Join(escalations, ",")
+	return k.UpdateNode(ctx, node)
+}
+
+func getSortedPriorities(podsByPriority map[int32][]v1.Pod) []int32 {
+	var priorities []int32
+	for priority := range podsByPriority {
+		priorities = append(priorities, priority)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	return priorities
+}
+
+// getPodPriority returns the priority of a pod, which is resolved from the pod's PriorityClass upon creation
+func getPodPriority(pod *v1.Pod) int32 {
+	if pod.Spec.Priority != nil {
+		return *pod.Spec.Priority
+	}
+	return 0
+}
+
+// getStatefulSetPodOrdinal extracts the ordinal from the name of a pod owned by a StatefulSet, or -1 if the name
+// doesn't end with an ordinal
+func getStatefulSetPodOrdinal(pod *v1.Pod) int {
+	index := strings.LastIndex(pod.Name, "-")
+	if index == -1 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(pod.Name[index+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
@@ -0,0 +1,260 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/kubectl/pkg/drain"
+)
+
+func createTestPodWithPriorityAndController(name, controllerKind, controllerName string, priority int32) v1.Pod {
+	pod := k8stest.CreateTestPod(name, "node", "100m", "100Mi", false, v1.PodRunning)
+	isController := true
+	pod.SetOwnerReferences([]metav1.OwnerReference{{Kind: controllerKind, Name: controllerName, Controller: &isController}})
+	pod.Spec.Priority = &priority
+	return pod
+}
+
+func getPodNamesInTiers(tiers [][]v1.Pod) [][]string {
+	var podNamesInTiers [][]string
+	for _, tier := range tiers {
+		var podNames []string
+		for _, pod := range tier {
+			podNames = append(podNames, pod.Name)
+		}
+		podNamesInTiers = append(podNamesInTiers, podNames)
+	}
+	return podNamesInTiers
+}
+
+func TestGroupPodsIntoEvictionTiers(t *testing.T) {
+	pods := []v1.Pod{
+		createTestPodWithPriorityAndController("critical-statefulset-0", "StatefulSet", "critical-statefulset", 1000),
+		createTestPodWithPriorityAndController("statefulset-0", "StatefulSet", "statefulset", 0),
+		createTestPodWithPriorityAndController("critical-pod", "ReplicaSet", "critical-replicaset", 1000),
+		createTestPodWithPriorityAndController("statefulset-2", "StatefulSet", "statefulset", 0),
+		createTestPodWithPriorityAndController("low-priority-pod", "ReplicaSet", "low-priority-replicaset", -10),
+		createTestPodWithPriorityAndController("statefulset-10", "StatefulSet", "statefulset", 0),
+		createTestPodWithPriorityAndController("other-statefulset-1", "StatefulSet", "other-statefulset", 0),
+		createTestPodWithPriorityAndController("pod", "ReplicaSet", "replicaset", 0),
+	}
+	tiers := getPodNamesInTiers(GroupPodsIntoEvictionTiers(pods))
+	expectedTiers := [][]string{
+		{"low-priority-pod"},
+		{"pod"},
+		{"critical-pod"},
+		{"other-statefulset-1", "statefulset-10"},
+		{"statefulset-2"},
+		{"statefulset-0"},
+		{"critical-statefulset-0"},
+	}
+	if len(tiers) != len(expectedTiers) {
+		t.Fatalf("expected %d tiers, got %d: %v", len(expectedTiers), len(tiers), tiers)
+	}
+	for i := range expectedTiers {
+		if len(tiers[i]) != len(expectedTiers[i]) {
+			t.Fatalf("expected tier %d to be %v, got %v", i, expectedTiers[i], tiers[i])
+		}
+		for j := range expectedTiers[i] {
+			if tiers[i][j] != expectedTiers[i][j] {
+				t.Errorf("expected tier %d to be %v, got %v", i, expectedTiers[i], tiers[i])
+			}
+		}
+	}
+}
+
+func TestGroupPodsIntoEvictionTiers_withNoPods(t *testing.T) {
+	if tiers := GroupPodsIntoEvictionTiers(nil); len(tiers) != 0 {
+		t.Errorf("expected no tiers, got %d", len(tiers))
+	}
+}
+
+func createTestReadyPodOfReplicaSet(name, nodeName string, replicaSet *appsv1.ReplicaSet) *v1.Pod {
+	pod := k8stest.CreateTestPod(name, nodeName, "100m", "100Mi", false, v1.PodRunning)
+	pod.SetNamespace(replicaSet.Namespace)
+	isController := true
+	pod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID, Controller: &isController}})
+	pod.SetLabels(replicaSet.Spec.Selector.MatchLabels)
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	return &pod
+}
+
+func TestKubernetesClient_countReadyPodsOfControllers(t *testing.T) {
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "replica-set", Namespace: "default", UID: types.UID("replica-set-uid")},
+		Spec:       appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}}},
+	}
+	otherReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-replica-set", Namespace: "default", UID: types.UID("other-replica-set-uid")},
+		Spec:       appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "b"}}},
+	}
+	evictedPod := createTestReadyPodOfReplicaSet("pod-1", "old-node", replicaSet)
+	clientSet := fake.NewSimpleClientset(
+		replicaSet,
+		otherReplicaSet,
+		evictedPod,
+		createTestReadyPodOfReplicaSet("pod-2", "new-node", replicaSet),
+		createTestReadyPodOfReplicaSet("pod-3", "new-node", otherReplicaSet),
+	)
+	client := NewKubernetesClient(clientSet)
+
+	numberOfReadyPods, err := client.countReadyPodsOfControllers(context.TODO(), []v1.Pod{*evictedPod}, "old-node")
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(numberOfReadyPods) != 1 || numberOfReadyPods[replicaSet.UID] != 1 {
+		t.Errorf("expected 1 ready pod outside of old-node for %s, got %v", replicaSet.Name, numberOfReadyPods)
+	}
+	for _, action := range clientSet.Actions() {
+		if listAction, ok := action.(k8stesting.ListAction); ok && listAction.GetResource().Resource == "pods" {
+			if labelSelector := listAction.GetListRestrictions().Labels.String(); labelSelector != "app=a" {
+				t.Errorf("expected the pods to be listed with the label selector of the ReplicaSet, got '%s'", labelSelector)
+			}
+		}
+	}
+}
+
+// newFakeClientSetRejectingEvictions creates a fake clientset supporting evictions, which rejects every eviction as if
+// it violated a PodDisruptionBudget, and returns a function returning the number of evictions attempted
+func newFakeClientSetRejectingEvictions(objects ...runtime.Object) (*fake.Clientset, func() int) {
+	clientSet := fake.NewSimpleClientset(objects...)
+	clientSet.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "policy/v1beta1"},
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: drain.EvictionSubresource, Kind: drain.EvictionKind}}},
+	}
+	var (
+		mutex                      sync.Mutex
+		numberOfEvictionsAttempted int
+	)
+	clientSet.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		numberOfEvictionsAttempted++
+		return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	})
+	return clientSet, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return numberOfEvictionsAttempted
+	}
+}
+
+func TestKubernetesClient_evictOrDeletePods_whenEvictionIsRejected(t *testing.T) {
+	EvictionInitialBackoff, EvictionMaximumBackoff, PodDeletionPollInterval = 20*time.Millisecond, 40*time.Millisecond, time.Millisecond
+	defer func() {
+		EvictionInitialBackoff, EvictionMaximumBackoff, PodDeletionPollInterval = 5*time.Second, time.Minute, time.Second
+	}()
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	pod := k8stest.CreateTestPod("pod", node.Name, "100m", "100Mi", false, v1.PodRunning)
+	pod.SetNamespace("default")
+	clientSet, getNumberOfEvictionsAttempted := newFakeClientSetRejectingEvictions(&node, &pod)
+	client := NewKubernetesClient(clientSet)
+
+	drainer := &drain.Helper{Ctx: context.TODO(), Client: clientSet, GracePeriodSeconds: -1}
+	isNamespaceEligibleForDeletionFallback := func(string) bool { return true }
+	if err := client.evictOrDeletePods(context.TODO(), drainer, node.Name, []v1.Pod{pod}, 90*time.Millisecond, isNamespaceEligibleForDeletionFallback); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	// The evictions are attempted at 0ms, 20ms and 60ms, after which the next attempt would be past the timeout
+	if numberOfEvictionsAttempted := getNumberOfEvictionsAttempted(); numberOfEvictionsAttempted != 3 {
+		t.Errorf("expected the eviction to have been attempted 3 times with an exponential backoff, got %d", numberOfEvictionsAttempted)
+	}
+	if _, err := clientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Error("pod should've been deleted, because it couldn't be evicted within the eviction timeout")
+	}
+	updatedNode, _ := clientSet.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{})
+	if escalations := updatedNode.Annotations[EvictionEscalationsAnnotationKey]; !strings.HasPrefix(escalations, "default/pod=") {
+		t.Errorf("the deletion of the pod should've been recorded in the %s annotation, got '%s'", EvictionEscalationsAnnotationKey, escalations)
+	}
+	events, _ := clientSet.CoreV1().Events("").List(context.TODO(), metav1.ListOptions{})
+	if len(events.Items) != 1 || events.Items[0].Reason != EvictionEscalatedToDeletionEventReason {
+		t.Errorf("expected an event with the reason %s, got %v", EvictionEscalatedToDeletionEventReason, events.Items)
+	}
+}
+
+func TestKubernetesClient_recordEvictionEscalations(t *testing.T) {
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	var escalations []string
+	for i := 0; i < MaximumEvictionEscalations; i++ {
+		escalations = append(escalations, fmt.Sprintf("default/old-pod-%d=2020-01-01T00:00:00Z", i))
+	}
+	node.Annotations[EvictionEscalationsAnnotationKey] = strings.Join(escalations, ",")
+	pod := k8stest.CreateTestPod("pod", node.Name, "100m", "100Mi", false, v1.PodRunning)
+	pod.SetNamespace("default")
+	clientSet := fake.NewSimpleClientset(&node, &pod)
+	client := NewKubernetesClient(clientSet)
+
+	if err := client.recordEvictionEscalations(context.TODO(), node.Name, []v1.Pod{pod}, time.Minute); err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	updatedNode, _ := clientSet.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{})
+	recordedEscalations := strings.Split(updatedNode.Annotations[EvictionEscalationsAnnotationKey], ",")
+	if len(recordedEscalations) != MaximumEvictionEscalations {
+		t.Fatalf("expected only the last %d escalations to be kept, got %d", MaximumEvictionEscalations, len(recordedEscalations))
+	}
+	if strings.HasPrefix(recordedEscalations[0], "default/old-pod-0=") {
+		t.Error("the oldest escalation should've been dropped")
+	}
+	if !strings.HasPrefix(recordedEscalations[len(recordedEscalations)-1], "default/pod=") {
+		t.Error("the new escalation should've been recorded last, got", recordedEscalations[len(recordedEscalations)-1])
+	}
+}
+
+func TestGetPodDeletionTimeout(t *testing.T) {
+	pod := k8stest.CreateTestPod("pod", "node", "100m", "100Mi", false, v1.PodRunning)
+	if timeout := getPodDeletionTimeout(&drain.Helper{GracePeriodSeconds: -1}, pod); timeout != 30*time.Second+PodDeletionTimeoutMargin {
+		t.Errorf("expected the default termination grace period plus the margin, got %s", timeout)
+	}
+	gracePeriodSeconds := int64(120)
+	pod.Spec.TerminationGracePeriodSeconds = &gracePeriodSeconds
+	if timeout := getPodDeletionTimeout(&drain.Helper{GracePeriodSeconds: -1}, pod); timeout != 120*time.Second+PodDeletionTimeoutMargin {
+		t.Errorf("expected the termination grace period of the pod plus the margin, got %s", timeout)
+	}
+	if timeout := getPodDeletionTimeout(&drain.Helper{GracePeriodSeconds: 10}, pod); timeout != 10*time.Second+PodDeletionTimeoutMargin {
+		t.Errorf("expected the grace period of the drainer plus the margin, got %s", timeout)
+	}
+}
+
+func TestKubernetesClient_evictOrDeletePods_whenEvictionIsRejectedAndNamespaceIsNotEligibleForDeletion(t *testing.T) {
+	EvictionInitialBackoff = 5 * time.Millisecond
+	defer func() {
+		EvictionInitialBackoff = 5 * time.Second
+	}()
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	pod := k8stest.CreateTestPod("pod", node.Name, "100m", "100Mi", false, v1.PodRunning)
+	pod.SetNamespace("default")
+	clientSet, getNumberOfEvictionsAttempted := newFakeClientSetRejectingEvictions(&node, &pod)
+	client := NewKubernetesClient(clientSet)
+
+	drainer := &drain.Helper{Ctx: context.TODO(), Client: clientSet, GracePeriodSeconds: -1}
+	isNamespaceEligibleForDeletionFallback := func(namespace string) bool { return namespace == "batch" }
+	if err := client.evictOrDeletePods(context.TODO(), drainer, node.Name, []v1.Pod{pod}, 20*time.Millisecond, isNamespaceEligibleForDeletionFallback); err == nil {
+		t.Error("should've returned an error, because the pod couldn't be evicted and its namespace isn't eligible for deletion")
+	}
+	if getNumberOfEvictionsAttempted() < 2 {
+		t.Error("the eviction should've been retried")
+	}
+	if _, err := clientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{}); err != nil {
+		t.Error("pod shouldn't have been deleted, because its namespace isn't eligible for deletion")
+	}
+	updatedNode, _ := clientSet.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{})
+	if _, ok := updatedNode.Annotations[EvictionEscalationsAnnotationKey]; ok {
+		t.Errorf("no escalation should've been recorded in the %s annotation", EvictionEscalationsAnnotationKey)
+	}
+}
@@ -0,0 +1,337 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// RolloutRestartedAtAnnotationKey is the annotation used by `kubectl rollout restart` to trigger a rollout
+	RolloutRestartedAtAnnotationKey = "kubectl.kubernetes.io/restartedAt"
+
+	// MigrationStrategyScaleUp temporarily increases the replicas of the Deployments that have pods on the node
+	MigrationStrategyScaleUp MigrationStrategy = "scale-up"
+
+	// MigrationStrategyRolloutRestart triggers a rollout restart of the Deployments that have pods on the node
+	MigrationStrategyRolloutRestart MigrationStrategy = "rollout-restart"
+)
+
+// MigrationStrategy is the way the pods owned by Deployments are moved away from a node by MigrateDeploymentPods
+type MigrationStrategy string
+
+var (
+	// MigrationPollInterval is the interval at which the pods of the Deployments being migrated are checked
+	MigrationPollInterval = 5 * time.Second
+)
+
+// MigrateDeploymentPods moves the pods owned by Deployments away from a node before said node gets drained, and
+// waits until the replacement pods are ready on the updated nodes.
+//
+// The node must be cordoned beforehand, otherwise the replacement pods could be scheduled on the very node the
+// pods are being moved away from.
+//
+// Returns the Deployments whose number of replicas has been increased, if any, which should be passed to
+// RestoreDeploymentReplicas once the node has been drained. Note that this is returned even if an error occurred.
+func MigrateDeploymentPods(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node, updatedNodes []*v1.Node, strategy MigrationStrategy, timeout time.Duration) ([]types.NamespacedName, error) {
+	numberOfPodsByDeployment, err := getNumberOfPodsByDeploymentInNode(ctx, kubernetesClient, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	updatedNodeNames := make(map[string]bool)
+	for _, updatedNode := range updatedNodes {
+		updatedNodeNames[updatedNode.Name] = true
+	}
+	var scaledUpDeployments []types.NamespacedName
+	// Maps each scaled up deployment to the number of replicas it had before being scaled up
+	originalReplicasByDeployment := make(map[types.NamespacedName]int32)
+	for deploymentName, numberOfPods := range numberOfPodsByDeployment {
+		switch strategy {
+		case MigrationStrategyScaleUp:
+			log.Printf("[%s][MIGRATION] Increasing replicas of deployment %s by %d", node.Name, deploymentName, numberOfPods)
+			originalReplicas, err := scaleUpDeployment(ctx, kubernetesClient, deploymentName, node.Name, numberOfPods)
+			if err != nil {
+				return scaledUpDeployments, fmt.Errorf("unable to scale up deployment %s: %v", deploymentName, err)
+			}
+			scaledUpDeployments = append(scaledUpDeployments, deploymentName)
+			originalReplicasByDeployment[deploymentName] = originalReplicas
+		case MigrationStrategyRolloutRestart:
+			log.Printf("[%s][MIGRATION] Restarting deployment %s", node.Name, deploymentName)
+			if err := restartDeployment(ctx, kubernetesClient, deploymentName); err != nil {
+				return scaledUpDeployments, fmt.Errorf("unable to restart deployment %s: %v", deploymentName, err)
+			}
+		default:
+			return scaledUpDeployments, fmt.Errorf("unsupported migration strategy '%s'", strategy)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for deploymentName, numberOfPods := range numberOfPodsByDeployment {
+		for {
+			migrated, err := isDeploymentMigrated(ctx, kubernetesClient, deploymentName, node.Name, updatedNodeNames, strategy, numberOfPods, originalReplicasByDeployment[deploymentName])
+			if err != nil {
+				return scaledUpDeployments, err
+			}
+			if migrated {
+				log.Printf("[%s][MIGRATION] Replacement pods of deployment %s are ready", node.Name, deploymentName)
+				break
+			}
+			if time.Now().After(deadline) {
+				return scaledUpDeployments, fmt.Errorf("timed out after %s waiting for the replacement pods of deployment %s to be ready", timeout, deploymentName)
+			}
+			if err := Sleep(ctx, MigrationPollInterval); err != nil {
+				return scaledUpDeployments, err
+			}
+		}
+	}
+	return scaledUpDeployments, nil
+}
+
+// RestoreDeploymentReplicas removes the replicas added to the given Deployments by MigrateDeploymentPods for a given
+// node.
+//
+// Since the pods of a Deployment may be migrated away from several nodes at the same time, the number of replicas
+// added for each node is tracked separately, and only the increment of the given node is subtracted from the current
+// number of replicas, so that the changes made to the Deployment by others in the meantime are preserved.
+func RestoreDeploymentReplicas(ctx context.Context, kubernetesClient KubernetesClientApi, nodeName string, deploymentNames []types.NamespacedName) error {
+	var lastErr error
+	for _, deploymentName := range deploymentNames {
+		var replicas int32
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			deployment, err := kubernetesClient.GetDeployment(ctx, deploymentName.Namespace, deploymentName.Name)
+			if err != nil {
+				return err
+			}
+			increments, err := parseDeploymentIncrements(deployment.Annotations[DeploymentIncrementsAnnotationKey])
+			if err != nil {
+				return err
+			}
+			increment, ok := increments[nodeName]
+			if !ok {
+				replicas = -1
+				return nil
+			}
+			delete(increments, nodeName)
+			replicas = getDeploymentReplicas(deployment) - int32(increment)
+			if replicas < 0 {
+				replicas = 0
+			}
+			deployment.Spec.Replicas = &replicas
+			if len(increments) == 0 {
+				delete(deployment.Annotations, DeploymentOriginalReplicasAnnotationKey)
+				delete(deployment.Annotations, DeploymentIncrementsAnnotationKey)
+			} else {
+				deployment.Annotations[DeploymentIncrementsAnnotationKey] = formatDeploymentIncrements(increments)
+			}
+			return kubernetesClient.UpdateDeployment(ctx, deployment)
+		})
+		if err != nil {
+			lastErr = fmt.Errorf("unable to restore replicas of deployment %s: %v", deploymentName, err)
+			continue
+		}
+		if replicas != -1 {
+			log.Printf("[%s][MIGRATION] Restored replicas of deployment %s to %d", nodeName, deploymentName, replicas)
+		}
+	}
+	return lastErr
+}
+
+// scaleUpDeployment increases the number of replicas of a deployment by the number of pods migrated away from a
+// given node, and persists both the original number of replicas and the increment of each node in annotations.
+// If increments are already persisted, it means that the pods of the deployment are being migrated away from another
+// node at the same time, or that a previous migration was interrupted before the replicas could be restored, in which
+// case the original number of replicas is the current number of replicas without these increments.
+//
+// Returns the original number of replicas
+func scaleUpDeployment(ctx context.Context, kubernetesClient KubernetesClientApi, deploymentName types.NamespacedName, nodeName string, increment int) (int32, error) {
+	var originalReplicas int32
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := kubernetesClient.GetDeployment(ctx, deploymentName.Namespace, deploymentName.Name)
+		if err != nil {
+			return err
+		}
+		increments, err := parseDeploymentIncrements(deployment.Annotations[DeploymentIncrementsAnnotationKey])
+		if err != nil {
+			return err
+		}
+		originalReplicas = getDeploymentReplicas(deployment) - int32(sumDeploymentIncrements(increments))
+		// The increment of the node is replaced rather than added to, so that retrying the migration of a node
+		// doesn't scale the deployment up further
+		replicas := getDeploymentReplicas(deployment) - int32(increments[nodeName]) + int32(increment)
+		increments[nodeName] = increment
+		if deployment.Annotations == nil {
+			deployment.Annotations = make(map[string]string)
+		}
+		deployment.Annotations[DeploymentOriginalReplicasAnnotationKey] = strconv.Itoa(int(originalReplicas))
+		deployment.Annotations[DeploymentIncrementsAnnotationKey] = formatDeploymentIncrements(increments)
+		deployment.Spec.Replicas = &replicas
+		return kubernetesClient.UpdateDeployment(ctx, deployment)
+	})
+	return originalReplicas, err
+}
+
+// getDeploymentReplicas returns the number of replicas of a deployment, which defaults to 1
+func getDeploymentReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return *deployment.Spec.Replicas
+}
+
+// restartDeployment triggers a rollout of a deployment the same way `kubectl rollout restart` does
+func restartDeployment(ctx context.Context, kubernetesClient KubernetesClientApi, deploymentName types.NamespacedName) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := kubernetesClient.GetDeployment(ctx, deploymentName.Namespace, deploymentName.Name)
+		if err != nil {
+			return err
+		}
+		if deployment.Spec.Template.Annotations == nil {
+			deployment.Spec.Template.Annotations = make(map[string]string)
+		}
+		deployment.Spec.Template.Annotations[RolloutRestartedAtAnnotationKey] = time.Now().Format(time.RFC3339)
+		return kubernetesClient.UpdateDeployment(ctx, deployment)
+	})
+}
+
+// parseDeploymentIncrements parses the comma-separated list of nodeName=increment pairs stored in the
+// DeploymentIncrementsAnnotationKey annotation of a deployment
+func parseDeploymentIncrements(value string) (map[string]int, error) {
+	increments := make(map[string]int)
+	if len(value) == 0 {
+		return increments, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid increment '%s' in annotation %s, must be in the format nodeName=increment", pair, DeploymentIncrementsAnnotationKey)
+		}
+		increment, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid increment '%s' in annotation %s: %v", pair, DeploymentIncrementsAnnotationKey, err)
+		}
+		increments[parts[0]] = increment
+	}
+	return increments, nil
+}
+
+// formatDeploymentIncrements formats the increment of each node into a list that can be parsed by
+// parseDeploymentIncrements
+func formatDeploymentIncrements(increments map[string]int) string {
+	var pairs []string
+	for nodeName, increment := range increments {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", nodeName, increment))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// sumDeploymentIncrements returns the total number of replicas added to a deployment across all nodes
+func sumDeploymentIncrements(increments map[string]int) int {
+	sum := 0
+	for _, increment := range increments {
+		sum += increment
+	}
+	return sum
+}
+
+// isDeploymentMigrated checks whether the replacement pods of a deployment are ready on the updated nodes
+func isDeploymentMigrated(ctx context.Context, kubernetesClient KubernetesClientApi, deploymentName types.NamespacedName, nodeName string, updatedNodeNames map[string]bool, strategy MigrationStrategy, numberOfPodsInNode int, originalReplicas int32) (bool, error) {
+	deployment, err := kubernetesClient.GetDeployment(ctx, deploymentName.Namespace, deploymentName.Name)
+	if err != nil {
+		return false, fmt.Errorf("unable to get deployment %s: %v", deploymentName, err)
+	}
+	pods, err := getPodsOfDeployment(ctx, kubernetesClient, deployment)
+	if err != nil {
+		return false, err
+	}
+	if strategy == MigrationStrategyScaleUp {
+		// There must be at least as many ready pods on the updated nodes as there are pods on the node, and the
+		// deployment must have its original number of replicas ready without counting the pods on the node
+		numberOfReadyPodsOutsideNode := 0
+		for _, pod := range pods {
+			if pod.DeletionTimestamp == nil && pod.Spec.NodeName != nodeName && IsPodReady(&pod) {
+				numberOfReadyPodsOutsideNode++
+			}
+		}
+		return countReadyPodsInNodes(pods, updatedNodeNames) >= numberOfPodsInNode && numberOfReadyPodsOutsideNode >= int(originalReplicas), nil
+	}
+	// The rollout must be complete, none of the deployment's pods may be left on the node, and there must be at least
+	// as many ready pods on the updated nodes as there were pods on the node, since the replacement pods may otherwise
+	// have been scheduled on other outdated nodes
+	replicas := getDeploymentReplicas(deployment)
+	if deployment.Status.ObservedGeneration < deployment.Generation || deployment.Status.UpdatedReplicas != replicas || deployment.Status.AvailableReplicas != replicas || deployment.Status.Replicas != replicas {
+		return false, nil
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName == nodeName && pod.DeletionTimestamp == nil {
+			return false, nil
+		}
+	}
+	return countReadyPodsInNodes(pods, updatedNodeNames) >= numberOfPodsInNode, nil
+}
+
+// getNumberOfPodsByDeploymentInNode counts the number of running pods owned by each deployment in a given node
+func getNumberOfPodsByDeploymentInNode(ctx context.Context, kubernetesClient KubernetesClientApi, nodeName string) (map[types.NamespacedName]int, error) {
+	podsInNode, err := kubernetesClient.GetPodsInNode(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	numberOfPodsByDeployment := make(map[types.NamespacedName]int)
+	for _, pod := range podsInNode {
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded || pod.DeletionTimestamp != nil {
+			continue
+		}
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil || owner.Kind != "ReplicaSet" {
+			continue
+		}
+		replicaSet, err := kubernetesClient.GetReplicaSet(ctx, pod.Namespace, owner.Name)
+		if err != nil {
+			log.Printf("[%s][MIGRATION] Unable to get ReplicaSet %s/%s of pod %s: %v", nodeName, pod.Namespace, owner.Name, pod.Name, err)
+			continue
+		}
+		if replicaSetOwner := metav1.GetControllerOf(replicaSet); replicaSetOwner != nil && replicaSetOwner.Kind == "Deployment" {
+			numberOfPodsByDeployment[types.NamespacedName{Namespace: pod.Namespace, Name: replicaSetOwner.Name}]++
+		}
+	}
+	return numberOfPodsByDeployment, nil
+}
+
+// getPodsOfDeployment retrieves the pods matching the selector of a given deployment
+func getPodsOfDeployment(ctx context.Context, kubernetesClient KubernetesClientApi, deployment *appsv1.Deployment) ([]v1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector for deployment %s/%s: %v", deployment.Namespace, deployment.Name, err)
+	}
+	return kubernetesClient.GetPodsByLabelSelector(ctx, deployment.Namespace, selector.String())
+}
+
+// countReadyPodsInNodes counts the number of ready pods scheduled on any of the given nodes
+func countReadyPodsInNodes(pods []v1.Pod, nodeNames map[string]bool) int {
+	count := 0
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && nodeNames[pod.Spec.NodeName] && IsPodReady(&pod) {
+			count++
+		}
+	}
+	return count
+}
+
+// IsPodReady checks whether a pod has the PodReady condition set to true
+func IsPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func createTestDeploymentPod(name, nodeName, replicaSetName string, ready bool) v1.Pod {
+	pod := k8stest.CreateTestPod(name, nodeName, "100m", "100Mi", false, v1.PodRunning)
+	isController := true
+	pod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "ReplicaSet", Name: replicaSetName, Controller: &isController}})
+	pod.SetLabels(map[string]string{"app": "test"})
+	if ready {
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	}
+	return pod
+}
+
+func TestMigrateDeploymentPods_withScaleUpStrategy(t *testing.T) {
+	oldNode := k8stest.CreateTestNode("old-node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", "us-west-2b", "i-07550830aef9e4179", "1000m", "1000Mi")
+	oldNodePod := createTestDeploymentPod("old-pod-1", oldNode.Name, "replica-set", true)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod})
+	mockKubernetesClient.ReplicaSets["replica-set"] = k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.Deployments["deployment"] = k8stest.CreateTestDeployment("deployment", 1, map[string]string{"app": "test"})
+
+	// The replacement pod will never be created by the mock, so the migration is expected to time out
+	scaledUpDeployments, err := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode}, MigrationStrategyScaleUp, 0)
+	if err == nil {
+		t.Error("migration should've timed out, because the replacement pod never became ready")
+	}
+	if len(scaledUpDeployments) != 1 {
+		t.Fatal("deployment should've been scaled up")
+	}
+	deployment := mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("deployment should've been scaled up to 2 replicas, but has %d", *deployment.Spec.Replicas)
+	}
+	if deployment.Annotations[DeploymentOriginalReplicasAnnotationKey] != "1" {
+		t.Error("the original number of replicas should've been persisted in an annotation")
+	}
+
+	// Once the replacement pod is ready on the updated node, the migration should succeed
+	mockKubernetesClient.Pods["new-pod-1"] = createTestDeploymentPod("new-pod-1", newNode.Name, "replica-set", true)
+	_, err = MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode}, MigrationStrategyScaleUp, 0)
+	if err != nil {
+		t.Error("migration shouldn't have failed, but got", err)
+	}
+	deployment = mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("deployment should've been scaled up using the original replicas persisted in the annotation, but has %d replicas", *deployment.Spec.Replicas)
+	}
+
+	if err := RestoreDeploymentReplicas(context.TODO(), mockKubernetesClient, oldNode.Name, scaledUpDeployments); err != nil {
+		t.Error("shouldn't have failed to restore replicas, but got", err)
+	}
+	deployment = mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 1 {
+		t.Errorf("deployment should've been restored to 1 replica, but has %d", *deployment.Spec.Replicas)
+	}
+	if _, ok := deployment.Annotations[DeploymentOriginalReplicasAnnotationKey]; ok {
+		t.Error("annotation should've been removed after restoring the replicas")
+	}
+}
+
+func TestMigrateDeploymentPods_withScaleUpStrategyOnMultipleNodesInParallel(t *testing.T) {
+	firstOldNode := k8stest.CreateTestNode("old-node-1", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	secondOldNode := k8stest.CreateTestNode("old-node-2", "us-west-2a", "i-0b22a22eec53b9321", "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", "us-west-2b", "i-07550830aef9e4179", "1000m", "1000Mi")
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode, newNode}, []v1.Pod{
+		createTestDeploymentPod("old-pod-1", firstOldNode.Name, "replica-set", true),
+		createTestDeploymentPod("old-pod-2", secondOldNode.Name, "replica-set", true),
+		createTestDeploymentPod("old-pod-3", secondOldNode.Name, "replica-set", true),
+	})
+	mockKubernetesClient.ReplicaSets["replica-set"] = k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.Deployments["deployment"] = k8stest.CreateTestDeployment("deployment", 3, map[string]string{"app": "test"})
+
+	firstScaledUpDeployments, _ := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &firstOldNode, []*v1.Node{&newNode}, MigrationStrategyScaleUp, 0)
+	secondScaledUpDeployments, _ := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &secondOldNode, []*v1.Node{&newNode}, MigrationStrategyScaleUp, 0)
+	deployment := mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 6 {
+		t.Errorf("deployment should've been scaled up by 1 for the first node and by 2 for the second node, but has %d replicas", *deployment.Spec.Replicas)
+	}
+
+	// The migration of the second node is still in flight, so only the replica added for the first node is removed
+	if err := RestoreDeploymentReplicas(context.TODO(), mockKubernetesClient, firstOldNode.Name, firstScaledUpDeployments); err != nil {
+		t.Error("shouldn't have failed to restore replicas, but got", err)
+	}
+	deployment = mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 5 {
+		t.Errorf("only the replica added for the first node should've been removed, but the deployment has %d replicas", *deployment.Spec.Replicas)
+	}
+	if deployment.Annotations[DeploymentOriginalReplicasAnnotationKey] != "3" || deployment.Annotations[DeploymentIncrementsAnnotationKey] != "old-node-2=2" {
+		t.Error("the annotations should've been kept until the migration of the second node is over, got", deployment.Annotations)
+	}
+
+	if err := RestoreDeploymentReplicas(context.TODO(), mockKubernetesClient, secondOldNode.Name, secondScaledUpDeployments); err != nil {
+		t.Error("shouldn't have failed to restore replicas, but got", err)
+	}
+	deployment = mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("deployment should've been restored to 3 replicas, but has %d", *deployment.Spec.Replicas)
+	}
+	if _, ok := deployment.Annotations[DeploymentIncrementsAnnotationKey]; ok {
+		t.Error("annotation should've been removed after restoring the replicas")
+	}
+}
+
+func TestScaleUpDeployment_whenUpdateConflicts(t *testing.T) {
+	deployment := k8stest.CreateTestDeployment("deployment", 1, map[string]string{"app": "test"})
+	clientSet := fake.NewSimpleClientset(&deployment)
+	conflicts := 0
+	clientSet.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts < 2 {
+			conflicts++
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, deployment.Name, nil)
+		}
+		return false, nil, nil
+	})
+	client := NewKubernetesClient(clientSet)
+	deploymentName := types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}
+
+	if _, err := scaleUpDeployment(context.TODO(), client, deploymentName, "old-node", 1); err != nil {
+		t.Fatal("the update should've been retried after the conflicts, but got", err)
+	}
+	if conflicts != 2 {
+		t.Errorf("expected 2 conflicts, got %d", conflicts)
+	}
+	updatedDeployment, _ := client.GetDeployment(context.TODO(), deployment.Namespace, deployment.Name)
+	if *updatedDeployment.Spec.Replicas != 2 {
+		t.Errorf("deployment should've been scaled up to 2 replicas, but has %d", *updatedDeployment.Spec.Replicas)
+	}
+
+	conflicts = 0
+	if err := RestoreDeploymentReplicas(context.TODO(), client, "old-node", []types.NamespacedName{deploymentName}); err != nil {
+		t.Fatal("the update should've been retried after the conflicts, but got", err)
+	}
+	updatedDeployment, _ = client.GetDeployment(context.TODO(), deployment.Namespace, deployment.Name)
+	if *updatedDeployment.Spec.Replicas != 1 {
+		t.Errorf("deployment should've been restored to 1 replica, but has %d", *updatedDeployment.Spec.Replicas)
+	}
+}
+
+func TestMigrateDeploymentPods_withRolloutRestartStrategy(t *testing.T) {
+	oldNode := k8stest.CreateTestNode("old-node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", "us-west-2b", "i-07550830aef9e4179", "1000m", "1000Mi")
+	oldNodePod := createTestDeploymentPod("old-pod-1", oldNode.Name, "replica-set", true)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod})
+	mockKubernetesClient.ReplicaSets["replica-set"] = k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.Deployments["deployment"] = k8stest.CreateTestDeployment("deployment", 1, map[string]string{"app": "test"})
+
+	scaledUpDeployments, err := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode}, MigrationStrategyRolloutRestart, 0)
+	if err == nil {
+		t.Error("migration should've timed out, because the rollout never completed")
+	}
+	if len(scaledUpDeployments) != 0 {
+		t.Error("no deployments should've been scaled up when using the rollout-restart strategy")
+	}
+	deployment := mockKubernetesClient.Deployments["deployment"]
+	if _, ok := deployment.Spec.Template.Annotations[RolloutRestartedAtAnnotationKey]; !ok {
+		t.Error("deployment should've been restarted")
+	}
+	if *deployment.Spec.Replicas != 1 {
+		t.Error("deployment shouldn't have been scaled up when using the rollout-restart strategy")
+	}
+}
+
+func TestMigrateDeploymentPods_withRolloutRestartStrategyWhenRolloutIsComplete(t *testing.T) {
+	oldNode := k8stest.CreateTestNode("old-node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	otherOldNode := k8stest.CreateTestNode("old-node-2", "us-west-2a", "i-0b22a22eec53b9321", "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", "us-west-2b", "i-07550830aef9e4179", "1000m", "1000Mi")
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, otherOldNode, newNode}, []v1.Pod{createTestDeploymentPod("old-pod-1", oldNode.Name, "replica-set", true)})
+	mockKubernetesClient.ReplicaSets["replica-set"] = k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	deployment := k8stest.CreateTestDeployment("deployment", 1, map[string]string{"app": "test"})
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	mockKubernetesClient.Deployments["deployment"] = deployment
+	oldNodePods, _ := getNumberOfPodsByDeploymentInNode(context.TODO(), mockKubernetesClient, oldNode.Name)
+	deploymentName := types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}
+	updatedNodeNames := map[string]bool{newNode.Name: true}
+
+	// The rollout is complete, but the replacement pod has been scheduled on another outdated node
+	delete(mockKubernetesClient.Pods, "old-pod-1")
+	mockKubernetesClient.Pods["new-pod-1"] = createTestDeploymentPod("new-pod-1", otherOldNode.Name, "replica-set", true)
+	migrated, err := isDeploymentMigrated(context.TODO(), mockKubernetesClient, deploymentName, oldNode.Name, updatedNodeNames, MigrationStrategyRolloutRestart, oldNodePods[deploymentName], 0)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if migrated {
+		t.Error("deployment shouldn't have been migrated, because the replacement pod isn't on an updated node")
+	}
+
+	mockKubernetesClient.Pods["new-pod-1"] = createTestDeploymentPod("new-pod-1", newNode.Name, "replica-set", true)
+	migrated, err = isDeploymentMigrated(context.TODO(), mockKubernetesClient, deploymentName, oldNode.Name, updatedNodeNames, MigrationStrategyRolloutRestart, oldNodePods[deploymentName], 0)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if !migrated {
+		t.Error("deployment should've been migrated, because the replacement pod is ready on an updated node")
+	}
+}
+
+func TestRestoreDeploymentReplicas_whenReplicasChangedDuringMigration(t *testing.T) {
+	oldNode := k8stest.CreateTestNode("old-node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", "us-west-2b", "i-07550830aef9e4179", "1000m", "1000Mi")
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{createTestDeploymentPod("old-pod-1", oldNode.Name, "replica-set", true)})
+	mockKubernetesClient.ReplicaSets["replica-set"] = k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.Deployments["deployment"] = k8stest.CreateTestDeployment("deployment", 1, map[string]string{"app": "test"})
+
+	scaledUpDeployments, _ := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode}, MigrationStrategyScaleUp, 0)
+	// The deployment is scaled up by someone else while the node is being migrated
+	deployment := mockKubernetesClient.Deployments["deployment"]
+	replicas := int32(5)
+	deployment.Spec.Replicas = &replicas
+	mockKubernetesClient.Deployments["deployment"] = deployment
+
+	if err := RestoreDeploymentReplicas(context.TODO(), mockKubernetesClient, oldNode.Name, scaledUpDeployments); err != nil {
+		t.Error("shouldn't have failed to restore replicas, but got", err)
+	}
+	deployment = mockKubernetesClient.Deployments["deployment"]
+	if *deployment.Spec.Replicas != 4 {
+		t.Errorf("only the replica added for the node should've been removed, but the deployment has %d replicas", *deployment.Spec.Replicas)
+	}
+	// Restoring the replicas of the same node again must not remove another replica
+	if err := RestoreDeploymentReplicas(context.TODO(), mockKubernetesClient, oldNode.Name, scaledUpDeployments); err != nil {
+		t.Error("shouldn't have failed to restore replicas, but got", err)
+	}
+	if deployment = mockKubernetesClient.Deployments["deployment"]; *deployment.Spec.Replicas != 4 {
+		t.Errorf("the replicas should've already been restored, but the deployment has %d replicas", *deployment.Spec.Replicas)
+	}
+}
+
+func TestMigrateDeploymentPods_withPodsNotOwnedByDeployments(t *testing.T) {
+	oldNode := k8stest.CreateTestNode("old-node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	oldNodePod := k8stest.CreateTestPod("old-pod-1", oldNode.Name, "100m", "100Mi", true, v1.PodRunning)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{oldNodePod})
+
+	scaledUpDeployments, err := MigrateDeploymentPods(context.TODO(), mockKubernetesClient, &oldNode, nil, MigrationStrategyScaleUp, 0)
+	if err != nil {
+		t.Error("shouldn't have returned an error, but got", err)
+	}
+	if len(scaledUpDeployments) != 0 || mockKubernetesClient.Counter["UpdateDeployment"] != 0 {
+		t.Error("there are no pods owned by deployments in the node, so nothing should've been scaled up")
+	}
+}
@@ -0,0 +1,156 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodeGroupRolloutsPath is the path of the cluster-scoped NodeGroupRollout resources
+var nodeGroupRolloutsPath = "/apis/" + v1alpha1.Group + "/" + v1alpha1.Version + "/" + v1alpha1.Resource
+
+// GetNodeGroupRollouts retrieves all NodeGroupRollouts
+func (k *KubernetesClient) GetNodeGroupRollouts(ctx context.Context) ([]v1alpha1.NodeGroupRollout, error) {
+	data, err := k.client.CoreV1().RESTClient().Get().AbsPath(nodeGroupRolloutsPath).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var nodeGroupRolloutList v1alpha1.NodeGroupRolloutList
+	if err := json.Unmarshal(data, &nodeGroupRolloutList); err != nil {
+		return nil, err
+	}
+	return nodeGroupRolloutList.Items, nil
+}
+
+// UpdateNodeGroupRolloutStatus updates the status of a NodeGroupRollout, and returns the updated NodeGroupRollout
+func (k *KubernetesClient) UpdateNodeGroupRolloutStatus(ctx context.Context, nodeGroupRollout *v1alpha1.NodeGroupRollout) (*v1alpha1.NodeGroupRollout, error) {
+	nodeGroupRollout.APIVersion = v1alpha1.Group + "/" + v1alpha1.Version
+	nodeGroupRollout.Kind = v1alpha1.Kind
+	body, err := json.Marshal(nodeGroupRollout)
+	if err != nil {
+		return nil, err
+	}
+	data, err := k.client.CoreV1().RESTClient().Put().AbsPath(nodeGroupRolloutsPath, nodeGroupRollout.Name, "status").Body(body).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	updatedNodeGroupRollout := &v1alpha1.NodeGroupRollout{}
+	if err := json.Unmarshal(data, updatedNodeGroupRollout); err != nil {
+		return nil, err
+	}
+	return updatedNodeGroupRollout, nil
+}
+
+// NodeGroupRolloutInformer watches the NodeGroupRollouts through the same REST path as GetNodeGroupRollouts, since
+// there is no typed client for them
+type NodeGroupRolloutInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewNodeGroupRolloutInformer creates a new NodeGroupRolloutInformer
+//
+// Start must be called for the event handlers to be called
+func NewNodeGroupRolloutInformer(client kubernetes.Interface) *NodeGroupRolloutInformer {
+	restClient := client.CoreV1().RESTClient()
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				data, err := restClient.Get().AbsPath(nodeGroupRolloutsPath).VersionedParams(&options, scheme.ParameterCodec).DoRaw(context.TODO())
+				if err != nil {
+					return nil, err
+				}
+				nodeGroupRolloutList := &v1alpha1.NodeGroupRolloutList{}
+				if err := json.Unmarshal(data, nodeGroupRolloutList); err != nil {
+					return nil, err
+				}
+				return nodeGroupRolloutList, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.Watch = true
+				stream, err := restClient.Get().AbsPath(nodeGroupRolloutsPath).VersionedParams(&options, scheme.ParameterCodec).Stream(context.TODO())
+				if err != nil {
+					return nil, err
+				}
+				return watch.NewStreamWatcher(
+					&nodeGroupRolloutWatchDecoder{stream: stream, decoder: json.NewDecoder(stream)},
+					apierrors.NewClientErrorReporter(http.StatusInternalServerError, http.MethodGet, "ClientWatchDecoding"),
+				), nil
+			},
+		},
+		&v1alpha1.NodeGroupRollout{}, 0, cache.Indexers{},
+	)
+	return &NodeGroupRolloutInformer{informer: informer}
+}
+
+// nodeGroupRolloutWatchDecoder decodes the events of a watch of NodeGroupRollouts, which are sent as one JSON object
+// per event
+type nodeGroupRolloutWatchDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *nodeGroupRolloutWatchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	var object runtime.Object = &v1alpha1.NodeGroupRollout{}
+	if event.Type == watch.Error {
+		object = &metav1.Status{}
+	}
+	if err := json.Unmarshal(event.Object, object); err != nil {
+		return "", nil, err
+	}
+	return event.Type, object, nil
+}
+
+func (d *nodeGroupRolloutWatchDecoder) Close() {
+	_ = d.stream.Close()
+}
+
+// AddEventHandler registers a function to call whenever a NodeGroupRollout is added or deleted, or whenever its spec
+// changes, which excludes the status updates of this application. The previous version of the NodeGroupRollout is
+// passed along for updates, and is nil otherwise.
+//
+// Handlers must be registered before calling Start
+func (i *NodeGroupRolloutInformer) AddEventHandler(handler func(oldNodeGroupRollout, nodeGroupRollout *v1alpha1.NodeGroupRollout)) {
+	i.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(object interface{}) { handleNodeGroupRolloutEvent(handler, object) },
+		UpdateFunc: func(oldObject, object interface{}) {
+			oldNodeGroupRollout, oldOk := oldObject.(*v1alpha1.NodeGroupRollout)
+			nodeGroupRollout, ok := object.(*v1alpha1.NodeGroupRollout)
+			// The generation is only incremented when the spec changes, because the status is a subresource
+			if oldOk && ok && oldNodeGroupRollout.Generation != nodeGroupRollout.Generation {
+				handler(oldNodeGroupRollout, nodeGroupRollout)
+			}
+		},
+		DeleteFunc: func(object interface{}) { handleNodeGroupRolloutEvent(handler, object) },
+	})
+}
+
+func handleNodeGroupRolloutEvent(handler func(oldNodeGroupRollout, nodeGroupRollout *v1alpha1.NodeGroupRollout), object interface{}) {
+	if tombstone, ok := object.(cache.DeletedFinalStateUnknown); ok {
+		object = tombstone.Obj
+	}
+	if nodeGroupRollout, ok := object.(*v1alpha1.NodeGroupRollout); ok {
+		handler(nil, nodeGroupRollout)
+	}
+}
+
+// Start starts watching the NodeGroupRollouts until the context is done
+func (i *NodeGroupRolloutInformer) Start(ctx context.Context) {
+	go i.informer.Run(ctx.Done())
+}
@@ -0,0 +1,120 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestKubernetesClient_NodeGroupRollouts(t *testing.T) {
+	var updatedNodeGroupRollout v1alpha1.NodeGroupRollout
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch {
+		case request.Method == http.MethodGet && request.URL.Path == "/apis/rollingupdate.twinproduction.github.io/v1alpha1/nodegrouprollouts":
+			_, _ = writer.Write([]byte(`{"apiVersion":"rollingupdate.twinproduction.github.io/v1alpha1","kind":"NodeGroupRolloutList","items":[{"metadata":{"name":"payments","resourceVersion":"1"},"spec":{"autoScalingGroupNames":["asg"],"maxUnavailable":"25%","drainTimeout":"10m"}}]}`))
+		case request.Method == http.MethodPut && request.URL.Path == "/apis/rollingupdate.twinproduction.github.io/v1alpha1/nodegrouprollouts/payments/status":
+			body, _ := ioutil.ReadAll(request.Body)
+			if err := json.Unmarshal(body, &updatedNodeGroupRollout); err != nil {
+				t.Error("Unexpected body:", string(body))
+			}
+			updatedNodeGroupRollout.ResourceVersion = "2"
+			_ = json.NewEncoder(writer).Encode(updatedNodeGroupRollout)
+		default:
+			t.Errorf("Unexpected request %s %s", request.Method, request.URL.Path)
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewKubernetesClient(clientSet)
+
+	nodeGroupRollouts, err := client.GetNodeGroupRollouts(context.TODO())
+	if err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	if len(nodeGroupRollouts) != 1 || nodeGroupRollouts[0].Name != "payments" {
+		t.Fatalf("Should've returned the NodeGroupRollout payments, got %+v", nodeGroupRollouts)
+	}
+	if nodeGroupRollouts[0].Spec.MaxUnavailable.String() != "25%" || nodeGroupRollouts[0].Spec.DrainTimeout.Duration.Minutes() != 10 {
+		t.Errorf("Spec wasn't decoded properly, got %+v", nodeGroupRollouts[0].Spec)
+	}
+
+	nodeGroupRollouts[0].Status.Phase = v1alpha1.PhaseInProgress
+	nodeGroupRollouts[0].Status.LastUpdateTime = &metav1.Time{}
+	nodeGroupRollout, err := client.UpdateNodeGroupRolloutStatus(context.TODO(), &nodeGroupRollouts[0])
+	if err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	if updatedNodeGroupRollout.Kind != v1alpha1.Kind || updatedNodeGroupRollout.APIVersion != "rollingupdate.twinproduction.github.io/v1alpha1" {
+		t.Errorf("The kind and API version should've been sent, got %s and %s", updatedNodeGroupRollout.Kind, updatedNodeGroupRollout.APIVersion)
+	}
+	if nodeGroupRollout.Status.Phase != v1alpha1.PhaseInProgress || nodeGroupRollout.ResourceVersion != "2" {
+		t.Errorf("Should've returned the updated NodeGroupRollout, got %+v", nodeGroupRollout)
+	}
+}
+
+func TestNodeGroupRolloutInformer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet || request.URL.Path != "/apis/rollingupdate.twinproduction.github.io/v1alpha1/nodegrouprollouts" {
+			t.Errorf("Unexpected request %s %s", request.Method, request.URL.Path)
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if request.URL.Query().Get("watch") != "true" {
+			_, _ = writer.Write([]byte(`{"apiVersion":"rollingupdate.twinproduction.github.io/v1alpha1","kind":"NodeGroupRolloutList","metadata":{"resourceVersion":"1"},"items":[{"metadata":{"name":"payments","resourceVersion":"1","generation":1},"spec":{"autoScalingGroupNames":["asg"]}}]}`))
+			return
+		}
+		// The status update doesn't change the generation, unlike the spec update that follows it
+		_, _ = writer.Write([]byte(`{"type":"MODIFIED","object":{"metadata":{"name":"payments","resourceVersion":"2","generation":1},"spec":{"autoScalingGroupNames":["asg"]},"status":{"phase":"InProgress"}}}` + "\n"))
+		_, _ = writer.Write([]byte(`{"type":"MODIFIED","object":{"metadata":{"name":"payments","resourceVersion":"3","generation":2},"spec":{"autoScalingGroupNames":["asg"],"paused":true}}}` + "\n"))
+		writer.(http.Flusher).Flush()
+		<-request.Context().Done()
+	}))
+	defer server.Close()
+	clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	informer := NewNodeGroupRolloutInformer(clientSet)
+	events := make(chan [2]*v1alpha1.NodeGroupRollout, 10)
+	informer.AddEventHandler(func(oldNodeGroupRollout, nodeGroupRollout *v1alpha1.NodeGroupRollout) {
+		events <- [2]*v1alpha1.NodeGroupRollout{oldNodeGroupRollout, nodeGroupRollout}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informer.Start(ctx)
+
+	for i, expectedGeneration := range []int64{1, 2} {
+		select {
+		case event := <-events:
+			if event[1].Name != "payments" || event[1].Generation != expectedGeneration {
+				t.Errorf("Event %d should've been for generation %d of NodeGroupRollout payments, got %+v", i, expectedGeneration, event[1])
+			}
+			if expectedGeneration == 1 && event[0] != nil {
+				t.Error("The previous version of an added NodeGroupRollout should've been nil")
+			}
+			if expectedGeneration == 2 && (event[0] == nil || event[0].Generation != 1 || !event[1].Spec.Paused) {
+				t.Errorf("The update should've been passed along with the previous version, got %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d should've been received", i)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("The status update shouldn't have resulted in an event, got %+v", event[1])
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReadinessRequirements are the requirements that an updated node must meet to be considered ready to accept the
+// pods of outdated nodes
+type ReadinessRequirements struct {
+	// StartupTaints are the keys of the taints that must have been removed from the node
+	StartupTaints []string
+
+	// RequiredDaemonSets are the DaemonSets, in the format "namespace/name", that must have a ready pod on the node
+	RequiredDaemonSets []string
+
+	// SoakDuration is the minimum duration for which the node must have been ready
+	SoakDuration time.Duration
+}
+
+// GetNodeReadyCondition returns the NodeReady condition of a node, or nil if the node doesn't have one
+func GetNodeReadyCondition(node *v1.Node) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == v1.NodeReady {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// GetNodeNotReadyReason checks whether a node meets the given readiness requirements
+//
+// Returns the reason why the node isn't ready, or an empty string if the node is ready
+func GetNodeNotReadyReason(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node, requirements ReadinessRequirements) (string, error) {
+	readyCondition := GetNodeReadyCondition(node)
+	if readyCondition == nil {
+		return "node has no Ready condition", nil
+	}
+	if readyCondition.Status != v1.ConditionTrue {
+		return fmt.Sprintf("node's Ready condition is %s", readyCondition.Status), nil
+	}
+	for _, taint := range node.Spec.Taints {
+		for _, startupTaint := range requirements.StartupTaints {
+			if taint.Key == startupTaint {
+				return fmt.Sprintf("node still has startup taint %s", taint.Key), nil
+			}
+		}
+	}
+	if len(requirements.RequiredDaemonSets) > 0 {
+		podsInNode, err := kubernetesClient.GetPodsInNode(ctx, node.Name)
+		if err != nil {
+			return "", err
+		}
+		for _, requiredDaemonSet := range requirements.RequiredDaemonSets {
+			if !hasReadyDaemonSetPod(podsInNode, requiredDaemonSet) {
+				return fmt.Sprintf("DaemonSet %s has no ready pod on node", requiredDaemonSet), nil
+			}
+		}
+	}
+	if readySince := time.Since(readyCondition.LastTransitionTime.Time); readySince < requirements.SoakDuration {
+		return fmt.Sprintf("node has only been ready for %s, which is less than %s", readySince.Round(time.Second), requirements.SoakDuration), nil
+	}
+	return "", nil
+}
+
+// hasReadyDaemonSetPod checks whether any of the given pods is a ready pod owned by a DaemonSet in the format
+// "namespace/name"
+func hasReadyDaemonSetPod(pods []v1.Pod, daemonSet string) bool {
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil || owner.Kind != "DaemonSet" || pod.Namespace+"/"+owner.Name != strings.TrimSpace(daemonSet) {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return true
+			}
+		}
+	}
+	return false
+}
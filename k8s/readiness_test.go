@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetNodeNotReadyReason(t *testing.T) {
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	daemonSetPod := k8stest.CreateTestPod("cni-pod", node.Name, "100m", "100Mi", true, v1.PodRunning)
+	daemonSetPod.SetNamespace("kube-system")
+	isController := true
+	daemonSetPod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "DaemonSet", Name: "cni", Controller: &isController}})
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, []v1.Pod{daemonSetPod})
+	requirements := ReadinessRequirements{
+		StartupTaints:      []string{"node.cilium.io/agent-not-ready"},
+		RequiredDaemonSets: []string{"kube-system/cni"},
+		SoakDuration:       time.Minute,
+	}
+	scenarios := []struct {
+		name          string
+		prepare       func()
+		expectedReady bool
+	}{
+		{
+			name:          "no-ready-condition",
+			prepare:       func() {},
+			expectedReady: false,
+		},
+		{
+			name: "ready-condition-not-last",
+			prepare: func() {
+				node.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour))},
+					{Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse},
+				}
+				node.Spec.Taints = []v1.Taint{{Key: "node.cilium.io/agent-not-ready", Effect: v1.TaintEffectNoSchedule}}
+			},
+			expectedReady: false, // because of the startup taint
+		},
+		{
+			name: "daemon-set-pod-not-ready",
+			prepare: func() {
+				node.Spec.Taints = nil
+			},
+			expectedReady: false,
+		},
+		{
+			name: "daemon-set-pod-ready",
+			prepare: func() {
+				daemonSetPod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+				mockKubernetesClient.Pods[daemonSetPod.Name] = daemonSetPod
+			},
+			expectedReady: true,
+		},
+		{
+			name: "soak-duration-not-reached",
+			prepare: func() {
+				node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-30 * time.Second))
+			},
+			expectedReady: false,
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			scenario.prepare()
+			notReadyReason, err := GetNodeNotReadyReason(context.TODO(), mockKubernetesClient, &node, requirements)
+			if err != nil {
+				t.Fatal("shouldn't have returned an error, but got", err)
+			}
+			if ready := len(notReadyReason) == 0; ready != scenario.expectedReady {
+				t.Errorf("expected ready to be %v, got %v (reason: %s)", scenario.expectedReady, ready, notReadyReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package k8s
+
+import (
+	"context"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// HandlerPrefix is the prefix of every annotation and taint managed by this application
+	HandlerPrefix = "aws-eks-asg-rolling-update-handler/"
+
+	// UnschedulableTaintKey is the taint added by Kubernetes to cordoned nodes
+	UnschedulableTaintKey = "node.kubernetes.io/unschedulable"
+
+	// OutdatedTaintKey is the taint added to outdated nodes so that new pods prefer updated nodes
+	OutdatedTaintKey = HandlerPrefix + "outdated"
+)
+
+// rollingUpdateAnnotationKeys are the annotations that represent the state of a node's rollout.
+//
+// RollingUpdatePausedAnnotationKey isn't one of them, because a node may be paused by an operator, or because the
+// verification of its evicted workloads timed out, and it must remain paused until the annotation is removed
+var rollingUpdateAnnotationKeys = []string{
+	RollingUpdateStartedTimestampAnnotationKey,
+	RollingUpdateDrainedTimestampAnnotationKey,
+	RollingUpdateTerminatedTimestampAnnotationKey,
+	EvictedWorkloadsAnnotationKey,
+	VerificationTimedOutAtAnnotationKey,
+	CordonedAnnotationKey,
+	TaintsAnnotationKey,
+}
+
+// HasRollingUpdateAnnotations checks whether a node has any of the annotations representing the state of a rollout
+func HasRollingUpdateAnnotations(node *v1.Node) bool {
+	for _, key := range rollingUpdateAnnotationKeys {
+		if _, ok := node.Annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RollbackNode reverts the changes made to a node during its rollout: the node is uncordoned if it was cordoned by
+// this application, the taints recorded as added by this application are removed and the rollout annotations are
+// cleared. A paused node remains paused.
+//
+// Cordons and taints applied by anything else (e.g. an operator cordoning the node before the rollout) are left as is.
+func RollbackNode(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node) error {
+	taintKeysToRemove := make(map[string]bool)
+	for _, key := range GetTaintKeysAddedToNode(node) {
+		taintKeysToRemove[key] = true
+	}
+	if node.Annotations[CordonedAnnotationKey] == "true" {
+		node.Spec.Unschedulable = false
+		taintKeysToRemove[UnschedulableTaintKey] = true
+	}
+	var taints []v1.Taint
+	for _, taint := range node.Spec.Taints {
+		if taintKeysToRemove[taint.Key] {
+			continue
+		}
+		taints = append(taints, taint)
+	}
+	node.Spec.Taints = taints
+	for _, key := range rollingUpdateAnnotationKeys {
+		delete(node.Annotations, key)
+	}
+	return kubernetesClient.UpdateNode(ctx, node)
+}
@@ -1,12 +1,38 @@
 package k8s
 
 import (
+	"context"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
 )
 
+// Resources represents an amount of cpu and memory, both in milli-units
+type Resources struct {
+	Cpu    int64
+	Memory int64
+}
+
+// CanFit checks whether the given resources fit in the resources available
+func (r Resources) CanFit(needed Resources) bool {
+	return r.Cpu-needed.Cpu >= 0 && r.Memory-needed.Memory >= 0
+}
+
+// Add returns the sum of the resources and the given resources
+func (r Resources) Add(other Resources) Resources {
+	return Resources{Cpu: r.Cpu + other.Cpu, Memory: r.Memory + other.Memory}
+}
+
+// Subtract returns the resources left after subtracting the given resources
+func (r Resources) Subtract(needed Resources) Resources {
+	return Resources{Cpu: r.Cpu - needed.Cpu, Memory: r.Memory - needed.Memory}
+}
+
 // CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes calculates the resources available in the target nodes
 // and compares them with the resources that would be required if the old node were to be drained
 //
@@ -16,14 +42,23 @@ import (
 // while the latter is definitely possible, it would slow down the process by quite a bit. In a way, this is
 // the beauty of co-existing with the cluster autoscaler; an extra node will be spun up to handle the leftovers,
 // if any.
-func CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(kubernetesClient KubernetesClientApi, oldNode *v1.Node, targetNodes []*v1.Node) bool {
-	totalAvailableTargetCpu := int64(0)
-	totalAvailableTargetMemory := int64(0)
-	// Get resources available in target nodes
+func CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(ctx context.Context, kubernetesClient KubernetesClientApi, oldNode *v1.Node, targetNodes []*v1.Node) bool {
+	resourcesNeeded, err := CalculateResourcesNeededToTransferAllPodsInNode(ctx, kubernetesClient, oldNode)
+	if err != nil {
+		log.Printf("Unable to determine resources needed for old node, assuming that enough resources are available")
+		return true
+	}
+	return CalculateResourcesAvailableInNodes(ctx, kubernetesClient, targetNodes).CanFit(resourcesNeeded)
+}
+
+// CalculateResourcesAvailableInNodes calculates the sum of the resources that have not been requested by any pod
+// in the target nodes
+func CalculateResourcesAvailableInNodes(ctx context.Context, kubernetesClient KubernetesClientApi, targetNodes []*v1.Node) Resources {
+	var available Resources
 	for _, targetNode := range targetNodes {
 		availableTargetCpu := targetNode.Status.Allocatable.Cpu().MilliValue()
 		availableTargetMemory := targetNode.Status.Allocatable.Memory().MilliValue()
-		podsInNode, err := kubernetesClient.GetPodsInNode(targetNode.Name)
+		podsInNode, err := kubernetesClient.GetPodsInNode(ctx, targetNode.Name)
 		if err != nil {
 			continue
 		}
@@ -39,20 +74,24 @@ func CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(kubernetesClient Kube
 				}
 				if container.Resources.Requests.Memory() != nil {
 					// Subtract the memory request of the pod from the node's total allocatable memory
-					totalAvailableTargetMemory -= container.Resources.Requests.Memory().MilliValue()
+					availableTargetMemory -= container.Resources.Requests.Memory().MilliValue()
 				}
 			}
 		}
-		totalAvailableTargetCpu += availableTargetCpu
-		totalAvailableTargetMemory += availableTargetMemory
+		available.Cpu += availableTargetCpu
+		available.Memory += availableTargetMemory
 	}
-	cpuNeeded := int64(0)
-	memoryNeeded := int64(0)
+	return available
+}
+
+// CalculateResourcesNeededToTransferAllPodsInNode calculates the sum of the resources requested by the pods in the
+// old node that would need to be rescheduled elsewhere if the old node were to be drained
+func CalculateResourcesNeededToTransferAllPodsInNode(ctx context.Context, kubernetesClient KubernetesClientApi, oldNode *v1.Node) (Resources, error) {
+	var needed Resources
 	// Get resources requested in old node
-	podsInNode, err := kubernetesClient.GetPodsInNode(oldNode.Name)
+	podsInNode, err := kubernetesClient.GetPodsInNode(ctx, oldNode.Name)
 	if err != nil {
-		log.Printf("Unable to determine resources needed for old node, assuming that enough resources are available")
-		return true
+		return needed, err
 	}
 	for _, podInNode := range podsInNode {
 		// Skip pods that have terminated (e.g. "Evicted" pods that haven't been cleaned up)
@@ -72,34 +111,117 @@ func CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(kubernetesClient Kube
 		}
 		for _, container := range podInNode.Spec.Containers {
 			if container.Resources.Requests.Cpu() != nil {
-				// Subtract the cpu request of the pod from the node's total allocatable
-				cpuNeeded += container.Resources.Requests.Cpu().MilliValue()
+				needed.Cpu += container.Resources.Requests.Cpu().MilliValue()
 			}
 			if container.Resources.Requests.Memory() != nil {
-				// Subtract the cpu request of the pod from the node's total allocatable
-				memoryNeeded += container.Resources.Requests.Memory().MilliValue()
+				needed.Memory += container.Resources.Requests.Memory().MilliValue()
 			}
 		}
 	}
-	leftOverCpu := totalAvailableTargetCpu - cpuNeeded
-	leftOverMemory := totalAvailableTargetMemory - memoryNeeded
-	return leftOverCpu >= 0 && leftOverMemory >= 0
+	return needed, nil
 }
 
 // AnnotateNodeByAwsAutoScalingInstance adds an annotation to the Kubernetes node represented by a given AWS instance
-func AnnotateNodeByAwsAutoScalingInstance(kubernetesClient KubernetesClientApi, instance *autoscaling.Instance, key, value string) error {
-	node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(instance)
+//
+// If the update conflicts because the node that was read is outdated, which happens when nodes are read from a cache
+// that hasn't received the latest update of the node yet, the node is read again from the API server and the
+// annotation is retried
+func AnnotateNodeByAwsAutoScalingInstance(ctx context.Context, kubernetesClient KubernetesClientApi, instance *autoscaling.Instance, key, value string) error {
+	node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, instance)
 	if err != nil {
 		return err
 	}
-	annotations := node.GetAnnotations()
-	if currentValue := annotations[key]; currentValue != value {
+	nodeName := node.Name
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if node == nil {
+			if node, err = kubernetesClient.GetNode(ctx, nodeName); err != nil {
+				return err
+			}
+		}
+		annotations := node.GetAnnotations()
+		if currentValue := annotations[key]; currentValue == value {
+			return nil
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
 		annotations[key] = value
 		node.SetAnnotations(annotations)
-		err = kubernetesClient.UpdateNode(node)
-		if err != nil {
+		if err := kubernetesClient.UpdateNode(ctx, node); err != nil {
+			node = nil
 			return err
 		}
+		return nil
+	})
+}
+
+// CordonNode marks a node as unschedulable, and annotates it with CordonedAnnotationKey so that RollbackNode only
+// uncordons the nodes that were cordoned by this application
+func CordonNode(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node) error {
+	if node.Spec.Unschedulable {
+		return nil
+	}
+	node.Spec.Unschedulable = true
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[CordonedAnnotationKey] = "true"
+	return kubernetesClient.UpdateNode(ctx, node)
+}
+
+// TaintNode adds a taint to a node, or updates its effect if the node already has a taint with the same key.
+// The key of the taints added are recorded in TaintsAnnotationKey so that RollbackNode only removes those
+func TaintNode(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node, key string, effect v1.TaintEffect) error {
+	for i, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			if taint.Effect == effect {
+				return nil
+			}
+			node.Spec.Taints[i].Effect = effect
+			return kubernetesClient.UpdateNode(ctx, node)
+		}
+	}
+	now := metav1.Now()
+	node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: key, Effect: effect, TimeAdded: &now})
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	taintKeys := GetTaintKeysAddedToNode(node)
+	for _, taintKey := range taintKeys {
+		if taintKey == key {
+			return kubernetesClient.UpdateNode(ctx, node)
+		}
+	}
+	node.Annotations[TaintsAnnotationKey] = strings.Join(append(taintKeys, key), ",")
+	return kubernetesClient.UpdateNode(ctx, node)
+}
+
+// GetTaintKeysAddedToNode returns the keys of the taints that were added to a node by TaintNode
+func GetTaintKeysAddedToNode(node *v1.Node) []string {
+	value := node.Annotations[TaintsAnnotationKey]
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// GetInstanceIdFromNode extracts the id of the AWS instance of a node from its providerID, which is in the format
+// aws:///<availability-zone>/<instance-id>
+func GetInstanceIdFromNode(node *v1.Node) string {
+	if !strings.HasPrefix(node.Spec.ProviderID, "aws://") {
+		return ""
+	}
+	return node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:]
+}
+
+// Sleep pauses for the given duration, or until the context is done, in which case the context's error is returned
+func Sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	return nil
 }
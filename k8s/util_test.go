@@ -1,6 +1,7 @@
 package k8s
 
 import (
+	"context"
 	"testing"
 
 	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
@@ -17,7 +18,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(t *testing.T) {
 	oldNodePod := k8stest.CreateTestPod("old-pod-1", oldNode.Name, "100m", "100Mi", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
 	if !hasEnoughResources {
 		t.Error("should've had enough space in node")
 	}
@@ -33,7 +34,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_whenNotEnoughSpac
 	newNodePod := k8stest.CreateTestPod("new-pod-1", newNode.Name, "900m", "200Mi", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod, newNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
 	if hasEnoughResources {
 		t.Error("shouldn't have had enough space in node")
 	}
@@ -51,7 +52,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_withMultiplePods(
 	newNodePod := k8stest.CreateTestPod("new-pod-1", newNode.Name, "200m", "200Mi", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodeFirstPod, oldNodeSecondPod, oldNodeThirdPod, newNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&newNode})
 	if hasEnoughResources {
 		t.Error("shouldn't have had enough space in node")
 	}
@@ -69,7 +70,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_withMultipleTarge
 	oldNodeThirdPod := k8stest.CreateTestPod("old-node-pod-3", oldNode.Name, "500m", "0", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, firstNewNode, secondNewNode}, []v1.Pod{oldNodeFirstPod, oldNodeSecondPod, oldNodeThirdPod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{&firstNewNode, &secondNewNode})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&firstNewNode, &secondNewNode})
 	if !hasEnoughResources {
 		t.Error("should've had enough space in node")
 	}
@@ -89,7 +90,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_withPodsSpreadAcr
 	oldNodeThirdPod := k8stest.CreateTestPod("old-node-pod-3", oldNode.Name, "0", "500Mi", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, firstNewNode, secondNewNode}, []v1.Pod{oldNodeFirstPod, oldNodeSecondPod, oldNodeThirdPod, firstNewNodePod, secondNewNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{&firstNewNode, &secondNewNode})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{&firstNewNode, &secondNewNode})
 	if hasEnoughResources {
 		t.Error("shouldn't have had enough space in node")
 	}
@@ -103,7 +104,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_withNoTargetNodes
 	oldNodePod := k8stest.CreateTestPod("old-node-pod-1", oldNode.Name, "500Mi", "500Mi", false, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{oldNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{})
 	if hasEnoughResources {
 		t.Error("there's no target nodes; there definitely shouldn't have been enough space")
 	}
@@ -114,7 +115,7 @@ func TestCheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes_withNoTargetNodes
 	oldNodePod := k8stest.CreateTestPod("old-node-pod-1", oldNode.Name, "500Mi", "500Mi", true, v1.PodRunning)
 	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{oldNodePod})
 
-	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(mockKubernetesClient, &oldNode, []*v1.Node{})
+	hasEnoughResources := CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(context.TODO(), mockKubernetesClient, &oldNode, []*v1.Node{})
 	if !hasEnoughResources {
 		t.Error("there's no target nodes, but the only pods in the old node are from daemon sets")
 	}
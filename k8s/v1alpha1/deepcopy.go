@@ -0,0 +1,93 @@
+package v1alpha1
+
+import "k8s.io/apimachinery/pkg/runtime"
+
+// DeepCopy returns a deep copy of the NodeGroupRollout
+func (in *NodeGroupRollout) DeepCopy() *NodeGroupRollout {
+	if in == nil {
+		return nil
+	}
+	out := &NodeGroupRollout{TypeMeta: in.TypeMeta}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return out
+}
+
+// DeepCopyObject returns a deep copy of the NodeGroupRollout as a runtime.Object, so that it can be cached by an
+// informer
+func (in *NodeGroupRollout) DeepCopyObject() runtime.Object {
+	if out := in.DeepCopy(); out != nil {
+		return out
+	}
+	return nil
+}
+
+// DeepCopy returns a deep copy of the NodeGroupRolloutList
+func (in *NodeGroupRolloutList) DeepCopy() *NodeGroupRolloutList {
+	if in == nil {
+		return nil
+	}
+	out := &NodeGroupRolloutList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]NodeGroupRollout, len(in.Items))
+		for i := range in.Items {
+			out.Items[i] = *in.Items[i].DeepCopy()
+		}
+	}
+	return out
+}
+
+// DeepCopyObject returns a deep copy of the NodeGroupRolloutList as a runtime.Object
+func (in *NodeGroupRolloutList) DeepCopyObject() runtime.Object {
+	if out := in.DeepCopy(); out != nil {
+		return out
+	}
+	return nil
+}
+
+// DeepCopyInto copies the NodeGroupRolloutSpec into out
+func (in *NodeGroupRolloutSpec) DeepCopyInto(out *NodeGroupRolloutSpec) {
+	*out = *in
+	if in.AutoScalingGroupNames != nil {
+		out.AutoScalingGroupNames = append([]string(nil), in.AutoScalingGroupNames...)
+	}
+	if in.AutoScalingGroupTags != nil {
+		out.AutoScalingGroupTags = make(map[string]string, len(in.AutoScalingGroupTags))
+		for key, value := range in.AutoScalingGroupTags {
+			out.AutoScalingGroupTags[key] = value
+		}
+	}
+	if in.MaxUnavailable != nil {
+		maxUnavailable := *in.MaxUnavailable
+		out.MaxUnavailable = &maxUnavailable
+	}
+	if in.MaxSurge != nil {
+		maxSurge := *in.MaxSurge
+		out.MaxSurge = &maxSurge
+	}
+	if in.DrainTimeout != nil {
+		drainTimeout := *in.DrainTimeout
+		out.DrainTimeout = &drainTimeout
+	}
+	if in.MaintenanceWindows != nil {
+		out.MaintenanceWindows = append([]MaintenanceWindow(nil), in.MaintenanceWindows...)
+	}
+}
+
+// DeepCopyInto copies the NodeGroupRolloutStatus into out
+func (in *NodeGroupRolloutStatus) DeepCopyInto(out *NodeGroupRolloutStatus) {
+	*out = *in
+	out.LastErrorTime = in.LastErrorTime.DeepCopy()
+	out.StartedAt = in.StartedAt.DeepCopy()
+	out.CompletedAt = in.CompletedAt.DeepCopy()
+	out.LastUpdateTime = in.LastUpdateTime.DeepCopy()
+	if in.AutoScalingGroups != nil {
+		out.AutoScalingGroups = make([]NodeGroupRolloutAutoScalingGroupStatus, len(in.AutoScalingGroups))
+		for i := range in.AutoScalingGroups {
+			out.AutoScalingGroups[i] = in.AutoScalingGroups[i]
+			out.AutoScalingGroups[i].CurrentNodes = append([]string(nil), in.AutoScalingGroups[i].CurrentNodes...)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Package v1alpha1 contains the types of the NodeGroupRollout custom resource
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	Group    = "rollingupdate.twinproduction.github.io"
+	Version  = "v1alpha1"
+	Kind     = "NodeGroupRollout"
+	Resource = "nodegrouprollouts"
+
+	PhaseInProgress = "InProgress"
+	PhasePaused     = "Paused"
+	PhaseCompleted  = "Completed"
+	PhaseFailed     = "Failed"
+)
+
+// NodeGroupRollout selects ASGs and overrides the settings used to roll their nodes
+type NodeGroupRollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodeGroupRolloutSpec   `json:"spec"`
+	Status NodeGroupRolloutStatus `json:"status,omitempty"`
+}
+
+// NodeGroupRolloutList is a list of NodeGroupRollouts
+type NodeGroupRolloutList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NodeGroupRollout `json:"items"`
+}
+
+// NodeGroupRolloutSpec is the desired configuration of the rolling update of the selected ASGs
+type NodeGroupRolloutSpec struct {
+	// AutoScalingGroupNames selects the ASGs with one of the given names
+	AutoScalingGroupNames []string `json:"autoScalingGroupNames,omitempty"`
+	// AutoScalingGroupTags selects the ASGs that have every one of the given tags
+	AutoScalingGroupTags map[string]string `json:"autoScalingGroupTags,omitempty"`
+
+	// MaxUnavailable overrides config.MaxUnavailable, either as a number of nodes or as a percentage
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// MaxSurge is the number of nodes by which the desired capacity is increased whenever the updated nodes don't
+	// have enough resources for the pods of the next outdated node, either as a number of nodes or as a percentage
+	// of the desired capacity. Defaults to 1
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+	// DrainTimeout is the maximum duration of the drain of a single node, after which the drain is retried during
+	// the next execution
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+	// MigrationStrategy overrides config.MigrationStrategy
+	MigrationStrategy string `json:"migrationStrategy,omitempty"`
+	// Paused prevents the rolling update of the selected ASGs from replacing more nodes
+	Paused bool `json:"paused,omitempty"`
+	// MaintenanceWindows overrides config.MaintenanceWindows
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+	// MaintenanceWindowClosePolicy overrides config.MaintenanceWindowClosePolicy
+	MaintenanceWindowClosePolicy string `json:"maintenanceWindowClosePolicy,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period during which the rollout of new nodes may be started
+type MaintenanceWindow struct {
+	// Schedule is the cron expression of when the maintenance window opens
+	Schedule string `json:"schedule"`
+	// Duration is how long the maintenance window stays open after opening
+	Duration metav1.Duration `json:"duration"`
+	// Timezone is the name of the timezone in which the schedule is evaluated, which overrides
+	// config.MaintenanceWindowTimezone
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// NodeGroupRolloutStatus is the progress of the rolling update of the selected ASGs
+type NodeGroupRolloutStatus struct {
+	Phase              string `json:"phase,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	OutdatedInstances  int    `json:"outdatedInstances"`
+	UpdatedInstances   int    `json:"updatedInstances"`
+	// CurrentNode is the comma-separated list of the nodes being replaced
+	CurrentNode    string       `json:"currentNode,omitempty"`
+	LastError      string       `json:"lastError,omitempty"`
+	LastErrorTime  *metav1.Time `json:"lastErrorTime,omitempty"`
+	StartedAt      *metav1.Time `json:"startedAt,omitempty"`
+	CompletedAt    *metav1.Time `json:"completedAt,omitempty"`
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+
+	AutoScalingGroups []NodeGroupRolloutAutoScalingGroupStatus `json:"autoScalingGroups,omitempty"`
+}
+
+// NodeGroupRolloutAutoScalingGroupStatus is the progress of the rolling update of a single selected ASG
+type NodeGroupRolloutAutoScalingGroupStatus struct {
+	Name              string   `json:"name"`
+	Phase             string   `json:"phase"`
+	OutdatedInstances int      `json:"outdatedInstances"`
+	UpdatedInstances  int      `json:"updatedInstances"`
+	CurrentNodes      []string `json:"currentNodes,omitempty"`
+	LastError         string   `json:"lastError,omitempty"`
+}
@@ -0,0 +1,35 @@
+package k8s
+
+import (
+	"context"
+
+	"k8s.io/api/core/v1"
+)
+
+// GetVolumesAttachedToNode returns the volumes that are still attached to a given node, based on both the
+// VolumeAttachments referencing the node and the node's status.volumesAttached
+func GetVolumesAttachedToNode(ctx context.Context, kubernetesClient KubernetesClientApi, node *v1.Node) ([]string, error) {
+	volumeAttachments, err := kubernetesClient.GetVolumeAttachmentsInNode(ctx, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	var volumes []string
+	alreadyAdded := make(map[string]bool)
+	for _, volumeAttachment := range volumeAttachments {
+		volume := volumeAttachment.Name
+		if volumeAttachment.Spec.Source.PersistentVolumeName != nil {
+			volume = *volumeAttachment.Spec.Source.PersistentVolumeName
+		}
+		if !alreadyAdded[volume] {
+			alreadyAdded[volume] = true
+			volumes = append(volumes, volume)
+		}
+	}
+	for _, attachedVolume := range node.Status.VolumesAttached {
+		if !alreadyAdded[string(attachedVolume.Name)] {
+			alreadyAdded[string(attachedVolume.Name)] = true
+			volumes = append(volumes, string(attachedVolume.Name))
+		}
+	}
+	return volumes, nil
+}
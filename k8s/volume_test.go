@@ -0,0 +1,34 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	"k8s.io/api/core/v1"
+)
+
+func TestGetVolumesAttachedToNode(t *testing.T) {
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	otherNode := k8stest.CreateTestNode("other-node", "us-west-2a", "i-07550830aef9e1481", "1000m", "1000Mi")
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node, otherNode}, []v1.Pod{})
+
+	volumes, err := GetVolumesAttachedToNode(context.TODO(), mockKubernetesClient, &node)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(volumes) != 0 {
+		t.Errorf("expected no volumes, got %v", volumes)
+	}
+
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", node.Name, "pv-1")
+	mockKubernetesClient.VolumeAttachments["csi-2"] = k8stest.CreateTestVolumeAttachment("csi-2", otherNode.Name, "pv-2")
+	node.Status.VolumesAttached = []v1.AttachedVolume{{Name: "kubernetes.io/csi/ebs.csi.aws.com^vol-1"}}
+	volumes, err = GetVolumesAttachedToNode(context.TODO(), mockKubernetesClient, &node)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(volumes) != 2 || volumes[0] != "pv-1" || volumes[1] != "kubernetes.io/csi/ebs.csi.aws.com^vol-1" {
+		t.Errorf("expected the VolumeAttachment of the node and the volume in its status, got %v", volumes)
+	}
+}
@@ -0,0 +1,121 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RollingUpdatePausedEventReason is the reason of the event created when a rolling update is paused
+	RollingUpdatePausedEventReason = "RollingUpdatePaused"
+)
+
+// Workload represents a controller whose pods can be rescheduled on other nodes once evicted
+type Workload struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// String returns the workload in the format "Kind/namespace/name"
+func (w Workload) String() string {
+	return fmt.Sprintf("%s/%s/%s", w.Kind, w.Namespace, w.Name)
+}
+
+// ParseWorkloads parses a comma-separated list of workloads in the format "Kind/namespace/name"
+func ParseWorkloads(value string) ([]Workload, error) {
+	var workloads []Workload
+	if len(value) == 0 {
+		return workloads, nil
+	}
+	for _, workloadValue := range strings.Split(value, ",") {
+		parts := strings.Split(workloadValue, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid workload '%s', must be in the format Kind/namespace/name", workloadValue)
+		}
+		workloads = append(workloads, Workload{Kind: parts[0], Namespace: parts[1], Name: parts[2]})
+	}
+	return workloads, nil
+}
+
+// FormatWorkloads formats a list of workloads into a comma-separated list that can be parsed by ParseWorkloads
+func FormatWorkloads(workloads []Workload) string {
+	var values []string
+	for _, workload := range workloads {
+		values = append(values, workload.String())
+	}
+	return strings.Join(values, ",")
+}
+
+// GetWorkloadsInNode retrieves the ReplicaSets and StatefulSets that own at least one running pod in a given node
+func GetWorkloadsInNode(ctx context.Context, kubernetesClient KubernetesClientApi, nodeName string) ([]Workload, error) {
+	podsInNode, err := kubernetesClient.GetPodsInNode(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	var workloads []Workload
+	alreadyAdded := make(map[Workload]bool)
+	for _, pod := range podsInNode {
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			continue
+		}
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil || (owner.Kind != "ReplicaSet" && owner.Kind != "StatefulSet") {
+			continue
+		}
+		workload := Workload{Kind: owner.Kind, Namespace: pod.Namespace, Name: owner.Name}
+		if !alreadyAdded[workload] {
+			alreadyAdded[workload] = true
+			workloads = append(workloads, workload)
+		}
+	}
+	return workloads, nil
+}
+
+// GetUnhealthyWorkloads returns the workloads that have less ready replicas than desired replicas.
+// Workloads that no longer exist are considered healthy.
+func GetUnhealthyWorkloads(ctx context.Context, kubernetesClient KubernetesClientApi, workloads []Workload) ([]Workload, error) {
+	var unhealthyWorkloads []Workload
+	for _, workload := range workloads {
+		var desiredReplicas, readyReplicas int32
+		switch workload.Kind {
+		case "ReplicaSet":
+			replicaSet, err := kubernetesClient.GetReplicaSet(ctx, workload.Namespace, workload.Name)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, fmt.Errorf("unable to get %s: %v", workload, err)
+			}
+			desiredReplicas, readyReplicas = getDesiredReplicas(replicaSet.Spec.Replicas), replicaSet.Status.ReadyReplicas
+		case "StatefulSet":
+			statefulSet, err := kubernetesClient.GetStatefulSet(ctx, workload.Namespace, workload.Name)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, fmt.Errorf("unable to get %s: %v", workload, err)
+			}
+			desiredReplicas, readyReplicas = getDesiredReplicas(statefulSet.Spec.Replicas), statefulSet.Status.ReadyReplicas
+		default:
+			continue
+		}
+		if readyReplicas < desiredReplicas {
+			unhealthyWorkloads = append(unhealthyWorkloads, workload)
+		}
+	}
+	return unhealthyWorkloads, nil
+}
+
+// getDesiredReplicas returns the number of desired replicas, which defaults to 1 if not specified
+func getDesiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
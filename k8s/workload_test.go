@@ -0,0 +1,67 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseWorkloads(t *testing.T) {
+	workloads := []Workload{{Kind: "ReplicaSet", Namespace: "default", Name: "web"}, {Kind: "StatefulSet", Namespace: "db", Name: "postgres"}}
+	parsedWorkloads, err := ParseWorkloads(FormatWorkloads(workloads))
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(parsedWorkloads) != 2 || parsedWorkloads[0] != workloads[0] || parsedWorkloads[1] != workloads[1] {
+		t.Errorf("expected %v, got %v", workloads, parsedWorkloads)
+	}
+	if parsedWorkloads, err = ParseWorkloads(""); err != nil || len(parsedWorkloads) != 0 {
+		t.Error("an empty value should've returned no workloads")
+	}
+	if _, err = ParseWorkloads("ReplicaSet/web"); err == nil {
+		t.Error("should've returned an error, because the workload isn't in the format Kind/namespace/name")
+	}
+}
+
+func TestGetWorkloadsInNode(t *testing.T) {
+	node := k8stest.CreateTestNode("node", "us-west-2a", "i-034fa1dfbfd35f8bb", "1000m", "1000Mi")
+	firstPod := createTestDeploymentPod("pod-1", node.Name, "replica-set", true)
+	secondPod := createTestDeploymentPod("pod-2", node.Name, "replica-set", true)
+	statefulSetPod := k8stest.CreateTestPod("stateful-pod-0", node.Name, "100m", "100Mi", false, v1.PodRunning)
+	isController := true
+	statefulSetPod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "StatefulSet", Name: "stateful", Controller: &isController}})
+	daemonSetPod := k8stest.CreateTestPod("daemon-set-pod", node.Name, "100m", "100Mi", true, v1.PodRunning)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, []v1.Pod{firstPod, secondPod, statefulSetPod, daemonSetPod})
+
+	workloads, err := GetWorkloadsInNode(context.TODO(), mockKubernetesClient, node.Name)
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(workloads) != 2 {
+		t.Errorf("expected 2 workloads, got %v", workloads)
+	}
+}
+
+func TestGetUnhealthyWorkloads(t *testing.T) {
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nil, nil)
+	replicas := int32(2)
+	replicaSet := k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	replicaSet.Spec.Replicas = &replicas
+	replicaSet.Status.ReadyReplicas = 2
+	mockKubernetesClient.ReplicaSets[replicaSet.Name] = replicaSet
+	statefulSet := appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &replicas}, Status: appsv1.StatefulSetStatus{ReadyReplicas: 1}}
+	statefulSet.SetName("stateful")
+	mockKubernetesClient.StatefulSets[statefulSet.Name] = statefulSet
+
+	unhealthyWorkloads, err := GetUnhealthyWorkloads(context.TODO(), mockKubernetesClient, []Workload{{Kind: "ReplicaSet", Name: "replica-set"}, {Kind: "StatefulSet", Name: "stateful"}})
+	if err != nil {
+		t.Fatal("shouldn't have returned an error, but got", err)
+	}
+	if len(unhealthyWorkloads) != 1 || unhealthyWorkloads[0].Name != "stateful" {
+		t.Errorf("only the StatefulSet should've been unhealthy, got %v", unhealthyWorkloads)
+	}
+}
@@ -1,27 +1,51 @@
 package k8stest
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 type MockKubernetesClient struct {
-	Counter map[string]int64
-	Nodes   map[string]v1.Node
-	Pods    map[string]v1.Pod
+	mutex sync.Mutex
+
+	Counter      map[string]int64
+	Nodes        map[string]v1.Node
+	Pods         map[string]v1.Pod
+	ReplicaSets  map[string]appsv1.ReplicaSet
+	StatefulSets map[string]appsv1.StatefulSet
+	Deployments  map[string]appsv1.Deployment
+
+	VolumeAttachments map[string]storagev1.VolumeAttachment
+	NodeGroupRollouts map[string]v1alpha1.NodeGroupRollout
+	ConfigMaps        map[string]v1.ConfigMap
 }
 
 func NewMockKubernetesClient(nodes []v1.Node, pods []v1.Pod) *MockKubernetesClient {
 	client := &MockKubernetesClient{
-		Counter: make(map[string]int64),
-		Nodes:   make(map[string]v1.Node),
-		Pods:    make(map[string]v1.Pod),
+		Counter:      make(map[string]int64),
+		Nodes:        make(map[string]v1.Node),
+		Pods:         make(map[string]v1.Pod),
+		ReplicaSets:  make(map[string]appsv1.ReplicaSet),
+		StatefulSets: make(map[string]appsv1.StatefulSet),
+		Deployments:  make(map[string]appsv1.Deployment),
+
+		VolumeAttachments: make(map[string]storagev1.VolumeAttachment),
+		NodeGroupRollouts: make(map[string]v1alpha1.NodeGroupRollout),
+		ConfigMaps:        make(map[string]v1.ConfigMap),
 	}
 	for _, node := range nodes {
 		client.Nodes[node.Name] = node
@@ -32,7 +56,9 @@ func NewMockKubernetesClient(nodes []v1.Node, pods []v1.Pod) *MockKubernetesClie
 	return client
 }
 
-func (mock *MockKubernetesClient) GetNodes() ([]v1.Node, error) {
+func (mock *MockKubernetesClient) GetNodes(_ context.Context) ([]v1.Node, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.Counter["GetNodes"]++
 	var nodes []v1.Node
 	for _, node := range mock.Nodes {
@@ -41,7 +67,9 @@ func (mock *MockKubernetesClient) GetNodes() ([]v1.Node, error) {
 	return nodes, nil
 }
 
-func (mock *MockKubernetesClient) GetPodsInNode(node string) ([]v1.Pod, error) {
+func (mock *MockKubernetesClient) GetPodsInNode(_ context.Context, node string) ([]v1.Pod, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.Counter["GetPodsInNode"]++
 	var pods []v1.Pod
 	for _, pod := range mock.Pods {
@@ -52,13 +80,34 @@ func (mock *MockKubernetesClient) GetPodsInNode(node string) ([]v1.Pod, error) {
 	return pods, nil
 }
 
-func (mock *MockKubernetesClient) GetNodeByAwsAutoScalingInstance(instance *autoscaling.Instance) (*v1.Node, error) {
+func (mock *MockKubernetesClient) GetPodsByLabelSelector(_ context.Context, namespace, labelSelector string) ([]v1.Pod, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetPodsByLabelSelector"]++
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var pods []v1.Pod
+	for _, pod := range mock.Pods {
+		if pod.Namespace == namespace && selector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func (mock *MockKubernetesClient) GetNodeByAwsAutoScalingInstance(_ context.Context, instance *autoscaling.Instance) (*v1.Node, error) {
+	mock.mutex.Lock()
 	mock.Counter["GetNodeByAwsAutoScalingInstance"]++
-	nodes, _ := mock.GetNodes()
+	mock.mutex.Unlock()
+	nodes, _ := mock.GetNodes(context.TODO())
 	return mock.FilterNodeByAutoScalingInstance(nodes, instance)
 }
 
 func (mock *MockKubernetesClient) FilterNodeByAutoScalingInstance(nodes []v1.Node, instance *autoscaling.Instance) (*v1.Node, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.Counter["FilterNodeByAutoScalingInstance"]++
 	for _, node := range nodes {
 		if node.Spec.ProviderID == fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId)) {
@@ -68,17 +117,131 @@ func (mock *MockKubernetesClient) FilterNodeByAutoScalingInstance(nodes []v1.Nod
 	return nil, errors.New("not found")
 }
 
-func (mock *MockKubernetesClient) UpdateNode(node *v1.Node) error {
+func (mock *MockKubernetesClient) GetNode(_ context.Context, name string) (*v1.Node, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetNode"]++
+	node, ok := mock.Nodes[name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &node, nil
+}
+
+func (mock *MockKubernetesClient) UpdateNode(_ context.Context, node *v1.Node) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.Counter["UpdateNode"]++
 	mock.Nodes[node.Name] = *node
 	return nil
 }
 
-func (mock *MockKubernetesClient) Drain(nodeName string, ignoreDaemonSets, deleteLocalData bool) error {
+func (mock *MockKubernetesClient) DeleteNode(_ context.Context, nodeName string) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["DeleteNode"]++
+	delete(mock.Nodes, nodeName)
+	return nil
+}
+
+func (mock *MockKubernetesClient) GetReplicaSet(_ context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetReplicaSet"]++
+	replicaSet, ok := mock.ReplicaSets[name]
+	if !ok || replicaSet.Namespace != namespace {
+		return nil, errors.New("not found")
+	}
+	return &replicaSet, nil
+}
+
+func (mock *MockKubernetesClient) GetStatefulSet(_ context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetStatefulSet"]++
+	statefulSet, ok := mock.StatefulSets[name]
+	if !ok || statefulSet.Namespace != namespace {
+		return nil, errors.New("not found")
+	}
+	return &statefulSet, nil
+}
+
+func (mock *MockKubernetesClient) GetDeployment(_ context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetDeployment"]++
+	deployment, ok := mock.Deployments[name]
+	if !ok || deployment.Namespace != namespace {
+		return nil, errors.New("not found")
+	}
+	return &deployment, nil
+}
+
+func (mock *MockKubernetesClient) UpdateDeployment(_ context.Context, deployment *appsv1.Deployment) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["UpdateDeployment"]++
+	mock.Deployments[deployment.Name] = *deployment
+	return nil
+}
+
+func (mock *MockKubernetesClient) Drain(_ context.Context, nodeName string, ignoreDaemonSets, deleteLocalData bool, _, _ time.Duration, _ func(namespace string) bool) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.Counter["Drain"]++
 	return nil
 }
 
+func (mock *MockKubernetesClient) CreateNodeEvent(_ context.Context, node *v1.Node, eventType, reason, message string) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["CreateNodeEvent"]++
+	return nil
+}
+
+func (mock *MockKubernetesClient) GetVolumeAttachmentsInNode(_ context.Context, nodeName string) ([]storagev1.VolumeAttachment, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetVolumeAttachmentsInNode"]++
+	var volumeAttachments []storagev1.VolumeAttachment
+	for _, volumeAttachment := range mock.VolumeAttachments {
+		if volumeAttachment.Spec.NodeName == nodeName {
+			volumeAttachments = append(volumeAttachments, volumeAttachment)
+		}
+	}
+	return volumeAttachments, nil
+}
+
+func (mock *MockKubernetesClient) GetConfigMap(_ context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetConfigMap"]++
+	configMap, ok := mock.ConfigMaps[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), name)
+	}
+	return configMap.DeepCopy(), nil
+}
+
+func (mock *MockKubernetesClient) GetNodeGroupRollouts(_ context.Context) ([]v1alpha1.NodeGroupRollout, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["GetNodeGroupRollouts"]++
+	var nodeGroupRollouts []v1alpha1.NodeGroupRollout
+	for _, nodeGroupRollout := range mock.NodeGroupRollouts {
+		nodeGroupRollouts = append(nodeGroupRollouts, *nodeGroupRollout.DeepCopy())
+	}
+	return nodeGroupRollouts, nil
+}
+
+func (mock *MockKubernetesClient) UpdateNodeGroupRolloutStatus(_ context.Context, nodeGroupRollout *v1alpha1.NodeGroupRollout) (*v1alpha1.NodeGroupRollout, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Counter["UpdateNodeGroupRolloutStatus"]++
+	mock.NodeGroupRollouts[nodeGroupRollout.Name] = *nodeGroupRollout.DeepCopy()
+	return nodeGroupRollout.DeepCopy(), nil
+}
+
 func CreateTestNode(name, availabilityZone, instanceId, allocatableCpu, allocatableMemory string) v1.Node {
 	node := v1.Node{
 		Spec: v1.NodeSpec{
@@ -120,3 +283,33 @@ func CreateTestPod(name, nodeName, cpuRequest, cpuMemory string, isDaemonSet boo
 	}
 	return pod
 }
+
+func CreateTestDeployment(name string, replicas int32, matchLabels map[string]string) appsv1.Deployment {
+	deployment := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: matchLabels},
+		},
+	}
+	deployment.SetName(name)
+	return deployment
+}
+
+func CreateTestReplicaSet(name, deploymentName string) appsv1.ReplicaSet {
+	replicaSet := appsv1.ReplicaSet{}
+	replicaSet.SetName(name)
+	replicaSet.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Deployment", Name: deploymentName, Controller: aws.Bool(true)}})
+	return replicaSet
+}
+
+func CreateTestVolumeAttachment(name, nodeName, persistentVolumeName string) storagev1.VolumeAttachment {
+	volumeAttachment := storagev1.VolumeAttachment{
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: "ebs.csi.aws.com",
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &persistentVolumeName},
+		},
+	}
+	volumeAttachment.SetName(name)
+	return volumeAttachment
+}
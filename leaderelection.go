@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// HealthPath is the path on which the health of the application is served
+	HealthPath = "/health"
+)
+
+// newLeaderElector creates a LeaderElector competing for the Lease config.LeaderElectionLeaseName, which calls
+// onStartedLeading once this replica has acquired the Lease.
+//
+// The identity of the replica is its hostname, which is the name of the pod when running on Kubernetes
+func newLeaderElector(client kubernetes.Interface, watchDog *leaderelection.HealthzAdaptor, onStartedLeading func(ctx context.Context)) (*leaderelection.LeaderElector, error) {
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get hostname to use as leader election identity: %v", err)
+	}
+	cfg := config.Get()
+	leaderElector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      cfg.LeaderElectionLeaseName,
+				Namespace: cfg.LeaderElectionNamespace,
+			},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration: cfg.LeaderElectionLeaseDuration,
+		RenewDeadline: cfg.LeaderElectionRenewDeadline,
+		RetryPeriod:   cfg.LeaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Acquired lease %s/%s as %s", cfg.LeaderElectionNamespace, cfg.LeaderElectionLeaseName, identity)
+				onStartedLeading(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Printf("Lost lease %s/%s", cfg.LeaderElectionNamespace, cfg.LeaderElectionLeaseName)
+			},
+			OnNewLeader: func(leaderIdentity string) {
+				if leaderIdentity != identity {
+					log.Printf("Waiting for lease %s/%s, which is currently held by %s", cfg.LeaderElectionNamespace, cfg.LeaderElectionLeaseName, leaderIdentity)
+				}
+			},
+		},
+		WatchDog: watchDog,
+		Name:     cfg.LeaderElectionLeaseName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	watchDog.SetLeaderElection(leaderElector)
+	return leaderElector, nil
+}
+
+// healthHandler reports the application as unhealthy if it is the leader, but has been unable to renew its Lease
+// for longer than the timeout of the watch dog
+func healthHandler(watchDog *leaderelection.HealthzAdaptor) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := watchDog.Check(request); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = writer.Write([]byte("ok"))
+	}
+}
+
+// leaderOnlyHandler rejects the requests received while this replica isn't the leader
+func leaderOnlyHandler(isLeader func() bool, handler http.Handler) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !isLeader() {
+			http.Error(writer, "not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+const (
+	// LifecycleActionResultContinue is the result used to complete a lifecycle action once the node has been drained
+	LifecycleActionResultContinue = "CONTINUE"
+)
+
+// HandleTerminatingInstances drains the nodes of the instances of an ASG that are waiting on the termination
+// lifecycle hook named config.LifecycleHookName, and completes their lifecycle action once they have been drained.
+//
+// This covers instances terminated by this application as well as instances terminated by anything else, such as
+// a scale-in of the ASG or the cluster-autoscaler.
+func HandleTerminatingInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group) {
+	lifecycleHookName := config.Get().LifecycleHookName
+	if len(lifecycleHookName) == 0 {
+		return
+	}
+	for _, instance := range autoScalingGroup.Instances {
+		if aws.StringValue(instance.LifecycleState) != autoscaling.LifecycleStateTerminatingWait {
+			continue
+		}
+		if !drainTerminatingInstance(ctx, kubernetesClient, autoScalingService, autoScalingGroup, instance, lifecycleHookName) {
+			// The lifecycle action is left pending, so the drain will be attempted again on the next execution
+			continue
+		}
+		log.Printf("[%s][%s] Completing lifecycle action of hook %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), lifecycleHookName)
+		if err := cloud.CompleteLifecycleAction(ctx, autoScalingService, aws.StringValue(autoScalingGroup.AutoScalingGroupName), lifecycleHookName, aws.StringValue(instance.InstanceId), LifecycleActionResultContinue); err != nil {
+			log.Printf("[%s][%s] Unable to complete lifecycle action: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+		}
+	}
+}
+
+// drainTerminatingInstance drains the node of an instance waiting on a termination lifecycle hook, unless it has
+// already been drained. The lifecycle action's heartbeat is recorded periodically while the node is being drained,
+// to prevent the lifecycle hook from timing out.
+//
+// Returns true if the node no longer needs to be drained
+func drainTerminatingInstance(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, instance *autoscaling.Instance, lifecycleHookName string) bool {
+	node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, instance)
+	if err != nil {
+		log.Printf("[%s][%s] Node of terminating instance not found, assuming that there is nothing to drain: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+		return true
+	}
+	if _, ok := node.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
+		return true
+	}
+	stopHeartbeat := make(chan struct{})
+	go recordLifecycleActionHeartbeats(ctx, autoScalingService, autoScalingGroup, instance, lifecycleHookName, stopHeartbeat)
+	defer close(stopHeartbeat)
+	log.Printf("[%s][%s] Draining node of terminating instance", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId))
+	if err := acquireDrainSlot(ctx); err != nil {
+		log.Printf("[%s][%s] Skipping because the wait for a drain slot was interrupted: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+		return false
+	}
+	drainCtx, cancelDrain := newDrainContext(ctx, autoScalingGroup)
+	err = drainNode(drainCtx, kubernetesClient, node.Name)
+	cancelDrain()
+	releaseDrainSlot()
+	if err != nil {
+		log.Printf("[%s][%s] Ran into error while draining node of terminating instance: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+		return false
+	}
+	// Only annotate if no error was encountered. The annotation is persisted even if the context has been cancelled
+	// in the meantime, so that the drain isn't done again on the next execution
+	checkpointCtx, cancel := newCheckpointContext()
+	defer cancel()
+	_ = k8s.AnnotateNodeByAwsAutoScalingInstance(checkpointCtx, kubernetesClient, instance, k8s.RollingUpdateDrainedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
+	return true
+}
+
+// recordLifecycleActionHeartbeats records the heartbeat of a lifecycle action every
+// config.LifecycleHookHeartbeatInterval until the stop channel is closed or the context is cancelled
+func recordLifecycleActionHeartbeats(ctx context.Context, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, instance *autoscaling.Instance, lifecycleHookName string, stop <-chan struct{}) {
+	if config.Get().LifecycleHookHeartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(config.Get().LifecycleHookHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cloud.RecordLifecycleActionHeartbeat(ctx, autoScalingService, aws.StringValue(autoScalingGroup.AutoScalingGroupName), lifecycleHookName, aws.StringValue(instance.InstanceId)); err != nil {
+				log.Printf("[%s][%s] Unable to record lifecycle action heartbeat: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+			}
+		}
+	}
+}
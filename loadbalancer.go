@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+var (
+	// LoadBalancerDeregistrationPollInterval is the interval at which the deregistration of an instance from its
+	// load balancers is checked
+	LoadBalancerDeregistrationPollInterval = 5 * time.Second
+
+	// elbv2Service and elbService are only set if config.WaitForLoadBalancerDeregistration is enabled
+	elbv2Service elbv2iface.ELBV2API
+	elbService   elbiface.ELBAPI
+)
+
+// deregisterFromLoadBalancers deregisters an instance from the target groups and the classic load balancers of its
+// ASG, and waits until the deregistration is complete or until the longest deregistration delay has passed.
+//
+// Returns true if the instance can be terminated
+func deregisterFromLoadBalancers(ctx context.Context, autoScalingGroup *autoscaling.Group, instance *autoscaling.Instance) bool {
+	if !config.Get().WaitForLoadBalancerDeregistration {
+		return true
+	}
+	autoScalingGroupName, instanceId := aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId)
+	var targetGroupArns, loadBalancerNames []string
+	if elbv2Service != nil {
+		targetGroupArns = aws.StringValueSlice(autoScalingGroup.TargetGroupARNs)
+	}
+	if elbService != nil {
+		loadBalancerNames = aws.StringValueSlice(autoScalingGroup.LoadBalancerNames)
+	}
+	if len(targetGroupArns) == 0 && len(loadBalancerNames) == 0 {
+		return true
+	}
+	var deregistrationDelay time.Duration
+	for _, targetGroupArn := range targetGroupArns {
+		delay, err := cloud.GetTargetGroupDeregistrationDelay(ctx, elbv2Service, targetGroupArn)
+		if err != nil {
+			log.Printf("[%s][%s] Unable to get deregistration delay, defaulting to %s: %v", autoScalingGroupName, instanceId, cloud.DefaultDeregistrationDelay, err.Error())
+			delay = cloud.DefaultDeregistrationDelay
+		}
+		if delay > deregistrationDelay {
+			deregistrationDelay = delay
+		}
+		if err := cloud.DeregisterInstanceFromTargetGroup(ctx, elbv2Service, targetGroupArn, instanceId); err != nil {
+			log.Printf("[%s][%s] Skipping termination because unable to deregister instance: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+	}
+	for _, loadBalancerName := range loadBalancerNames {
+		delay, err := cloud.GetClassicLoadBalancerDeregistrationDelay(ctx, elbService, loadBalancerName)
+		if err != nil {
+			log.Printf("[%s][%s] Unable to get connection draining timeout, defaulting to %s: %v", autoScalingGroupName, instanceId, cloud.DefaultDeregistrationDelay, err.Error())
+			delay = cloud.DefaultDeregistrationDelay
+		}
+		if delay > deregistrationDelay {
+			deregistrationDelay = delay
+		}
+		if err := cloud.DeregisterInstanceFromClassicLoadBalancer(ctx, elbService, loadBalancerName, instanceId); err != nil {
+			log.Printf("[%s][%s] Skipping termination because unable to deregister instance: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+	}
+	log.Printf("[%s][%s] Waiting up to %s for instance to be deregistered from %d target groups and %d classic load balancers", autoScalingGroupName, instanceId, deregistrationDelay, len(targetGroupArns), len(loadBalancerNames))
+	deadline := time.Now().Add(deregistrationDelay)
+	for {
+		registered, err := isInstanceRegisteredInLoadBalancers(ctx, targetGroupArns, loadBalancerNames, instanceId)
+		if err != nil {
+			log.Printf("[%s][%s] Skipping termination because unable to check whether instance is deregistered: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+		if !registered {
+			log.Printf("[%s][%s] Instance has been deregistered from its load balancers", autoScalingGroupName, instanceId)
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[%s][%s] Instance is still being deregistered after %s, proceeding anyways", autoScalingGroupName, instanceId, deregistrationDelay)
+			return true
+		}
+		if err := k8s.Sleep(ctx, LoadBalancerDeregistrationPollInterval); err != nil {
+			log.Printf("[%s][%s] Skipping termination because the wait for the deregistration was interrupted: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+	}
+}
+
+// isInstanceRegisteredInLoadBalancers checks whether an instance is still registered in any of the given target
+// groups or classic load balancers
+func isInstanceRegisteredInLoadBalancers(ctx context.Context, targetGroupArns, loadBalancerNames []string, instanceId string) (bool, error) {
+	for _, targetGroupArn := range targetGroupArns {
+		if registered, err := cloud.IsInstanceRegisteredInTargetGroup(ctx, elbv2Service, targetGroupArn, instanceId); err != nil || registered {
+			return registered, err
+		}
+	}
+	for _, loadBalancerName := range loadBalancerNames {
+		if registered, err := cloud.IsInstanceRegisteredInClassicLoadBalancer(ctx, elbService, loadBalancerName, instanceId); err != nil || registered {
+			return registered, err
+		}
+	}
+	return false, nil
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
@@ -15,12 +25,17 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/leaderelection"
 )
 
 const (
-	MaximumFailedExecutionBeforePanic = 10               // Maximum number of allowed failed executions before panicking
-	ExecutionInterval                 = 20 * time.Second // Duration to sleep between each execution
+	MaximumFailedExecutionBeforePanic = 10               // Maximum number of allowed failed resyncs before panicking
+	ResyncInterval                    = 20 * time.Second // Duration between each resync of every ASG, regardless of events
 	ExecutionTimeout                  = 15 * time.Minute // Maximum execution duration before timing out
+	KubernetesClientCacheSyncTimeout  = 5 * time.Minute  // Maximum duration to wait for the Kubernetes client cache to be populated
+	LeaderElectionHealthTimeout       = 20 * time.Second // Maximum duration the leader can fail to renew its lease before being reported as unhealthy
+	CheckpointTimeout                 = 30 * time.Second // Maximum duration of the requests persisting the progress of a node after its execution has been cancelled
 )
 
 var (
@@ -38,244 +53,736 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to create AWS services: %s", err.Error())
 	}
-	for {
-		start := time.Now()
-		if err := run(ec2Service, autoScalingService); err != nil {
-			log.Printf("Error during execution: %s", err.Error())
-			executionFailedCounter++
-			if executionFailedCounter > MaximumFailedExecutionBeforePanic {
-				panic(fmt.Errorf("execution failed %d times: %v", executionFailedCounter, err))
-			}
-		} else if executionFailedCounter > 0 {
-			log.Printf("Execution was successful after %d failed attempts, resetting counter to 0", executionFailedCounter)
-			executionFailedCounter = 0
+	if config.Get().DryRun {
+		log.Println("Running in dry-run mode, the actions that would mutate AWS or Kubernetes resources are logged instead of being taken")
+		ec2Service, autoScalingService = cloud.NewDryRunEC2Service(ec2Service), cloud.NewDryRunAutoScalingService(autoScalingService)
+	}
+	initializeDrainSemaphore(config.Get().MaxConcurrentDrains)
+	if config.Get().WaitForLoadBalancerDeregistration {
+		elbv2Service, elbService, err = cloud.GetLoadBalancingServices(config.Get().AwsRegion)
+		if err != nil {
+			log.Fatalf("Unable to create AWS load balancing services: %s", err.Error())
+		}
+		if config.Get().DryRun {
+			elbv2Service, elbService = cloud.NewDryRunELBV2Service(elbv2Service), cloud.NewDryRunELBService(elbService)
 		}
-		log.Printf("Execution took %dms, sleeping for %s", time.Since(start).Milliseconds(), ExecutionInterval)
-		time.Sleep(ExecutionInterval)
 	}
-}
-
-func run(ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI) error {
-	log.Println("Starting execution")
-	cfg := config.Get()
 	client, err := k8s.CreateClientSet()
 	if err != nil {
-		return errors.New("unable to create Kubernetes client: " + err.Error())
+		log.Fatalf("Unable to create Kubernetes client: %s", err.Error())
 	}
-	kubernetesClient := k8s.NewKubernetesClient(client)
-	if cfg.Debug {
-		log.Println("Created Kubernetes Client successfully")
+	if len(os.Args) > 1 && os.Args[1] == PlanCommand {
+		os.Exit(runPlanCommand(context.Background(), k8s.NewKubernetesClient(client), ec2Service, autoScalingService, os.Args[2:]))
 	}
-
-	var autoScalingGroups []*autoscaling.Group
-	if len(cfg.ClusterName) > 0 {
-		autoScalingGroups, err = cloud.DescribeEnabledAutoScalingGroupsByClusterName(autoScalingService, cfg.ClusterName)
+	var kubernetesClient k8s.KubernetesClientApi
+	var cachedKubernetesClient *k8s.CachedKubernetesClient
+	if config.Get().KubernetesClientCache {
+		cachedKubernetesClient = k8s.NewCachedKubernetesClient(client)
+		kubernetesClient = cachedKubernetesClient
 	} else {
-		autoScalingGroups, err = cloud.DescribeAutoScalingGroupsByNames(autoScalingService, cfg.AutoScalingGroupNames)
+		kubernetesClient = k8s.NewKubernetesClient(client)
 	}
-	if err != nil {
-		return errors.New("unable to describe AutoScalingGroups: " + err.Error())
+	if config.Get().DryRun {
+		kubernetesClient = k8s.NewDryRunKubernetesClient(kubernetesClient)
+	}
+	startKubernetesClientCache := func(ctx context.Context) {
+		if cachedKubernetesClient != nil {
+			cachedKubernetesClient.Start(ctx)
+			if err := cachedKubernetesClient.WaitForCacheSync(KubernetesClientCacheSyncTimeout); err != nil {
+				log.Fatalf("Unable to populate Kubernetes client cache: %s", err.Error())
+			}
+			log.Println("Populated Kubernetes client cache successfully")
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnShutdownSignal(cancel)
+	if len(os.Args) > 1 && os.Args[1] == RunOnceCommand {
+		startKubernetesClientCache(ctx)
+		os.Exit(runRunOnceCommand(ctx, kubernetesClient, ec2Service, autoScalingService, os.Args[2:], os.Stdout))
+	}
+	controller := NewController(kubernetesClient, ec2Service, autoScalingService)
+	if cachedKubernetesClient != nil {
+		cachedKubernetesClient.AddNodeEventHandler(controller.OnNodeEvent)
+		cachedKubernetesClient.AddPodEventHandler(controller.OnPodEvent)
+	}
+	var nodeGroupRolloutInformer *k8s.NodeGroupRolloutInformer
+	if config.Get().NodeGroupRollouts {
+		nodeGroupRolloutInformer = k8s.NewNodeGroupRolloutInformer(client)
+		nodeGroupRolloutInformer.AddEventHandler(controller.OnNodeGroupRolloutEvent)
 	}
-	if cfg.Debug {
-		log.Println("Described AutoScalingGroups successfully")
+	runController := func(ctx context.Context) {
+		startKubernetesClientCache(ctx)
+		if nodeGroupRolloutInformer != nil {
+			nodeGroupRolloutInformer.Start(ctx)
+		}
+		controller.Run(ctx)
+	}
+	isLeader := func() bool { return true }
+	watchDog := leaderelection.NewLeaderHealthzAdaptor(LeaderElectionHealthTimeout)
+	var leaderElector *leaderelection.LeaderElector
+	var hasStartedLeading int32
+	stoppedLeading := make(chan struct{})
+	if config.Get().LeaderElection {
+		leaderElector, err = newLeaderElector(client, watchDog, func(ctx context.Context) {
+			atomic.StoreInt32(&hasStartedLeading, 1)
+			defer close(stoppedLeading)
+			runController(ctx)
+		})
+		if err != nil {
+			log.Fatalf("Unable to create leader elector: %s", err.Error())
+		}
+		isLeader = leaderElector.IsLeader
+	}
+	if len(config.Get().ListenAddress) > 0 {
+		http.Handle(HealthPath, healthHandler(watchDog))
+		http.Handle(TriggerPath, leaderOnlyHandler(isLeader, controller))
+		go func() {
+			log.Fatal(http.ListenAndServe(config.Get().ListenAddress, nil))
+		}()
+	}
+	if leaderElector != nil {
+		leaderElector.Run(ctx)
+		// The controller is only running if the lease was acquired, in which case its context has been cancelled
+		// and the steps in progress must be given a chance to complete
+		if atomic.LoadInt32(&hasStartedLeading) == 1 {
+			<-stoppedLeading
+		}
+		if ctx.Err() == nil {
+			// Exit to let another replica take over
+			log.Fatalln("Leadership lost, exiting")
+		}
+	} else {
+		runController(ctx)
 	}
-	return HandleRollingUpgrade(kubernetesClient, ec2Service, autoScalingService, autoScalingGroups)
+	log.Println("Shut down gracefully")
+}
+
+// cancelOnShutdownSignal cancels the context of the application on SIGTERM or SIGINT, which stops the rolling
+// upgrades in progress once their current step has been completed or checkpointed.
+//
+// A second signal exits immediately
+func cancelOnShutdownSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	log.Printf("Received %s, shutting down after the current steps", <-signals)
+	cancel()
+	log.Fatalf("Received %s again, exiting immediately", <-signals)
+}
+
+// AutoScalingGroupErrors are the errors returned by the handling of the ASGs that failed during an execution, indexed
+// by ASG name
+type AutoScalingGroupErrors map[string]error
+
+func (errs AutoScalingGroupErrors) Error() string {
+	var autoScalingGroupNames []string
+	for autoScalingGroupName := range errs {
+		autoScalingGroupNames = append(autoScalingGroupNames, autoScalingGroupName)
+	}
+	sort.Strings(autoScalingGroupNames)
+	var messages []string
+	for _, autoScalingGroupName := range autoScalingGroupNames {
+		messages = append(messages, fmt.Sprintf("[%s] %s", autoScalingGroupName, errs[autoScalingGroupName].Error()))
+	}
+	return strings.Join(messages, "; ")
 }
 
 // HandleRollingUpgrade handles rolling upgrades.
 //
-// Returns an error if an execution lasts for longer than ExecutionTimeout
-func HandleRollingUpgrade(kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group) error {
-	timeout := make(chan bool, 1)
-	result := make(chan bool, 1)
-	go func() {
-		time.Sleep(ExecutionTimeout)
-		timeout <- true
-	}()
-	go func() {
-		result <- DoHandleRollingUpgrade(kubernetesClient, ec2Service, autoScalingService, autoScalingGroups)
-	}()
-	select {
-	case <-timeout:
+// Returns ErrTimedOut if an execution lasts for longer than ExecutionTimeout, in which case it is cancelled, or the
+// AutoScalingGroupErrors returned by DoHandleRollingUpgrade otherwise
+func HandleRollingUpgrade(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group) error {
+	ctx, cancel := context.WithTimeout(ctx, ExecutionTimeout)
+	defer cancel()
+	err := DoHandleRollingUpgrade(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroups)
+	if ctx.Err() == context.DeadlineExceeded {
 		return ErrTimedOut
-	case <-result:
-		return nil
 	}
+	return err
 }
 
 // DoHandleRollingUpgrade handles rolling upgrades by iterating over every single AutoScalingGroups' outdated
-// instances
-func DoHandleRollingUpgrade(kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group) bool {
+// instances, after going through the same steps as Controller.Resync.
+//
+// Up to config.AutoScalingGroupConcurrency AutoScalingGroups are handled in parallel, each of them being bound by
+// config.AutoScalingGroupTimeout. The AutoScalingGroups that haven't been handled yet are skipped once the context is
+// cancelled.
+//
+// Returns AutoScalingGroupErrors if the handling of at least one AutoScalingGroup failed
+func DoHandleRollingUpgrade(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group) error {
+	prepareExecution(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroups, nil)
+	concurrency := config.Get().AutoScalingGroupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		mutex sync.Mutex
+		errs  = make(AutoScalingGroupErrors)
+	)
+	autoScalingGroupsToHandle := make(chan *autoscaling.Group)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for autoScalingGroup := range autoScalingGroupsToHandle {
+				if err := handleRollingUpgradeForAutoScalingGroupWithTimeout(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup); err != nil {
+					mutex.Lock()
+					errs[aws.StringValue(autoScalingGroup.AutoScalingGroupName)] = err
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
 	for _, autoScalingGroup := range autoScalingGroups {
-		outdatedInstances, updatedInstances, err := SeparateOutdatedFromUpdatedInstances(autoScalingGroup, ec2Service)
+		if ctx.Err() != nil {
+			break
+		}
+		autoScalingGroupsToHandle <- autoScalingGroup
+	}
+	close(autoScalingGroupsToHandle)
+	waitGroup.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// prepareExecution goes through the steps that don't belong to a single ASG, before the ASGs found during the current
+// execution are handled: the nodes of the terminated instances are deleted, the lingering nodes are recovered and the
+// NodeGroupRollouts are refreshed.
+//
+// The nodes for which skipNode returns true are left alone. skipNode may be nil
+func prepareExecution(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group, skipNode func(node *v1.Node) bool) {
+	DeleteTerminatedNodes(ctx, kubernetesClient, ec2Service, skipNode)
+	RecoverLingeringNodes(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroups, skipNode)
+	refreshNodeGroupRollouts(ctx, kubernetesClient, autoScalingGroups)
+}
+
+// HandleRollingUpgradeForAutoScalingGroup handles the rolling upgrade of a single AutoScalingGroup
+func HandleRollingUpgradeForAutoScalingGroup(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group) error {
+	HandleTerminatingInstances(ctx, kubernetesClient, autoScalingService, autoScalingGroup)
+	if isRollingUpdateAborted(autoScalingGroup) {
+		log.Printf("[%s] Skipping because the rolling update has been aborted, rolling back its nodes", aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		RollbackAutoScalingGroup(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup)
+		return nil
+	}
+	outdatedInstances, updatedInstances, _, err := SeparateOutdatedFromUpdatedInstances(ctx, autoScalingGroup, ec2Service)
+	if err != nil {
+		return fmt.Errorf("unable to separate outdated instances from updated instances: %v", err)
+	}
+	outdatedInstances, updatedInstances = HandleOrphanInstances(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup, outdatedInstances, updatedInstances)
+	// An updated node should never have been annotated by this application, so this indicates that at one point,
+	// the node was considered outdated compared to the ASG's current LT/LC (e.g. the LT was reverted mid-rollout)
+	RollbackInstances(ctx, kubernetesClient, autoScalingGroup, updatedInstances)
+	// The instances terminated by the recovery and by the replacement of the outdated nodes share the same decrements,
+	// so that they don't take the desired capacity below the min size together
+	decrements := newDesiredCapacityDecrements(autoScalingGroup)
+	recoveredInstanceIds := RecoverStuckInstances(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup, outdatedInstances, decrements)
+	if config.Get().Debug {
+		log.Printf("[%s] outdatedInstances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), outdatedInstances)
+		log.Printf("[%s] updatedInstances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), updatedInstances)
+	}
+	// Get the updated and ready nodes from the list of updated instances
+	// This will be used to determine if the desired number of updated instances need to scale up or not
+	// We also use this to clean up, if necessary
+	updatedReadyNodes, numberOfNonReadyNodesOrInstances, _ := getReadyNodesAndNumberOfNonReadyNodesOrInstances(ctx, updatedInstances, autoScalingGroup, kubernetesClient)
+	if len(outdatedInstances) == 0 {
+		log.Printf("[%s] All instances are up to date", aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		if len(cloud.GetTagValue(autoScalingGroup, cloud.OriginalDesiredCapacityTagKey)) > 0 {
+			// The surge capacity has been removed along with the outdated instances
+			if err := cloud.DeleteAutoScalingGroupTags(ctx, autoScalingService, autoScalingGroup, cloud.OriginalDesiredCapacityTagKey); err != nil {
+				log.Printf("[%s] Unable to delete tag: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+			}
+		}
+		return nil
+	} else {
+		log.Printf("[%s] outdated=%d; updated=%d; updatedAndReady=%d; asgCurrent=%d; asgDesired=%d; asgMax=%d", aws.StringValue(autoScalingGroup.AutoScalingGroupName), len(outdatedInstances), len(updatedInstances), len(updatedReadyNodes), len(autoScalingGroup.Instances), aws.Int64Value(autoScalingGroup.DesiredCapacity), aws.Int64Value(autoScalingGroup.MaxSize))
+	}
+	if closedReason := getMaintenanceWindowClosedReason(autoScalingGroup, time.Now()); len(closedReason) > 0 && getMaintenanceWindowClosePolicy(autoScalingGroup) == config.MaintenanceWindowClosePolicyRevert {
+		log.Printf("[%s] Skipping and rolling back the nodes whose rollout has started, because %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), closedReason)
+		rollbackNodesBeingRolledOut(ctx, kubernetesClient, autoScalingGroup, outdatedInstances)
+		return nil
+	}
+	pausedReason := getRollingUpdatePausedReason(ctx, kubernetesClient, autoScalingGroup, outdatedInstances)
+	// The outdated nodes aren't tainted while the rolling update is paused, which includes being outside of the
+	// maintenance windows, otherwise the nodes rolled back because of the revert policy would be tainted and rolled
+	// back again on every execution
+	if len(config.Get().OutdatedNodeTaintEffect) > 0 && len(pausedReason) == 0 {
+		taintOutdatedNodes(ctx, kubernetesClient, autoScalingGroup, outdatedInstances, v1.TaintEffect(config.Get().OutdatedNodeTaintEffect))
+	}
+	if int64(len(autoScalingGroup.Instances)) < aws.Int64Value(autoScalingGroup.DesiredCapacity) {
+		log.Printf("[%s] Skipping because ASG has a desired capacity of %d, but only has %d instances", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.Int64Value(autoScalingGroup.DesiredCapacity), len(autoScalingGroup.Instances))
+		return nil
+	}
+	if numberOfNonReadyNodesOrInstances != 0 {
+		log.Printf("[%s] ASG has %d non-ready updated nodes/instances, waiting until all nodes/instances are ready", aws.StringValue(autoScalingGroup.AutoScalingGroupName), numberOfNonReadyNodesOrInstances)
+		return nil
+	}
+	if len(pausedReason) > 0 {
+		log.Printf("[%s] Rolling update is paused because %s, only the nodes that have already been drained will be rolled out", aws.StringValue(autoScalingGroup.AutoScalingGroupName), pausedReason)
+	}
+	replaceOutdatedNodes(ctx, kubernetesClient, autoScalingService, autoScalingGroup, outdatedInstances, recoveredInstanceIds, updatedReadyNodes, decrements, len(pausedReason) > 0)
+	return nil
+}
+
+// desiredCapacityDecrements keeps track of the number of instances of an ASG that can still be terminated while
+// decrementing its desired capacity during the current pass, so that terminating multiple instances never takes the
+// desired capacity below the min size of the ASG
+type desiredCapacityDecrements struct {
+	remaining int64
+}
+
+// newDesiredCapacityDecrements creates a desiredCapacityDecrements allowing the desired capacity of an ASG to be
+// decremented down to its min size, which includes removing any surge capacity added while its updated nodes didn't
+// have enough resources available
+func newDesiredCapacityDecrements(autoScalingGroup *autoscaling.Group) *desiredCapacityDecrements {
+	return &desiredCapacityDecrements{remaining: aws.Int64Value(autoScalingGroup.DesiredCapacity) - aws.Int64Value(autoScalingGroup.MinSize)}
+}
+
+// take checks whether the next instance to be terminated should decrement the desired capacity, and if so, counts
+// that decrement
+func (decrements *desiredCapacityDecrements) take() bool {
+	if decrements.remaining <= 0 {
+		return false
+	}
+	decrements.remaining--
+	return true
+}
+
+// outdatedNode is an outdated instance whose node has been selected to be replaced during the current execution
+type outdatedNode struct {
+	instance                       *autoscaling.Instance
+	node                           *v1.Node
+	shouldDrain                    bool
+	shouldDecrementDesiredCapacity bool
+}
+
+// drainDecision is the decision made by drainSelector for an outdated node that hasn't been drained yet
+type drainDecision int
+
+const (
+	// drainDecisionDrain means that the node can be drained, and that the resources needed by its pods have been
+	// reserved
+	drainDecisionDrain drainDecision = iota
+	// drainDecisionMaxUnavailableReached means that the node cannot be drained, because the maximum number of
+	// unavailable nodes has been reached
+	drainDecisionMaxUnavailableReached
+	// drainDecisionScaleUp means that the desired capacity of the ASG must be increased before the node can be
+	// drained, because the updated nodes don't have enough resources left for its pods
+	drainDecisionScaleUp
+)
+
+// drainSelector decides which of the outdated nodes of an ASG can be drained, in the order in which they're passed
+// to decide. It's used both to replace the outdated nodes and to build the rollout plan, so that the plan makes the
+// same decisions as an actual execution.
+type drainSelector struct {
+	maxUnavailable int
+	// numberOfUnavailableNodes is the number of nodes that have been drained but not terminated, including the nodes
+	// selected to be drained
+	numberOfUnavailableNodes int
+	// availableResources are the resources available in the updated and ready nodes
+	availableResources k8s.Resources
+	// reserve reserves the resources needed by the pods of a node out of the resources available, and returns false
+	// if they don't fit
+	reserve func(available, needed k8s.Resources) bool
+}
+
+// decide decides whether an outdated node that hasn't been drained yet, and whose pods need resourcesNeeded, can be
+// drained
+func (selector *drainSelector) decide(resourcesNeeded k8s.Resources) drainDecision {
+	if selector.numberOfUnavailableNodes >= selector.maxUnavailable {
+		return drainDecisionMaxUnavailableReached
+	}
+	if !selector.reserve(selector.availableResources, resourcesNeeded) {
+		return drainDecisionScaleUp
+	}
+	selector.numberOfUnavailableNodes++
+	return drainDecisionDrain
+}
+
+// replaceOutdatedNodes selects up to maxUnavailable outdated nodes that can be replaced given the resources available
+// in the updated nodes, then drains and terminates them in parallel.
+//
+// Nodes that have already been drained, but not terminated, are unavailable and therefore count against
+// maxUnavailable. The resources needed by each selected node are reserved from the resources available in the updated
+// nodes for the duration of the pass, so that multiple nodes drained at once don't use the same resources. If there isn't enough resources for the next node, the ASG's desired capacity is
+// increased by the max surge of the ASG.
+//
+// If paused is true, only the nodes that have already been drained are terminated, so that the nodes whose rollout
+// was in progress when the rolling update was paused end up in a stable state.
+//
+// The instances of recoveredInstanceIds have already been handled by RecoverStuckInstances, so they're only counted
+// against maxUnavailable.
+//
+// Returns true if at least one node has been drained and scheduled for termination successfully
+func replaceOutdatedNodes(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, outdatedInstances []*autoscaling.Instance, recoveredInstanceIds map[string]bool, updatedReadyNodes []*v1.Node, decrements *desiredCapacityDecrements, paused bool) bool {
+	nodes := make(map[*autoscaling.Instance]*v1.Node)
+	// The resources needed by the pods of the nodes selected during this pass. The pods of the nodes drained during
+	// the previous passes have been moved since, so they're accounted for in the resources available
+	var reservedResources k8s.Resources
+	selector := &drainSelector{
+		maxUnavailable: getMaxUnavailable(autoScalingGroup),
+		reserve: func(available, needed k8s.Resources) bool {
+			if !available.Subtract(reservedResources).CanFit(needed) {
+				return false
+			}
+			reservedResources = reservedResources.Add(needed)
+			return true
+		},
+	}
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
 		if err != nil {
-			log.Printf("[%s] Skipping because unable to separate outdated instances from updated instances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+			log.Printf("[%s][%s] Skipping because unable to get outdated node from Kubernetes: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
 			continue
 		}
-		if config.Get().Debug {
-			log.Printf("[%s] outdatedInstances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), outdatedInstances)
-			log.Printf("[%s] updatedInstances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), updatedInstances)
-		}
-		// Get the updated and ready nodes from the list of updated instances
-		// This will be used to determine if the desired number of updated instances need to scale up or not
-		// We also use this to clean up, if necessary
-		updatedReadyNodes, numberOfNonReadyNodesOrInstances := getReadyNodesAndNumberOfNonReadyNodesOrInstances(updatedInstances, autoScalingGroup, kubernetesClient)
-		if len(outdatedInstances) == 0 {
-			log.Printf("[%s] All instances are up to date", aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		nodes[outdatedInstance] = node
+		if _, minutesSinceDrained, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node); minutesSinceDrained != -1 && minutesSinceTerminated == -1 {
+			selector.numberOfUnavailableNodes++
+		}
+	}
+	var nodesToReplace []*outdatedNode
+	selector.availableResources = k8s.CalculateResourcesAvailableInNodes(ctx, kubernetesClient, updatedReadyNodes)
+outdatedInstancesLoop:
+	for _, outdatedInstance := range outdatedInstances {
+		node, ok := nodes[outdatedInstance]
+		if !ok || recoveredInstanceIds[aws.StringValue(outdatedInstance.InstanceId)] {
 			continue
-		} else {
-			log.Printf("[%s] outdated=%d; updated=%d; updatedAndReady=%d; asgCurrent=%d; asgDesired=%d; asgMax=%d", aws.StringValue(autoScalingGroup.AutoScalingGroupName), len(outdatedInstances), len(updatedInstances), len(updatedReadyNodes), len(autoScalingGroup.Instances), aws.Int64Value(autoScalingGroup.DesiredCapacity), aws.Int64Value(autoScalingGroup.MaxSize))
 		}
-		if int64(len(autoScalingGroup.Instances)) < aws.Int64Value(autoScalingGroup.DesiredCapacity) {
-			log.Printf("[%s] Skipping because ASG has a desired capacity of %d, but only has %d instances", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.Int64Value(autoScalingGroup.DesiredCapacity), len(autoScalingGroup.Instances))
+		minutesSinceStarted, minutesSinceDrained, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node)
+		if paused && minutesSinceDrained == -1 {
 			continue
 		}
-		if numberOfNonReadyNodesOrInstances != 0 {
-			log.Printf("[%s] ASG has %d non-ready updated nodes/instances, waiting until all nodes/instances are ready", aws.StringValue(autoScalingGroup.AutoScalingGroupName), numberOfNonReadyNodesOrInstances)
+		if isNodePaused(node) {
+			log.Printf("[%s][%s] Skipping because the node has been annotated with %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), k8s.RollingUpdatePausedAnnotationKey)
 			continue
 		}
-		for _, outdatedInstance := range outdatedInstances {
-			node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(outdatedInstance)
+		// Check if outdated nodes in k8s have been marked with annotation from aws-eks-asg-rolling-update-handler
+		if minutesSinceStarted == -1 {
+			log.Printf("[%s][%s] Starting node rollout process", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+			// Annotate the node to persist the fact that the rolling update process has begun
+			err := k8s.AnnotateNodeByAwsAutoScalingInstance(ctx, kubernetesClient, outdatedInstance, k8s.RollingUpdateStartedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
 			if err != nil {
-				log.Printf("[%s][%s] Skipping because unable to get outdated node from Kubernetes: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
-				continue
+				log.Printf("[%s][%s] Skipping because unable to annotate node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
 			}
-			minutesSinceStarted, minutesSinceDrained, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node)
-			// Check if outdated nodes in k8s have been marked with annotation from aws-eks-asg-rolling-update-handler
-			if minutesSinceStarted == -1 {
-				log.Printf("[%s][%s] Starting node rollout process", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-				// Annotate the node to persist the fact that the rolling update process has begun
-				err := k8s.AnnotateNodeByAwsAutoScalingInstance(kubernetesClient, outdatedInstance, k8s.RollingUpdateStartedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
-				if err != nil {
-					log.Printf("[%s][%s] Skipping because unable to annotate node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
-					continue
-				}
-			} else {
-				log.Printf("[%s][%s] Node already started rollout process", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-				// check if existing updatedInstances have the capacity to support what's inside this node
-				hasEnoughResources := k8s.CheckIfNodeHasEnoughResourcesToTransferAllPodsInNodes(kubernetesClient, node, updatedReadyNodes)
-				if hasEnoughResources {
-					log.Printf("[%s][%s] Updated nodes have enough resources available", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-					if minutesSinceDrained == -1 {
-						log.Printf("[%s][%s] Draining node", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-						err := kubernetesClient.Drain(node.Name, config.Get().IgnoreDaemonSets, config.Get().DeleteLocalData)
-						if err != nil {
-							log.Printf("[%s][%s] Skipping because ran into error while draining node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
-							continue
-						} else {
-							// Only annotate if no error was encountered
-							_ = k8s.AnnotateNodeByAwsAutoScalingInstance(kubernetesClient, outdatedInstance, k8s.RollingUpdateDrainedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
-						}
-					} else {
-						log.Printf("[%s][%s] Node has already been drained %d minutes ago, skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), minutesSinceDrained)
-					}
-					if minutesSinceTerminated == -1 {
-						// Terminate node
-						log.Printf("[%s][%s] Terminating node", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-						shouldDecrementDesiredCapacity := aws.Int64Value(autoScalingGroup.DesiredCapacity) != aws.Int64Value(autoScalingGroup.MinSize)
-						err = cloud.TerminateEc2Instance(autoScalingService, outdatedInstance, shouldDecrementDesiredCapacity)
-						if err != nil {
-							log.Printf("[%s][%s] Ran into error while terminating node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
-							continue
-						} else {
-							// Only annotate if no error was encountered
-							_ = k8s.AnnotateNodeByAwsAutoScalingInstance(kubernetesClient, outdatedInstance, k8s.RollingUpdateTerminatedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
-						}
-					} else {
-						log.Printf("[%s][%s] Node is already in the process of being terminated since %d minutes ago, skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), minutesSinceTerminated)
-						// TODO: check if minutesSinceTerminated > 10. If that happens, then there's clearly a problem, so we should do something about it
-						// The node has already been terminated, there's nothing to do here, continue to the next one
-						continue
-					}
-					// If this code is reached, it means that the current node has been successfully drained and
-					// scheduled for termination.
-					// As a result, we return here to make sure that multiple old instances didn't use the same updated
-					// instances to calculate resources available
-					log.Printf("[%s][%s] Node has been drained and scheduled for termination successfully", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-					return true
-				} else {
-					// Don't increase the ASG if the node has already been drained or scheduled for termination
-					if minutesSinceDrained != -1 || minutesSinceTerminated != -1 {
-						continue
-					}
-					log.Printf("[%s][%s] Updated nodes do not have enough resources available, increasing desired count by 1", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
-					err := cloud.SetAutoScalingGroupDesiredCount(autoScalingService, autoScalingGroup, aws.Int64Value(autoScalingGroup.DesiredCapacity)+1)
-					if err != nil {
-						log.Printf("[%s][%s] Unable to increase ASG desired size: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
-						log.Printf("[%s][%s] Skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+			continue
+		}
+		log.Printf("[%s][%s] Node already started rollout process", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+		if minutesSinceTerminated != -1 {
+			// The node has already been terminated, there's nothing to do here, continue to the next one
+			// If the termination is stuck, it will be handled by RecoverStuckInstances
+			log.Printf("[%s][%s] Node is already in the process of being terminated since %d minutes ago, skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), minutesSinceTerminated)
+			continue
+		}
+		if minutesSinceDrained != -1 {
+			log.Printf("[%s][%s] Node has already been drained %d minutes ago, skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), minutesSinceDrained)
+		} else {
+			// check if existing updatedInstances have the capacity to support what's inside this node, without
+			// counting the resources reserved for the other nodes being replaced
+			resourcesNeeded, err := k8s.CalculateResourcesNeededToTransferAllPodsInNode(ctx, kubernetesClient, node)
+			if err != nil {
+				log.Printf("[%s][%s] Unable to determine resources needed for old node, assuming that enough resources are available", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+			}
+			switch selector.decide(resourcesNeeded) {
+			case drainDecisionMaxUnavailableReached:
+				log.Printf("[%s][%s] Skipping because the maximum number of unavailable nodes (%d) has been reached", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), selector.maxUnavailable)
+				continue
+			case drainDecisionScaleUp:
+				surge := getScaleUpSurge(autoScalingGroup, aws.Int64Value(autoScalingGroup.DesiredCapacity))
+				log.Printf("[%s][%s] Updated nodes do not have enough resources available, increasing desired count by %d", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), surge)
+				// The desired capacity before the first increase is kept track of, so that the surge capacity can be
+				// removed if the rolling update is aborted
+				if len(cloud.GetTagValue(autoScalingGroup, cloud.OriginalDesiredCapacityTagKey)) == 0 {
+					if err := cloud.SetAutoScalingGroupTag(ctx, autoScalingService, autoScalingGroup, cloud.OriginalDesiredCapacityTagKey, strconv.FormatInt(aws.Int64Value(autoScalingGroup.DesiredCapacity), 10)); err != nil {
+						log.Printf("[%s][%s] Skipping because unable to record the original desired capacity: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
 						continue
-					} else {
-						// ASG was scaled up already, stop iterating over outdated instances in current ASG so we can
-						// move on to the next ASG
-						break
 					}
 				}
+				err := cloud.SetAutoScalingGroupDesiredCount(ctx, autoScalingService, autoScalingGroup, aws.Int64Value(autoScalingGroup.DesiredCapacity)+surge)
+				if err != nil {
+					log.Printf("[%s][%s] Unable to increase ASG desired size: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+					log.Printf("[%s][%s] Skipping", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+					continue
+				}
+				// ASG was scaled up already, stop iterating over outdated instances in current ASG so we can
+				// move on to the next ASG
+				break outdatedInstancesLoop
 			}
+			log.Printf("[%s][%s] Updated nodes have enough resources available", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
 		}
+		nodesToReplace = append(nodesToReplace, &outdatedNode{
+			instance:                       outdatedInstance,
+			node:                           node,
+			shouldDrain:                    minutesSinceDrained == -1,
+			shouldDecrementDesiredCapacity: decrements.take(),
+		})
+	}
+	if len(nodesToReplace) == 0 {
+		return false
 	}
+	var (
+		waitGroup             sync.WaitGroup
+		mutex                 sync.Mutex
+		hasReplacedAtLeastOne bool
+	)
+	for _, nodeToReplace := range nodesToReplace {
+		waitGroup.Add(1)
+		go func(nodeToReplace *outdatedNode) {
+			defer waitGroup.Done()
+			if replaceOutdatedNode(ctx, kubernetesClient, autoScalingService, autoScalingGroup, nodeToReplace, updatedReadyNodes) {
+				mutex.Lock()
+				hasReplacedAtLeastOne = true
+				mutex.Unlock()
+			}
+		}(nodeToReplace)
+	}
+	waitGroup.Wait()
+	return hasReplacedAtLeastOne
+}
+
+// replaceOutdatedNode drains an outdated node if it hasn't been drained yet, and then terminates it.
+//
+// Returns true if the node has been drained and scheduled for termination successfully
+func replaceOutdatedNode(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, nodeToReplace *outdatedNode, updatedReadyNodes []*v1.Node) bool {
+	node, outdatedInstance := nodeToReplace.node, nodeToReplace.instance
+	if nodeToReplace.shouldDrain {
+		var err error
+		var evictedWorkloads []k8s.Workload
+		if config.Get().VerifyEvictedWorkloads {
+			// The workloads must be retrieved before migrating or draining, as their pods will no longer be on the node afterward
+			evictedWorkloads, err = k8s.GetWorkloadsInNode(ctx, kubernetesClient, node.Name)
+			if err != nil {
+				log.Printf("[%s][%s] Skipping because unable to retrieve workloads in node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+				return false
+			}
+		}
+		// Limit the number of nodes being drained at the same time across all ASGs
+		if err := acquireDrainSlot(ctx); err != nil {
+			log.Printf("[%s][%s] Skipping because the wait for a drain slot was interrupted: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			return false
+		}
+		// The node is cordoned before being drained so that the cordon is recorded and can be undone by a rollback,
+		// and before the pods are migrated so that their replacements aren't scheduled on it
+		if err := k8s.CordonNode(ctx, kubernetesClient, node); err != nil {
+			releaseDrainSlot()
+			log.Printf("[%s][%s] Skipping because unable to cordon node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			return false
+		}
+		var scaledUpDeployments []types.NamespacedName
+		if migrationStrategy := getMigrationStrategy(autoScalingGroup); migrationStrategy == config.MigrationStrategyScaleUp || migrationStrategy == config.MigrationStrategyRolloutRestart {
+			log.Printf("[%s][%s] Migrating pods owned by deployments using strategy %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), migrationStrategy)
+			scaledUpDeployments, err = k8s.MigrateDeploymentPods(ctx, kubernetesClient, node, updatedReadyNodes, k8s.MigrationStrategy(migrationStrategy), config.Get().MigrationTimeout)
+			if err != nil {
+				log.Printf("[%s][%s] Unable to migrate pods owned by deployments, falling back to eviction: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			}
+		}
+		log.Printf("[%s][%s] Draining node", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+		drainCtx, cancelDrain := newDrainContext(ctx, autoScalingGroup)
+		// The drain is interrupted when the maintenance window closes if the node must be rolled back afterward
+		drainCtx, cancelMaintenanceWindowDeadline := withMaintenanceWindowDeadline(drainCtx, autoScalingGroup)
+		err = drainNode(drainCtx, kubernetesClient, node.Name)
+		cancelMaintenanceWindowDeadline()
+		cancelDrain()
+		releaseDrainSlot()
+		// The progress of the node must be persisted even if the execution has been cancelled during the drain
+		checkpointCtx, cancel := newCheckpointContext()
+		defer cancel()
+		if len(scaledUpDeployments) > 0 {
+			// Restore the replicas regardless of whether the drain succeeded or not, since the
+			// migration will be done again on the next execution if the drain failed
+			if err := k8s.RestoreDeploymentReplicas(checkpointCtx, kubernetesClient, node.Name, scaledUpDeployments); err != nil {
+				log.Printf("[%s][%s] Unable to restore replicas of deployments: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			}
+		}
+		if err != nil {
+			log.Printf("[%s][%s] Skipping because ran into error while draining node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			return false
+		}
+		// Only annotate if no error was encountered
+		if len(evictedWorkloads) > 0 {
+			_ = k8s.AnnotateNodeByAwsAutoScalingInstance(checkpointCtx, kubernetesClient, outdatedInstance, k8s.EvictedWorkloadsAnnotationKey, k8s.FormatWorkloads(evictedWorkloads))
+		}
+		_ = k8s.AnnotateNodeByAwsAutoScalingInstance(checkpointCtx, kubernetesClient, outdatedInstance, k8s.RollingUpdateDrainedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
+	}
+	if !prepareForTermination(ctx, kubernetesClient, autoScalingGroup, outdatedInstance) {
+		// The node will remain unavailable until it can be terminated
+		return false
+	}
+	// Terminate node
+	log.Printf("[%s][%s] Terminating node", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+	err := cloud.TerminateEc2Instance(ctx, autoScalingService, outdatedInstance, nodeToReplace.shouldDecrementDesiredCapacity)
+	if err != nil {
+		log.Printf("[%s][%s] Ran into error while terminating node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+		return false
+	}
+	// Only annotate if no error was encountered. The termination cannot be undone, so the annotation is persisted even
+	// if the execution has been cancelled in the meantime
+	checkpointCtx, cancel := newCheckpointContext()
+	defer cancel()
+	_ = k8s.AnnotateNodeByAwsAutoScalingInstance(checkpointCtx, kubernetesClient, outdatedInstance, k8s.RollingUpdateTerminatedTimestampAnnotationKey, time.Now().Format(time.RFC3339))
+	log.Printf("[%s][%s] Node has been drained and scheduled for termination successfully", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
 	return true
 }
 
-func getReadyNodesAndNumberOfNonReadyNodesOrInstances(updatedInstances []*autoscaling.Instance, autoScalingGroup *autoscaling.Group, kubernetesClient k8s.KubernetesClientApi) ([]*v1.Node, int) {
+// prepareForTermination goes through the steps that must be completed before the instance of a drained node is
+// terminated: the workloads evicted from the node must be healthy, its volumes must be detached and the instance must
+// be deregistered from its load balancers.
+//
+// Returns true if the instance can be terminated
+func prepareForTermination(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, outdatedInstance *autoscaling.Instance) bool {
+	if config.Get().VerifyEvictedWorkloads {
+		if verified, err := verifyEvictedWorkloads(ctx, kubernetesClient, autoScalingGroup, outdatedInstance); !verified {
+			if err != nil {
+				log.Printf("[%s][%s] Unable to verify evicted workloads, holding node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			}
+			return false
+		}
+	}
+	if !waitForVolumeDetachment(ctx, kubernetesClient, autoScalingGroup, outdatedInstance) {
+		return false
+	}
+	return deregisterFromLoadBalancers(ctx, autoScalingGroup, outdatedInstance)
+}
+
+// getMaxUnavailable resolves the maximum number of nodes of an ASG that may be unavailable at the same time, using
+// the NodeGroupRollout selecting the ASG if it sets one, the ASG's cloud.MaxUnavailableTagKey tag if present, or
+// config.MaxUnavailable otherwise
+func getMaxUnavailable(autoScalingGroup *autoscaling.Group) int {
+	value := config.Get().MaxUnavailable
+	if rollout := getNodeGroupRollout(autoScalingGroup); rollout != nil && rollout.Spec.MaxUnavailable != nil {
+		value = rollout.Spec.MaxUnavailable.String()
+	} else if tagValue := cloud.GetTagValue(autoScalingGroup, cloud.MaxUnavailableTagKey); len(tagValue) > 0 {
+		value = tagValue
+	}
+	maxUnavailable, err := config.ParseMaxUnavailable(value, int(aws.Int64Value(autoScalingGroup.DesiredCapacity)))
+	if err != nil {
+		log.Printf("[%s] Invalid maximum number of unavailable nodes, defaulting to 1: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		return 1
+	}
+	return maxUnavailable
+}
+
+// getScaleUpSurge returns the number of nodes to add to an ASG whose desired capacity is desiredCapacity when its
+// updated nodes don't have enough resources left, which is getMaxSurge capped to the room left below the ASG's max
+// size, so that a large surge doesn't prevent the ASG from being scaled up at all
+func getScaleUpSurge(autoScalingGroup *autoscaling.Group, desiredCapacity int64) int64 {
+	surge := int64(getMaxSurge(autoScalingGroup))
+	if room := aws.Int64Value(autoScalingGroup.MaxSize) - desiredCapacity; room > 0 && surge > room {
+		surge = room
+	}
+	return surge
+}
+
+// getReadinessRequirements returns the requirements that an updated node must meet to be considered ready
+func getReadinessRequirements() k8s.ReadinessRequirements {
+	return k8s.ReadinessRequirements{
+		StartupTaints:      config.Get().StartupTaints,
+		RequiredDaemonSets: config.Get().RequiredDaemonSets,
+		SoakDuration:       config.Get().NodeReadySoakDuration,
+	}
+}
+
+// getReadyNodesAndNumberOfNonReadyNodesOrInstances retrieves the nodes of the updated instances that are ready to
+// accept pods, as well as the number of updated instances that aren't in service or whose node isn't ready.
+//
+// The reason why each of these instances isn't ready is returned by instance ID
+func getReadyNodesAndNumberOfNonReadyNodesOrInstances(ctx context.Context, updatedInstances []*autoscaling.Instance, autoScalingGroup *autoscaling.Group, kubernetesClient k8s.KubernetesClientApi) ([]*v1.Node, int, map[string]string) {
 	var updatedReadyNodes []*v1.Node
-	numberOfNonReadyNodesOrInstances := 0
+	notReadyReasons := make(map[string]string)
+	readinessRequirements := getReadinessRequirements()
 	for _, updatedInstance := range updatedInstances {
 		if aws.StringValue(updatedInstance.LifecycleState) != "InService" {
-			numberOfNonReadyNodesOrInstances++
+			notReadyReasons[aws.StringValue(updatedInstance.InstanceId)] = "instance is " + aws.StringValue(updatedInstance.LifecycleState)
 			log.Printf("[%s][%s] Skipping because instance is not in LifecycleState 'InService', but is in '%s' instead", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(updatedInstance.InstanceId), aws.StringValue(updatedInstance.LifecycleState))
 			continue
 		}
-		updatedNode, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(updatedInstance)
+		updatedNode, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, updatedInstance)
 		if err != nil {
-			numberOfNonReadyNodesOrInstances++
+			notReadyReasons[aws.StringValue(updatedInstance.InstanceId)] = "no node"
 			log.Printf("[%s][%s] Skipping because unable to get updated node from Kubernetes: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(updatedInstance.InstanceId), err.Error())
 			continue
 		}
-		// Check if Kubelet is ready to accept pods on that node
-		conditions := updatedNode.Status.Conditions
-		if len(conditions) == 0 {
-			log.Printf("[%s][%s] For some magical reason, %s doesn't have any conditions, therefore it is impossible to determine whether the node is ready to accept new pods or not", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(updatedInstance.InstanceId), updatedNode.Name)
-			numberOfNonReadyNodesOrInstances++
-		} else if kubeletCondition := conditions[len(conditions)-1]; kubeletCondition.Type == v1.NodeReady && kubeletCondition.Status == v1.ConditionTrue {
-			updatedReadyNodes = append(updatedReadyNodes, updatedNode)
+		// Check if the node is ready to accept pods
+		notReadyReason, err := k8s.GetNodeNotReadyReason(ctx, kubernetesClient, updatedNode, readinessRequirements)
+		if err != nil {
+			notReadyReasons[aws.StringValue(updatedInstance.InstanceId)] = "unable to determine readiness: " + err.Error()
+			log.Printf("[%s][%s] Skipping because unable to determine whether %s is ready: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(updatedInstance.InstanceId), updatedNode.Name, err.Error())
+		} else if len(notReadyReason) > 0 {
+			notReadyReasons[aws.StringValue(updatedInstance.InstanceId)] = "not ready: " + notReadyReason
+			log.Printf("[%s][%s] Skipping because %s is not ready: %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(updatedInstance.InstanceId), updatedNode.Name, notReadyReason)
 		} else {
-			numberOfNonReadyNodesOrInstances++
-		}
-		// Cleaning up
-		// This is an edge case, but it may happen that an ASG's launch template is modified, creating a new
-		// template version, but then that new template version is deleted before the node has been terminated.
-		// To make it even more of an edge case, the draining function would've had to time out, meaning that
-		// the termination would be skipped until the next run.
-		// This would cause an instance to be considered as updated, even though it has been drained therefore
-		// cordoned (NoSchedule).
-		if startedAtValue, ok := updatedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey]; ok {
-			// An updated node should never have k8s.RollingUpdateStartedTimestampAnnotationKey, so this indicates that
-			// at one point, this node was considered old compared to the ASG's current LT/LC
-			// First, check if there's a NoSchedule taint
-			for i, taint := range updatedNode.Spec.Taints {
-				if taint.Effect == v1.TaintEffectNoSchedule {
-					// There's a taint, but we need to make sure it was added after the rolling update started
-					startedAt, err := time.Parse(time.RFC3339, startedAtValue)
-					// If the annotation can't be parsed OR the taint was added after the rolling updated started,
-					// we need to remove that taint
-					if err != nil || taint.TimeAdded.Time.After(startedAt) {
-						log.Printf("[%s] EDGE-0001: Attempting to remove taint from updated node %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), updatedNode.Name)
-						// Remove the taint
-						updatedNode.Spec.Taints = append(updatedNode.Spec.Taints[:i], updatedNode.Spec.Taints[i+1:]...)
-						// Remove the annotation
-						delete(updatedNode.Annotations, k8s.RollingUpdateStartedTimestampAnnotationKey)
-						// Update the node
-						err = kubernetesClient.UpdateNode(updatedNode)
-						if err != nil {
-							log.Printf("[%s] EDGE-0001: Unable to update tainted node %s: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), updatedNode.Name, err.Error())
-						}
-						break
-					}
-				}
-			}
+			updatedReadyNodes = append(updatedReadyNodes, updatedNode)
+		}
+	}
+	return updatedReadyNodes, len(notReadyReasons), notReadyReasons
+}
+
+// taintOutdatedNodes taints the nodes of every outdated instance so that new pods prefer updated nodes
+func taintOutdatedNodes(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, outdatedInstances []*autoscaling.Instance, effect v1.TaintEffect) {
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("[%s] Unable to get nodes to taint outdated nodes: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		return
+	}
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.FilterNodeByAutoScalingInstance(nodes, outdatedInstance)
+		if err != nil {
+			continue
+		}
+		if err := k8s.TaintNode(ctx, kubernetesClient, node, k8s.OutdatedTaintKey, effect); err != nil {
+			log.Printf("[%s][%s] Unable to taint outdated node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+		}
+	}
+}
+
+// verifyEvictedWorkloads checks whether the workloads evicted from an outdated instance's node have recovered, and
+// pauses the rolling update of the ASG if they haven't recovered within config.EvictedWorkloadsVerificationTimeout.
+//
+// Returns true if the instance can be terminated, and an error if the evicted workloads could not be verified, in
+// which case the instance must not be terminated either
+func verifyEvictedWorkloads(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, outdatedInstance *autoscaling.Instance) (bool, error) {
+	node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
+	if err != nil {
+		return false, fmt.Errorf("unable to get node: %v", err)
+	}
+	if _, ok := node.Annotations[k8s.VerificationTimedOutAtAnnotationKey]; ok {
+		// The verification timed out, but the rolling update was resumed by removing the paused annotation
+		log.Printf("[%s][%s] Rolling update was resumed after the verification of evicted workloads timed out, skipping verification", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId))
+		return true, nil
+	}
+	evictedWorkloads, err := k8s.ParseWorkloads(node.Annotations[k8s.EvictedWorkloadsAnnotationKey])
+	if err != nil {
+		// Terminating the node without knowing which workloads were evicted from it could take down the replacements
+		// of the workloads that haven't recovered yet, so the node is held until the annotation is fixed or removed
+		return false, fmt.Errorf("unable to parse annotation %s: %v", k8s.EvictedWorkloadsAnnotationKey, err)
+	}
+	unhealthyWorkloads, err := k8s.GetUnhealthyWorkloads(ctx, kubernetesClient, evictedWorkloads)
+	if err != nil {
+		return false, err
+	}
+	if len(unhealthyWorkloads) == 0 {
+		if len(evictedWorkloads) > 0 {
+			log.Printf("[%s][%s] All %d evicted workloads are healthy", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), len(evictedWorkloads))
 		}
+		return true, nil
+	}
+	drainedAt, err := time.Parse(time.RFC3339, node.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey])
+	if err != nil || time.Since(drainedAt) < config.Get().EvictedWorkloadsVerificationTimeout {
+		log.Printf("[%s][%s] Waiting for %d evicted workloads to become healthy: %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), len(unhealthyWorkloads), k8s.FormatWorkloads(unhealthyWorkloads))
+		return false, nil
 	}
-	return updatedReadyNodes, numberOfNonReadyNodesOrInstances
+	message := fmt.Sprintf("Pausing rolling update, because %d evicted workloads did not become healthy within %s: %s", len(unhealthyWorkloads), config.Get().EvictedWorkloadsVerificationTimeout, k8s.FormatWorkloads(unhealthyWorkloads))
+	log.Printf("[%s][%s] %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), message)
+	node.Annotations[k8s.VerificationTimedOutAtAnnotationKey] = time.Now().Format(time.RFC3339)
+	node.Annotations[k8s.RollingUpdatePausedAnnotationKey] = "true"
+	if err := kubernetesClient.UpdateNode(ctx, node); err != nil {
+		return false, fmt.Errorf("unable to annotate node to pause rolling update: %v", err)
+	}
+	if err := kubernetesClient.CreateNodeEvent(ctx, node, v1.EventTypeWarning, k8s.RollingUpdatePausedEventReason, message); err != nil {
+		log.Printf("[%s][%s] Unable to create event: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+	}
+	return false, nil
 }
 
 func getRollingUpdateTimestampsFromNode(node *v1.Node) (minutesSinceStarted int, minutesSinceDrained int, minutesSinceTerminated int) {
@@ -311,7 +818,9 @@ func getRollingUpdateTimestampsFromNode(node *v1.Node) (minutesSinceStarted int,
 
 // SeparateOutdatedFromUpdatedInstances splits a list of instances into a list of outdated
 // instances and a list of updated instances.
-func SeparateOutdatedFromUpdatedInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+//
+// Also returns the reason why each instance is outdated or updated, indexed by instance id
+func SeparateOutdatedFromUpdatedInstances(ctx context.Context, asg *autoscaling.Group, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, map[string]string, error) {
 	if config.Get().Debug {
 		log.Printf("[%s] Separating outdated from updated instances", aws.StringValue(asg.AutoScalingGroupName))
 	}
@@ -326,16 +835,18 @@ func SeparateOutdatedFromUpdatedInstances(asg *autoscaling.Group, ec2Svc ec2ifac
 		targetLaunchTemplateOverrides = asg.MixedInstancesPolicy.LaunchTemplate.Overrides
 	}
 	if targetLaunchTemplate != nil {
-		return SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(targetLaunchTemplate, targetLaunchTemplateOverrides, asg.Instances, ec2Svc)
+		return SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(ctx, targetLaunchTemplate, targetLaunchTemplateOverrides, asg.Instances, ec2Svc)
 	} else if targetLaunchConfiguration != nil {
 		return SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(targetLaunchConfiguration, asg.Instances)
 	}
-	return nil, nil, errors.New("AutoScalingGroup has neither launch template nor launch configuration")
+	return nil, nil, nil, errors.New("AutoScalingGroup has neither launch template nor launch configuration")
 }
 
 // SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate separates a list of instances into a list of outdated
 // instances and a list of updated instances.
-func SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(targetLaunchTemplate *autoscaling.LaunchTemplateSpecification, overrides []*autoscaling.LaunchTemplateOverrides, instances []*autoscaling.Instance, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+//
+// Also returns the reason why each instance is outdated or updated, indexed by instance id
+func SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(ctx context.Context, targetLaunchTemplate *autoscaling.LaunchTemplateSpecification, overrides []*autoscaling.LaunchTemplateOverrides, instances []*autoscaling.Instance, ec2Svc ec2iface.EC2API) ([]*autoscaling.Instance, []*autoscaling.Instance, map[string]string, error) {
 	var (
 		oldInstances   []*autoscaling.Instance
 		newInstances   []*autoscaling.Instance
@@ -344,38 +855,43 @@ func SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(targetLaunchTemplat
 	)
 	switch {
 	case targetLaunchTemplate.LaunchTemplateId != nil && aws.StringValue(targetLaunchTemplate.LaunchTemplateId) != "":
-		if targetTemplate, err = cloud.DescribeLaunchTemplateByID(ec2Svc, aws.StringValue(targetLaunchTemplate.LaunchTemplateId)); err != nil {
-			return nil, nil, fmt.Errorf("error retrieving information about launch template %s: %v", aws.StringValue(targetLaunchTemplate.LaunchTemplateId), err)
+		if targetTemplate, err = cloud.DescribeLaunchTemplateByID(ctx, ec2Svc, aws.StringValue(targetLaunchTemplate.LaunchTemplateId)); err != nil {
+			return nil, nil, nil, fmt.Errorf("error retrieving information about launch template %s: %v", aws.StringValue(targetLaunchTemplate.LaunchTemplateId), err)
 		}
 	case targetLaunchTemplate.LaunchTemplateName != nil && aws.StringValue(targetLaunchTemplate.LaunchTemplateName) != "":
-		if targetTemplate, err = cloud.DescribeLaunchTemplateByName(ec2Svc, aws.StringValue(targetLaunchTemplate.LaunchTemplateName)); err != nil {
-			return nil, nil, fmt.Errorf("error retrieving information about launch template name %s: %v", aws.StringValue(targetLaunchTemplate.LaunchTemplateName), err)
+		if targetTemplate, err = cloud.DescribeLaunchTemplateByName(ctx, ec2Svc, aws.StringValue(targetLaunchTemplate.LaunchTemplateName)); err != nil {
+			return nil, nil, nil, fmt.Errorf("error retrieving information about launch template name %s: %v", aws.StringValue(targetLaunchTemplate.LaunchTemplateName), err)
 		}
 	default:
-		return nil, nil, fmt.Errorf("invalid launch template name")
+		return nil, nil, nil, fmt.Errorf("invalid launch template name")
 	}
 	// extra safety check
 	if targetTemplate == nil {
-		return nil, nil, fmt.Errorf("no template found")
+		return nil, nil, nil, fmt.Errorf("no template found")
 	}
+	reasons := make(map[string]string)
 	// now we can loop through each node and compare
 	for _, instance := range instances {
+		instanceId := aws.StringValue(instance.InstanceId)
 		switch {
 		case instance.LaunchTemplate == nil:
-			fallthrough
+			reasons[instanceId] = fmt.Sprintf("instance has no launch template, but the ASG uses launch template %s", getLaunchTemplateIdentifier(targetLaunchTemplate))
 		case aws.StringValue(instance.LaunchTemplate.LaunchTemplateName) != aws.StringValue(targetLaunchTemplate.LaunchTemplateName):
 			fallthrough
 		case aws.StringValue(instance.LaunchTemplate.LaunchTemplateId) != aws.StringValue(targetLaunchTemplate.LaunchTemplateId):
-			fallthrough
+			reasons[instanceId] = fmt.Sprintf("launch template %s differs from the ASG's launch template %s", getLaunchTemplateIdentifier(instance.LaunchTemplate), getLaunchTemplateIdentifier(targetLaunchTemplate))
 		case !compareLaunchTemplateVersions(targetTemplate, targetLaunchTemplate, instance.LaunchTemplate):
-			fallthrough
+			reasons[instanceId] = fmt.Sprintf("launch template version %s differs from the ASG's launch template version %s", resolveLaunchTemplateVersion(targetTemplate, instance.LaunchTemplate.Version), resolveLaunchTemplateVersion(targetTemplate, targetLaunchTemplate.Version))
 		case overrides != nil && len(overrides) > 0 && !isInstanceTypePartOfLaunchTemplateOverrides(overrides, instance.InstanceType):
-			oldInstances = append(oldInstances, instance)
+			reasons[instanceId] = fmt.Sprintf("instance type %s is not part of the ASG's launch template overrides", aws.StringValue(instance.InstanceType))
 		default:
+			reasons[instanceId] = fmt.Sprintf("launch template %s version %s matches the ASG's", getLaunchTemplateIdentifier(targetLaunchTemplate), resolveLaunchTemplateVersion(targetTemplate, targetLaunchTemplate.Version))
 			newInstances = append(newInstances, instance)
+			continue
 		}
+		oldInstances = append(oldInstances, instance)
 	}
-	return oldInstances, newInstances, nil
+	return oldInstances, newInstances, reasons, nil
 }
 
 func isInstanceTypePartOfLaunchTemplateOverrides(overrides []*autoscaling.LaunchTemplateOverrides, instanceType *string) bool {
@@ -387,21 +903,39 @@ func isInstanceTypePartOfLaunchTemplateOverrides(overrides []*autoscaling.Launch
 	return false
 }
 
+// getLaunchTemplateIdentifier returns the name of a launch template if it is set, or its id otherwise
+func getLaunchTemplateIdentifier(launchTemplate *autoscaling.LaunchTemplateSpecification) string {
+	if name := aws.StringValue(launchTemplate.LaunchTemplateName); len(name) > 0 {
+		return name
+	}
+	return aws.StringValue(launchTemplate.LaunchTemplateId)
+}
+
 // SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration separates a list of instances into a list of outdated
 // instances and a list of updated instances.
-func SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(targetLaunchConfigurationName *string, instances []*autoscaling.Instance) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+//
+// Also returns the reason why each instance is outdated or updated, indexed by instance id
+func SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(targetLaunchConfigurationName *string, instances []*autoscaling.Instance) ([]*autoscaling.Instance, []*autoscaling.Instance, map[string]string, error) {
 	var (
 		oldInstances []*autoscaling.Instance
 		newInstances []*autoscaling.Instance
 	)
+	reasons := make(map[string]string)
 	for _, i := range instances {
+		instanceId := aws.StringValue(i.InstanceId)
 		if i.LaunchConfigurationName != nil && *i.LaunchConfigurationName == *targetLaunchConfigurationName {
+			reasons[instanceId] = fmt.Sprintf("launch configuration %s matches the ASG's", *targetLaunchConfigurationName)
 			newInstances = append(newInstances, i)
 		} else {
+			if i.LaunchConfigurationName == nil {
+				reasons[instanceId] = fmt.Sprintf("instance has no launch configuration, but the ASG uses launch configuration %s", *targetLaunchConfigurationName)
+			} else {
+				reasons[instanceId] = fmt.Sprintf("launch configuration %s differs from the ASG's launch configuration %s", *i.LaunchConfigurationName, *targetLaunchConfigurationName)
+			}
 			oldInstances = append(oldInstances, i)
 		}
 	}
-	return oldInstances, newInstances, nil
+	return oldInstances, newInstances, reasons, nil
 }
 
 // compareLaunchTemplateVersions compare two launch template versions and see if they match
@@ -421,22 +955,17 @@ func compareLaunchTemplateVersions(targetTemplate *ec2.LaunchTemplate, lt1, lt2
 		return false
 	}
 	// if either version starts with `$`, then resolve to actual version from LaunchTemplate
-	var lt1version, lt2version string
-	switch aws.StringValue(lt1.Version) {
-	case "$Default":
-		lt1version = fmt.Sprintf("%d", aws.Int64Value(targetTemplate.DefaultVersionNumber))
-	case "$Latest":
-		lt1version = fmt.Sprintf("%d", aws.Int64Value(targetTemplate.LatestVersionNumber))
-	default:
-		lt1version = aws.StringValue(lt1.Version)
-	}
-	switch aws.StringValue(lt2.Version) {
+	return resolveLaunchTemplateVersion(targetTemplate, lt1.Version) == resolveLaunchTemplateVersion(targetTemplate, lt2.Version)
+}
+
+// resolveLaunchTemplateVersion resolves `$Latest` and `$Default` to the actual version of the target launch template
+func resolveLaunchTemplateVersion(targetTemplate *ec2.LaunchTemplate, version *string) string {
+	switch aws.StringValue(version) {
 	case "$Default":
-		lt2version = fmt.Sprintf("%d", aws.Int64Value(targetTemplate.DefaultVersionNumber))
+		return fmt.Sprintf("%d", aws.Int64Value(targetTemplate.DefaultVersionNumber))
 	case "$Latest":
-		lt2version = fmt.Sprintf("%d", aws.Int64Value(targetTemplate.LatestVersionNumber))
+		return fmt.Sprintf("%d", aws.Int64Value(targetTemplate.LatestVersionNumber))
 	default:
-		lt2version = aws.StringValue(lt2.Version)
+		return aws.StringValue(version)
 	}
-	return lt1version == lt2version
 }
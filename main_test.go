@@ -1,44 +1,64 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
 	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloudtest"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
 	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
 	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8stest"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration_whenInstanceIsOutdated(t *testing.T) {
 	instance := cloudtest.CreateTestAutoScalingInstance("instance", "v1", nil, "InService")
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v2"), []*autoscaling.Instance{instance})
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v2"), []*autoscaling.Instance{instance})
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned", err)
 	}
 	if len(outdated) != 1 || len(updated) != 0 {
 		t.Error("Instance should've been outdated")
 	}
+	if expectedReason := "launch configuration v1 differs from the ASG's launch configuration v2"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration_whenInstanceIsUpdated(t *testing.T) {
 	instance := cloudtest.CreateTestAutoScalingInstance("instance", "v1", nil, "InService")
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v1"), []*autoscaling.Instance{instance})
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v1"), []*autoscaling.Instance{instance})
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned", err)
 	}
 	if len(outdated) != 0 || len(updated) != 1 {
 		t.Error("Instance should've been updated")
 	}
+	if expectedReason := "launch configuration v1 matches the ASG's"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration_whenOneInstanceIsUpdatedAndTwoInstancesAreOutdated(t *testing.T) {
 	firstInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
 	secondInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
 	thirdInstance := cloudtest.CreateTestAutoScalingInstance("new", "v2", nil, "InService")
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v2"), []*autoscaling.Instance{firstInstance, secondInstance, thirdInstance})
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration(aws.String("v2"), []*autoscaling.Instance{firstInstance, secondInstance, thirdInstance})
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned", err)
 	}
@@ -48,6 +68,9 @@ func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchConfiguration_whenOneIns
 	if len(updated) != 1 {
 		t.Error("1 instance should've been outdated")
 	}
+	if len(reasons) != 3 {
+		t.Error("A reason should've been returned for each instance")
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsOutdated(t *testing.T) {
@@ -68,13 +91,16 @@ func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsO
 		LaunchTemplateName:   updatedLaunchTemplate.LaunchTemplateName,
 	}
 	instance := cloudtest.CreateTestAutoScalingInstance("instance", "", outdatedLaunchTemplate, "InService")
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(updatedLaunchTemplate, nil, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(context.TODO(), updatedLaunchTemplate, nil, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned:", err)
 	}
 	if len(outdated) != 1 || len(updated) != 0 {
 		t.Error("Instance should've been outdated")
 	}
+	if expectedReason := "launch template version v1 differs from the ASG's launch template version v2"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsOutdatedDueToMixedInstancesPolicyInstanceTypeGettingRemoved(t *testing.T) {
@@ -96,13 +122,16 @@ func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsO
 		{InstanceType: aws.String("c5d.2xlarge")},
 	}
 	// Notice: The instance's instance type isn't part of the overrides.
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(launchTemplate, overrides, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(context.TODO(), launchTemplate, overrides, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned:", err)
 	}
 	if len(outdated) != 1 || len(updated) != 0 {
 		t.Error("Instance should've been outdated")
 	}
+	if expectedReason := "instance type c5n.2xlarge is not part of the ASG's launch template overrides"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsUpdated(t *testing.T) {
@@ -118,13 +147,16 @@ func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceIsU
 		LaunchTemplateName:   updatedLaunchTemplate.LaunchTemplateName,
 	}
 	instance := cloudtest.CreateTestAutoScalingInstance("instance", "", updatedLaunchTemplate, "InService")
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(updatedLaunchTemplate, nil, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(context.TODO(), updatedLaunchTemplate, nil, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned:", err)
 	}
 	if len(outdated) != 0 || len(updated) != 1 {
 		t.Error("Instance should've been updated")
 	}
+	if expectedReason := "launch template name version v1 matches the ASG's"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceWithMixedInstancesPolicyIsUpdated(t *testing.T) {
@@ -145,13 +177,16 @@ func TestSeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate_whenInstanceWit
 		{InstanceType: aws.String("c5.2xlarge")},
 		{InstanceType: aws.String("c5d.2xlarge")},
 	}
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(launchTemplate, overrides, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstancesUsingLaunchTemplate(context.TODO(), launchTemplate, overrides, []*autoscaling.Instance{instance}, cloudtest.NewMockEC2Service([]*ec2.LaunchTemplate{updatedEc2LaunchTemplate}))
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned:", err)
 	}
 	if len(outdated) != 0 || len(updated) != 1 {
 		t.Error("Instance should've been updated")
 	}
+	if expectedReason := "launch template name version v1 matches the ASG's"; reasons["instance"] != expectedReason {
+		t.Errorf("Expected reason '%s', got '%s'", expectedReason, reasons["instance"])
+	}
 }
 
 func TestSeparateOutdatedFromUpdatedInstances_withLaunchConfigurationWhenOneInstanceIsUpdatedAndTwoInstancesAreOutdated(t *testing.T) {
@@ -161,7 +196,7 @@ func TestSeparateOutdatedFromUpdatedInstances_withLaunchConfigurationWhenOneInst
 
 	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstInstance, secondInstance, thirdInstance}, false)
 
-	outdated, updated, err := SeparateOutdatedFromUpdatedInstances(asg, nil)
+	outdated, updated, reasons, err := SeparateOutdatedFromUpdatedInstances(context.TODO(), asg, nil)
 	if err != nil {
 		t.Fatal("Shouldn't have returned an error, but returned", err)
 	}
@@ -171,6 +206,9 @@ func TestSeparateOutdatedFromUpdatedInstances_withLaunchConfigurationWhenOneInst
 	if len(updated) != 1 {
 		t.Error("1 instance should've been outdated")
 	}
+	if len(reasons) != 3 {
+		t.Error("A reason should've been returned for each instance")
+	}
 }
 
 func TestHandleRollingUpgrade(t *testing.T) {
@@ -185,7 +223,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
 
 	// First run (Node rollout process gets marked as started)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 1 {
 		t.Error("Node should've been annotated, meaning that UpdateNode should've been called once")
 	}
@@ -201,7 +239,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	}
 
 	// Second run (ASG's desired capacity gets increased)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("ASG should've been increased because there's no updated nodes yet")
 	}
@@ -209,13 +247,16 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	if aws.Int64Value(asg.DesiredCapacity) != 2 {
 		t.Error("The desired capacity of the ASG should've been increased to 2")
 	}
+	if originalDesiredCapacity := cloud.GetTagValue(asg, cloud.OriginalDesiredCapacityTagKey); originalDesiredCapacity != "1" {
+		t.Errorf("The original desired capacity of the ASG should've been recorded as 1, got '%s'", originalDesiredCapacity)
+	}
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
 	}
 
 	// Third run (Nothing changed)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -231,7 +272,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	// Fourth run (new instance has been registered to ASG, but is pending)
 	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending")
 	asg.Instances = append(asg.Instances, newInstance)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -242,7 +283,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 
 	// Fifth run (new instance is now InService, but node has still not joined cluster (GetNodeByAwsAutoScalingInstance should return not found))
 	newInstance.SetLifecycleState("InService")
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -252,7 +293,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -262,7 +303,7 @@ func TestHandleRollingUpgrade(t *testing.T) {
 	newNode = mockKubernetesClient.Nodes[newNode.Name]
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; !ok {
 		t.Error("Node should've been drained")
@@ -300,7 +341,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
 
 	// First run (Node rollout process gets marked as started)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 1 {
 		t.Error("Node should've been annotated, meaning that UpdateNode should've been called once")
 	}
@@ -316,7 +357,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	}
 
 	// Second run (ASG's desired capacity gets increased)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("ASG should've been increased because there's no updated nodes yet")
 	}
@@ -330,7 +371,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	}
 
 	// Third run (Nothing changed)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -346,7 +387,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	// Fourth run (new instance has been registered to ASG, but is pending)
 	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "", newLaunchTemplateSpecification, "Pending")
 	asg.Instances = append(asg.Instances, newInstance)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -357,7 +398,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 
 	// Fifth run (new instance is now InService, but node has still not joined cluster (GetNodeByAwsAutoScalingInstance should return not found))
 	newInstance.SetLifecycleState("InService")
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -367,7 +408,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -377,7 +418,7 @@ func TestHandleRollingUpgrade_withLaunchTemplate(t *testing.T) {
 	newNode = mockKubernetesClient.Nodes[newNode.Name]
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; !ok {
 		t.Error("Node should've been drained")
@@ -409,7 +450,7 @@ func TestHandleRollingUpgrade_withLaunchTemplateWhenLaunchTemplateDidNotUpdate(t
 	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
 
 	// First run (No changes, no updates)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 0 {
 		t.Error("The LT hasn't been updated, therefore nothing should've changed")
 	}
@@ -432,7 +473,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
 
 	// First run (Node rollout process gets marked as started)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 1 {
 		t.Error("Node should've been annotated, meaning that UpdateNode should've been called once")
 	}
@@ -448,7 +489,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	}
 
 	// Second run (ASG's desired capacity gets increased)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("ASG should've been increased because there's no updated nodes yet")
 	}
@@ -462,7 +503,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	}
 
 	// Third run (Nothing changed)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -478,7 +519,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	// Fourth run (new instance has been registered to ASG, but is pending)
 	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending")
 	asg.Instances = append(asg.Instances, newInstance)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
 		t.Error("Desired capacity shouldn't have been updated")
 	}
@@ -489,7 +530,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 
 	// Fifth run (new instance is now InService, but node has still not joined cluster (GetNodeByAwsAutoScalingInstance should return not found))
 	newInstance.SetLifecycleState("InService")
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -499,7 +540,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
@@ -509,14 +550,14 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	newNode = mockKubernetesClient.Nodes[newNode.Name]
 	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
 	mockKubernetesClient.Nodes[newNode.Name] = newNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; ok {
 		t.Error("Node shouldn't have been drained yet, therefore shouldn't have been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey)
 	}
 
 	// Eight run (ASG's desired capacity gets increased)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 2 {
 		t.Error("ASG should've been increased again")
 	}
@@ -535,7 +576,7 @@ func TestHandleRollingUpgrade_withEnoughPodsToRequireTwoNewNodes(t *testing.T) {
 	newSecondNode := k8stest.CreateTestNode("new-node-2", aws.StringValue(newSecondInstance.AvailabilityZone), aws.StringValue(newSecondInstance.InstanceId), "1000m", "1000Mi")
 	newSecondNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
 	mockKubernetesClient.Nodes[newSecondNode.Name] = newSecondNode
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
 	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateDrainedTimestampAnnotationKey]; !ok {
 		t.Error("Node should've been drained")
@@ -577,7 +618,7 @@ func TestHandleRollingUpgrade_withMixedInstancePolicyWhenOneOfTheInstanceTypesOv
 	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
 
 	// First run (Nothing changed)
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 0 {
 		t.Error("Nothing should've changed")
 	}
@@ -590,8 +631,2219 @@ func TestHandleRollingUpgrade_withMixedInstancePolicyWhenOneOfTheInstanceTypesOv
 	})
 
 	// Second run
-	HandleRollingUpgrade(mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
 	if mockKubernetesClient.Counter["UpdateNode"] != 1 {
 		t.Error("The old instance's instance type is no longer part of the ASG's MixedInstancePolicy's LaunchTemplate overrides, therefore, it is outdated and should've been annotated")
 	}
 }
+
+func TestHandleRollingUpgrade_withEvictedWorkloadsVerification(t *testing.T) {
+	config.Get().VerifyEvictedWorkloads = true
+	config.Get().EvictedWorkloadsVerificationTimeout = time.Hour
+	defer func() {
+		config.Get().VerifyEvictedWorkloads = false
+		config.Get().EvictedWorkloadsVerificationTimeout = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.EvictedWorkloadsAnnotationKey] = "ReplicaSet//replica-set"
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, nil)
+	replicaSet := k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	replicas := int32(1)
+	replicaSet.Spec.Replicas = &replicas
+	mockKubernetesClient.ReplicaSets[replicaSet.Name] = replicaSet
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// First run (evicted workload isn't ready yet, so the node shouldn't be terminated)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the evicted workload isn't healthy yet")
+	}
+
+	// Second run (verification times out, so the rolling update should be paused)
+	config.Get().EvictedWorkloadsVerificationTimeout = 0
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the verification timed out")
+	}
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if oldNode.Annotations[k8s.RollingUpdatePausedAnnotationKey] != "true" {
+		t.Error("Node should've been annotated with", k8s.RollingUpdatePausedAnnotationKey)
+	}
+
+	// Third run (the evicted workload is now healthy, but the rolling update is still paused)
+	replicaSet.Status.ReadyReplicas = 1
+	mockKubernetesClient.ReplicaSets[replicaSet.Name] = replicaSet
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the rolling update is paused")
+	}
+
+	// Fourth run (the rolling update has been resumed)
+	delete(oldNode.Annotations, k8s.RollingUpdatePausedAnnotationKey)
+	mockKubernetesClient.Nodes[oldNode.Name] = oldNode
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated, because the rolling update has been resumed")
+	}
+}
+
+func TestHandleRollingUpgrade_withEvictedWorkloadsVerificationWhenAnnotationIsMalformed(t *testing.T) {
+	config.Get().VerifyEvictedWorkloads = true
+	config.Get().EvictedWorkloadsVerificationTimeout = time.Hour
+	defer func() {
+		config.Get().VerifyEvictedWorkloads = false
+		config.Get().EvictedWorkloadsVerificationTimeout = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.EvictedWorkloadsAnnotationKey] = "malformed"
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because its evicted workloads couldn't be verified")
+	}
+
+	// The node is held until the annotation is fixed
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	oldNode.Annotations[k8s.EvictedWorkloadsAnnotationKey] = ""
+	mockKubernetesClient.Nodes[oldNode.Name] = oldNode
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated, because the annotation no longer lists any evicted workload")
+	}
+}
+
+func TestHandleRollingUpgrade_withStuckTermination(t *testing.T) {
+	config.Get().StuckTerminationThreshold = 10 * time.Minute
+	defer func() {
+		config.Get().StuckTerminationThreshold = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	ec2Instance := cloudtest.CreateTestEc2Instance(aws.StringValue(oldInstance.InstanceId))
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)] = ec2Instance
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// First run (the instance is still InService, so the termination should be re-issued)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Termination should've been re-issued")
+	}
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if terminatedAt, _ := getTimeFromAnnotation(&oldNode, k8s.RollingUpdateTerminatedTimestampAnnotationKey); time.Since(terminatedAt) > time.Minute {
+		t.Error("The terminated-at annotation should've been reset")
+	}
+
+	// Second run (the termination isn't stuck anymore, because the annotation was reset)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Termination shouldn't have been re-issued again")
+	}
+
+	// Third run (the instance has been terminated and removed from the ASG, but the node lingers)
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	oldNode.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	mockKubernetesClient.Nodes[oldNode.Name] = oldNode
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameTerminated)}
+	asg.Instances = nil
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["DeleteNode"] != 0 {
+		t.Error("Lingering node shouldn't have been deleted, because DeleteNodeAfterTermination is disabled")
+	}
+
+	// Fourth run (same as the third run, but the deletion of nodes after termination is enabled)
+	config.Get().DeleteNodeAfterTermination = true
+	defer func() {
+		config.Get().DeleteNodeAfterTermination = false
+	}()
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["DeleteNode"] != 1 {
+		t.Error("Lingering node should've been deleted")
+	}
+	if _, ok := mockKubernetesClient.Nodes[oldNode.Name]; ok {
+		t.Error("Lingering node should no longer exist")
+	}
+}
+
+func TestHandleRollingUpgrade_withStuckDrain(t *testing.T) {
+	config.Get().StuckDrainThreshold = 10 * time.Minute
+	defer func() {
+		config.Get().StuckDrainThreshold = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The updated instance never becomes ready, so without recovery, the drained node would never be terminated
+	config.Get().StuckDrainThreshold = 0
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the updated instance isn't ready and recovery is disabled")
+	}
+
+	config.Get().StuckDrainThreshold = 10 * time.Minute
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated, because it has been drained for longer than the stuck drain threshold")
+	}
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if _, ok := oldNode.GetAnnotations()[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; !ok {
+		t.Error("Node should've been annotated with", k8s.RollingUpdateTerminatedTimestampAnnotationKey)
+	}
+}
+
+func TestHandleRollingUpgrade_withStuckDrainsAfterSurge(t *testing.T) {
+	config.Get().StuckDrainThreshold = 10 * time.Minute
+	defer func() {
+		config.Get().StuckDrainThreshold = 0
+	}()
+	firstOldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	secondOldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstOldInstance, secondOldInstance, newInstance}, false)
+	// The desired capacity was increased from the min size of 2 to 3 to make room for the pods of the first node
+	asg.SetMinSize(2)
+	asg.SetDesiredCapacity(3)
+
+	firstOldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(firstOldInstance.AvailabilityZone), aws.StringValue(firstOldInstance.InstanceId), "1000m", "1000Mi")
+	firstOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	firstOldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	secondOldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(secondOldInstance.AvailabilityZone), aws.StringValue(secondOldInstance.InstanceId), "1000m", "1000Mi")
+	secondOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	secondOldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode, newNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 2 {
+		t.Errorf("Both nodes should've been terminated, because they have been drained for longer than the stuck drain threshold, got %d terminations", mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"])
+	}
+	// Only the surge capacity can be removed, otherwise the desired capacity would go below the min size
+	if decrements := mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroupAndDecrementDesiredCapacity"]; decrements != 1 {
+		t.Errorf("Only one of the terminations should've decremented the desired capacity, got %d", decrements)
+	}
+}
+
+func TestHandleRollingUpgrade_withStuckDrainOfInstanceWithVolumesAndLoadBalancers(t *testing.T) {
+	config.Get().StuckDrainThreshold = 10 * time.Minute
+	config.Get().WaitForLoadBalancerDeregistration = true
+	config.Get().WaitForVolumeDetachment = true
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+	asg.TargetGroupARNs = []*string{aws.String("target-group")}
+	mockELBV2Service := cloudtest.NewMockELBV2Service(map[string][]string{"target-group": {"old-1"}})
+	elbv2Service = mockELBV2Service
+	defer func() {
+		config.Get().StuckDrainThreshold = 0
+		config.Get().WaitForLoadBalancerDeregistration = false
+		config.Get().WaitForVolumeDetachment = false
+		elbv2Service = nil
+	}()
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, nil)
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", oldNode.Name, "pv-1")
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The recovery of the stuck drain must go through the same steps as any other termination
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["CreateNodeEvent"] != 2 {
+		t.Errorf("An event should've been created for the volume detachment timing out and another for the recovery, got %d", mockKubernetesClient.Counter["CreateNodeEvent"])
+	}
+	if mockELBV2Service.Counter["DeregisterTargets"] != 1 {
+		t.Error("Instance should've been deregistered from the target group before being terminated")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated, because it has been drained for longer than the stuck drain threshold")
+	}
+}
+
+func TestHandleRollingUpgrade_withStuckTerminationOfInstanceWaitingOnLifecycleHook(t *testing.T) {
+	config.Get().StuckTerminationThreshold = 10 * time.Minute
+	defer func() {
+		config.Get().StuckTerminationThreshold = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, autoscaling.LifecycleStateTerminatingWait)
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	ec2Instance := cloudtest.CreateTestEc2Instance(aws.StringValue(oldInstance.InstanceId))
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)] = ec2Instance
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockEc2Service.Counter["TerminateInstances"] != 0 || mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 || mockAutoScalingService.Counter["DetachInstances"] != 0 {
+		t.Error("The instance is held by a termination lifecycle hook, so it shouldn't have been terminated directly")
+	}
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if terminatedAt, _ := getTimeFromAnnotation(&oldNode, k8s.RollingUpdateTerminatedTimestampAnnotationKey); time.Since(terminatedAt) < time.Minute {
+		t.Error("The terminated-at annotation shouldn't have been reset, since nothing was done")
+	}
+}
+
+func TestHandleRollingUpgrade_whenRollingUpdateIsAborted(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+	asg.MinSize = aws.Int64(1)
+	asg.Tags = []*autoscaling.TagDescription{{Key: aws.String(cloud.RollingUpdateAbortedTagKey), Value: aws.String("true")}}
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.CordonedAnnotationKey] = "true"
+	oldNode.Spec.Unschedulable = true
+	oldNode.Spec.Taints = []v1.Taint{{Key: k8s.UnschedulableTaintKey, Effect: v1.TaintEffectNoSchedule}, {Key: "dedicated", Effect: v1.TaintEffectNoSchedule}}
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 0 || mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("The rolling update has been aborted, so no node should've been drained or terminated")
+	}
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if oldNode.Spec.Unschedulable {
+		t.Error("Node should've been uncordoned")
+	}
+	if len(oldNode.Spec.Taints) != 1 || oldNode.Spec.Taints[0].Key != "dedicated" {
+		t.Error("Only the taints added as a result of the rollout should've been removed, got", oldNode.Spec.Taints)
+	}
+	if k8s.HasRollingUpdateAnnotations(&oldNode) {
+		t.Error("The rollout annotations should've been cleared, got", oldNode.Annotations)
+	}
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 0 {
+		t.Error("The desired capacity shouldn't have been scaled down, because the ASG would've terminated an instance without draining it")
+	}
+}
+
+func TestHandleRollingUpgrade_whenRollingUpdateIsAbortedAfterSurge(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	firstNewInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	secondNewInstance := cloudtest.CreateTestAutoScalingInstance("new-2", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, firstNewInstance, secondNewInstance}, false)
+	// The desired capacity was increased from 2 to 3 during the rolling update
+	asg.Tags = []*autoscaling.TagDescription{
+		{Key: aws.String(cloud.RollingUpdateAbortedTagKey), Value: aws.String("true")},
+		{Key: aws.String(cloud.OriginalDesiredCapacityTagKey), Value: aws.String("2")},
+	}
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	firstNewNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(firstNewInstance.AvailabilityZone), aws.StringValue(firstNewInstance.InstanceId), "1000m", "1000Mi")
+	firstNewNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	secondNewNode := k8stest.CreateTestNode("new-node-2", aws.StringValue(secondNewInstance.AvailabilityZone), aws.StringValue(secondNewInstance.InstanceId), "1000m", "1000Mi")
+	secondNewNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	// The first updated node would be removed first, but it has been paused by an operator
+	firstNewNode.Annotations[k8s.RollingUpdatePausedAnnotationKey] = "true"
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, firstNewNode, secondNewNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 0 {
+		t.Error("The desired capacity shouldn't have been scaled down, because the ASG would've terminated an instance without draining it")
+	}
+	if mockKubernetesClient.Counter["Drain"] != 1 || mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroupAndDecrementDesiredCapacity"] != 1 || mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("A single updated node should've been drained and terminated while decrementing the desired capacity, to remove the surge capacity")
+	}
+	if _, ok := mockKubernetesClient.Nodes[secondNewNode.Name].Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; !ok {
+		t.Error("The second updated node should've been terminated")
+	}
+	if oldNode = mockKubernetesClient.Nodes[oldNode.Name]; k8s.HasRollingUpdateAnnotations(&oldNode) {
+		t.Error("The outdated node should've been rolled back, got", oldNode.Annotations)
+	}
+	if firstNewNode = mockKubernetesClient.Nodes[firstNewNode.Name]; !isNodePaused(&firstNewNode) || k8s.HasRollingUpdateAnnotations(&firstNewNode) {
+		t.Error("The updated node paused by an operator should've been left as is, got", firstNewNode.Annotations)
+	}
+
+	// The desired capacity has been decremented by the termination
+	asg.DesiredCapacity = aws.Int64(2)
+	asg.Instances = []*autoscaling.Instance{oldInstance, firstNewInstance}
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("No other node should've been terminated, because the surge capacity has been removed")
+	}
+	if len(cloud.GetTagValue(asg, cloud.OriginalDesiredCapacityTagKey)) != 0 {
+		t.Error("The original desired capacity tag should've been deleted once the surge capacity was removed")
+	}
+}
+
+func TestHandleRollingUpgrade_whenLaunchConfigurationIsRevertedMidRollout(t *testing.T) {
+	instance := cloudtest.CreateTestAutoScalingInstance("instance-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{instance}, false)
+
+	node := k8stest.CreateTestNode("node-1", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId), "1000m", "1000Mi")
+	node.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	node.Annotations[k8s.CordonedAnnotationKey] = "true"
+	node.Spec.Unschedulable = true
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	node = mockKubernetesClient.Nodes[node.Name]
+	if node.Spec.Unschedulable || k8s.HasRollingUpdateAnnotations(&node) {
+		t.Error("Node is no longer outdated, so it should've been rolled back")
+	}
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 0 {
+		t.Error("No surge capacity was added, so the desired capacity shouldn't have been modified")
+	}
+}
+
+func TestHandleRollingUpgrade_whenLaunchConfigurationIsRevertedMidRolloutOfNodeCordonedBeforehand(t *testing.T) {
+	instance := cloudtest.CreateTestAutoScalingInstance("instance-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{instance}, false)
+
+	node := k8stest.CreateTestNode("node-1", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId), "1000m", "1000Mi")
+	node.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	node.Annotations[k8s.TaintsAnnotationKey] = k8s.OutdatedTaintKey
+	// The node was cordoned, tainted and paused by an operator before its rollout started
+	node.Annotations[k8s.RollingUpdatePausedAnnotationKey] = "true"
+	node.Spec.Unschedulable = true
+	node.Spec.Taints = []v1.Taint{
+		{Key: k8s.UnschedulableTaintKey, Effect: v1.TaintEffectNoSchedule},
+		{Key: k8s.HandlerPrefix + "maintenance", Effect: v1.TaintEffectNoSchedule},
+		{Key: k8s.OutdatedTaintKey, Effect: v1.TaintEffectPreferNoSchedule},
+	}
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	node = mockKubernetesClient.Nodes[node.Name]
+	if k8s.HasRollingUpdateAnnotations(&node) {
+		t.Error("Node is no longer outdated, so its rollout annotations should've been cleared, got", node.Annotations)
+	}
+	if !node.Spec.Unschedulable {
+		t.Error("Node wasn't cordoned by the rollout, so it should still be cordoned")
+	}
+	if len(node.Spec.Taints) != 2 || node.Spec.Taints[0].Key != k8s.UnschedulableTaintKey || node.Spec.Taints[1].Key != k8s.HandlerPrefix+"maintenance" {
+		t.Error("Only the taints added by the rollout should've been removed, got", node.Spec.Taints)
+	}
+	if !isNodePaused(&node) {
+		t.Error("Node was paused by an operator, so it should still be paused")
+	}
+}
+
+func TestHandleRollingUpgrade_withOutdatedNodeTaintEffect(t *testing.T) {
+	config.Get().OutdatedNodeTaintEffect = string(v1.TaintEffectPreferNoSchedule)
+	defer func() {
+		config.Get().OutdatedNodeTaintEffect = ""
+	}()
+	firstOldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	secondOldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstOldInstance, secondOldInstance}, false)
+
+	firstOldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(firstOldInstance.AvailabilityZone), aws.StringValue(firstOldInstance.InstanceId), "1000m", "1000Mi")
+	secondOldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(secondOldInstance.AvailabilityZone), aws.StringValue(secondOldInstance.InstanceId), "1000m", "1000Mi")
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode}, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	for _, node := range mockKubernetesClient.Nodes {
+		if len(node.Spec.Taints) != 1 || node.Spec.Taints[0].Key != k8s.OutdatedTaintKey || node.Spec.Taints[0].Effect != v1.TaintEffectPreferNoSchedule {
+			t.Errorf("Outdated node %s should've been tainted, got %v", node.Name, node.Spec.Taints)
+		}
+	}
+
+	// The launch configuration is reverted, so the nodes are no longer outdated
+	asg.LaunchConfigurationName = aws.String("v1")
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	for _, node := range mockKubernetesClient.Nodes {
+		if len(node.Spec.Taints) != 0 {
+			t.Errorf("Node %s is no longer outdated, so its taint should've been removed, got %v", node.Name, node.Spec.Taints)
+		}
+	}
+}
+
+func TestHandleRollingUpgrade_withMaxUnavailable(t *testing.T) {
+	var oldInstances []*autoscaling.Instance
+	var nodes []v1.Node
+	var pods []v1.Pod
+	for _, name := range []string{"old-1", "old-2", "old-3"} {
+		oldInstance := cloudtest.CreateTestAutoScalingInstance(name, "v1", nil, "InService")
+		oldInstances = append(oldInstances, oldInstance)
+		oldNode := k8stest.CreateTestNode(name+"-node", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+		oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+		nodes = append(nodes, oldNode)
+		pods = append(pods, k8stest.CreateTestPod(name+"-pod", oldNode.Name, "400m", "400Mi", false, v1.PodRunning))
+	}
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	nodes = append(nodes, newNode)
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, append(oldInstances, newInstance), false)
+	asg.Tags = []*autoscaling.TagDescription{{Key: aws.String(cloud.MaxUnavailableTagKey), Value: aws.String("3")}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nodes, pods)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The updated node only has enough resources for the pods of 2 of the 3 outdated nodes, so even though up to 3
+	// nodes may be unavailable, only 2 should be replaced, and the ASG should be scaled up for the third one
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 2 {
+		t.Errorf("2 nodes should've been drained, but %d were", mockKubernetesClient.Counter["Drain"])
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 2 {
+		t.Errorf("2 nodes should've been terminated, but %d were", mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"])
+	}
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 1 {
+		t.Error("ASG should've been scaled up, because there's not enough resources left for the third node")
+	}
+}
+
+func TestHandleRollingUpgrade_withMaxUnavailableReached(t *testing.T) {
+	firstOldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	secondOldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstOldInstance, secondOldInstance, newInstance}, false)
+
+	// The first node has been drained, but is waiting for its evicted workloads to be healthy before being terminated
+	config.Get().VerifyEvictedWorkloads = true
+	config.Get().EvictedWorkloadsVerificationTimeout = time.Hour
+	defer func() {
+		config.Get().VerifyEvictedWorkloads = false
+		config.Get().EvictedWorkloadsVerificationTimeout = 0
+	}()
+	firstOldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(firstOldInstance.AvailabilityZone), aws.StringValue(firstOldInstance.InstanceId), "1000m", "1000Mi")
+	firstOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	firstOldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	firstOldNode.Annotations[k8s.EvictedWorkloadsAnnotationKey] = "ReplicaSet//replica-set"
+	secondOldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(secondOldInstance.AvailabilityZone), aws.StringValue(secondOldInstance.InstanceId), "1000m", "1000Mi")
+	secondOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode, newNode}, nil)
+	replicaSet := k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.ReplicaSets[replicaSet.Name] = replicaSet
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("The second node shouldn't have been drained, because the first node is still unavailable and the default maximum number of unavailable nodes is 1")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("The first node shouldn't have been terminated, because its evicted workloads aren't healthy yet")
+	}
+}
+
+func TestHandleRollingUpgrade_withMaxUnavailableNotReachedByDrainedNode(t *testing.T) {
+	firstOldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	secondOldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstOldInstance, secondOldInstance, newInstance}, false)
+	asg.Tags = []*autoscaling.TagDescription{{Key: aws.String(cloud.MaxUnavailableTagKey), Value: aws.String("2")}}
+
+	// The first node has been drained, but is waiting for its evicted workloads to be healthy before being terminated
+	config.Get().VerifyEvictedWorkloads = true
+	config.Get().EvictedWorkloadsVerificationTimeout = time.Hour
+	defer func() {
+		config.Get().VerifyEvictedWorkloads = false
+		config.Get().EvictedWorkloadsVerificationTimeout = 0
+	}()
+	firstOldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(firstOldInstance.AvailabilityZone), aws.StringValue(firstOldInstance.InstanceId), "1000m", "1000Mi")
+	firstOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	firstOldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	firstOldNode.Annotations[k8s.EvictedWorkloadsAnnotationKey] = "ReplicaSet//replica-set"
+	secondOldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(secondOldInstance.AvailabilityZone), aws.StringValue(secondOldInstance.InstanceId), "1000m", "1000Mi")
+	secondOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode, newNode}, nil)
+	replicaSet := k8stest.CreateTestReplicaSet("replica-set", "deployment")
+	mockKubernetesClient.ReplicaSets[replicaSet.Name] = replicaSet
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 1 {
+		t.Errorf("The second node should've been drained, because only the first node is unavailable and up to 2 nodes may be unavailable, but %d were drained", mockKubernetesClient.Counter["Drain"])
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Errorf("Only the second node should've been terminated, because the evicted workloads of the first node aren't healthy yet, but %d were terminated", mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"])
+	}
+}
+
+func TestHandleRollingUpgrade_withMultipleAutoScalingGroupsInParallel(t *testing.T) {
+	config.Get().AutoScalingGroupConcurrency = 2
+	initializeDrainSemaphore(1)
+	defer func() {
+		config.Get().AutoScalingGroupConcurrency = 0
+		initializeDrainSemaphore(0)
+	}()
+	var autoScalingGroups []*autoscaling.Group
+	var nodes []v1.Node
+	var pods []v1.Pod
+	for _, name := range []string{"asg-1", "asg-2"} {
+		oldInstance := cloudtest.CreateTestAutoScalingInstance(name+"-old", "v1", nil, "InService")
+		oldNode := k8stest.CreateTestNode(name+"-old-node", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+		oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+		newInstance := cloudtest.CreateTestAutoScalingInstance(name+"-new", "v2", nil, "InService")
+		newNode := k8stest.CreateTestNode(name+"-new-node", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+		newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+		nodes = append(nodes, oldNode, newNode)
+		pods = append(pods, k8stest.CreateTestPod(name+"-pod", oldNode.Name, "400m", "400Mi", false, v1.PodRunning))
+		autoScalingGroups = append(autoScalingGroups, cloudtest.CreateTestAutoScalingGroup(name, "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false))
+	}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nodes, pods)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService(autoScalingGroups)
+
+	// Each ASG has its own updated node, so both outdated nodes should be replaced during the same execution
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, autoScalingGroups)
+	if mockKubernetesClient.Counter["Drain"] != 2 {
+		t.Errorf("2 nodes should've been drained, but %d were", mockKubernetesClient.Counter["Drain"])
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 2 {
+		t.Errorf("2 nodes should've been terminated, but %d were", mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"])
+	}
+	if len(drainSemaphore) != 0 {
+		t.Error("All drain slots should've been released")
+	}
+}
+
+func TestHandleRollingUpgrade_withMultipleAutoScalingGroupsInParallelReservingResourcesOfTheirOwnUpdatedNodes(t *testing.T) {
+	config.Get().AutoScalingGroupConcurrency = 2
+	defer func() {
+		config.Get().AutoScalingGroupConcurrency = 0
+	}()
+	var autoScalingGroups []*autoscaling.Group
+	var nodes []v1.Node
+	var pods []v1.Pod
+	for _, name := range []string{"asg-1", "asg-2"} {
+		oldInstance := cloudtest.CreateTestAutoScalingInstance(name+"-old", "v1", nil, "InService")
+		oldNode := k8stest.CreateTestNode(name+"-old-node", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+		oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+		newInstance := cloudtest.CreateTestAutoScalingInstance(name+"-new", "v2", nil, "InService")
+		newNode := k8stest.CreateTestNode(name+"-new-node", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+		newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+		nodes = append(nodes, oldNode, newNode)
+		pods = append(pods, k8stest.CreateTestPod(name+"-pod", oldNode.Name, "600m", "600Mi", false, v1.PodRunning))
+		autoScalingGroups = append(autoScalingGroups, cloudtest.CreateTestAutoScalingGroup(name, "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false))
+	}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nodes, pods)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService(autoScalingGroups)
+
+	// The resources reserved by the first ASG were reserved out of its own updated node, so they must not be
+	// subtracted from the resources available in the updated node of the second one
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, autoScalingGroups)
+	if mockKubernetesClient.Counter["Drain"] != 2 {
+		t.Errorf("2 nodes should've been drained, but %d were", mockKubernetesClient.Counter["Drain"])
+	}
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 0 {
+		t.Error("Neither ASG should've been scaled up, because each updated node has enough resources for the pods of the outdated node of its ASG")
+	}
+}
+
+func TestHandleRollingUpgrade_withFailingAutoScalingGroup(t *testing.T) {
+	failingAutoScalingGroup := cloudtest.CreateTestAutoScalingGroup("failing-asg", "", nil, []*autoscaling.Instance{cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")}, false)
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{cloudtest.CreateTestAutoScalingInstance("new-1", "v1", nil, "InService")}, false)
+	autoScalingGroups := []*autoscaling.Group{failingAutoScalingGroup, asg}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nil, nil)
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService(autoScalingGroups)
+
+	// The failing ASG has neither a launch template nor a launch configuration
+	err := HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, autoScalingGroups)
+	autoScalingGroupErrors, ok := err.(AutoScalingGroupErrors)
+	if !ok {
+		t.Fatalf("Should've returned AutoScalingGroupErrors, got %v", err)
+	}
+	if len(autoScalingGroupErrors) != 1 || autoScalingGroupErrors["failing-asg"] == nil {
+		t.Errorf("Only the failing ASG should've returned an error, got %v", autoScalingGroupErrors)
+	}
+}
+
+func TestHandleRollingUpgrade_withInstanceWaitingOnTerminationLifecycleHook(t *testing.T) {
+	config.Get().LifecycleHookName = "drain"
+	defer func() {
+		config.Get().LifecycleHookName = ""
+	}()
+	// The instance is being terminated outside of a rolling update (e.g. scale-in), so it isn't outdated
+	terminatingInstance := cloudtest.CreateTestAutoScalingInstance("terminating-1", "v1", nil, autoscaling.LifecycleStateTerminatingWait)
+	terminatingNode := k8stest.CreateTestNode("terminating-node-1", aws.StringValue(terminatingInstance.AvailabilityZone), aws.StringValue(terminatingInstance.InstanceId), "1000m", "1000Mi")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{terminatingInstance}, false)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{terminatingNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 1 {
+		t.Error("Node of the terminating instance should've been drained")
+	}
+	if mockAutoScalingService.Counter["CompleteLifecycleAction"] != 1 {
+		t.Error("Lifecycle action should've been completed")
+	}
+	if aws.StringValue(terminatingInstance.LifecycleState) != autoscaling.LifecycleStateTerminatingProceed {
+		t.Errorf("Instance should've been in lifecycle state %s, but was in %s", autoscaling.LifecycleStateTerminatingProceed, aws.StringValue(terminatingInstance.LifecycleState))
+	}
+	if _, ok := mockKubernetesClient.Nodes[terminatingNode.Name].Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey]; !ok {
+		t.Error("Node should've been annotated with the drained timestamp")
+	}
+}
+
+func TestHandleRollingUpgrade_withAlreadyDrainedInstanceWaitingOnTerminationLifecycleHook(t *testing.T) {
+	config.Get().LifecycleHookName = "drain"
+	defer func() {
+		config.Get().LifecycleHookName = ""
+	}()
+	terminatingInstance := cloudtest.CreateTestAutoScalingInstance("terminating-1", "v1", nil, autoscaling.LifecycleStateTerminatingWait)
+	terminatingNode := k8stest.CreateTestNode("terminating-node-1", aws.StringValue(terminatingInstance.AvailabilityZone), aws.StringValue(terminatingInstance.InstanceId), "1000m", "1000Mi")
+	terminatingNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	terminatingNode.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{terminatingInstance}, false)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{terminatingNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The node was already drained by the rolling update, so the lifecycle action should be completed right away
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("Node should not have been drained again")
+	}
+	if mockAutoScalingService.Counter["CompleteLifecycleAction"] != 1 {
+		t.Error("Lifecycle action should've been completed")
+	}
+}
+
+func TestHandleRollingUpgrade_withLoadBalancerDeregistration(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+	asg.TargetGroupARNs = []*string{aws.String("target-group")}
+	asg.LoadBalancerNames = []*string{aws.String("classic-load-balancer")}
+	config.Get().WaitForLoadBalancerDeregistration = true
+	mockELBV2Service := cloudtest.NewMockELBV2Service(map[string][]string{"target-group": {"old-1", "new-1"}})
+	mockELBService := cloudtest.NewMockELBService(map[string][]string{"classic-load-balancer": {"old-1", "new-1"}})
+	elbv2Service, elbService = mockELBV2Service, mockELBService
+	defer func() {
+		config.Get().WaitForLoadBalancerDeregistration = false
+		elbv2Service, elbService = nil, nil
+	}()
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockELBV2Service.Counter["DeregisterTargets"] != 1 {
+		t.Error("Instance should've been deregistered from the target group")
+	}
+	if mockELBService.Counter["DeregisterInstancesFromLoadBalancer"] != 1 {
+		t.Error("Instance should've been deregistered from the classic load balancer")
+	}
+	if _, ok := mockELBV2Service.Targets["target-group"]["old-1"]; ok {
+		t.Error("Outdated instance should no longer be registered in the target group")
+	}
+	if _, ok := mockELBV2Service.Targets["target-group"]["new-1"]; !ok {
+		t.Error("Updated instance should still be registered in the target group")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated once the instance was deregistered")
+	}
+}
+
+func TestHandleRollingUpgrade_withLoadBalancerDeregistrationExceedingDeregistrationDelay(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+	asg.TargetGroupARNs = []*string{aws.String("target-group")}
+	config.Get().WaitForLoadBalancerDeregistration = true
+	mockELBV2Service := cloudtest.NewMockELBV2Service(map[string][]string{"target-group": {"old-1", "new-1"}})
+	mockELBV2Service.KeepDraining = true
+	elbv2Service = mockELBV2Service
+	defer func() {
+		config.Get().WaitForLoadBalancerDeregistration = false
+		elbv2Service = nil
+	}()
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The target never leaves the draining state, but the deregistration delay of 0 seconds has already passed
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockELBV2Service.Counter["DescribeTargetHealth"] == 0 {
+		t.Error("Target health should've been checked")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated once the deregistration delay passed")
+	}
+}
+
+func TestHandleRollingUpgrade_withVolumeDetachmentTimeout(t *testing.T) {
+	config.Get().WaitForVolumeDetachment = true
+	defer func() {
+		config.Get().WaitForVolumeDetachment = false
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", oldNode.Name, "pv-1")
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The volume never gets detached, but the volume detachment timeout of 0 has already passed
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["GetVolumeAttachmentsInNode"] == 0 {
+		t.Error("Volume attachments should've been checked")
+	}
+	if mockKubernetesClient.Counter["CreateNodeEvent"] != 1 {
+		t.Error("An event should've been created, because the volume detachment timed out")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated once the volume detachment timed out")
+	}
+}
+
+func TestWaitForVolumeDetachment(t *testing.T) {
+	config.Get().WaitForVolumeDetachment = true
+	config.Get().VolumeDetachmentTimeout = 50 * time.Millisecond
+	VolumeDetachmentPollInterval = 10 * time.Millisecond
+	defer func() {
+		config.Get().WaitForVolumeDetachment = false
+		config.Get().VolumeDetachmentTimeout = 0
+		VolumeDetachmentPollInterval = 5 * time.Second
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", oldNode.Name, "pv-1")
+
+	if !waitForVolumeDetachment(context.TODO(), mockKubernetesClient, asg, oldInstance) {
+		t.Error("Instance should've been allowed to be terminated once the volume detachment timed out")
+	}
+	if mockKubernetesClient.Counter["GetVolumeAttachmentsInNode"] < 2 {
+		t.Error("Volume attachments should've been checked more than once")
+	}
+	// The node is only looked up by instance once, and then retrieved by name on every poll
+	if mockKubernetesClient.Counter["GetNodeByAwsAutoScalingInstance"] != 1 {
+		t.Errorf("Node should've been looked up by instance once, got %d lookups", mockKubernetesClient.Counter["GetNodeByAwsAutoScalingInstance"])
+	}
+	if mockKubernetesClient.Counter["GetNode"] == 0 {
+		t.Error("Node should've been retrieved by name to refresh its attached volumes")
+	}
+}
+
+func TestHandleRollingUpgrade_withVolumesDetached(t *testing.T) {
+	config.Get().WaitForVolumeDetachment = true
+	config.Get().VolumeDetachmentTimeout = time.Minute
+	defer func() {
+		config.Get().WaitForVolumeDetachment = false
+		config.Get().VolumeDetachmentTimeout = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	// The volume is attached to the updated node, so it shouldn't prevent the outdated node from being terminated
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", newNode.Name, "pv-1")
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["CreateNodeEvent"] != 0 {
+		t.Error("No event should've been created, because no volumes were attached to the outdated node")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Node should've been terminated")
+	}
+}
+
+func TestHandleRollingUpgrade_whenCancelledWhileWaitingForVolumeDetachment(t *testing.T) {
+	config.Get().WaitForVolumeDetachment = true
+	config.Get().VolumeDetachmentTimeout = time.Minute
+	defer func() {
+		config.Get().WaitForVolumeDetachment = false
+		config.Get().VolumeDetachmentTimeout = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockKubernetesClient.VolumeAttachments["csi-1"] = k8stest.CreateTestVolumeAttachment("csi-1", oldNode.Name, "pv-1")
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The volume never gets detached, so the execution is still waiting when it gets cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := HandleRollingUpgrade(ctx, mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg}); err != nil {
+		t.Error("Shouldn't have returned an error, because the execution was cancelled rather than timed out, but returned", err)
+	}
+	if elapsed := time.Since(start); elapsed >= VolumeDetachmentPollInterval {
+		t.Errorf("Execution should've stopped as soon as it was cancelled, but took %s", elapsed)
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the execution was cancelled before the volume was detached")
+	}
+	if _, ok := mockKubernetesClient.Nodes[oldNode.Name].Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey]; !ok {
+		t.Error("Node should've been annotated with", k8s.RollingUpdateDrainedTimestampAnnotationKey, "so that it isn't drained again on the next execution")
+	}
+}
+
+func TestHandleRollingUpgrade_withDryRun(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+	dryRunKubernetesClient := k8s.NewDryRunKubernetesClient(mockKubernetesClient)
+	dryRunEc2Service := cloud.NewDryRunEC2Service(mockEc2Service)
+	dryRunAutoScalingService := cloud.NewDryRunAutoScalingService(mockAutoScalingService)
+
+	// First run (Node rollout process would be marked as started)
+	HandleRollingUpgrade(context.TODO(), dryRunKubernetesClient, dryRunEc2Service, dryRunAutoScalingService, []*autoscaling.Group{asg})
+	// Second run (Node would be drained and terminated)
+	HandleRollingUpgrade(context.TODO(), dryRunKubernetesClient, dryRunEc2Service, dryRunAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["UpdateNode"] != 0 || mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("Node shouldn't have been annotated or drained, because dry run is enabled")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because dry run is enabled")
+	}
+	node, _ := dryRunKubernetesClient.GetNodeByAwsAutoScalingInstance(context.TODO(), oldInstance)
+	if _, ok := node.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; !ok {
+		t.Error("Node should've been planned for termination, meaning that it should've been annotated with", k8s.RollingUpdateTerminatedTimestampAnnotationKey, "by the dry run client")
+	}
+}
+
+func TestBuildAutoScalingGroupPlan(t *testing.T) {
+	oldInstance1 := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	oldInstance2 := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance1, oldInstance2, newInstance}, false)
+
+	oldNode1 := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance1.AvailabilityZone), aws.StringValue(oldInstance1.InstanceId), "1000m", "1000Mi")
+	oldNode2 := k8stest.CreateTestNode("old-node-2", aws.StringValue(oldInstance2.AvailabilityZone), aws.StringValue(oldInstance2.InstanceId), "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	oldNode1Pod := k8stest.CreateTestPod("old-pod-1", oldNode1.Name, "600m", "600Mi", false, v1.PodRunning)
+	oldNode2Pod := k8stest.CreateTestPod("old-pod-2", oldNode2.Name, "600m", "600Mi", false, v1.PodRunning)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode1, oldNode2, newNode}, []v1.Pod{oldNode1Pod, oldNode2Pod})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+
+	plan := buildAutoScalingGroupPlan(context.TODO(), mockKubernetesClient, mockEc2Service, asg)
+	if len(plan.Error) > 0 || len(plan.BlockedReason) > 0 {
+		t.Fatalf("Plan shouldn't have had an error or been blocked, but had error '%s' and blocked reason '%s'", plan.Error, plan.BlockedReason)
+	}
+	if plan.NodesToAdd != 1 {
+		t.Errorf("1 node should've been added, because the updated node only has enough resources for the pods of one outdated node, but got %d", plan.NodesToAdd)
+	}
+	if len(plan.Instances) != 3 {
+		t.Fatalf("Plan should've had 3 instances, got %d", len(plan.Instances))
+	}
+	if plan.Instances[0].Outdated || plan.Instances[0].Status != "ready" || plan.Instances[0].DrainOrder != 0 {
+		t.Errorf("Updated instance should've been ready and not drained, got %+v", plan.Instances[0])
+	}
+	if !plan.Instances[1].Outdated || plan.Instances[1].DrainOrder != 1 || plan.Instances[1].RequiresNewNode {
+		t.Errorf("First outdated instance should've been drained first without a new node, got %+v", plan.Instances[1])
+	}
+	if !plan.Instances[2].Outdated || plan.Instances[2].DrainOrder != 2 || !plan.Instances[2].RequiresNewNode {
+		t.Errorf("Second outdated instance should've been drained second after a new node is added, got %+v", plan.Instances[2])
+	}
+	if plan.Instances[1].Reason != "launch configuration v1 differs from the ASG's launch configuration v2" {
+		t.Error("Unexpected reason for the outdated instance:", plan.Instances[1].Reason)
+	}
+}
+
+func TestDrainSelector_decide(t *testing.T) {
+	var reserved k8s.Resources
+	selector := &drainSelector{
+		maxUnavailable:           2,
+		numberOfUnavailableNodes: 1,
+		availableResources:       k8s.Resources{Cpu: 1000, Memory: 1000},
+		reserve: func(available, needed k8s.Resources) bool {
+			if !available.Subtract(reserved).CanFit(needed) {
+				return false
+			}
+			reserved = reserved.Add(needed)
+			return true
+		},
+	}
+	if decision := selector.decide(k8s.Resources{Cpu: 1500, Memory: 100}); decision != drainDecisionScaleUp {
+		t.Errorf("expected the node to require a scale up, because its pods need more resources than available, got %d", decision)
+	}
+	if decision := selector.decide(k8s.Resources{Cpu: 600, Memory: 600}); decision != drainDecisionDrain {
+		t.Errorf("expected the node to be drained, got %d", decision)
+	}
+	if reserved.Cpu != 600 || reserved.Memory != 600 {
+		t.Errorf("expected the resources of the drained node to have been reserved, got %+v", reserved)
+	}
+	if decision := selector.decide(k8s.Resources{}); decision != drainDecisionMaxUnavailableReached {
+		t.Errorf("expected the maximum number of unavailable nodes to have been reached, got %d", decision)
+	}
+}
+
+func TestBuildAutoScalingGroupPlan_whenOutdatedNodeHasAlreadyBeenDrained(t *testing.T) {
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	oldNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+
+	plan := buildAutoScalingGroupPlan(context.TODO(), mockKubernetesClient, mockEc2Service, asg)
+	if plan.BlockedReason != "waiting for 1 updated nodes/instances to be ready" {
+		t.Error("Plan should've been blocked by the pending instance, got", plan.BlockedReason)
+	}
+	if plan.NodesToAdd != 0 || plan.Instances[1].DrainOrder != 0 {
+		t.Error("Outdated node shouldn't have been drained again, because it has already been drained")
+	}
+	if plan.Instances[0].Status != "instance is Pending" {
+		t.Error("Unexpected status for the updated instance:", plan.Instances[0].Status)
+	}
+}
+
+func TestHandleRollingUpgrade_withDeleteNodeAfterTermination(t *testing.T) {
+	config.Get().DeleteNodeAfterTermination = true
+	defer func() {
+		config.Get().DeleteNodeAfterTermination = false
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	ec2Instance := cloudtest.CreateTestEc2Instance(aws.StringValue(oldInstance.InstanceId))
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)] = ec2Instance
+	mockEc2Service.Instances[aws.StringValue(newInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(newInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(newInstance.InstanceId)].State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// First run (the outdated node is drained and scheduled for termination)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Fatal("Node should've been scheduled for termination")
+	}
+
+	// Second run (the instance is still shutting down, so the node shouldn't be deleted yet)
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameShuttingDown)}
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["DeleteNode"] != 0 {
+		t.Error("Node shouldn't have been deleted, because its instance hasn't been terminated yet")
+	}
+
+	// Third run (the instance has been terminated)
+	ec2Instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameTerminated)}
+	asg.Instances = []*autoscaling.Instance{newInstance}
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["DeleteNode"] != 1 {
+		t.Error("Node should've been deleted, because its instance has been terminated")
+	}
+	if _, ok := mockKubernetesClient.Nodes[oldNode.Name]; ok {
+		t.Error("Node should no longer exist")
+	}
+	if _, ok := mockKubernetesClient.Nodes[newNode.Name]; !ok {
+		t.Error("Updated node should still exist")
+	}
+	if mockKubernetesClient.Counter["CreateNodeEvent"] != 1 {
+		t.Error("The deletion of the node should've been recorded in an event")
+	}
+}
+
+func TestHandleRollingUpgrade_withOutdatedOrphanInstance(t *testing.T) {
+	config.Get().OrphanInstanceGracePeriod = 15 * time.Minute
+	defer func() {
+		config.Get().OrphanInstanceGracePeriod = 0
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(oldInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)].LaunchTime = aws.Time(time.Now().Add(-time.Hour))
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("Nothing should've been drained, because the outdated instance has no node")
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Outdated instance should've been terminated, because it never registered as a node")
+	}
+}
+
+func TestHandleRollingUpgrade_withPendingInstanceWithoutNode(t *testing.T) {
+	config.Get().OrphanInstanceGracePeriod = 15 * time.Minute
+	defer func() {
+		config.Get().OrphanInstanceGracePeriod = 0
+	}()
+	// The instance is held by a launch lifecycle hook, so it cannot have registered as a node yet
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending:Wait")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{newInstance}, false)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockEc2Service.Instances[aws.StringValue(newInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(newInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(newInstance.InstanceId)].LaunchTime = aws.Time(time.Now().Add(-time.Hour))
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Instance shouldn't have been terminated, because it is still pending")
+	}
+	if len(cloud.GetTagValue(asg, cloud.OrphanReplacementsTagKey)) != 0 {
+		t.Error("The instance shouldn't have been counted against the orphan instance retry budget")
+	}
+}
+
+func TestHandleRollingUpgrade_withUpdatedOrphanInstances(t *testing.T) {
+	config.Get().OrphanInstanceGracePeriod = 15 * time.Minute
+	config.Get().OrphanInstanceRetryBudget = 1
+	defer func() {
+		config.Get().OrphanInstanceGracePeriod = 0
+		config.Get().OrphanInstanceRetryBudget = 0
+	}()
+	firstInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstInstance}, false)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockEc2Service.Instances[aws.StringValue(firstInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(firstInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(firstInstance.InstanceId)].LaunchTime = aws.Time(time.Now().Add(-time.Hour))
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// First run (the updated instance never registered as a node, so it should be replaced)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Updated instance should've been terminated to be replaced")
+	}
+	if cloud.GetTagValue(asg, cloud.OrphanReplacementsTagKey) != "1" {
+		t.Error("The number of replaced orphan instances should've been tracked")
+	}
+
+	// Second run (the replacement never registered as a node either, and the retry budget has been exhausted)
+	secondInstance := cloudtest.CreateTestAutoScalingInstance("new-2", "v2", nil, "InService")
+	mockEc2Service.Instances[aws.StringValue(secondInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(secondInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(secondInstance.InstanceId)].LaunchTime = aws.Time(time.Now().Add(-time.Hour))
+	asg.Instances = []*autoscaling.Instance{secondInstance}
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Error("Updated instance shouldn't have been replaced, because the retry budget has been exhausted")
+	}
+	if !cloud.HasTag(asg, cloud.FailingTagKey, "true") {
+		t.Error("ASG should've been flagged as failing")
+	}
+
+	// Third run (the instance has finally registered as a node, so the retry budget should be reset)
+	secondNode := k8stest.CreateTestNode("new-node-2", aws.StringValue(secondInstance.AvailabilityZone), aws.StringValue(secondInstance.InstanceId), "1000m", "1000Mi")
+	secondNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	mockKubernetesClient.Nodes[secondNode.Name] = secondNode
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if len(cloud.GetTagValue(asg, cloud.OrphanReplacementsTagKey)) != 0 || cloud.HasTag(asg, cloud.FailingTagKey, "true") {
+		t.Error("The retry budget should've been reset")
+	}
+}
+
+func TestHandleRollingUpgrade_whenUpdatedNodeHasStartupTaint(t *testing.T) {
+	config.Get().StartupTaints = []string{"node.cilium.io/agent-not-ready"}
+	defer func() {
+		config.Get().StartupTaints = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	// The Ready condition isn't the last condition, which shouldn't matter
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}, {Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse}}
+	newNode.Spec.Taints = []v1.Taint{{Key: "node.cilium.io/agent-not-ready", Effect: v1.TaintEffectNoSchedule}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// First run (the updated node still has its startup taint, so it isn't ready)
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("Outdated node shouldn't have been drained, because the updated node still has a startup taint")
+	}
+
+	// Second run (the startup taint has been removed)
+	newNode = mockKubernetesClient.Nodes[newNode.Name]
+	newNode.Spec.Taints = nil
+	mockKubernetesClient.Nodes[newNode.Name] = newNode
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["Drain"] != 1 {
+		t.Error("Outdated node should've been drained, because the updated node is ready")
+	}
+}
+
+func TestController(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	oldNodePod := k8stest.CreateTestPod("old-pod-1", oldNode.Name, "100m", "100Mi", false, v1.PodRunning)
+	unrelatedPod := k8stest.CreateTestPod("unrelated-pod-1", "unrelated-node", "100m", "100Mi", false, v1.PodRunning)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+	controller := NewController(mockKubernetesClient, mockEc2Service, mockAutoScalingService)
+	defer controller.queue.ShutDown()
+
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	if controller.queue.Len() != 1 {
+		t.Fatalf("The ASG should've been enqueued by the resync, but the queue has %d items", controller.queue.Len())
+	}
+	// The updated node isn't ready, so the outdated node shouldn't be drained
+	controller.processNextItem(context.TODO())
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("Outdated node shouldn't have been drained, because the updated node isn't ready")
+	}
+
+	// Events for nodes and pods that don't belong to the ASG shouldn't enqueue anything
+	controller.OnPodEvent(&unrelatedPod)
+	controller.OnNodeEvent(&v1.Node{})
+	// The updated node becoming ready should enqueue the ASG without waiting for the next resync
+	newNode = mockKubernetesClient.Nodes[newNode.Name]
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	mockKubernetesClient.Nodes[newNode.Name] = newNode
+	controller.OnNodeEvent(&newNode)
+	controller.OnPodEvent(&oldNodePod)
+	time.Sleep(EventReconciliationDelay + time.Second)
+	if controller.queue.Len() != 1 {
+		t.Fatalf("The ASG should've been enqueued once by the events, but the queue has %d items", controller.queue.Len())
+	}
+	controller.processNextItem(context.TODO())
+	if mockKubernetesClient.Counter["Drain"] != 1 {
+		t.Error("Outdated node should've been drained, because the updated node is ready")
+	}
+}
+
+func TestController_withConsecutiveReconciliations(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	firstOldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	secondOldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{firstOldInstance, secondOldInstance, newInstance}, false)
+
+	firstOldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(firstOldInstance.AvailabilityZone), aws.StringValue(firstOldInstance.InstanceId), "1000m", "1000Mi")
+	firstOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	secondOldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(secondOldInstance.AvailabilityZone), aws.StringValue(secondOldInstance.InstanceId), "1000m", "1000Mi")
+	secondOldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	// The updated node can fit the pod of either outdated node, but not both at once
+	firstOldNodePod := k8stest.CreateTestPod("old-pod-1", firstOldNode.Name, "600m", "600Mi", false, v1.PodRunning)
+	secondOldNodePod := k8stest.CreateTestPod("old-pod-2", secondOldNode.Name, "600m", "600Mi", false, v1.PodRunning)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{firstOldNode, secondOldNode, newNode}, []v1.Pod{firstOldNodePod, secondOldNodePod})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+	controller := NewController(mockKubernetesClient, mockEc2Service, mockAutoScalingService)
+	defer controller.queue.ShutDown()
+
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	controller.processNextItem(context.TODO())
+	if mockKubernetesClient.Counter["Drain"] != 1 {
+		t.Fatalf("Only the first outdated node should've been drained, because the max unavailable is 1, got %d drains", mockKubernetesClient.Counter["Drain"])
+	}
+	// Once the first node has been drained, the pod of the second node fits in the updated node, so the resources
+	// reserved for the first node by the previous reconciliation must not carry over to the next one
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	controller.processNextItem(context.TODO())
+	if mockKubernetesClient.Counter["Drain"] != 2 {
+		t.Error("The second outdated node should've been drained, because the resources reserved for the first one should've been released")
+	}
+	if mockAutoScalingService.Counter["SetDesiredCapacity"] != 0 {
+		t.Error("The desired capacity shouldn't have been increased, because the updated node has enough resources available")
+	}
+}
+
+func TestController_withAutoScalingGroupBeingReconciled(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	config.Get().DeleteNodeAfterTermination = true
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+		config.Get().DeleteNodeAfterTermination = false
+	}()
+	// The instance has been terminated, but is still listed in the ASG
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "Terminating:Proceed")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)] = cloudtest.CreateTestEc2Instance(aws.StringValue(oldInstance.InstanceId))
+	mockEc2Service.Instances[aws.StringValue(oldInstance.InstanceId)].State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameTerminated)}
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+	controller := NewController(mockKubernetesClient, mockEc2Service, mockAutoScalingService)
+	defer controller.queue.ShutDown()
+
+	// A worker is reconciling the ASG, so the resync must leave its nodes alone
+	locked := controller.tryLockAutoScalingGroups([]string{"asg"})
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	if mockKubernetesClient.Counter["DeleteNode"] != 0 {
+		t.Error("Node shouldn't have been deleted, because its ASG is being reconciled")
+	}
+	controller.unlockAutoScalingGroups(locked)
+
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	if mockKubernetesClient.Counter["DeleteNode"] != 1 {
+		t.Error("Node should've been deleted, because its ASG is no longer being reconciled")
+	}
+
+	// The ASG is being prepared by a resync, so the worker must requeue it instead of reconciling it
+	locked = controller.tryLockAutoScalingGroups([]string{"asg"})
+	defer controller.unlockAutoScalingGroups(locked)
+	describeCount := mockAutoScalingService.Counter["DescribeAutoScalingGroups"]
+	controller.processNextItem(context.TODO())
+	if mockAutoScalingService.Counter["DescribeAutoScalingGroups"] != describeCount {
+		t.Error("The ASG shouldn't have been reconciled, because it is being prepared by a resync")
+	}
+	time.Sleep(EventReconciliationDelay + time.Second)
+	if controller.queue.Len() != 1 {
+		t.Errorf("The ASG should've been requeued, but the queue has %d items", controller.queue.Len())
+	}
+}
+
+func TestController_OnNodeGroupRolloutEvent(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg", "other-asg"}
+	config.Get().NodeGroupRollouts = true
+	defer func() {
+		refreshNodeGroupRollouts(context.TODO(), k8stest.NewMockKubernetesClient(nil, nil), nil)
+		config.Get().AutoScalingGroupNames = nil
+		config.Get().NodeGroupRollouts = false
+	}()
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{}, false)
+	otherAsg := cloudtest.CreateTestAutoScalingGroup("other-asg", "v2", nil, []*autoscaling.Instance{}, false)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{}, []v1.Pod{})
+	oldRollout := v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Generation: 1},
+		Spec:       v1alpha1.NodeGroupRolloutSpec{AutoScalingGroupNames: []string{"asg"}},
+	}
+	mockKubernetesClient.NodeGroupRollouts["payments"] = oldRollout
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg, otherAsg})
+	controller := NewController(mockKubernetesClient, mockEc2Service, mockAutoScalingService)
+	defer controller.queue.ShutDown()
+
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	for controller.queue.Len() > 0 {
+		item, _ := controller.queue.Get()
+		controller.queue.Done(item)
+	}
+	if rollout := getNodeGroupRollout(asg); rollout == nil || rollout.Spec.Paused {
+		t.Fatal("asg should've been selected by the NodeGroupRollout, which isn't paused")
+	}
+	// The NodeGroupRollout is paused and now selects other-asg instead of asg
+	rollout := *oldRollout.DeepCopy()
+	rollout.Generation = 2
+	rollout.Spec = v1alpha1.NodeGroupRolloutSpec{AutoScalingGroupNames: []string{"other-asg"}, Paused: true}
+	mockKubernetesClient.NodeGroupRollouts["payments"] = rollout
+	controller.OnNodeGroupRolloutEvent(&oldRollout, &rollout)
+	if controller.queue.Len() != 2 {
+		t.Errorf("Both the ASG selected before the change and the ASG selected after the change should've been enqueued, but the queue has %d items", controller.queue.Len())
+	}
+	if getNodeGroupRollout(asg) != nil {
+		t.Error("asg shouldn't be selected by the NodeGroupRollout anymore")
+	}
+	if rollout := getNodeGroupRollout(otherAsg); rollout == nil || !rollout.Spec.Paused {
+		t.Error("The change to the NodeGroupRollout should've been taken into account before the next resync")
+	}
+}
+
+func TestController_Run(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	instance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{instance}, false)
+	node := k8stest.CreateTestNode("new-node-1", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId), "1000m", "1000Mi")
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+	controller := NewController(mockKubernetesClient, mockEc2Service, mockAutoScalingService)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		controller.Run(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run should've returned after its context was cancelled")
+	}
+	if !controller.queue.ShuttingDown() {
+		t.Error("The queue should've been shut down")
+	}
+}
+
+func TestController_ServeHTTP(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v1", nil, []*autoscaling.Instance{}, false)
+	controller := NewController(k8stest.NewMockKubernetesClient([]v1.Node{}, []v1.Pod{}), cloudtest.NewMockEC2Service(nil), cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg}))
+	defer controller.queue.ShutDown()
+	if err := controller.Resync(context.TODO()); err != nil {
+		t.Fatal("Shouldn't have returned an error, but returned", err)
+	}
+	controller.processNextItem(context.TODO())
+
+	scenarios := []struct {
+		method             string
+		target             string
+		expectedStatusCode int
+		expectedQueueLen   int
+	}{
+		{method: http.MethodGet, target: TriggerPath, expectedStatusCode: http.StatusMethodNotAllowed, expectedQueueLen: 0},
+		{method: http.MethodPost, target: TriggerPath + "?autoScalingGroupName=other-asg", expectedStatusCode: http.StatusNotFound, expectedQueueLen: 0},
+		{method: http.MethodPost, target: TriggerPath + "?autoScalingGroupName=asg", expectedStatusCode: http.StatusAccepted, expectedQueueLen: 1},
+		{method: http.MethodPost, target: TriggerPath, expectedStatusCode: http.StatusAccepted, expectedQueueLen: 1},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.method+" "+scenario.target, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			controller.ServeHTTP(recorder, httptest.NewRequest(scenario.method, scenario.target, nil))
+			if recorder.Code != scenario.expectedStatusCode {
+				t.Errorf("expected status code %d, got %d", scenario.expectedStatusCode, recorder.Code)
+			}
+			if controller.queue.Len() != scenario.expectedQueueLen {
+				t.Errorf("expected %d items in the queue, got %d", scenario.expectedQueueLen, controller.queue.Len())
+			}
+			if controller.queue.Len() > 0 {
+				controller.processNextItem(context.TODO())
+			}
+		})
+	}
+}
+
+func TestLeaderOnlyHandler(t *testing.T) {
+	controller := NewController(k8stest.NewMockKubernetesClient([]v1.Node{}, []v1.Pod{}), cloudtest.NewMockEC2Service(nil), cloudtest.NewMockAutoScalingService(nil))
+	defer controller.queue.ShutDown()
+	recorder := httptest.NewRecorder()
+	leaderOnlyHandler(func() bool { return false }, controller).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, TriggerPath, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, because this replica isn't the leader, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	leaderOnlyHandler(func() bool { return true }, controller).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, TriggerPath, nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("expected status code %d, because this replica is the leader, got %d", http.StatusAccepted, recorder.Code)
+	}
+}
+
+func TestRunOnce_whenAllInstancesAreUpdated(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	instance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{instance}, false)
+	node := k8stest.CreateTestNode("new-node-1", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId), "1000m", "1000Mi")
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{node}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	output := &bytes.Buffer{}
+	if exitCode := RunOnce(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, time.Minute, output); exitCode != RunOnceExitCodeSucceeded {
+		t.Errorf("Exit code should've been %d, got %d", RunOnceExitCodeSucceeded, exitCode)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Output should've had 1 progress record and 1 result record, got %d lines", len(lines))
+	}
+	var progress RunOnceProgress
+	if err := json.Unmarshal([]byte(lines[0]), &progress); err != nil || progress.AutoScalingGroup != "asg" || !progress.Updated || progress.UpdatedReadyNodes != 1 {
+		t.Error("Unexpected progress record:", lines[0])
+	}
+	var result RunOnceResult
+	if err := json.Unmarshal([]byte(lines[1]), &result); err != nil || result.Result != RunOnceResultSucceeded {
+		t.Error("Unexpected result record:", lines[1])
+	}
+}
+
+func TestRunOnce_whenDeadlineIsReachedBeforeAllInstancesAreUpdated(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "Pending")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	// The updated instance never becomes ready, so the outdated node can never be replaced
+	output := &bytes.Buffer{}
+	if exitCode := RunOnce(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, 100*time.Millisecond, output); exitCode != RunOnceExitCodeOutdated {
+		t.Errorf("Exit code should've been %d, got %d", RunOnceExitCodeOutdated, exitCode)
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because the updated instance isn't ready")
+	}
+	if !strings.Contains(output.String(), `"result":"outdated"`) {
+		t.Error("Output should've ended with an outdated result, got", output.String())
+	}
+}
+
+func TestRunOnce_whenRollingUpdateIsAborted(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+	asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(cloud.RollingUpdateAbortedTagKey), Value: aws.String("true")})
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	output := &bytes.Buffer{}
+	if exitCode := RunOnce(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, time.Minute, output); exitCode != RunOnceExitCodeFailed {
+		t.Errorf("Exit code should've been %d, got %d", RunOnceExitCodeFailed, exitCode)
+	}
+	if !strings.Contains(output.String(), `"result":"failed"`) {
+		t.Error("Output should've ended with a failed result, got", output.String())
+	}
+}
+
+func TestRunOnce_whenAutoScalingGroupIsFailing(t *testing.T) {
+	config.Get().AutoScalingGroupNames = []string{"asg"}
+	defer func() {
+		config.Get().AutoScalingGroupNames = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance}, false)
+	asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(cloud.FailingTagKey), Value: aws.String("true")})
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	output := &bytes.Buffer{}
+	if exitCode := RunOnce(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, time.Minute, output); exitCode != RunOnceExitCodeFailed {
+		t.Errorf("Exit code should've been %d, got %d", RunOnceExitCodeFailed, exitCode)
+	}
+	if !strings.Contains(output.String(), `"failing":true`) || !strings.Contains(output.String(), `"result":"failed"`) {
+		t.Error("Output should've flagged the ASG as failing and ended with a failed result, got", output.String())
+	}
+}
+
+func TestCountFailedExecutionsByAutoScalingGroup(t *testing.T) {
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{}, false)
+	otherAsg := cloudtest.CreateTestAutoScalingGroup("other-asg", "v2", nil, []*autoscaling.Instance{}, false)
+	autoScalingGroups := []*autoscaling.Group{asg, otherAsg}
+	failedExecutionsByAutoScalingGroup := make(map[string]int)
+	for i := 1; i < MaximumFailedExecutionBeforePanic; i++ {
+		if message := countFailedExecutionsByAutoScalingGroup(failedExecutionsByAutoScalingGroup, autoScalingGroups, AutoScalingGroupErrors{"asg": errors.New("error")}); len(message) != 0 {
+			t.Fatalf("Execution %d shouldn't have failed the command, got '%s'", i, message)
+		}
+	}
+	// An execution where the ASG succeeds resets its count
+	countFailedExecutionsByAutoScalingGroup(failedExecutionsByAutoScalingGroup, autoScalingGroups, nil)
+	if failedExecutionsByAutoScalingGroup["asg"] != 0 {
+		t.Errorf("Failed executions of the ASG should've been reset, got %d", failedExecutionsByAutoScalingGroup["asg"])
+	}
+	for i := 1; i <= MaximumFailedExecutionBeforePanic; i++ {
+		message := countFailedExecutionsByAutoScalingGroup(failedExecutionsByAutoScalingGroup, autoScalingGroups, AutoScalingGroupErrors{"asg": errors.New("error")})
+		if i < MaximumFailedExecutionBeforePanic && len(message) != 0 {
+			t.Fatalf("Execution %d shouldn't have failed the command, got '%s'", i, message)
+		} else if i == MaximumFailedExecutionBeforePanic && !strings.Contains(message, "asg failed 10 times in a row") {
+			t.Errorf("Execution %d should've failed the command, got '%s'", i, message)
+		}
+	}
+	if _, exists := failedExecutionsByAutoScalingGroup["other-asg"]; exists {
+		t.Error("The ASG that never failed shouldn't have been counted")
+	}
+}
+
+func TestNodeGroupRollout(t *testing.T) {
+	config.Get().NodeGroupRollouts = true
+	defer func() {
+		refreshNodeGroupRollouts(context.TODO(), k8stest.NewMockKubernetesClient(nil, nil), nil)
+		config.Get().NodeGroupRollouts = false
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+	asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String("team"), Value: aws.String("payments")})
+	otherAsg := cloudtest.CreateTestAutoScalingGroup("other-asg", "v2", nil, []*autoscaling.Instance{}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	maxUnavailable := intstr.FromString("50%")
+	mockKubernetesClient.NodeGroupRollouts["payments"] = v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Generation: 2},
+		Spec: v1alpha1.NodeGroupRolloutSpec{
+			AutoScalingGroupTags: map[string]string{"team": "payments"},
+			MaxUnavailable:       &maxUnavailable,
+			MigrationStrategy:    config.MigrationStrategyScaleUp,
+		},
+	}
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg, otherAsg})
+
+	refreshNodeGroupRollouts(context.TODO(), mockKubernetesClient, []*autoscaling.Group{asg, otherAsg})
+	if getNodeGroupRollout(otherAsg) != nil {
+		t.Error("other-asg shouldn't have been selected, because it doesn't have the tag selected by the NodeGroupRollout")
+	}
+	if maxUnavailable := getMaxUnavailable(asg); maxUnavailable != 1 {
+		t.Errorf("Max unavailable should've been 50%% of 2 nodes, got %d", maxUnavailable)
+	}
+	if migrationStrategy := getMigrationStrategy(asg); migrationStrategy != config.MigrationStrategyScaleUp {
+		t.Errorf("Migration strategy should've been overridden by the NodeGroupRollout, got %s", migrationStrategy)
+	}
+
+	// First run (Node rollout process gets marked as started)
+	handleRollingUpgradeForAutoScalingGroupWithTimeout(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, asg)
+	status := mockKubernetesClient.NodeGroupRollouts["payments"].Status
+	if status.Phase != v1alpha1.PhaseInProgress || status.OutdatedInstances != 1 || status.UpdatedInstances != 1 || status.CurrentNode != oldNode.Name {
+		t.Errorf("Status should've reported the rollout of %s as in progress, got %+v", oldNode.Name, status)
+	}
+	if status.ObservedGeneration != 2 || status.StartedAt == nil || status.CompletedAt != nil || status.LastUpdateTime == nil {
+		t.Errorf("Status should've had its generation and timestamps set, got %+v", status)
+	}
+
+	// The status shouldn't be written again if it didn't change
+	mockKubernetesClient.Counter["UpdateNodeGroupRolloutStatus"] = 0
+	updateNodeGroupRolloutStatus(context.TODO(), mockKubernetesClient, mockEc2Service, asg, nil)
+	if mockKubernetesClient.Counter["UpdateNodeGroupRolloutStatus"] != 0 {
+		t.Error("Status shouldn't have been updated, because it didn't change")
+	}
+}
+
+func TestNodeGroupRollout_whenPaused(t *testing.T) {
+	config.Get().NodeGroupRollouts = true
+	defer func() {
+		refreshNodeGroupRollouts(context.TODO(), k8stest.NewMockKubernetesClient(nil, nil), nil)
+		config.Get().NodeGroupRollouts = false
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockKubernetesClient.NodeGroupRollouts["asg"] = v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "asg"},
+		Spec:       v1alpha1.NodeGroupRolloutSpec{AutoScalingGroupNames: []string{"asg"}, Paused: true},
+	}
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	refreshNodeGroupRollouts(context.TODO(), mockKubernetesClient, []*autoscaling.Group{asg})
+	handleRollingUpgradeForAutoScalingGroupWithTimeout(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, asg)
+	if _, ok := mockKubernetesClient.Nodes[oldNode.Name].Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey]; ok {
+		t.Error("Node shouldn't have started rolling out, because the NodeGroupRollout is paused")
+	}
+	if phase := mockKubernetesClient.NodeGroupRollouts["asg"].Status.Phase; phase != v1alpha1.PhasePaused {
+		t.Errorf("Phase should've been %s, got %s", v1alpha1.PhasePaused, phase)
+	}
+}
+
+func TestNodeGroupRollout_withMaxSurge(t *testing.T) {
+	config.Get().NodeGroupRollouts = true
+	defer func() {
+		refreshNodeGroupRollouts(context.TODO(), k8stest.NewMockKubernetesClient(nil, nil), nil)
+		config.Get().NodeGroupRollouts = false
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	oldNodePod := k8stest.CreateTestPod("old-pod-1", oldNode.Name, "100m", "100Mi", false, v1.PodRunning)
+	newNodePod := k8stest.CreateTestPod("new-pod-1", newNode.Name, "950m", "950Mi", false, v1.PodRunning)
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{oldNodePod, newNodePod})
+	maxSurge := intstr.FromInt(3)
+	mockKubernetesClient.NodeGroupRollouts["asg"] = v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "asg"},
+		Spec:       v1alpha1.NodeGroupRolloutSpec{AutoScalingGroupNames: []string{"asg"}, MaxSurge: &maxSurge},
+	}
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	refreshNodeGroupRollouts(context.TODO(), mockKubernetesClient, []*autoscaling.Group{asg})
+	plan := buildAutoScalingGroupPlan(context.TODO(), mockKubernetesClient, mockEc2Service, asg)
+	if plan.NodesToAdd != 3 {
+		t.Errorf("The plan should've added 3 nodes, because the max surge is 3, got %d", plan.NodesToAdd)
+	}
+	HandleRollingUpgradeForAutoScalingGroup(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, asg)
+	if desiredCapacity := aws.Int64Value(asg.DesiredCapacity); desiredCapacity != 5 {
+		t.Errorf("The desired capacity should've been increased from 2 to 5, because the max surge is 3, got %d", desiredCapacity)
+	}
+
+	asg.SetDesiredCapacity(2)
+	asg.SetMaxSize(3)
+	if surge := getScaleUpSurge(asg, aws.Int64Value(asg.DesiredCapacity)); surge != 1 {
+		t.Errorf("The surge should've been capped to the room left below the max size, got %d", surge)
+	}
+}
+
+func TestHandleRollingUpgrade_whenRollingUpdateIsPaused(t *testing.T) {
+	config.Get().PauseConfigMap = "kube-system/rolling-update-pause"
+	config.Get().OutdatedNodeTaintEffect = string(v1.TaintEffectPreferNoSchedule)
+	defer func() {
+		config.Get().PauseConfigMap = ""
+		config.Get().OutdatedNodeTaintEffect = ""
+	}()
+	scenarios := []struct {
+		name       string
+		tags       []*autoscaling.TagDescription
+		configMaps map[string]v1.ConfigMap
+	}{
+		{
+			name: "tag",
+			tags: []*autoscaling.TagDescription{{Key: aws.String(cloud.RollingUpdatePausedTagKey), Value: aws.String("true")}},
+		},
+		{
+			name: "configmap-paused",
+			configMaps: map[string]v1.ConfigMap{
+				"kube-system/rolling-update-pause": {Data: map[string]string{PauseConfigMapPausedKey: "true"}},
+			},
+		},
+		{
+			name: "configmap-paused-asgs",
+			configMaps: map[string]v1.ConfigMap{
+				"kube-system/rolling-update-pause": {Data: map[string]string{PauseConfigMapPausedAutoScalingGroupsKey: "other-asg, asg"}},
+			},
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			drainedInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+			oldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+			newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+			asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{drainedInstance, oldInstance, newInstance}, false)
+			asg.Tags = scenario.tags
+
+			drainedNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(drainedInstance.AvailabilityZone), aws.StringValue(drainedInstance.InstanceId), "1000m", "1000Mi")
+			drainedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+			drainedNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+			oldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+			newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+			newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+			mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{drainedNode, oldNode, newNode}, []v1.Pod{})
+			for key, configMap := range scenario.configMaps {
+				mockKubernetesClient.ConfigMaps[key] = configMap
+			}
+			mockEc2Service := cloudtest.NewMockEC2Service(nil)
+			mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+			HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+			if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+				t.Error("The node that had already been drained should've been terminated")
+			}
+			if _, ok := mockKubernetesClient.Nodes[oldNode.Name].Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey]; ok {
+				t.Error("Node shouldn't have started rolling out, because the rolling update is paused")
+			}
+			if taints := mockKubernetesClient.Nodes[oldNode.Name].Spec.Taints; len(taints) != 0 {
+				t.Errorf("Node shouldn't have been tainted, because the rolling update is paused, got %v", taints)
+			}
+			if reason := getRollingUpdatePausedReason(context.TODO(), mockKubernetesClient, asg, asg.Instances); len(reason) == 0 {
+				t.Error("Rolling update should've been paused")
+			}
+		})
+	}
+}
+
+func TestHandleRollingUpgrade_whenRollingUpdateIsPausedByNodeAnnotation(t *testing.T) {
+	drainedInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	pausedInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-3", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{drainedInstance, pausedInstance, oldInstance, newInstance}, false)
+
+	drainedNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(drainedInstance.AvailabilityZone), aws.StringValue(drainedInstance.InstanceId), "1000m", "1000Mi")
+	drainedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	drainedNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(pausedInstance.AvailabilityZone), aws.StringValue(pausedInstance.InstanceId), "1000m", "1000Mi")
+	pausedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode.Annotations[k8s.RollingUpdatePausedAnnotationKey] = "true"
+	oldNode := k8stest.CreateTestNode("old-node-3", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{drainedNode, pausedNode, oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 1 {
+		t.Errorf("Only the node that had already been drained should've been terminated, got %d terminations", mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"])
+	}
+	if _, ok := mockKubernetesClient.Nodes[drainedNode.Name].Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; !ok {
+		t.Error("The node that had already been drained should've been terminated")
+	}
+	if _, ok := mockKubernetesClient.Nodes[pausedNode.Name].Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; ok {
+		t.Error("The paused node shouldn't have been terminated, because it must be left as is until the annotation is removed")
+	}
+	if mockKubernetesClient.Nodes[oldNode.Name].Spec.Unschedulable {
+		t.Error("Node shouldn't have been cordoned, because the rolling update is paused")
+	}
+	if mockKubernetesClient.Counter["Drain"] != 0 {
+		t.Error("No node should've been drained, because the rolling update is paused")
+	}
+	if reason := getRollingUpdatePausedReason(context.TODO(), mockKubernetesClient, asg, asg.Instances); len(reason) == 0 {
+		t.Error("Rolling update should've been paused")
+	}
+	plan := buildAutoScalingGroupPlan(context.TODO(), mockKubernetesClient, mockEc2Service, asg)
+	if !strings.Contains(plan.BlockedReason, k8s.RollingUpdatePausedAnnotationKey) {
+		t.Errorf("The plan should've been blocked by the annotation of the paused node, got %q", plan.BlockedReason)
+	}
+}
+
+func TestGetRollingUpdatePausedReason_whenConfigMapDoesNotExist(t *testing.T) {
+	config.Get().PauseConfigMap = "kube-system/rolling-update-pause"
+	defer func() {
+		config.Get().PauseConfigMap = ""
+	}()
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, nil, false)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nil, nil)
+	if reason := getRollingUpdatePausedReason(context.TODO(), mockKubernetesClient, asg, nil); len(reason) != 0 {
+		t.Error("Rolling update shouldn't have been paused, because the ConfigMap doesn't exist, got", reason)
+	}
+	mockKubernetesClient.ConfigMaps["kube-system/rolling-update-pause"] = v1.ConfigMap{Data: map[string]string{PauseConfigMapPausedAutoScalingGroupsKey: "other-asg"}}
+	if reason := getRollingUpdatePausedReason(context.TODO(), mockKubernetesClient, asg, nil); len(reason) != 0 {
+		t.Error("Rolling update shouldn't have been paused, because the ASG isn't listed in the ConfigMap, got", reason)
+	}
+}
+
+func TestComputeNodeGroupRolloutStatus(t *testing.T) {
+	startedAt := time.Now().Add(-time.Hour)
+	rollout := &v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "rollout"},
+		Status: v1alpha1.NodeGroupRolloutStatus{
+			Phase:     v1alpha1.PhaseInProgress,
+			StartedAt: &metav1.Time{Time: startedAt},
+			AutoScalingGroups: []v1alpha1.NodeGroupRolloutAutoScalingGroupStatus{
+				{Name: "asg-a", Phase: v1alpha1.PhaseInProgress, OutdatedInstances: 1, UpdatedInstances: 2, CurrentNodes: []string{"node-a"}},
+				{Name: "asg-b", Phase: v1alpha1.PhaseCompleted, UpdatedInstances: 3},
+				{Name: "asg-removed", Phase: v1alpha1.PhaseFailed, LastError: "error"},
+			},
+		},
+	}
+	rolloutNameByAutoScalingGroupName := map[string]string{"asg-a": "rollout", "asg-b": "rollout"}
+	now := time.Now()
+
+	status := computeNodeGroupRolloutStatus(rollout, v1alpha1.NodeGroupRolloutAutoScalingGroupStatus{Name: "asg-a", Phase: v1alpha1.PhaseInProgress, OutdatedInstances: 1, UpdatedInstances: 2, CurrentNodes: []string{"node-a", "node-b"}}, rolloutNameByAutoScalingGroupName, now)
+	if len(status.AutoScalingGroups) != 2 {
+		t.Fatalf("ASGs that are no longer selected should've been removed, got %+v", status.AutoScalingGroups)
+	}
+	if status.Phase != v1alpha1.PhaseInProgress || status.OutdatedInstances != 1 || status.UpdatedInstances != 5 || status.CurrentNode != "node-a,node-b" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if !status.StartedAt.Time.Equal(startedAt) {
+		t.Error("StartedAt shouldn't have changed, because the rollout was already in progress")
+	}
+
+	rollout.Status = status
+	status = computeNodeGroupRolloutStatus(rollout, v1alpha1.NodeGroupRolloutAutoScalingGroupStatus{Name: "asg-a", Phase: v1alpha1.PhaseCompleted, UpdatedInstances: 3}, rolloutNameByAutoScalingGroupName, now)
+	if status.Phase != v1alpha1.PhaseCompleted || status.CompletedAt == nil || !status.CompletedAt.Time.Equal(now) || len(status.CurrentNode) != 0 {
+		t.Errorf("Rollout should've been completed, got %+v", status)
+	}
+
+	rollout.Status = status
+	status = computeNodeGroupRolloutStatus(rollout, v1alpha1.NodeGroupRolloutAutoScalingGroupStatus{Name: "asg-b", Phase: v1alpha1.PhaseFailed, OutdatedInstances: 1, LastError: "unable to describe instances"}, rolloutNameByAutoScalingGroupName, now)
+	if status.Phase != v1alpha1.PhaseFailed || status.LastError != "unable to describe instances" || status.LastErrorTime == nil {
+		t.Errorf("Rollout should've failed, got %+v", status)
+	}
+	if status.CompletedAt != nil || !status.StartedAt.Time.Equal(now) {
+		t.Error("A new rollout should've started, because the rollout was previously completed")
+	}
+}
+
+func TestHandleRollingUpgrade_whenOutsideOfMaintenanceWindows(t *testing.T) {
+	// The maintenance window opens in an hour, and closed 22 hours ago
+	closedMaintenanceWindow, _ := config.NewMaintenanceWindow(fmt.Sprintf("0 %d * * *", time.Now().UTC().Add(time.Hour).Hour()), time.Hour, "UTC")
+	config.Get().MaintenanceWindows = []*config.MaintenanceWindow{closedMaintenanceWindow}
+	defer func() {
+		config.Get().MaintenanceWindows = nil
+		config.Get().MaintenanceWindowClosePolicy = ""
+	}()
+	scenarios := []struct {
+		closePolicy        string
+		expectedTerminated int64
+		expectedRolledBack bool
+	}{
+		{closePolicy: config.MaintenanceWindowClosePolicyFinish, expectedTerminated: 1},
+		{closePolicy: config.MaintenanceWindowClosePolicyRevert, expectedTerminated: 0, expectedRolledBack: true},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.closePolicy, func(t *testing.T) {
+			config.Get().MaintenanceWindowClosePolicy = scenario.closePolicy
+			drainedInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+			oldInstance := cloudtest.CreateTestAutoScalingInstance("old-2", "v1", nil, "InService")
+			newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+			asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{drainedInstance, oldInstance, newInstance}, false)
+
+			drainedNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(drainedInstance.AvailabilityZone), aws.StringValue(drainedInstance.InstanceId), "1000m", "1000Mi")
+			drainedNode.Spec.Unschedulable = true
+			drainedNode.Annotations[k8s.CordonedAnnotationKey] = "true"
+			drainedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+			drainedNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+			oldNode := k8stest.CreateTestNode("old-node-2", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+			newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+			newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+			mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{drainedNode, oldNode, newNode}, []v1.Pod{})
+			mockEc2Service := cloudtest.NewMockEC2Service(nil)
+			mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+			HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+			if terminated := mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"]; terminated != scenario.expectedTerminated {
+				t.Errorf("Expected %d node(s) to have been terminated, got %d", scenario.expectedTerminated, terminated)
+			}
+			if _, ok := mockKubernetesClient.Nodes[oldNode.Name].Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey]; ok {
+				t.Error("Node shouldn't have started rolling out, because the ASG is outside of its maintenance windows")
+			}
+			drainedNode = mockKubernetesClient.Nodes[drainedNode.Name]
+			if rolledBack := !drainedNode.Spec.Unschedulable && !k8s.HasRollingUpdateAnnotations(&drainedNode); rolledBack != scenario.expectedRolledBack {
+				t.Errorf("Expected the drained node to have been rolled back=%v, got %v", scenario.expectedRolledBack, rolledBack)
+			}
+		})
+	}
+}
+
+func TestHandleRollingUpgrade_whenOutsideOfMaintenanceWindowsWithRevertPolicyAndOutdatedNodeTaintEffect(t *testing.T) {
+	// The maintenance window opens in an hour, and closed 22 hours ago
+	closedMaintenanceWindow, _ := config.NewMaintenanceWindow(fmt.Sprintf("0 %d * * *", time.Now().UTC().Add(time.Hour).Hour()), time.Hour, "UTC")
+	config.Get().MaintenanceWindows = []*config.MaintenanceWindow{closedMaintenanceWindow}
+	config.Get().MaintenanceWindowClosePolicy = config.MaintenanceWindowClosePolicyRevert
+	config.Get().OutdatedNodeTaintEffect = string(v1.TaintEffectPreferNoSchedule)
+	defer func() {
+		config.Get().MaintenanceWindows = nil
+		config.Get().MaintenanceWindowClosePolicy = ""
+		config.Get().OutdatedNodeTaintEffect = ""
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	oldNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	oldNode = mockKubernetesClient.Nodes[oldNode.Name]
+	if k8s.HasRollingUpdateAnnotations(&oldNode) || len(oldNode.Spec.Taints) != 0 {
+		t.Errorf("Node should've been rolled back without being tainted, because the ASG is outside of its maintenance windows, got annotations %v and taints %v", oldNode.Annotations, oldNode.Spec.Taints)
+	}
+	numberOfNodeUpdates := mockKubernetesClient.Counter["UpdateNode"]
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if mockKubernetesClient.Counter["UpdateNode"] != numberOfNodeUpdates {
+		t.Error("Node shouldn't have been tainted and rolled back again, because it has already been rolled back")
+	}
+}
+
+func TestHandleRollingUpgrade_whenOutsideOfMaintenanceWindowsWithRevertPolicyAndPausedNode(t *testing.T) {
+	// The maintenance window opens in an hour, and closed 22 hours ago
+	closedMaintenanceWindow, _ := config.NewMaintenanceWindow(fmt.Sprintf("0 %d * * *", time.Now().UTC().Add(time.Hour).Hour()), time.Hour, "UTC")
+	config.Get().MaintenanceWindows = []*config.MaintenanceWindow{closedMaintenanceWindow}
+	config.Get().MaintenanceWindowClosePolicy = config.MaintenanceWindowClosePolicyRevert
+	defer func() {
+		config.Get().MaintenanceWindows = nil
+		config.Get().MaintenanceWindowClosePolicy = ""
+	}()
+	pausedInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{pausedInstance, newInstance}, false)
+
+	// The verification of the workloads evicted from the node timed out, which paused its rollout
+	pausedNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(pausedInstance.AvailabilityZone), aws.StringValue(pausedInstance.InstanceId), "1000m", "1000Mi")
+	pausedNode.Spec.Unschedulable = true
+	pausedNode.Annotations[k8s.CordonedAnnotationKey] = "true"
+	pausedNode.Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode.Annotations[k8s.RollingUpdateDrainedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode.Annotations[k8s.VerificationTimedOutAtAnnotationKey] = time.Now().Format(time.RFC3339)
+	pausedNode.Annotations[k8s.RollingUpdatePausedAnnotationKey] = "true"
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{pausedNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	pausedNode = mockKubernetesClient.Nodes[pausedNode.Name]
+	if !isNodePaused(&pausedNode) {
+		t.Error("Node should've remained paused after the maintenance window closed")
+	}
+	if _, ok := pausedNode.Annotations[k8s.VerificationTimedOutAtAnnotationKey]; !ok || !pausedNode.Spec.Unschedulable {
+		t.Errorf("Node shouldn't have been rolled back, because it's paused, got annotations %v", pausedNode.Annotations)
+	}
+	if mockAutoScalingService.Counter["TerminateInstanceInAutoScalingGroup"] != 0 {
+		t.Error("Node shouldn't have been terminated, because it's paused")
+	}
+}
+
+func TestHandleRollingUpgrade_whenInsideOfMaintenanceWindow(t *testing.T) {
+	openMaintenanceWindow, _ := config.NewMaintenanceWindow("* * * * *", time.Hour, "UTC")
+	config.Get().MaintenanceWindows = []*config.MaintenanceWindow{openMaintenanceWindow}
+	defer func() {
+		config.Get().MaintenanceWindows = nil
+	}()
+	oldInstance := cloudtest.CreateTestAutoScalingInstance("old-1", "v1", nil, "InService")
+	newInstance := cloudtest.CreateTestAutoScalingInstance("new-1", "v2", nil, "InService")
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, []*autoscaling.Instance{oldInstance, newInstance}, false)
+
+	oldNode := k8stest.CreateTestNode("old-node-1", aws.StringValue(oldInstance.AvailabilityZone), aws.StringValue(oldInstance.InstanceId), "1000m", "1000Mi")
+	newNode := k8stest.CreateTestNode("new-node-1", aws.StringValue(newInstance.AvailabilityZone), aws.StringValue(newInstance.InstanceId), "1000m", "1000Mi")
+	newNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	mockKubernetesClient := k8stest.NewMockKubernetesClient([]v1.Node{oldNode, newNode}, []v1.Pod{})
+	mockEc2Service := cloudtest.NewMockEC2Service(nil)
+	mockAutoScalingService := cloudtest.NewMockAutoScalingService([]*autoscaling.Group{asg})
+
+	HandleRollingUpgrade(context.TODO(), mockKubernetesClient, mockEc2Service, mockAutoScalingService, []*autoscaling.Group{asg})
+	if _, ok := mockKubernetesClient.Nodes[oldNode.Name].Annotations[k8s.RollingUpdateStartedTimestampAnnotationKey]; !ok {
+		t.Error("Node should've started rolling out, because the maintenance window is open")
+	}
+}
+
+func TestGetMaintenanceWindowClosedReason_withNodeGroupRollout(t *testing.T) {
+	config.Get().NodeGroupRollouts = true
+	// The global maintenance window is always open, but it is overridden by the NodeGroupRollout
+	openMaintenanceWindow, _ := config.NewMaintenanceWindow("* * * * *", time.Hour, "UTC")
+	config.Get().MaintenanceWindows = []*config.MaintenanceWindow{openMaintenanceWindow}
+	defer func() {
+		refreshNodeGroupRollouts(context.TODO(), k8stest.NewMockKubernetesClient(nil, nil), nil)
+		config.Get().NodeGroupRollouts = false
+		config.Get().MaintenanceWindows = nil
+	}()
+	asg := cloudtest.CreateTestAutoScalingGroup("asg", "v2", nil, nil, false)
+	mockKubernetesClient := k8stest.NewMockKubernetesClient(nil, nil)
+	mockKubernetesClient.NodeGroupRollouts["asg"] = v1alpha1.NodeGroupRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "asg"},
+		Spec: v1alpha1.NodeGroupRolloutSpec{
+			AutoScalingGroupNames:        []string{"asg"},
+			MaintenanceWindows:           []v1alpha1.MaintenanceWindow{{Schedule: "0 22 * * 1-5", Duration: metav1.Duration{Duration: 4 * time.Hour}, Timezone: "Europe/Paris"}},
+			MaintenanceWindowClosePolicy: config.MaintenanceWindowClosePolicyRevert,
+		},
+	}
+	refreshNodeGroupRollouts(context.TODO(), mockKubernetesClient, []*autoscaling.Group{asg})
+	// Thursday 23:00 in Paris
+	if reason := getMaintenanceWindowClosedReason(asg, time.Date(2021, time.January, 7, 22, 0, 0, 0, time.UTC)); len(reason) != 0 {
+		t.Error("The maintenance window of the NodeGroupRollout should've been open, got", reason)
+	}
+	if closesAt, ok := getMaintenanceWindowClosesAt(asg, time.Date(2021, time.January, 7, 22, 0, 0, 0, time.UTC)); !ok || !closesAt.Equal(time.Date(2021, time.January, 8, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("The maintenance window of the NodeGroupRollout should've closed at 01:00 UTC, got %s", closesAt)
+	}
+	// Saturday 12:00 in Paris
+	if reason := getMaintenanceWindowClosedReason(asg, time.Date(2021, time.January, 9, 11, 0, 0, 0, time.UTC)); !strings.Contains(reason, "2021-01-11T22:00:00+01:00") {
+		t.Error("The maintenance window of the NodeGroupRollout should've been closed until Monday, got", reason)
+	}
+	if policy := getMaintenanceWindowClosePolicy(asg); policy != config.MaintenanceWindowClosePolicyRevert {
+		t.Errorf("The close policy should've been %s, got %s", config.MaintenanceWindowClosePolicyRevert, policy)
+	}
+
+	rollout := mockKubernetesClient.NodeGroupRollouts["asg"]
+	rollout.Spec.MaintenanceWindows[0].Schedule = "0 22 * * FOO"
+	mockKubernetesClient.NodeGroupRollouts["asg"] = rollout
+	refreshNodeGroupRollouts(context.TODO(), mockKubernetesClient, []*autoscaling.Group{asg})
+	if reason := getMaintenanceWindowClosedReason(asg, time.Now()); len(reason) == 0 {
+		t.Error("Rollouts should've been prevented, because the maintenance window of the NodeGroupRollout is invalid")
+	}
+}
+
+func TestIsNamespaceEligibleForDeletionFallback(t *testing.T) {
+	defer func() {
+		config.Get().EvictionFallbackToDeletion = false
+		config.Get().EvictionFallbackNamespaces = nil
+	}()
+	if isNamespaceEligibleForDeletionFallback("default") {
+		t.Error("no namespace should be eligible when the fallback to deletion is disabled")
+	}
+	config.Get().EvictionFallbackToDeletion = true
+	if !isNamespaceEligibleForDeletionFallback("default") {
+		t.Error("every namespace should be eligible when the fallback to deletion is enabled without specifying namespaces")
+	}
+	config.Get().EvictionFallbackNamespaces = []string{"batch", "sandbox"}
+	if !isNamespaceEligibleForDeletionFallback("sandbox") {
+		t.Error("namespace 'sandbox' should be eligible, because it's part of the list of namespaces")
+	}
+	if isNamespaceEligibleForDeletionFallback("default") {
+		t.Error("namespace 'default' shouldn't be eligible, because it isn't part of the list of namespaces")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// getMaintenanceWindows resolves the maintenance windows of an ASG, using those of the NodeGroupRollout selecting the
+// ASG if it has any, or config.MaintenanceWindows otherwise.
+// Returns an error if any of the maintenance windows of the NodeGroupRollout is invalid
+func getMaintenanceWindows(autoScalingGroup *autoscaling.Group) ([]*config.MaintenanceWindow, error) {
+	rollout := getNodeGroupRollout(autoScalingGroup)
+	if rollout == nil || len(rollout.Spec.MaintenanceWindows) == 0 {
+		return config.Get().MaintenanceWindows, nil
+	}
+	var maintenanceWindows []*config.MaintenanceWindow
+	for _, rolloutMaintenanceWindow := range rollout.Spec.MaintenanceWindows {
+		timezone := rolloutMaintenanceWindow.Timezone
+		if len(timezone) == 0 {
+			timezone = config.Get().MaintenanceWindowTimezone
+		}
+		maintenanceWindow, err := config.NewMaintenanceWindow(rolloutMaintenanceWindow.Schedule, rolloutMaintenanceWindow.Duration.Duration, timezone)
+		if err != nil {
+			return nil, fmt.Errorf("NodeGroupRollout %s has an invalid maintenance window: %v", rollout.Name, err)
+		}
+		maintenanceWindows = append(maintenanceWindows, maintenanceWindow)
+	}
+	return maintenanceWindows, nil
+}
+
+// getMaintenanceWindowClosePolicy resolves what happens to the nodes of an ASG that are being rolled out when its
+// maintenance window closes, using the NodeGroupRollout selecting the ASG if it has a valid policy, or
+// config.MaintenanceWindowClosePolicy otherwise
+func getMaintenanceWindowClosePolicy(autoScalingGroup *autoscaling.Group) string {
+	if rollout := getNodeGroupRollout(autoScalingGroup); rollout != nil && len(rollout.Spec.MaintenanceWindowClosePolicy) > 0 {
+		switch rollout.Spec.MaintenanceWindowClosePolicy {
+		case config.MaintenanceWindowClosePolicyFinish, config.MaintenanceWindowClosePolicyRevert:
+			return rollout.Spec.MaintenanceWindowClosePolicy
+		default:
+			log.Printf("[%s] Ignoring invalid maintenance window close policy '%s' of NodeGroupRollout %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), rollout.Spec.MaintenanceWindowClosePolicy, rollout.Name)
+		}
+	}
+	if len(config.Get().MaintenanceWindowClosePolicy) == 0 {
+		return config.MaintenanceWindowClosePolicyFinish
+	}
+	return config.Get().MaintenanceWindowClosePolicy
+}
+
+// getMaintenanceWindowClosedReason returns why the rollout of new nodes of an ASG cannot be started at the given
+// time because of its maintenance windows.
+//
+// Returns an empty string if the ASG has no maintenance windows, or if one of them is open
+func getMaintenanceWindowClosedReason(autoScalingGroup *autoscaling.Group, now time.Time) string {
+	maintenanceWindows, err := getMaintenanceWindows(autoScalingGroup)
+	if err != nil {
+		// The maintenance windows may be restricting the rollout, so nothing new is started until they are fixed
+		return err.Error()
+	}
+	if len(maintenanceWindows) == 0 {
+		return ""
+	}
+	var opensAt time.Time
+	for _, maintenanceWindow := range maintenanceWindows {
+		if _, ok := maintenanceWindow.ClosesAt(now); ok {
+			return ""
+		}
+		if nextOpensAt := maintenanceWindow.OpensAt(now); !nextOpensAt.IsZero() && (opensAt.IsZero() || nextOpensAt.Before(opensAt)) {
+			opensAt = nextOpensAt
+		}
+	}
+	if opensAt.IsZero() {
+		return "the ASG is outside of its maintenance windows, which never open"
+	}
+	return fmt.Sprintf("the ASG is outside of its maintenance windows, the next of which opens at %s", opensAt.Format(time.RFC3339))
+}
+
+// getMaintenanceWindowClosesAt returns when the open maintenance window of an ASG that closes the latest closes.
+// Returns false if the ASG has no maintenance windows, or if none of them is open
+func getMaintenanceWindowClosesAt(autoScalingGroup *autoscaling.Group, now time.Time) (time.Time, bool) {
+	maintenanceWindows, err := getMaintenanceWindows(autoScalingGroup)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var closesAt time.Time
+	for _, maintenanceWindow := range maintenanceWindows {
+		if maintenanceWindowClosesAt, ok := maintenanceWindow.ClosesAt(now); ok && maintenanceWindowClosesAt.After(closesAt) {
+			closesAt = maintenanceWindowClosesAt
+		}
+	}
+	return closesAt, !closesAt.IsZero()
+}
+
+// withMaintenanceWindowDeadline creates a context that is cancelled when the open maintenance window of an ASG
+// closes, if the ASG uses the config.MaintenanceWindowClosePolicyRevert policy.
+// Otherwise, the context is only cancelled when the parent context is
+func withMaintenanceWindowDeadline(ctx context.Context, autoScalingGroup *autoscaling.Group) (context.Context, context.CancelFunc) {
+	if getMaintenanceWindowClosePolicy(autoScalingGroup) == config.MaintenanceWindowClosePolicyRevert {
+		if closesAt, ok := getMaintenanceWindowClosesAt(autoScalingGroup, time.Now()); ok {
+			return context.WithDeadline(ctx, closesAt)
+		}
+	}
+	return context.WithCancel(ctx)
+}
+
+// rollbackNodesBeingRolledOut rolls back the nodes of the given outdated instances whose rollout has started, but
+// that haven't been scheduled for termination yet.
+//
+// Paused nodes are left as is, so that their rollout resumes where it left off once they are no longer paused
+func rollbackNodesBeingRolledOut(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, outdatedInstances []*autoscaling.Instance) {
+	var instancesBeingRolledOut []*autoscaling.Instance
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
+		if err != nil {
+			continue
+		}
+		if isNodePaused(node) {
+			log.Printf("[%s][%s] Not rolling back node %s, because it has been annotated with %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), node.Name, k8s.RollingUpdatePausedAnnotationKey)
+			continue
+		}
+		if minutesSinceStarted, _, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node); minutesSinceStarted != -1 && minutesSinceTerminated == -1 {
+			instancesBeingRolledOut = append(instancesBeingRolledOut, outdatedInstance)
+		}
+	}
+	RollbackInstances(ctx, kubernetesClient, autoScalingGroup, instancesBeingRolledOut)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s/v1alpha1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// nodeGroupRollouts contains the NodeGroupRollouts found during the last resync, keyed by name
+	nodeGroupRollouts = make(map[string]*v1alpha1.NodeGroupRollout)
+	// nodeGroupRolloutNameByAutoScalingGroupName maps each ASG to the NodeGroupRollout selecting it
+	nodeGroupRolloutNameByAutoScalingGroupName = make(map[string]string)
+	nodeGroupRolloutsMutex                     sync.Mutex
+)
+
+// refreshNodeGroupRollouts retrieves the NodeGroupRollouts and maps each of the given ASGs to the NodeGroupRollout
+// selecting it, if any. If several NodeGroupRollouts select the same ASG, the first one by name is used.
+//
+// Called on every resync, as well as whenever the NodeGroupRollouts change (see Controller.OnNodeGroupRolloutEvent).
+//
+// Does nothing unless config.NodeGroupRollouts is enabled
+func refreshNodeGroupRollouts(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroups []*autoscaling.Group) {
+	if !config.Get().NodeGroupRollouts {
+		return
+	}
+	items, err := kubernetesClient.GetNodeGroupRollouts(ctx)
+	if err != nil {
+		log.Printf("Unable to get NodeGroupRollouts, keeping the NodeGroupRollouts found during the last resync: %v", err.Error())
+		return
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	rollouts := make(map[string]*v1alpha1.NodeGroupRollout)
+	rolloutNameByAutoScalingGroupName := make(map[string]string)
+	for i := range items {
+		rollout := &items[i]
+		rollouts[rollout.Name] = rollout
+		for _, autoScalingGroup := range autoScalingGroups {
+			if !nodeGroupRolloutSelectsAutoScalingGroup(rollout, autoScalingGroup) {
+				continue
+			}
+			autoScalingGroupName := aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+			if otherRolloutName, ok := rolloutNameByAutoScalingGroupName[autoScalingGroupName]; ok {
+				log.Printf("[%s] Ignoring NodeGroupRollout %s, because the ASG is already selected by NodeGroupRollout %s", autoScalingGroupName, rollout.Name, otherRolloutName)
+				continue
+			}
+			rolloutNameByAutoScalingGroupName[autoScalingGroupName] = rollout.Name
+		}
+	}
+	nodeGroupRolloutsMutex.Lock()
+	defer nodeGroupRolloutsMutex.Unlock()
+	nodeGroupRollouts = rollouts
+	nodeGroupRolloutNameByAutoScalingGroupName = rolloutNameByAutoScalingGroupName
+}
+
+// nodeGroupRolloutSelectsAutoScalingGroup checks whether the ASG has one of the names and every one of the tags
+// selected by the NodeGroupRollout. A NodeGroupRollout that has neither names nor tags selects nothing
+func nodeGroupRolloutSelectsAutoScalingGroup(rollout *v1alpha1.NodeGroupRollout, autoScalingGroup *autoscaling.Group) bool {
+	if len(rollout.Spec.AutoScalingGroupNames) == 0 && len(rollout.Spec.AutoScalingGroupTags) == 0 {
+		return false
+	}
+	if len(rollout.Spec.AutoScalingGroupNames) > 0 {
+		hasName := false
+		for _, name := range rollout.Spec.AutoScalingGroupNames {
+			hasName = hasName || name == aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+		}
+		if !hasName {
+			return false
+		}
+	}
+	for key, value := range rollout.Spec.AutoScalingGroupTags {
+		if !cloud.HasTag(autoScalingGroup, key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// getNodeGroupRollout returns a copy of the NodeGroupRollout selecting the ASG, or nil if there is none
+func getNodeGroupRollout(autoScalingGroup *autoscaling.Group) *v1alpha1.NodeGroupRollout {
+	nodeGroupRolloutsMutex.Lock()
+	defer nodeGroupRolloutsMutex.Unlock()
+	rolloutName, ok := nodeGroupRolloutNameByAutoScalingGroupName[aws.StringValue(autoScalingGroup.AutoScalingGroupName)]
+	if !ok {
+		return nil
+	}
+	return nodeGroupRollouts[rolloutName].DeepCopy()
+}
+
+// getMigrationStrategy resolves the migration strategy of an ASG, using the NodeGroupRollout selecting the ASG if
+// it has a valid strategy, or config.MigrationStrategy otherwise
+func getMigrationStrategy(autoScalingGroup *autoscaling.Group) string {
+	if rollout := getNodeGroupRollout(autoScalingGroup); rollout != nil && len(rollout.Spec.MigrationStrategy) > 0 {
+		switch rollout.Spec.MigrationStrategy {
+		case config.MigrationStrategyEvict, config.MigrationStrategyScaleUp, config.MigrationStrategyRolloutRestart:
+			return rollout.Spec.MigrationStrategy
+		default:
+			log.Printf("[%s] Ignoring invalid migration strategy '%s' of NodeGroupRollout %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), rollout.Spec.MigrationStrategy, rollout.Name)
+		}
+	}
+	return config.Get().MigrationStrategy
+}
+
+// getMaxSurge resolves the number of nodes by which the desired capacity of an ASG is increased whenever its updated
+// nodes don't have enough resources for the pods of the next outdated node, using the NodeGroupRollout selecting the
+// ASG if it sets one, or 1 otherwise. Percentages are relative to the desired capacity of the ASG
+func getMaxSurge(autoScalingGroup *autoscaling.Group) int {
+	rollout := getNodeGroupRollout(autoScalingGroup)
+	if rollout == nil || rollout.Spec.MaxSurge == nil {
+		return 1
+	}
+	// The max surge has the same format as the max unavailable, and is also never lower than 1
+	maxSurge, err := config.ParseMaxUnavailable(rollout.Spec.MaxSurge.String(), int(aws.Int64Value(autoScalingGroup.DesiredCapacity)))
+	if err != nil {
+		log.Printf("[%s] Ignoring invalid maxSurge of NodeGroupRollout %s, defaulting to 1: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), rollout.Name, err.Error())
+		return 1
+	}
+	return maxSurge
+}
+
+// newDrainContext creates the context used to drain a node of an ASG, which is cancelled after the drain timeout of
+// the NodeGroupRollout selecting the ASG, if any
+func newDrainContext(ctx context.Context, autoScalingGroup *autoscaling.Group) (context.Context, context.CancelFunc) {
+	if rollout := getNodeGroupRollout(autoScalingGroup); rollout != nil && rollout.Spec.DrainTimeout != nil && rollout.Spec.DrainTimeout.Duration > 0 {
+		return context.WithTimeout(ctx, rollout.Spec.DrainTimeout.Duration)
+	}
+	return context.WithCancel(ctx)
+}
+
+// updateNodeGroupRolloutStatus updates the status of the NodeGroupRollout selecting an ASG, if any, with the
+// progress of the ASG after it has been handled.
+//
+// The status is only written if it changed
+func updateNodeGroupRolloutStatus(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingGroup *autoscaling.Group, handlingErr error) {
+	if getNodeGroupRollout(autoScalingGroup) == nil {
+		return
+	}
+	autoScalingGroupName := aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+	autoScalingGroupStatus := v1alpha1.NodeGroupRolloutAutoScalingGroupStatus{Name: autoScalingGroupName}
+	outdatedInstances, updatedInstances, _, err := SeparateOutdatedFromUpdatedInstances(ctx, autoScalingGroup, ec2Service)
+	if err != nil && handlingErr == nil {
+		handlingErr = err
+	}
+	autoScalingGroupStatus.OutdatedInstances = len(outdatedInstances)
+	autoScalingGroupStatus.UpdatedInstances = len(updatedInstances)
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
+		if err != nil {
+			continue
+		}
+		if minutesSinceStarted, _, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node); minutesSinceStarted != -1 && minutesSinceTerminated == -1 {
+			autoScalingGroupStatus.CurrentNodes = append(autoScalingGroupStatus.CurrentNodes, node.Name)
+		}
+	}
+	switch {
+	case handlingErr != nil:
+		autoScalingGroupStatus.Phase = v1alpha1.PhaseFailed
+		autoScalingGroupStatus.LastError = handlingErr.Error()
+	case isRollingUpdateAborted(autoScalingGroup):
+		autoScalingGroupStatus.Phase = v1alpha1.PhaseFailed
+		autoScalingGroupStatus.LastError = "the rolling update has been aborted"
+	case len(outdatedInstances) == 0:
+		autoScalingGroupStatus.Phase = v1alpha1.PhaseCompleted
+	case len(getRollingUpdatePausedReason(ctx, kubernetesClient, autoScalingGroup, outdatedInstances)) > 0:
+		autoScalingGroupStatus.Phase = v1alpha1.PhasePaused
+	default:
+		autoScalingGroupStatus.Phase = v1alpha1.PhaseInProgress
+	}
+	nodeGroupRolloutsMutex.Lock()
+	rolloutName := nodeGroupRolloutNameByAutoScalingGroupName[autoScalingGroupName]
+	rollout, ok := nodeGroupRollouts[rolloutName]
+	var updatedRollout *v1alpha1.NodeGroupRollout
+	if ok {
+		updatedRollout = rollout.DeepCopy()
+		updatedRollout.Status = computeNodeGroupRolloutStatus(rollout, autoScalingGroupStatus, nodeGroupRolloutNameByAutoScalingGroupName, time.Now())
+	}
+	nodeGroupRolloutsMutex.Unlock()
+	if !ok || equality.Semantic.DeepEqual(rollout.Status, updatedRollout.Status) {
+		return
+	}
+	now := metav1.Now()
+	updatedRollout.Status.LastUpdateTime = &now
+	// The status is written without holding the lock, so that the other ASGs aren't blocked by the API server. If
+	// another ASG selected by the same NodeGroupRollout wrote its status in the meantime, the resource version is
+	// outdated and the update is rejected, in which case it is retried on the next execution
+	updatedRollout, err = kubernetesClient.UpdateNodeGroupRolloutStatus(ctx, updatedRollout)
+	if err != nil {
+		log.Printf("[%s] Unable to update status of NodeGroupRollout %s: %v", autoScalingGroupName, rolloutName, err.Error())
+		return
+	}
+	nodeGroupRolloutsMutex.Lock()
+	defer nodeGroupRolloutsMutex.Unlock()
+	// The NodeGroupRollouts may have been refreshed in the meantime, in which case the refreshed one is kept
+	if nodeGroupRollouts[rolloutName] == rollout {
+		nodeGroupRollouts[rolloutName] = updatedRollout
+	}
+}
+
+// computeNodeGroupRolloutStatus computes the status of a NodeGroupRollout from its current status and the progress
+// of one of the ASGs it selects. The ASGs that are no longer selected by the NodeGroupRollout are removed.
+//
+// The LastUpdateTime of the returned status is left unchanged
+func computeNodeGroupRolloutStatus(rollout *v1alpha1.NodeGroupRollout, autoScalingGroupStatus v1alpha1.NodeGroupRolloutAutoScalingGroupStatus, rolloutNameByAutoScalingGroupName map[string]string, now time.Time) v1alpha1.NodeGroupRolloutStatus {
+	var status v1alpha1.NodeGroupRolloutStatus
+	rollout.Status.DeepCopyInto(&status)
+	status.ObservedGeneration = rollout.Generation
+	var autoScalingGroups []v1alpha1.NodeGroupRolloutAutoScalingGroupStatus
+	for _, existingAutoScalingGroupStatus := range status.AutoScalingGroups {
+		if existingAutoScalingGroupStatus.Name != autoScalingGroupStatus.Name && rolloutNameByAutoScalingGroupName[existingAutoScalingGroupStatus.Name] == rollout.Name {
+			autoScalingGroups = append(autoScalingGroups, existingAutoScalingGroupStatus)
+		}
+	}
+	autoScalingGroups = append(autoScalingGroups, autoScalingGroupStatus)
+	sort.Slice(autoScalingGroups, func(i, j int) bool {
+		return autoScalingGroups[i].Name < autoScalingGroups[j].Name
+	})
+	status.AutoScalingGroups = autoScalingGroups
+	status.OutdatedInstances, status.UpdatedInstances = 0, 0
+	var currentNodes []string
+	phases := make(map[string]bool)
+	for _, autoScalingGroup := range autoScalingGroups {
+		status.OutdatedInstances += autoScalingGroup.OutdatedInstances
+		status.UpdatedInstances += autoScalingGroup.UpdatedInstances
+		currentNodes = append(currentNodes, autoScalingGroup.CurrentNodes...)
+		phases[autoScalingGroup.Phase] = true
+	}
+	status.CurrentNode = strings.Join(currentNodes, ",")
+	if len(autoScalingGroupStatus.LastError) > 0 && autoScalingGroupStatus.LastError != status.LastError {
+		status.LastError = autoScalingGroupStatus.LastError
+		status.LastErrorTime = &metav1.Time{Time: now}
+	}
+	previousPhase := status.Phase
+	switch {
+	case phases[v1alpha1.PhaseFailed]:
+		status.Phase = v1alpha1.PhaseFailed
+	case phases[v1alpha1.PhasePaused]:
+		status.Phase = v1alpha1.PhasePaused
+	case phases[v1alpha1.PhaseInProgress]:
+		status.Phase = v1alpha1.PhaseInProgress
+	default:
+		status.Phase = v1alpha1.PhaseCompleted
+	}
+	if status.Phase != v1alpha1.PhaseCompleted && (previousPhase == "" || previousPhase == v1alpha1.PhaseCompleted) {
+		status.StartedAt = &metav1.Time{Time: now}
+		status.CompletedAt = nil
+	} else if status.Phase == v1alpha1.PhaseCompleted && previousPhase != v1alpha1.PhaseCompleted {
+		status.CompletedAt = &metav1.Time{Time: now}
+	}
+	return status
+}
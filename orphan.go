@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/api/core/v1"
+)
+
+// HandleOrphanInstances looks for instances of an ASG that still haven't registered as a node
+// config.OrphanInstanceGracePeriod after being launched.
+//
+// Outdated orphans are terminated directly, since there is nothing to drain. Updated orphans are terminated so that
+// the ASG replaces them, up to config.OrphanInstanceRetryBudget times, after which the ASG is flagged as failing
+// with the cloud.FailingTagKey tag. The budget is reset once all updated instances have registered as nodes.
+//
+// Returns the outdated and updated instances that haven't been terminated
+func HandleOrphanInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, outdatedInstances, updatedInstances []*autoscaling.Instance) ([]*autoscaling.Instance, []*autoscaling.Instance) {
+	if config.Get().OrphanInstanceGracePeriod == 0 {
+		return outdatedInstances, updatedInstances
+	}
+	autoScalingGroupName := aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("[%s] Unable to get nodes to look for orphan instances: %v", autoScalingGroupName, err.Error())
+		return outdatedInstances, updatedInstances
+	}
+	var remainingOutdatedInstances []*autoscaling.Instance
+	for _, outdatedInstance := range outdatedInstances {
+		if !isOrphanInstance(ctx, kubernetesClient, ec2Service, autoScalingGroup, outdatedInstance, nodes) {
+			remainingOutdatedInstances = append(remainingOutdatedInstances, outdatedInstance)
+			continue
+		}
+		log.Printf("[%s][%s] Terminating outdated instance, because it never registered as a node", autoScalingGroupName, aws.StringValue(outdatedInstance.InstanceId))
+		if err := cloud.TerminateEc2Instance(ctx, autoScalingService, outdatedInstance, false); err != nil {
+			log.Printf("[%s][%s] Unable to terminate outdated orphan instance: %v", autoScalingGroupName, aws.StringValue(outdatedInstance.InstanceId), err.Error())
+			remainingOutdatedInstances = append(remainingOutdatedInstances, outdatedInstance)
+		}
+	}
+	replacements, _ := strconv.Atoi(cloud.GetTagValue(autoScalingGroup, cloud.OrphanReplacementsTagKey))
+	isFailing := cloud.HasTag(autoScalingGroup, cloud.FailingTagKey, "true")
+	allUpdatedInstancesRegistered := true
+	var remainingUpdatedInstances []*autoscaling.Instance
+	for _, updatedInstance := range updatedInstances {
+		if _, err := kubernetesClient.FilterNodeByAutoScalingInstance(nodes, updatedInstance); err != nil {
+			allUpdatedInstancesRegistered = false
+		}
+		if !isOrphanInstance(ctx, kubernetesClient, ec2Service, autoScalingGroup, updatedInstance, nodes) {
+			remainingUpdatedInstances = append(remainingUpdatedInstances, updatedInstance)
+			continue
+		}
+		if isFailing || replacements >= config.Get().OrphanInstanceRetryBudget {
+			if !isFailing {
+				log.Printf("[%s] Flagging ASG as failing, because %d updated instances have already been replaced after never registering as a node", autoScalingGroupName, replacements)
+				if err := cloud.SetAutoScalingGroupTag(ctx, autoScalingService, autoScalingGroup, cloud.FailingTagKey, "true"); err != nil {
+					log.Printf("[%s] Unable to flag ASG as failing: %v", autoScalingGroupName, err.Error())
+				} else {
+					isFailing = true
+				}
+			}
+			log.Printf("[%s][%s] Not replacing updated instance that never registered as a node, because the ASG is failing", autoScalingGroupName, aws.StringValue(updatedInstance.InstanceId))
+			remainingUpdatedInstances = append(remainingUpdatedInstances, updatedInstance)
+			continue
+		}
+		log.Printf("[%s][%s] Replacing updated instance, because it never registered as a node (replacement %d/%d)", autoScalingGroupName, aws.StringValue(updatedInstance.InstanceId), replacements+1, config.Get().OrphanInstanceRetryBudget)
+		if err := cloud.TerminateEc2Instance(ctx, autoScalingService, updatedInstance, false); err != nil {
+			log.Printf("[%s][%s] Unable to terminate updated orphan instance: %v", autoScalingGroupName, aws.StringValue(updatedInstance.InstanceId), err.Error())
+			remainingUpdatedInstances = append(remainingUpdatedInstances, updatedInstance)
+			continue
+		}
+		replacements++
+		if err := cloud.SetAutoScalingGroupTag(ctx, autoScalingService, autoScalingGroup, cloud.OrphanReplacementsTagKey, strconv.Itoa(replacements)); err != nil {
+			log.Printf("[%s] Unable to keep track of the number of replaced orphan instances: %v", autoScalingGroupName, err.Error())
+		}
+	}
+	if allUpdatedInstancesRegistered && (replacements > 0 || isFailing) {
+		log.Printf("[%s] All updated instances have registered as nodes, resetting the orphan instance retry budget", autoScalingGroupName)
+		if err := cloud.DeleteAutoScalingGroupTags(ctx, autoScalingService, autoScalingGroup, cloud.OrphanReplacementsTagKey, cloud.FailingTagKey); err != nil {
+			log.Printf("[%s] Unable to reset the orphan instance retry budget: %v", autoScalingGroupName, err.Error())
+		}
+	}
+	return remainingOutdatedInstances, remainingUpdatedInstances
+}
+
+// isOrphanInstance checks whether an instance has been running for longer than config.OrphanInstanceGracePeriod
+// without registering as a node.
+//
+// Only InService instances can be orphans, since an instance that is still pending, e.g. because it is held by a
+// launch lifecycle hook, may not have had a chance to register yet
+func isOrphanInstance(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingGroup *autoscaling.Group, instance *autoscaling.Instance, nodes []v1.Node) bool {
+	if aws.StringValue(instance.LifecycleState) != autoscaling.LifecycleStateInService {
+		return false
+	}
+	if _, err := kubernetesClient.FilterNodeByAutoScalingInstance(nodes, instance); err == nil {
+		return false
+	}
+	ec2Instance, err := cloud.DescribeEc2Instance(ctx, ec2Service, aws.StringValue(instance.InstanceId))
+	if err != nil {
+		log.Printf("[%s][%s] Unable to get launch time of instance without node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), err.Error())
+		return false
+	}
+	if ec2Instance == nil || ec2Instance.LaunchTime == nil {
+		return false
+	}
+	return time.Since(aws.TimeValue(ec2Instance.LaunchTime)) > config.Get().OrphanInstanceGracePeriod
+}
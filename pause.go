@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// PauseConfigMapPausedKey is the key of the config.PauseConfigMap ConfigMap used to pause the rolling update of
+	// every ASG
+	PauseConfigMapPausedKey = "paused"
+
+	// PauseConfigMapPausedAutoScalingGroupsKey is the key of the config.PauseConfigMap ConfigMap listing the
+	// comma-separated names of the ASGs whose rolling update is paused
+	PauseConfigMapPausedAutoScalingGroupsKey = "pausedAutoScalingGroups"
+)
+
+// getRollingUpdatePausedReason returns why the rolling update of an ASG has been paused through the ASG's
+// cloud.RollingUpdatePausedTagKey tag, the NodeGroupRollout selecting the ASG, the config.PauseConfigMap ConfigMap or
+// the k8s.RollingUpdatePausedAnnotationKey annotation of one of its outdated nodes, or because the ASG is outside of
+// its maintenance windows.
+//
+// While paused, the nodes that have already been drained are rolled out as usual, but no other node is.
+// Returns an empty string if the rolling update hasn't been paused
+func getRollingUpdatePausedReason(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, outdatedInstances []*autoscaling.Instance) string {
+	if cloud.HasTag(autoScalingGroup, cloud.RollingUpdatePausedTagKey, "true") {
+		return fmt.Sprintf("the ASG has the tag %s=true", cloud.RollingUpdatePausedTagKey)
+	}
+	if rollout := getNodeGroupRollout(autoScalingGroup); rollout != nil && rollout.Spec.Paused {
+		return fmt.Sprintf("NodeGroupRollout %s is paused", rollout.Name)
+	}
+	if pausedReason := getPauseConfigMapPausedReason(ctx, kubernetesClient, autoScalingGroup); len(pausedReason) > 0 {
+		return pausedReason
+	}
+	if pausedReason := getPausedNodeReason(ctx, kubernetesClient, outdatedInstances); len(pausedReason) > 0 {
+		return pausedReason
+	}
+	return getMaintenanceWindowClosedReason(autoScalingGroup, time.Now())
+}
+
+// getPausedNodeReason returns why the rolling update of an ASG has been paused through the
+// k8s.RollingUpdatePausedAnnotationKey annotation of one of its outdated nodes, or an empty string if it hasn't
+func getPausedNodeReason(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, outdatedInstances []*autoscaling.Instance) string {
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
+		if err != nil {
+			continue
+		}
+		if isNodePaused(node) {
+			return fmt.Sprintf("the outdated node %s has the annotation %s=true, remove it to resume the rolling update", node.Name, k8s.RollingUpdatePausedAnnotationKey)
+		}
+	}
+	return ""
+}
+
+// isNodePaused checks whether a node has been annotated with k8s.RollingUpdatePausedAnnotationKey, in which case it
+// must be left as is until the annotation is removed
+func isNodePaused(node *v1.Node) bool {
+	return node.Annotations[k8s.RollingUpdatePausedAnnotationKey] == "true"
+}
+
+// getPauseConfigMapPausedReason returns why the rolling update of an ASG has been paused through the
+// config.PauseConfigMap ConfigMap, or an empty string if it hasn't
+func getPauseConfigMapPausedReason(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group) string {
+	if len(config.Get().PauseConfigMap) == 0 {
+		return ""
+	}
+	namespaceAndName := strings.Split(config.Get().PauseConfigMap, "/")
+	configMap, err := kubernetesClient.GetConfigMap(ctx, namespaceAndName[0], namespaceAndName[1])
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ""
+		}
+		// The ConfigMap may be pausing the rolling update, so nothing new is started until it can be read
+		return fmt.Sprintf("unable to get ConfigMap %s: %v", config.Get().PauseConfigMap, err.Error())
+	}
+	if strings.ToLower(strings.TrimSpace(configMap.Data[PauseConfigMapPausedKey])) == "true" {
+		return fmt.Sprintf("every rolling update is paused by ConfigMap %s", config.Get().PauseConfigMap)
+	}
+	for _, autoScalingGroupName := range strings.Split(configMap.Data[PauseConfigMapPausedAutoScalingGroupsKey], ",") {
+		if strings.TrimSpace(autoScalingGroupName) == aws.StringValue(autoScalingGroup.AutoScalingGroupName) {
+			return fmt.Sprintf("the ASG is paused by ConfigMap %s", config.Get().PauseConfigMap)
+		}
+	}
+	return ""
+}
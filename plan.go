@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// PlanCommand is the subcommand that prints the rollout plan of every ASG, then exits
+	PlanCommand = "plan"
+
+	PlanOutputTable = "table"
+	PlanOutputJSON  = "json"
+)
+
+// Plan is the rollout plan of every ASG, as it would be carried out from the current state of the ASGs and nodes
+type Plan struct {
+	AutoScalingGroups []*AutoScalingGroupPlan `json:"autoScalingGroups"`
+}
+
+// AutoScalingGroupPlan is the rollout plan of a single ASG
+type AutoScalingGroupPlan struct {
+	Name            string `json:"name"`
+	DesiredCapacity int64  `json:"desiredCapacity"`
+	MaxSize         int64  `json:"maxSize"`
+	MaxUnavailable  int    `json:"maxUnavailable"`
+	// NodesToAdd is the number of nodes by which the desired capacity would be increased to make room for the pods
+	// of the outdated nodes
+	NodesToAdd int `json:"nodesToAdd"`
+	// BlockedReason is the reason why the rollout cannot currently make progress, if any
+	BlockedReason string          `json:"blockedReason,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Instances     []*InstancePlan `json:"instances"`
+}
+
+// InstancePlan is the part of the rollout plan of an ASG concerning a single instance
+type InstancePlan struct {
+	InstanceId string `json:"instanceId"`
+	NodeName   string `json:"nodeName,omitempty"`
+	Outdated   bool   `json:"outdated"`
+	// Reason is the reason why the instance is outdated or updated
+	Reason string `json:"reason"`
+	Status string `json:"status"`
+	// DrainOrder is the position of the node in the order in which outdated nodes would be drained, starting from 1,
+	// or 0 if the node doesn't need to be drained
+	DrainOrder int `json:"drainOrder,omitempty"`
+	// RequiresNewNode is whether the desired capacity would be increased before draining the node, because
+	// the updated nodes wouldn't have enough resources left for its pods
+	RequiresNewNode bool `json:"requiresNewNode,omitempty"`
+}
+
+// runPlanCommand prints the rollout plan of every ASG in the format passed as the -output flag.
+//
+// Returns the exit code of the command
+func runPlanCommand(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, args []string) int {
+	flagSet := flag.NewFlagSet(PlanCommand, flag.ContinueOnError)
+	output := flagSet.String("output", PlanOutputTable, "Format of the plan, either table or json")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if *output != PlanOutputTable && *output != PlanOutputJSON {
+		fmt.Fprintf(os.Stderr, "Invalid output format '%s', must be either %s or %s\n", *output, PlanOutputTable, PlanOutputJSON)
+		return 2
+	}
+	plan, err := BuildPlan(ctx, kubernetesClient, ec2Service, autoScalingService)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to build plan: %s\n", err.Error())
+		return 1
+	}
+	if *output == PlanOutputJSON {
+		err = plan.WriteJSON(os.Stdout)
+	} else {
+		err = plan.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write plan: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// BuildPlan runs the detection of outdated instances and the capacity calculations once against every ASG, without
+// changing anything, to determine which nodes would be replaced, in which order, and how many nodes would be added
+func BuildPlan(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI) (*Plan, error) {
+	autoScalingGroups, err := describeAutoScalingGroups(ctx, autoScalingService)
+	if err != nil {
+		return nil, errors.New("unable to describe AutoScalingGroups: " + err.Error())
+	}
+	refreshNodeGroupRollouts(ctx, kubernetesClient, autoScalingGroups)
+	plan := &Plan{AutoScalingGroups: []*AutoScalingGroupPlan{}}
+	for _, autoScalingGroup := range autoScalingGroups {
+		plan.AutoScalingGroups = append(plan.AutoScalingGroups, buildAutoScalingGroupPlan(ctx, kubernetesClient, ec2Service, autoScalingGroup))
+	}
+	return plan, nil
+}
+
+// buildAutoScalingGroupPlan builds the rollout plan of a single ASG.
+//
+// The readiness of the updated nodes is determined and the outdated nodes are selected for draining by the same code
+// as HandleRollingUpgradeForAutoScalingGroup, but over the whole rollout rather than over a single execution: when
+// maxUnavailable is reached, the nodes drained so far are assumed to have been terminated by the next execution, and
+// when the updated nodes don't have enough resources left, the next execution is assumed to find as many new nodes as
+// the max surge of the ASG, each with the same allocatable resources as the outdated node.
+func buildAutoScalingGroupPlan(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingGroup *autoscaling.Group) *AutoScalingGroupPlan {
+	autoScalingGroupPlan := &AutoScalingGroupPlan{
+		Name:            aws.StringValue(autoScalingGroup.AutoScalingGroupName),
+		DesiredCapacity: aws.Int64Value(autoScalingGroup.DesiredCapacity),
+		MaxSize:         aws.Int64Value(autoScalingGroup.MaxSize),
+		MaxUnavailable:  getMaxUnavailable(autoScalingGroup),
+		Instances:       []*InstancePlan{},
+	}
+	outdatedInstances, updatedInstances, reasons, err := SeparateOutdatedFromUpdatedInstances(ctx, autoScalingGroup, ec2Service)
+	if err != nil {
+		autoScalingGroupPlan.Error = fmt.Sprintf("unable to separate outdated instances from updated instances: %v", err)
+		return autoScalingGroupPlan
+	}
+	updatedReadyNodes, numberOfNonReadyNodesOrInstances, notReadyReasons := getReadyNodesAndNumberOfNonReadyNodesOrInstances(ctx, updatedInstances, autoScalingGroup, kubernetesClient)
+	for _, updatedInstance := range updatedInstances {
+		instancePlan := &InstancePlan{InstanceId: aws.StringValue(updatedInstance.InstanceId), Reason: reasons[aws.StringValue(updatedInstance.InstanceId)], Status: "ready"}
+		if notReadyReason, ok := notReadyReasons[instancePlan.InstanceId]; ok {
+			instancePlan.Status = notReadyReason
+		}
+		if updatedNode, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, updatedInstance); err == nil {
+			instancePlan.NodeName = updatedNode.Name
+		}
+		autoScalingGroupPlan.Instances = append(autoScalingGroupPlan.Instances, instancePlan)
+	}
+	// Unlike an execution, which releases the resources it reserved once it's over, the plan keeps the resources
+	// reserved for the whole rollout, since the pods of the drained nodes will have moved to the updated nodes
+	var plannedResources k8s.Resources
+	selector := &drainSelector{
+		maxUnavailable:     autoScalingGroupPlan.MaxUnavailable,
+		availableResources: k8s.CalculateResourcesAvailableInNodes(ctx, kubernetesClient, updatedReadyNodes),
+		reserve: func(available, needed k8s.Resources) bool {
+			if !available.Subtract(plannedResources).CanFit(needed) {
+				return false
+			}
+			plannedResources = plannedResources.Add(needed)
+			return true
+		},
+	}
+	var outdatedNodes []*v1.Node
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, outdatedInstance)
+		if err != nil {
+			outdatedNodes = append(outdatedNodes, nil)
+			continue
+		}
+		outdatedNodes = append(outdatedNodes, node)
+		if _, minutesSinceDrained, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node); minutesSinceDrained != -1 && minutesSinceTerminated == -1 {
+			selector.numberOfUnavailableNodes++
+		}
+	}
+	drainOrder := 0
+	for i, outdatedInstance := range outdatedInstances {
+		instancePlan := &InstancePlan{InstanceId: aws.StringValue(outdatedInstance.InstanceId), Outdated: true, Reason: reasons[aws.StringValue(outdatedInstance.InstanceId)]}
+		autoScalingGroupPlan.Instances = append(autoScalingGroupPlan.Instances, instancePlan)
+		node := outdatedNodes[i]
+		if node == nil {
+			instancePlan.Status = "no node"
+			continue
+		}
+		instancePlan.NodeName = node.Name
+		if _, minutesSinceDrained, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node); minutesSinceTerminated != -1 {
+			instancePlan.Status = "terminating"
+			continue
+		} else if minutesSinceDrained != -1 {
+			instancePlan.Status = "drained, waiting to be terminated"
+			continue
+		}
+		resourcesNeeded, _ := k8s.CalculateResourcesNeededToTransferAllPodsInNode(ctx, kubernetesClient, node)
+		decision := selector.decide(resourcesNeeded)
+		if decision == drainDecisionMaxUnavailableReached {
+			selector.numberOfUnavailableNodes = 0
+			decision = selector.decide(resourcesNeeded)
+		}
+		if decision == drainDecisionScaleUp {
+			surge := getScaleUpSurge(autoScalingGroup, autoScalingGroupPlan.DesiredCapacity+int64(autoScalingGroupPlan.NodesToAdd))
+			instancePlan.RequiresNewNode = true
+			autoScalingGroupPlan.NodesToAdd += int(surge)
+			selector.availableResources = selector.availableResources.Add(k8s.Resources{
+				Cpu:    surge * node.Status.Allocatable.Cpu().MilliValue(),
+				Memory: surge * node.Status.Allocatable.Memory().MilliValue(),
+			})
+			selector.numberOfUnavailableNodes = 0
+			selector.decide(resourcesNeeded)
+		}
+		drainOrder++
+		instancePlan.DrainOrder = drainOrder
+		instancePlan.Status = "to be drained"
+	}
+	pausedReason := getRollingUpdatePausedReason(ctx, kubernetesClient, autoScalingGroup, outdatedInstances)
+	switch {
+	case isRollingUpdateAborted(autoScalingGroup):
+		autoScalingGroupPlan.BlockedReason = "the rolling update has been aborted"
+	case len(outdatedInstances) == 0:
+	case int64(len(autoScalingGroup.Instances)) < aws.Int64Value(autoScalingGroup.DesiredCapacity):
+		autoScalingGroupPlan.BlockedReason = fmt.Sprintf("the ASG has a desired capacity of %d, but only has %d instances", aws.Int64Value(autoScalingGroup.DesiredCapacity), len(autoScalingGroup.Instances))
+	case numberOfNonReadyNodesOrInstances > 0:
+		autoScalingGroupPlan.BlockedReason = fmt.Sprintf("waiting for %d updated nodes/instances to be ready", numberOfNonReadyNodesOrInstances)
+	case len(pausedReason) > 0:
+		autoScalingGroupPlan.BlockedReason = "the rolling update has been paused, because " + pausedReason
+	case aws.Int64Value(autoScalingGroup.DesiredCapacity)+int64(autoScalingGroupPlan.NodesToAdd) > aws.Int64Value(autoScalingGroup.MaxSize):
+		autoScalingGroupPlan.BlockedReason = fmt.Sprintf("adding %d nodes would exceed the max size of the ASG", autoScalingGroupPlan.NodesToAdd)
+	}
+	return autoScalingGroupPlan
+}
+
+// WriteJSON writes the plan as indented JSON
+func (plan *Plan) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+// WriteTable writes the plan as one table per ASG
+func (plan *Plan) WriteTable(writer io.Writer) error {
+	tabWriter := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for i, autoScalingGroupPlan := range plan.AutoScalingGroups {
+		if i > 0 {
+			fmt.Fprintln(tabWriter)
+		}
+		fmt.Fprintf(tabWriter, "ASG %s: desired=%d; max=%d; maxUnavailable=%d; nodesToAdd=%d\n", autoScalingGroupPlan.Name, autoScalingGroupPlan.DesiredCapacity, autoScalingGroupPlan.MaxSize, autoScalingGroupPlan.MaxUnavailable, autoScalingGroupPlan.NodesToAdd)
+		if len(autoScalingGroupPlan.Error) > 0 {
+			fmt.Fprintf(tabWriter, "Error: %s\n", autoScalingGroupPlan.Error)
+			continue
+		}
+		if len(autoScalingGroupPlan.BlockedReason) > 0 {
+			fmt.Fprintf(tabWriter, "Blocked: %s\n", autoScalingGroupPlan.BlockedReason)
+		}
+		fmt.Fprintln(tabWriter, "DRAIN ORDER\tINSTANCE\tNODE\tOUTDATED\tNEW NODE\tSTATUS\tREASON")
+		for _, instancePlan := range autoScalingGroupPlan.Instances {
+			drainOrder, nodeName, requiresNewNode := "-", "-", "-"
+			if instancePlan.DrainOrder > 0 {
+				drainOrder = strconv.Itoa(instancePlan.DrainOrder)
+			}
+			if len(instancePlan.NodeName) > 0 {
+				nodeName = instancePlan.NodeName
+			}
+			if instancePlan.RequiresNewNode {
+				requiresNewNode = "yes"
+			}
+			fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%t\t%s\t%s\t%s\n", drainOrder, instancePlan.InstanceId, nodeName, instancePlan.Outdated, requiresNewNode, instancePlan.Status, instancePlan.Reason)
+		}
+	}
+	return tabWriter.Flush()
+}
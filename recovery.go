@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	StuckTerminationRecoveredEventReason = "StuckTerminationRecovered"
+	StuckDrainRecoveredEventReason       = "StuckDrainRecovered"
+)
+
+// RecoverStuckInstances looks for outdated instances that have been drained or terminated for longer than
+// config.StuckDrainThreshold or config.StuckTerminationThreshold respectively, and attempts to move them along.
+//
+// The instances of stuck drains decrement the desired capacity of the ASG as long as decrements allows it, like any
+// other outdated instance being terminated.
+//
+// Returns the IDs of the instances whose stuck drain has been handled, which must not be replaced again during the
+// same execution
+func RecoverStuckInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, outdatedInstances []*autoscaling.Instance, decrements *desiredCapacityDecrements) map[string]bool {
+	recoveredInstanceIds := make(map[string]bool)
+	if len(outdatedInstances) == 0 || (config.Get().StuckTerminationThreshold == 0 && config.Get().StuckDrainThreshold == 0) {
+		return recoveredInstanceIds
+	}
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("[%s] Unable to get nodes to look for stuck instances: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		return recoveredInstanceIds
+	}
+	for _, outdatedInstance := range outdatedInstances {
+		node, err := kubernetesClient.FilterNodeByAutoScalingInstance(nodes, outdatedInstance)
+		if err != nil || isNodePaused(node) {
+			continue
+		}
+		if terminatedAt, ok := getTimeFromAnnotation(node, k8s.RollingUpdateTerminatedTimestampAnnotationKey); ok {
+			if config.Get().StuckTerminationThreshold != 0 && time.Since(terminatedAt) > config.Get().StuckTerminationThreshold {
+				log.Printf("[%s][%s] Termination has been stuck since %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), terminatedAt.Format(time.RFC3339))
+				recoverStuckTermination(ctx, kubernetesClient, ec2Service, autoScalingService, node, aws.StringValue(outdatedInstance.InstanceId))
+			}
+		} else if drainedAt, ok := getTimeFromAnnotation(node, k8s.RollingUpdateDrainedTimestampAnnotationKey); ok {
+			if config.Get().StuckDrainThreshold != 0 && time.Since(drainedAt) > config.Get().StuckDrainThreshold {
+				log.Printf("[%s][%s] Node has been drained since %s, but was never terminated", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), drainedAt.Format(time.RFC3339))
+				// Whether the recovery succeeds or not, the node must not go through the same steps again during this
+				// execution, since the node read afterward may not reflect the termination yet
+				recoveredInstanceIds[aws.StringValue(outdatedInstance.InstanceId)] = true
+				// The instance goes through the same steps as in replaceOutdatedNode before being terminated
+				if !prepareForTermination(ctx, kubernetesClient, autoScalingGroup, outdatedInstance) {
+					continue
+				}
+				recoverStuckDrain(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup, outdatedInstance, node, decrements.take())
+			}
+		}
+	}
+	return recoveredInstanceIds
+}
+
+// RecoverLingeringNodes looks for nodes whose termination has been stuck for longer than
+// config.StuckTerminationThreshold, and whose instance is no longer part of any of the given ASGs.
+//
+// Such nodes would otherwise never be looked at again, because only the instances of the ASGs are iterated over.
+//
+// The nodes for which skipNode returns true are left alone. skipNode may be nil
+func RecoverLingeringNodes(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroups []*autoscaling.Group, skipNode func(node *v1.Node) bool) {
+	if config.Get().StuckTerminationThreshold == 0 {
+		return
+	}
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("Unable to get nodes to look for lingering nodes: %v", err.Error())
+		return
+	}
+	instanceIds := make(map[string]bool)
+	for _, autoScalingGroup := range autoScalingGroups {
+		for _, instance := range autoScalingGroup.Instances {
+			instanceIds[aws.StringValue(instance.InstanceId)] = true
+		}
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		terminatedAt, ok := getTimeFromAnnotation(node, k8s.RollingUpdateTerminatedTimestampAnnotationKey)
+		if !ok || time.Since(terminatedAt) <= config.Get().StuckTerminationThreshold {
+			continue
+		}
+		instanceId := k8s.GetInstanceIdFromNode(node)
+		if len(instanceId) == 0 || instanceIds[instanceId] || (skipNode != nil && skipNode(node)) {
+			continue
+		}
+		log.Printf("[%s] Node has been terminated since %s, but still exists", node.Name, terminatedAt.Format(time.RFC3339))
+		recoverStuckTermination(ctx, kubernetesClient, ec2Service, autoScalingService, node, instanceId)
+	}
+}
+
+// recoverStuckTermination checks the real state of an instance whose termination has been stuck and either deletes
+// the Node if the instance is gone and config.DeleteNodeAfterTermination is enabled, or re-issues the termination
+func recoverStuckTermination(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, node *v1.Node, instanceId string) {
+	ec2Instance, err := cloud.DescribeEc2Instance(ctx, ec2Service, instanceId)
+	if err != nil {
+		log.Printf("[%s][%s] Unable to recover stuck termination: %v", node.Name, instanceId, err.Error())
+		return
+	}
+	if cloud.IsEc2InstanceTerminated(ec2Instance) {
+		if !config.Get().DeleteNodeAfterTermination {
+			log.Printf("[%s][%s] Instance has already been terminated, leaving the node to be removed by the cloud controller", node.Name, instanceId)
+			return
+		}
+		reportRecovery(ctx, kubernetesClient, node, instanceId, StuckTerminationRecoveredEventReason, "Deleted lingering node, because its instance has already been terminated")
+		if err := kubernetesClient.DeleteNode(ctx, node.Name); err != nil {
+			log.Printf("[%s][%s] Unable to delete lingering node: %v", node.Name, instanceId, err.Error())
+		}
+		return
+	}
+	autoScalingInstance, err := cloud.DescribeAutoScalingInstance(ctx, autoScalingService, instanceId)
+	if err != nil {
+		log.Printf("[%s][%s] Unable to recover stuck termination: %v", node.Name, instanceId, err.Error())
+		return
+	}
+	if autoScalingInstance != nil && aws.StringValue(autoScalingInstance.LifecycleState) == autoscaling.LifecycleStateTerminatingWait {
+		// The instance is held by a termination lifecycle hook, which must be allowed to run to completion. The ASG
+		// terminates the instance by itself once the hook is completed or times out
+		log.Printf("[%s][%s] Not recovering stuck termination, because the instance is waiting on a termination lifecycle hook", node.Name, instanceId)
+		return
+	}
+	var action string
+	switch {
+	case autoScalingInstance == nil:
+		err = cloud.TerminateEc2InstanceById(ctx, ec2Service, instanceId)
+		action = "Terminated instance directly, because it is no longer part of an ASG"
+	case strings.HasPrefix(aws.StringValue(autoScalingInstance.LifecycleState), "Terminating"):
+		err = cloud.TerminateEc2InstanceById(ctx, ec2Service, instanceId)
+		action = fmt.Sprintf("Terminated instance directly, because it was stuck in lifecycle state %s", aws.StringValue(autoScalingInstance.LifecycleState))
+	default:
+		action, err = terminateOrDetachInstance(ctx, ec2Service, autoScalingService, aws.StringValue(autoScalingInstance.AutoScalingGroupName), instanceId, false)
+	}
+	if err != nil {
+		log.Printf("[%s][%s] Unable to recover stuck termination: %v", node.Name, instanceId, err.Error())
+		return
+	}
+	reportRecovery(ctx, kubernetesClient, node, instanceId, StuckTerminationRecoveredEventReason, action)
+	resetTerminatedTimestamp(ctx, kubernetesClient, node, instanceId)
+}
+
+// recoverStuckDrain terminates an instance whose node has been drained long ago, but was never terminated, the same
+// way replaceOutdatedNode would have
+func recoverStuckDrain(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, outdatedInstance *autoscaling.Instance, node *v1.Node, shouldDecrementDesiredCapacity bool) {
+	action, err := terminateOrDetachInstance(ctx, ec2Service, autoScalingService, aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), shouldDecrementDesiredCapacity)
+	if err != nil {
+		log.Printf("[%s][%s] Unable to recover stuck drain: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(outdatedInstance.InstanceId), err.Error())
+		return
+	}
+	reportRecovery(ctx, kubernetesClient, node, aws.StringValue(outdatedInstance.InstanceId), StuckDrainRecoveredEventReason, action)
+	resetTerminatedTimestamp(ctx, kubernetesClient, node, aws.StringValue(outdatedInstance.InstanceId))
+}
+
+// terminateOrDetachInstance terminates an instance through its ASG, and if that fails, detaches the instance from
+// its ASG and terminates it directly
+//
+// Returns a description of the action taken
+func terminateOrDetachInstance(ctx context.Context, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroupName, instanceId string, shouldDecrementDesiredCapacity bool) (string, error) {
+	err := cloud.TerminateEc2Instance(ctx, autoScalingService, &autoscaling.Instance{InstanceId: aws.String(instanceId)}, shouldDecrementDesiredCapacity)
+	if err == nil {
+		return "Re-issued termination of instance", nil
+	}
+	log.Printf("[%s][%s] Unable to terminate instance through ASG, detaching it instead: %v", autoScalingGroupName, instanceId, err.Error())
+	if err := cloud.DetachInstanceFromAutoScalingGroup(ctx, autoScalingService, autoScalingGroupName, instanceId, shouldDecrementDesiredCapacity); err != nil {
+		return "", fmt.Errorf("unable to detach instance: %v", err)
+	}
+	if err := cloud.TerminateEc2InstanceById(ctx, ec2Service, instanceId); err != nil {
+		return "", fmt.Errorf("instance was detached, but could not be terminated: %v", err)
+	}
+	return "Detached instance from ASG and terminated it directly", nil
+}
+
+// reportRecovery logs the recovery action and creates an event for the node
+func reportRecovery(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, node *v1.Node, instanceId, reason, action string) {
+	log.Printf("[%s][%s] %s", node.Name, instanceId, action)
+	if err := kubernetesClient.CreateNodeEvent(ctx, node, v1.EventTypeWarning, reason, action); err != nil {
+		log.Printf("[%s][%s] Unable to create event: %v", node.Name, instanceId, err.Error())
+	}
+}
+
+// resetTerminatedTimestamp sets the terminated-at annotation of a node to the current time, so that the stuck
+// termination threshold starts over
+func resetTerminatedTimestamp(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, node *v1.Node, instanceId string) {
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey] = time.Now().Format(time.RFC3339)
+	if err := kubernetesClient.UpdateNode(ctx, node); err != nil {
+		log.Printf("[%s][%s] Unable to annotate node: %v", node.Name, instanceId, err.Error())
+	}
+}
+
+// getTimeFromAnnotation parses the RFC3339 timestamp stored in the annotation of a node
+func getTimeFromAnnotation(node *v1.Node, key string) (time.Time, bool) {
+	value, ok := node.Annotations[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
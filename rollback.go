@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// isRollingUpdateAborted checks whether the rolling update of an ASG has been aborted by an operator
+func isRollingUpdateAborted(autoScalingGroup *autoscaling.Group) bool {
+	return cloud.HasTag(autoScalingGroup, cloud.RollingUpdateAbortedTagKey, "true")
+}
+
+// RollbackAutoScalingGroup rolls back the nodes of an ASG whose rolling update has been aborted, and removes the
+// surge capacity that was added during the rolling update.
+//
+// The surge capacity is removed by draining and terminating as many updated instances as the desired capacity exceeds
+// the one recorded in the cloud.OriginalDesiredCapacityTagKey tag, while decrementing the desired capacity, rather
+// than by scaling the desired capacity down, which would let the ASG terminate instances of its choosing without
+// draining them first
+func RollbackAutoScalingGroup(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group) {
+	surplusInstances := getSurplusInstances(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup)
+	surplusInstanceIds := make(map[string]bool)
+	for _, surplusInstance := range surplusInstances {
+		surplusInstanceIds[aws.StringValue(surplusInstance.InstanceId)] = true
+	}
+	var instances []*autoscaling.Instance
+	for _, instance := range autoScalingGroup.Instances {
+		if !surplusInstanceIds[aws.StringValue(instance.InstanceId)] {
+			instances = append(instances, instance)
+		}
+	}
+	RollbackInstances(ctx, kubernetesClient, autoScalingGroup, instances)
+	removeSurplusInstances(ctx, kubernetesClient, autoScalingService, autoScalingGroup, surplusInstances, instances)
+}
+
+// getSurplusInstances returns the updated instances of an ASG to terminate in order to bring its desired capacity back
+// down to the one recorded in the cloud.OriginalDesiredCapacityTagKey tag, or to its min size if it's higher.
+//
+// The instances whose removal has already started come first, so that the same instances are removed across passes,
+// and paused nodes are left as is. The tag is deleted once there is no surge capacity left
+func getSurplusInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group) []*autoscaling.Instance {
+	value := cloud.GetTagValue(autoScalingGroup, cloud.OriginalDesiredCapacityTagKey)
+	if len(value) == 0 {
+		return nil
+	}
+	originalDesiredCapacity, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("[%s] Ignoring invalid value '%s' of tag %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), value, cloud.OriginalDesiredCapacityTagKey)
+		return nil
+	}
+	if minSize := aws.Int64Value(autoScalingGroup.MinSize); originalDesiredCapacity < minSize {
+		originalDesiredCapacity = minSize
+	}
+	surplus := aws.Int64Value(autoScalingGroup.DesiredCapacity) - originalDesiredCapacity
+	if surplus <= 0 {
+		log.Printf("[%s] Surge capacity has been removed", aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		if err := cloud.DeleteAutoScalingGroupTags(ctx, autoScalingService, autoScalingGroup, cloud.OriginalDesiredCapacityTagKey); err != nil {
+			log.Printf("[%s] Unable to delete tag: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		}
+		return nil
+	}
+	_, updatedInstances, _, err := SeparateOutdatedFromUpdatedInstances(ctx, autoScalingGroup, ec2Service)
+	if err != nil {
+		log.Printf("[%s] Unable to separate outdated instances from updated instances to remove the surge capacity: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		return nil
+	}
+	var startedInstances, otherInstances []*autoscaling.Instance
+	for _, updatedInstance := range updatedInstances {
+		// The instances that are already terminating don't count toward the desired capacity anymore
+		if aws.StringValue(updatedInstance.LifecycleState) != autoscaling.LifecycleStateInService {
+			continue
+		}
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, updatedInstance)
+		if err != nil {
+			continue
+		}
+		if isNodePaused(node) {
+			continue
+		}
+		minutesSinceStarted, _, minutesSinceTerminated := getRollingUpdateTimestampsFromNode(node)
+		if minutesSinceTerminated != -1 {
+			// The desired capacity has already been decremented when the instance was terminated
+			continue
+		}
+		if minutesSinceStarted != -1 {
+			startedInstances = append(startedInstances, updatedInstance)
+		} else {
+			otherInstances = append(otherInstances, updatedInstance)
+		}
+	}
+	sort.Slice(otherInstances, func(i, j int) bool {
+		return aws.StringValue(otherInstances[i].InstanceId) < aws.StringValue(otherInstances[j].InstanceId)
+	})
+	surplusInstances := append(startedInstances, otherInstances...)
+	if int64(len(surplusInstances)) > surplus {
+		surplusInstances = surplusInstances[:surplus]
+	}
+	return surplusInstances
+}
+
+// removeSurplusInstances drains and terminates the given surplus instances of an ASG while decrementing its desired
+// capacity, the same way outdated nodes are replaced. The pods may be migrated to the ready nodes of the remaining
+// instances
+func removeSurplusInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group, surplusInstances, remainingInstances []*autoscaling.Instance) {
+	if len(surplusInstances) == 0 {
+		return
+	}
+	remainingReadyNodes, _, _ := getReadyNodesAndNumberOfNonReadyNodesOrInstances(ctx, remainingInstances, autoScalingGroup, kubernetesClient)
+	var waitGroup sync.WaitGroup
+	for _, surplusInstance := range surplusInstances {
+		node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, surplusInstance)
+		if err != nil {
+			log.Printf("[%s][%s] Skipping removal of surge capacity because unable to get node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(surplusInstance.InstanceId), err.Error())
+			continue
+		}
+		minutesSinceStarted, minutesSinceDrained, _ := getRollingUpdateTimestampsFromNode(node)
+		if minutesSinceStarted == -1 {
+			log.Printf("[%s][%s] Removing node %s to remove the surge capacity", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(surplusInstance.InstanceId), node.Name)
+			// The node is annotated so that it's removed again on the next pass if its removal doesn't complete
+			if err := k8s.AnnotateNodeByAwsAutoScalingInstance(ctx, kubernetesClient, surplusInstance, k8s.RollingUpdateStartedTimestampAnnotationKey, time.Now().Format(time.RFC3339)); err != nil {
+				log.Printf("[%s][%s] Skipping removal of surge capacity because unable to annotate node: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(surplusInstance.InstanceId), err.Error())
+				continue
+			}
+		}
+		waitGroup.Add(1)
+		go func(nodeToRemove *outdatedNode) {
+			defer waitGroup.Done()
+			replaceOutdatedNode(ctx, kubernetesClient, autoScalingService, autoScalingGroup, nodeToRemove, remainingReadyNodes)
+		}(&outdatedNode{
+			instance:                       surplusInstance,
+			node:                           node,
+			shouldDrain:                    minutesSinceDrained == -1,
+			shouldDecrementDesiredCapacity: true,
+		})
+	}
+	waitGroup.Wait()
+}
+
+// RollbackInstances rolls back the nodes of the given instances that have been annotated by this application.
+//
+// This is used for nodes that are no longer outdated (including those that were merely tainted as outdated), for
+// instance because the ASG's launch template was reverted mid-rollout, as well as for every node of an ASG whose
+// rolling update has been aborted.
+// Nodes that have already been scheduled for termination are left as is.
+//
+// The desired capacity of the ASG is left as is as well. See RollbackAutoScalingGroup for how the surge capacity of
+// an aborted rolling update is removed.
+func RollbackInstances(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, instances []*autoscaling.Instance) {
+	if len(instances) == 0 {
+		return
+	}
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("[%s] Unable to get nodes to roll back: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), err.Error())
+		return
+	}
+	for _, instance := range instances {
+		if strings.HasPrefix(aws.StringValue(instance.LifecycleState), "Terminating") {
+			// The instance is going away regardless (e.g. scale-in), so its node must remain drained
+			continue
+		}
+		node, err := kubernetesClient.FilterNodeByAutoScalingInstance(nodes, instance)
+		if err != nil || !k8s.HasRollingUpdateAnnotations(node) {
+			continue
+		}
+		if _, ok := node.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; ok {
+			log.Printf("[%s][%s] Not rolling back node %s, because it has already been scheduled for termination", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), node.Name)
+			continue
+		}
+		log.Printf("[%s][%s] Rolling back node %s", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), node.Name)
+		if err := k8s.RollbackNode(ctx, kubernetesClient, node); err != nil {
+			log.Printf("[%s][%s] Unable to roll back node %s: %v", aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId), node.Name, err.Error())
+		}
+	}
+}
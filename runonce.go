@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	// RunOnceCommand is the subcommand that rolls every ASG until they are all updated or a deadline is reached, then
+	// exits
+	RunOnceCommand = "run-once"
+
+	RunOnceDefaultDeadline = time.Hour
+
+	RunOnceExitCodeSucceeded = 0 // Every ASG has been updated
+	RunOnceExitCodeFailed    = 1 // The rolling update of at least one ASG failed or was aborted
+	RunOnceExitCodeOutdated  = 2 // The deadline was reached or the command was interrupted before every ASG was updated
+
+	RunOnceResultSucceeded = "succeeded"
+	RunOnceResultFailed    = "failed"
+	RunOnceResultOutdated  = "outdated"
+
+	runOnceEventProgress = "progress"
+	runOnceEventResult   = "result"
+)
+
+// RunOnceProgress is the structured record written after each iteration for every ASG
+type RunOnceProgress struct {
+	Event             string    `json:"event"`
+	Time              time.Time `json:"time"`
+	AutoScalingGroup  string    `json:"autoScalingGroup"`
+	DesiredCapacity   int64     `json:"desiredCapacity"`
+	OutdatedInstances int       `json:"outdatedInstances"`
+	UpdatedInstances  int       `json:"updatedInstances"`
+	UpdatedReadyNodes int       `json:"updatedReadyNodes"`
+	// Updated is whether the ASG has no outdated instances left and all of its updated nodes are ready
+	Updated bool   `json:"updated"`
+	Aborted bool   `json:"aborted,omitempty"`
+	Failing bool   `json:"failing,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RunOnceResult is the structured record written once before exiting
+type RunOnceResult struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Result   string    `json:"result"`
+	Message  string    `json:"message"`
+	ExitCode int       `json:"exitCode"`
+}
+
+// runRunOnceCommand rolls every ASG until they are all updated or the deadline passed as the -deadline flag is
+// reached, writing the progress to the given writer as one JSON record per line.
+//
+// Returns the exit code of the command
+func runRunOnceCommand(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, args []string, writer io.Writer) int {
+	flagSet := flag.NewFlagSet(RunOnceCommand, flag.ContinueOnError)
+	deadline := flagSet.Duration("deadline", RunOnceDefaultDeadline, "Maximum duration to wait for every ASG to be updated")
+	if err := flagSet.Parse(args); err != nil {
+		return RunOnceExitCodeFailed
+	}
+	if *deadline <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid deadline '%s', must be greater than 0\n", *deadline)
+		return RunOnceExitCodeFailed
+	}
+	return RunOnce(ctx, kubernetesClient, ec2Service, autoScalingService, *deadline, writer)
+}
+
+// RunOnce handles the rolling upgrade of every ASG every ResyncInterval until they are all updated, one of them
+// fails or is aborted, or the deadline is reached.
+//
+// An ASG fails when it has been flagged with the cloud.FailingTagKey tag, or when its rolling upgrade returned an
+// error MaximumFailedExecutionBeforePanic times in a row
+//
+// The steps in progress when the deadline is reached or the context is cancelled are checkpointed as they would be
+// on shutdown, so that a subsequent run picks up where this one left off
+func RunOnce(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, deadline time.Duration, writer io.Writer) int {
+	encoder := json.NewEncoder(writer)
+	deadlineCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	failedExecutions := 0
+	failedExecutionsByAutoScalingGroup := make(map[string]int)
+	for {
+		autoScalingGroups, updated, progressErrors, err := getRunOnceProgress(deadlineCtx, kubernetesClient, ec2Service, autoScalingService, encoder)
+		if err != nil {
+			if deadlineCtx.Err() != nil {
+				break
+			}
+			log.Printf("Unable to get progress of the rolling update: %v", err)
+			failedExecutions++
+		} else if len(autoScalingGroups) == 0 {
+			return writeRunOnceResult(encoder, RunOnceResultFailed, "no AutoScalingGroups found", RunOnceExitCodeFailed)
+		} else if aborted := getAbortedAutoScalingGroupNames(autoScalingGroups); len(aborted) > 0 {
+			// The nodes of the aborted ASGs are rolled back before exiting
+			HandleRollingUpgrade(deadlineCtx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroups)
+			return writeRunOnceResult(encoder, RunOnceResultFailed, fmt.Sprintf("the rolling update of %v has been aborted", aborted), RunOnceExitCodeFailed)
+		} else if failing := getFailingAutoScalingGroupNames(autoScalingGroups); len(failing) > 0 {
+			return writeRunOnceResult(encoder, RunOnceResultFailed, fmt.Sprintf("%v have been flagged as failing", failing), RunOnceExitCodeFailed)
+		} else if updated {
+			return writeRunOnceResult(encoder, RunOnceResultSucceeded, "all AutoScalingGroups have been updated", RunOnceExitCodeSucceeded)
+		} else {
+			err := HandleRollingUpgrade(deadlineCtx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroups)
+			autoScalingGroupErrors, ok := err.(AutoScalingGroupErrors)
+			if err != nil {
+				log.Printf("Execution failed: %v", err)
+			}
+			if err != nil && !ok {
+				failedExecutions++
+			} else {
+				// The execution itself went through, but some of the ASGs may have failed
+				failedExecutions = 0
+				if autoScalingGroupErrors == nil {
+					autoScalingGroupErrors = make(AutoScalingGroupErrors)
+				}
+				for autoScalingGroupName, progressErr := range progressErrors {
+					if _, exists := autoScalingGroupErrors[autoScalingGroupName]; !exists {
+						autoScalingGroupErrors[autoScalingGroupName] = progressErr
+					}
+				}
+				if message := countFailedExecutionsByAutoScalingGroup(failedExecutionsByAutoScalingGroup, autoScalingGroups, autoScalingGroupErrors); len(message) > 0 {
+					return writeRunOnceResult(encoder, RunOnceResultFailed, message, RunOnceExitCodeFailed)
+				}
+			}
+		}
+		if failedExecutions >= MaximumFailedExecutionBeforePanic {
+			return writeRunOnceResult(encoder, RunOnceResultFailed, fmt.Sprintf("execution failed %d times in a row", failedExecutions), RunOnceExitCodeFailed)
+		}
+		if k8s.Sleep(deadlineCtx, ResyncInterval) != nil {
+			break
+		}
+	}
+	// The last execution may have completed the rolling update right before the deadline was reached
+	checkpointCtx, cancelCheckpoint := newCheckpointContext()
+	defer cancelCheckpoint()
+	if autoScalingGroups, updated, _, err := getRunOnceProgress(checkpointCtx, kubernetesClient, ec2Service, autoScalingService, encoder); err == nil && len(autoScalingGroups) > 0 && updated {
+		return writeRunOnceResult(encoder, RunOnceResultSucceeded, "all AutoScalingGroups have been updated", RunOnceExitCodeSucceeded)
+	}
+	message := fmt.Sprintf("deadline of %s reached before all AutoScalingGroups were updated", deadline)
+	if ctx.Err() != nil {
+		message = "interrupted before all AutoScalingGroups were updated"
+	}
+	return writeRunOnceResult(encoder, RunOnceResultOutdated, message, RunOnceExitCodeOutdated)
+}
+
+// getRunOnceProgress describes the ASGs and writes the progress of each of them.
+//
+// Returns the ASGs, whether every single one of them has been updated, and the errors of the ASGs whose progress
+// couldn't be determined, indexed by ASG name
+func getRunOnceProgress(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, encoder *json.Encoder) ([]*autoscaling.Group, bool, AutoScalingGroupErrors, error) {
+	autoScalingGroups, err := describeAutoScalingGroups(ctx, autoScalingService)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	allUpdated := true
+	progressErrors := make(AutoScalingGroupErrors)
+	for _, autoScalingGroup := range autoScalingGroups {
+		progress := RunOnceProgress{
+			Event:            runOnceEventProgress,
+			Time:             time.Now(),
+			AutoScalingGroup: aws.StringValue(autoScalingGroup.AutoScalingGroupName),
+			DesiredCapacity:  aws.Int64Value(autoScalingGroup.DesiredCapacity),
+			Aborted:          isRollingUpdateAborted(autoScalingGroup),
+			Failing:          cloud.HasTag(autoScalingGroup, cloud.FailingTagKey, "true"),
+		}
+		outdatedInstances, updatedInstances, _, err := SeparateOutdatedFromUpdatedInstances(ctx, autoScalingGroup, ec2Service)
+		if err != nil {
+			progressErrors[progress.AutoScalingGroup] = fmt.Errorf("unable to separate outdated instances from updated instances: %v", err)
+			progress.Error = progressErrors[progress.AutoScalingGroup].Error()
+		} else {
+			updatedReadyNodes, numberOfNonReadyNodesOrInstances, _ := getReadyNodesAndNumberOfNonReadyNodesOrInstances(ctx, updatedInstances, autoScalingGroup, kubernetesClient)
+			progress.OutdatedInstances = len(outdatedInstances)
+			progress.UpdatedInstances = len(updatedInstances)
+			progress.UpdatedReadyNodes = len(updatedReadyNodes)
+			progress.Updated = len(outdatedInstances) == 0 && numberOfNonReadyNodesOrInstances == 0 && int64(len(updatedReadyNodes)) >= aws.Int64Value(autoScalingGroup.DesiredCapacity)
+		}
+		allUpdated = allUpdated && progress.Updated
+		if err := encoder.Encode(progress); err != nil {
+			log.Printf("[%s] Unable to write progress: %v", progress.AutoScalingGroup, err)
+		}
+	}
+	return autoScalingGroups, allUpdated, progressErrors, nil
+}
+
+// getAbortedAutoScalingGroupNames returns the names of the ASGs whose rolling update has been aborted
+func getAbortedAutoScalingGroupNames(autoScalingGroups []*autoscaling.Group) []string {
+	var names []string
+	for _, autoScalingGroup := range autoScalingGroups {
+		if isRollingUpdateAborted(autoScalingGroup) {
+			names = append(names, aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		}
+	}
+	return names
+}
+
+// getFailingAutoScalingGroupNames returns the names of the ASGs that have been flagged as failing
+func getFailingAutoScalingGroupNames(autoScalingGroups []*autoscaling.Group) []string {
+	var names []string
+	for _, autoScalingGroup := range autoScalingGroups {
+		if cloud.HasTag(autoScalingGroup, cloud.FailingTagKey, "true") {
+			names = append(names, aws.StringValue(autoScalingGroup.AutoScalingGroupName))
+		}
+	}
+	return names
+}
+
+// countFailedExecutionsByAutoScalingGroup increments the number of consecutive failed executions of each ASG that
+// has an error, and resets it for the others.
+//
+// Returns a message describing the first ASG that reached MaximumFailedExecutionBeforePanic, or an empty string
+func countFailedExecutionsByAutoScalingGroup(failedExecutionsByAutoScalingGroup map[string]int, autoScalingGroups []*autoscaling.Group, autoScalingGroupErrors AutoScalingGroupErrors) string {
+	message := ""
+	for _, autoScalingGroup := range autoScalingGroups {
+		autoScalingGroupName := aws.StringValue(autoScalingGroup.AutoScalingGroupName)
+		err, failed := autoScalingGroupErrors[autoScalingGroupName]
+		if !failed {
+			delete(failedExecutionsByAutoScalingGroup, autoScalingGroupName)
+			continue
+		}
+		failedExecutionsByAutoScalingGroup[autoScalingGroupName]++
+		if len(message) == 0 && failedExecutionsByAutoScalingGroup[autoScalingGroupName] >= MaximumFailedExecutionBeforePanic {
+			message = fmt.Sprintf("the rolling update of %s failed %d times in a row: %v", autoScalingGroupName, failedExecutionsByAutoScalingGroup[autoScalingGroupName], err)
+		}
+	}
+	return message
+}
+
+// writeRunOnceResult writes the result of the command, and returns its exit code
+func writeRunOnceResult(encoder *json.Encoder, result, message string, exitCode int) int {
+	if err := encoder.Encode(RunOnceResult{Event: runOnceEventResult, Time: time.Now(), Result: result, Message: message, ExitCode: exitCode}); err != nil {
+		log.Printf("Unable to write result: %v", err)
+	}
+	return exitCode
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/cloud"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	NodeDeletedEventReason        = "NodeDeleted"
+	NodeDeletionFailedEventReason = "NodeDeletionFailed"
+)
+
+// DeleteTerminatedNodes deletes the nodes that have been scheduled for termination by this application and whose
+// instance has reached the terminated state, instead of leaving them NotReady until the cloud controller removes them.
+//
+// The nodes for which skipNode returns true are left alone. skipNode may be nil
+func DeleteTerminatedNodes(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, skipNode func(node *v1.Node) bool) {
+	if !config.Get().DeleteNodeAfterTermination {
+		return
+	}
+	nodes, err := kubernetesClient.GetNodes(ctx)
+	if err != nil {
+		log.Printf("Unable to get nodes to look for terminated nodes: %v", err.Error())
+		return
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		if _, ok := node.Annotations[k8s.RollingUpdateTerminatedTimestampAnnotationKey]; !ok || (skipNode != nil && skipNode(node)) {
+			continue
+		}
+		instanceId := k8s.GetInstanceIdFromNode(node)
+		if len(instanceId) == 0 {
+			continue
+		}
+		ec2Instance, err := cloud.DescribeEc2Instance(ctx, ec2Service, instanceId)
+		if err != nil {
+			log.Printf("[%s][%s] Unable to check whether instance has been terminated: %v", node.Name, instanceId, err.Error())
+			continue
+		}
+		if !cloud.IsEc2InstanceTerminated(ec2Instance) {
+			if config.Get().Debug {
+				log.Printf("[%s][%s] Not deleting node yet, because its instance is in state %s", node.Name, instanceId, getEc2InstanceStateName(ec2Instance))
+			}
+			continue
+		}
+		if err := kubernetesClient.DeleteNode(ctx, node.Name); err != nil {
+			message := fmt.Sprintf("Unable to delete node after its instance was terminated: %v", err)
+			log.Printf("[%s][%s] %s", node.Name, instanceId, message)
+			if err := kubernetesClient.CreateNodeEvent(ctx, node, v1.EventTypeWarning, NodeDeletionFailedEventReason, message); err != nil {
+				log.Printf("[%s][%s] Unable to create event: %v", node.Name, instanceId, err.Error())
+			}
+			continue
+		}
+		log.Printf("[%s][%s] Deleted node, because its instance has been terminated", node.Name, instanceId)
+		if err := kubernetesClient.CreateNodeEvent(ctx, node, v1.EventTypeNormal, NodeDeletedEventReason, "Deleted node, because its instance has been terminated"); err != nil {
+			log.Printf("[%s][%s] Unable to create event: %v", node.Name, instanceId, err.Error())
+		}
+	}
+}
+
+// getEc2InstanceStateName returns the name of the state of an EC2 instance
+func getEc2InstanceStateName(instance *ec2.Instance) string {
+	if instance == nil || instance.State == nil {
+		return ec2.InstanceStateNameTerminated
+	}
+	return aws.StringValue(instance.State.Name)
+}
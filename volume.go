@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	VolumeDetachmentTimedOutEventReason = "VolumeDetachmentTimedOut"
+)
+
+var (
+	// VolumeDetachmentPollInterval is the interval at which the volumes attached to a drained node are checked
+	VolumeDetachmentPollInterval = 5 * time.Second
+)
+
+// waitForVolumeDetachment waits until the node of an instance no longer has any volume attached to it, or until
+// config.VolumeDetachmentTimeout has passed. Terminating an instance while its volumes are being detached would
+// otherwise leave the replacement pods waiting for the attachment to time out.
+//
+// Returns true if the instance can be terminated
+func waitForVolumeDetachment(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, autoScalingGroup *autoscaling.Group, instance *autoscaling.Instance) bool {
+	if !config.Get().WaitForVolumeDetachment {
+		return true
+	}
+	autoScalingGroupName, instanceId := aws.StringValue(autoScalingGroup.AutoScalingGroupName), aws.StringValue(instance.InstanceId)
+	node, err := kubernetesClient.GetNodeByAwsAutoScalingInstance(ctx, instance)
+	if err != nil {
+		log.Printf("[%s][%s] Skipping termination because unable to get node to check attached volumes: %v", autoScalingGroupName, instanceId, err.Error())
+		return false
+	}
+	deadline := time.Now().Add(config.Get().VolumeDetachmentTimeout)
+	for {
+		volumes, err := k8s.GetVolumesAttachedToNode(ctx, kubernetesClient, node)
+		if err != nil {
+			log.Printf("[%s][%s] Skipping termination because unable to check attached volumes: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+		if len(volumes) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			message := fmt.Sprintf("Volumes %s are still attached after %s, proceeding with termination anyways", strings.Join(volumes, ","), config.Get().VolumeDetachmentTimeout)
+			log.Printf("[%s][%s] %s", autoScalingGroupName, instanceId, message)
+			if err := kubernetesClient.CreateNodeEvent(ctx, node, v1.EventTypeWarning, VolumeDetachmentTimedOutEventReason, message); err != nil {
+				log.Printf("[%s][%s] Unable to create event: %v", autoScalingGroupName, instanceId, err.Error())
+			}
+			return true
+		}
+		log.Printf("[%s][%s] Waiting for volumes %s to be detached", autoScalingGroupName, instanceId, strings.Join(volumes, ","))
+		if err := k8s.Sleep(ctx, VolumeDetachmentPollInterval); err != nil {
+			log.Printf("[%s][%s] Skipping termination because the wait for the volume detachment was interrupted: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+		// The node has already been found, so it only needs to be retrieved by name to refresh its attached volumes
+		if node, err = kubernetesClient.GetNode(ctx, node.Name); err != nil {
+			log.Printf("[%s][%s] Skipping termination because unable to get node to check attached volumes: %v", autoScalingGroupName, instanceId, err.Error())
+			return false
+		}
+	}
+}
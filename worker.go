@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/config"
+	"github.com/TwinProduction/aws-eks-asg-rolling-update-handler/k8s"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+var (
+	// drainSemaphore limits the number of nodes being drained at the same time across all ASGs.
+	// A nil channel means that there is no limit.
+	drainSemaphore chan struct{}
+
+	// autoScalingGroupFailedCounters keeps track of the number of consecutive failed executions of each ASG
+	autoScalingGroupFailedCounters      = make(map[string]int)
+	autoScalingGroupFailedCountersMutex sync.Mutex
+)
+
+// initializeDrainSemaphore creates the semaphore used to limit the number of nodes being drained at the same time
+func initializeDrainSemaphore(maxConcurrentDrains int) {
+	if maxConcurrentDrains > 0 {
+		drainSemaphore = make(chan struct{}, maxConcurrentDrains)
+	} else {
+		drainSemaphore = nil
+	}
+}
+
+// acquireDrainSlot blocks until a node can be drained without exceeding config.MaxConcurrentDrains.
+//
+// Returns an error if the context is cancelled before a slot is acquired
+func acquireDrainSlot(ctx context.Context) error {
+	if drainSemaphore == nil {
+		return nil
+	}
+	select {
+	case drainSemaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseDrainSlot releases a slot acquired with acquireDrainSlot
+func releaseDrainSlot() {
+	if drainSemaphore != nil {
+		<-drainSemaphore
+	}
+}
+
+// drainNode drains a node using the eviction settings of the configuration
+func drainNode(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, nodeName string) error {
+	var evictionTierTimeout time.Duration
+	if config.Get().PriorityOrderedEviction {
+		evictionTierTimeout = config.Get().EvictionTierTimeout
+	}
+	return kubernetesClient.Drain(ctx, nodeName, config.Get().IgnoreDaemonSets, config.Get().DeleteLocalData, config.Get().EvictionTimeout, evictionTierTimeout, isNamespaceEligibleForDeletionFallback)
+}
+
+// isNamespaceEligibleForDeletionFallback checks whether pods in a given namespace may be deleted when they cannot
+// be evicted
+func isNamespaceEligibleForDeletionFallback(namespace string) bool {
+	if !config.Get().EvictionFallbackToDeletion {
+		return false
+	}
+	if len(config.Get().EvictionFallbackNamespaces) == 0 {
+		return true
+	}
+	for _, eligibleNamespace := range config.Get().EvictionFallbackNamespaces {
+		if eligibleNamespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRollingUpgradeForAutoScalingGroupWithTimeout handles the rolling upgrade of a single ASG, cancelling the
+// handling after config.AutoScalingGroupTimeout.
+//
+// Returns the error of the handling, or ErrTimedOut if it timed out
+func handleRollingUpgradeForAutoScalingGroupWithTimeout(ctx context.Context, kubernetesClient k8s.KubernetesClientApi, ec2Service ec2iface.EC2API, autoScalingService autoscalingiface.AutoScalingAPI, autoScalingGroup *autoscaling.Group) error {
+	if config.Get().AutoScalingGroupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Get().AutoScalingGroupTimeout)
+		defer cancel()
+	}
+	err := HandleRollingUpgradeForAutoScalingGroup(ctx, kubernetesClient, ec2Service, autoScalingService, autoScalingGroup)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ErrTimedOut
+	}
+	recordAutoScalingGroupResult(aws.StringValue(autoScalingGroup.AutoScalingGroupName), err)
+	// The status is written even if the execution has been cancelled, so that it reflects where the rollout stopped
+	checkpointCtx, cancelCheckpoint := newCheckpointContext()
+	defer cancelCheckpoint()
+	updateNodeGroupRolloutStatus(checkpointCtx, kubernetesClient, ec2Service, autoScalingGroup, err)
+	return err
+}
+
+// recordAutoScalingGroupResult keeps track of the number of consecutive failed executions of an ASG
+func recordAutoScalingGroupResult(autoScalingGroupName string, err error) {
+	autoScalingGroupFailedCountersMutex.Lock()
+	defer autoScalingGroupFailedCountersMutex.Unlock()
+	if err != nil {
+		autoScalingGroupFailedCounters[autoScalingGroupName]++
+		log.Printf("[%s] Execution failed %d consecutive times: %v", autoScalingGroupName, autoScalingGroupFailedCounters[autoScalingGroupName], err.Error())
+	} else if autoScalingGroupFailedCounters[autoScalingGroupName] > 0 {
+		log.Printf("[%s] Execution was successful after %d failed attempts, resetting counter to 0", autoScalingGroupName, autoScalingGroupFailedCounters[autoScalingGroupName])
+		delete(autoScalingGroupFailedCounters, autoScalingGroupName)
+	}
+}
+
+// newCheckpointContext creates a context, independent of the context of the execution, used to persist the progress
+// of a node once a step that cannot be undone has been completed, so that said progress isn't lost if the execution
+// is cancelled, e.g. because the application is shutting down
+func newCheckpointContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), CheckpointTimeout)
+}